@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+)
+
+// Alert statuses
+const (
+	StatusFiring   = "firing"
+	StatusResolved = "resolved"
+)
+
+// Alert is a notification about a rule firing or resolving for a series
+type Alert struct {
+	Status      string            `json:"status"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	Value       float64           `json:"value"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt,omitzero"`
+}
+
+// alertState tracks a rule for one series, a row of a metric of a database
+// told apart by its tags
+type alertState struct {
+	labels      map[string]string
+	annotations map[string]string
+	value       float64
+	activeAt    time.Time // when the condition started to hold, zero if it doesn't
+	firing      bool
+	startsAt    time.Time
+	notifiedAt  time.Time
+	seenAt      time.Time // when the series was last reported
+
+	// previous sample of rate rules
+	last   float64
+	lastAt time.Time
+}
+
+// scrape tracks how often pgwatch sends a metric of a database
+type scrape struct {
+	at       time.Time
+	interval time.Duration
+}
+
+// staleIntervals is how many scrape intervals of its metric a series may
+// be missing before its state is dropped
+const staleIntervals = 3
+
+// expireInterval is how often stale series are dropped
+const expireInterval = time.Minute
+
+// resendInterval is how often firing alerts are sent to Alertmanager again,
+// it resolves alerts it doesn't hear of until their endsAt
+const resendInterval = time.Minute
+
+// notification is a batch of queued alerts, resent ones only go to the
+// Alertmanager notifiers
+type notification struct {
+	alerts []Alert
+	resend bool
+}
+
+type AlertReceiver struct {
+	Rules          []*Rule
+	Notifiers      []Notifier
+	RepeatInterval time.Duration
+	states         map[string]*alertState
+	scrapes        map[string]*scrape // by database and metric
+	mu             sync.Mutex
+	queue          chan notification
+	queueMu        sync.Mutex // guards sending to queue and closed
+	closed         bool
+	pending        sync.WaitGroup
+	stop           chan struct{}
+	done           chan struct{}
+	sinks.SyncMetricHandler
+}
+
+func NewAlertReceiver(cfg *Config) *AlertReceiver {
+	recv := &AlertReceiver{
+		Rules:             cfg.Rules,
+		RepeatInterval:    cfg.RepeatInterval,
+		states:            make(map[string]*alertState),
+		scrapes:           make(map[string]*scrape),
+		queue:             make(chan notification, 1024),
+		stop:              make(chan struct{}),
+		done:              make(chan struct{}),
+		SyncMetricHandler: sinks.NewSyncMetricHandler(1024),
+	}
+	for _, notifierCfg := range cfg.Notifiers {
+		recv.Notifiers = append(recv.Notifiers, NewNotifier(notifierCfg))
+	}
+
+	go recv.HandleSyncMetric()
+	go recv.dispatch()
+	go recv.expirePeriodically()
+	go recv.resendPeriodically()
+	return recv
+}
+
+func (r *AlertReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
+	r.Evaluate(msg, time.Now())
+	return &pb.Reply{}, nil
+}
+
+// HandleSyncMetric resolves the alerts of databases removed from pgwatch,
+// they won't send the measurements resolving them anymore
+func (r *AlertReceiver) HandleSyncMetric() {
+	for {
+		req, ok := r.GetSyncChannelContent()
+		if !ok {
+			return
+		}
+		if req.GetOperation() == pb.SyncOp_DeleteOp {
+			r.forget(req.GetDBName(), req.GetMetricName(), time.Now())
+		}
+	}
+}
+
+// Evaluate checks the rows of msg against the rules applying to them and
+// queues notifications for alerts that started firing, kept firing for the
+// repeat interval or resolved
+func (r *AlertReceiver) Evaluate(msg *pb.MeasurementEnvelope, now time.Time) {
+	var alerts []Alert
+	matched := false
+
+	r.mu.Lock()
+	for _, rule := range r.Rules {
+		if !rule.matches(msg.GetDBName(), msg.GetMetricName()) {
+			continue
+		}
+		matched = true
+		for _, row := range msg.GetData() {
+			fields := row.GetFields()
+			tags := rowTags(msg.GetCustomTags(), fields)
+			if !rule.matchesTags(tags) {
+				continue
+			}
+			value, ok := numericValue(fields[rule.Field])
+			if !ok {
+				continue
+			}
+
+			key, labels := seriesKey(rule, msg.GetDBName(), tags)
+			state, ok := r.states[key]
+			if !ok {
+				state = &alertState{labels: labels}
+				r.states[key] = state
+			}
+			state.seenAt = now
+			if alert, ok := r.observe(rule, state, value, sinks.MeasurementTime(row, now), now); ok {
+				alerts = append(alerts, alert)
+			}
+		}
+	}
+	if matched {
+		r.observeScrape(msg.GetDBName(), msg.GetMetricName(), now)
+	}
+	r.mu.Unlock()
+
+	r.send(notification{alerts: alerts})
+}
+
+// observeScrape remembers when a metric of a database was received and
+// the time since it was received before
+func (r *AlertReceiver) observeScrape(dbname, metric string, now time.Time) {
+	key := scrapeKey(dbname, metric)
+	s, ok := r.scrapes[key]
+	if !ok {
+		r.scrapes[key] = &scrape{at: now}
+		return
+	}
+	if now.After(s.at) {
+		s.interval = now.Sub(s.at)
+		s.at = now
+	}
+}
+
+func scrapeKey(dbname, metric string) string {
+	return dbname + "\x00" + metric
+}
+
+// Expire drops the series that weren't reported for staleIntervals scrape
+// intervals of their metric, e.g. rows of a replica that disappeared or
+// queries that stopped running, and resolves their firing alerts
+func (r *AlertReceiver) Expire(now time.Time) {
+	var alerts []Alert
+
+	r.mu.Lock()
+	for key, state := range r.states {
+		s, ok := r.scrapes[scrapeKey(state.labels["dbname"], state.labels["metric"])]
+		if !ok || s.interval == 0 || now.Sub(state.seenAt) <= staleIntervals*s.interval {
+			continue
+		}
+		if state.firing {
+			log.Printf("[INFO]: Alert %s resolved, the series is no longer reported", describeState(state))
+			alerts = append(alerts, state.alert(StatusResolved, now))
+		}
+		delete(r.states, key)
+	}
+	// metrics that aren't sent anymore have no series left
+	for key, s := range r.scrapes {
+		if s.interval > 0 && now.Sub(s.at) > staleIntervals*s.interval {
+			delete(r.scrapes, key)
+		}
+	}
+	r.mu.Unlock()
+
+	r.send(notification{alerts: alerts})
+}
+
+func (r *AlertReceiver) expirePeriodically() {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case now := <-ticker.C:
+			r.Expire(now)
+		}
+	}
+}
+
+// Resend queues the firing alerts for the Alertmanager notifiers, which
+// need them sent again independent of the repeat interval
+func (r *AlertReceiver) Resend() {
+	if !slices.ContainsFunc(r.Notifiers, isAlertmanager) {
+		return
+	}
+	var alerts []Alert
+
+	r.mu.Lock()
+	for _, key := range slices.Sorted(maps.Keys(r.states)) {
+		if state := r.states[key]; state.firing {
+			alerts = append(alerts, state.alert(StatusFiring, time.Time{}))
+		}
+	}
+	r.mu.Unlock()
+
+	r.send(notification{alerts: alerts, resend: true})
+}
+
+func (r *AlertReceiver) resendPeriodically() {
+	ticker := time.NewTicker(resendInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.Resend()
+		}
+	}
+}
+
+// observe updates the state of a series with a sample and returns the
+// alert to send, if any
+func (r *AlertReceiver) observe(rule *Rule, state *alertState, value float64, at, now time.Time) (Alert, bool) {
+	if rule.Type == RuleRate {
+		last, lastAt := state.last, state.lastAt
+		state.last, state.lastAt = value, at
+		// the first sample has nothing to compare to, a decrease is a
+		// counter reset
+		if lastAt.IsZero() || !at.After(lastAt) || value < last {
+			return Alert{}, false
+		}
+		value = (value - last) / at.Sub(lastAt).Seconds()
+	}
+	state.value = value
+
+	if !rule.check(value) {
+		state.activeAt = time.Time{}
+		if !state.firing {
+			return Alert{}, false
+		}
+		state.firing = false
+		log.Printf("[INFO]: Alert %s resolved", describeState(state))
+		return state.alert(StatusResolved, at), true
+	}
+
+	if state.activeAt.IsZero() {
+		state.activeAt = at
+	}
+	switch {
+	case !state.firing && at.Sub(state.activeAt) >= rule.For:
+		state.firing = true
+		state.startsAt = state.activeAt
+		log.Printf("[WARNING]: Alert %s firing, value %s", describeState(state), formatValue(value))
+	case state.firing && r.RepeatInterval > 0 && now.Sub(state.notifiedAt) >= r.RepeatInterval:
+	default:
+		return Alert{}, false
+	}
+	state.annotations = rule.annotate(state.labels, value)
+	state.notifiedAt = now
+	return state.alert(StatusFiring, time.Time{}), true
+}
+
+func (state *alertState) alert(status string, endsAt time.Time) Alert {
+	return Alert{
+		Status:      status,
+		Labels:      state.labels,
+		Annotations: state.annotations,
+		Value:       state.value,
+		StartsAt:    state.startsAt,
+		EndsAt:      endsAt,
+	}
+}
+
+func describeState(state *alertState) string {
+	return fmt.Sprintf("%s on %s", state.labels["alertname"], state.labels["dbname"])
+}
+
+// seriesKey identifies a series of a rule by its labels: the rule's name,
+// severity and labels, the database, the metric and the row's tags
+func seriesKey(rule *Rule, dbname string, tags map[string]string) (string, map[string]string) {
+	labels := make(map[string]string, len(tags)+len(rule.Labels)+4)
+	maps.Copy(labels, tags)
+	maps.Copy(labels, rule.Labels)
+	labels["alertname"] = rule.Name
+	labels["dbname"] = dbname
+	labels["metric"] = rule.Metric
+	labels["severity"] = rule.Severity
+
+	var key strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(labels)) {
+		fmt.Fprintf(&key, "%s=%q,", name, labels[name])
+	}
+	return key.String(), labels
+}
+
+// forget drops the series of a database, or only of one of its metrics if
+// metric is set, resolving their firing alerts
+func (r *AlertReceiver) forget(dbname, metric string, now time.Time) {
+	var alerts []Alert
+
+	r.mu.Lock()
+	for key, state := range r.states {
+		if state.labels["dbname"] != dbname || (metric != "" && state.labels["metric"] != metric) {
+			continue
+		}
+		if state.firing {
+			log.Printf("[INFO]: Alert %s resolved, the database was removed", describeState(state))
+			alerts = append(alerts, state.alert(StatusResolved, now))
+		}
+		delete(r.states, key)
+	}
+	for key := range r.scrapes {
+		if db, m, _ := strings.Cut(key, "\x00"); db == dbname && (metric == "" || m == metric) {
+			delete(r.scrapes, key)
+		}
+	}
+	r.mu.Unlock()
+
+	r.send(notification{alerts: alerts})
+}
+
+// send queues alerts for the notifiers, alerts of measurements arriving
+// while the receiver is closed are dropped
+func (r *AlertReceiver) send(n notification) {
+	if len(n.alerts) == 0 || len(r.Notifiers) == 0 {
+		return
+	}
+	r.queueMu.Lock()
+	defer r.queueMu.Unlock()
+	if r.closed {
+		log.Printf("[WARNING]: Dropping %d alerts, the receiver is closed", len(n.alerts))
+		return
+	}
+	r.pending.Add(1)
+	r.queue <- n
+}
+
+// dispatch sends queued alerts to all notifiers, in order, so a resolved
+// alert never overtakes its firing one
+func (r *AlertReceiver) dispatch() {
+	defer close(r.done)
+	for n := range r.queue {
+		for _, notifier := range r.Notifiers {
+			if n.resend && !isAlertmanager(notifier) {
+				continue
+			}
+			if err := notifier.Notify(context.Background(), n.alerts); err != nil {
+				log.Println("[ERROR]: Unable to send alerts: " + err.Error())
+			}
+		}
+		r.pending.Done()
+	}
+}
+
+// Wait blocks until all queued alerts were sent
+func (r *AlertReceiver) Wait() {
+	r.pending.Wait()
+}
+
+// Close sends the queued alerts and stops the dispatcher
+func (r *AlertReceiver) Close() {
+	r.queueMu.Lock()
+	if r.closed {
+		r.queueMu.Unlock()
+		return
+	}
+	r.closed = true
+	close(r.stop)
+	close(r.queue)
+	r.queueMu.Unlock()
+	<-r.done
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// recorder is a notifier remembering the alerts it was sent
+type recorder struct {
+	mu     sync.Mutex
+	alerts []Alert
+}
+
+func (n *recorder) Notify(_ context.Context, alerts []Alert) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.alerts = append(n.alerts, alerts...)
+	return nil
+}
+
+// take returns and forgets the alerts received so far
+func (n *recorder) take() []Alert {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	alerts := n.alerts
+	n.alerts = nil
+	return alerts
+}
+
+func newTestReceiver(t *testing.T, rules string) (*AlertReceiver, *recorder) {
+	cfg, err := ParseConfig([]byte(rules))
+	assert.NoError(t, err)
+	recv := NewAlertReceiver(cfg)
+	rec := &recorder{}
+	recv.Notifiers = []Notifier{rec}
+	t.Cleanup(recv.Close)
+	return recv, rec
+}
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := LoadConfig("rules.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Hour, cfg.RepeatInterval)
+	assert.Len(t, cfg.Rules, 3)
+	assert.Equal(t, 5*time.Minute, cfg.Rules[0].For)
+	assert.Equal(t, RuleThreshold, cfg.Rules[0].Type)
+	assert.Equal(t, "warning", cfg.Rules[1].Severity)
+	assert.Equal(t, RuleRate, cfg.Rules[2].Type)
+	assert.Equal(t, NotifierWebhook, cfg.Notifiers[0].Type)
+
+	for name, rules := range map[string]string{
+		"unknown key":      "rules: [{name: a, metric: m, field: f, op: '>', treshold: 1}]",
+		"no rules":         "rules: []",
+		"unknown op":       "rules: [{name: a, metric: m, field: f, op: '=>'}]",
+		"unknown type":     "rules: [{name: a, metric: m, field: f, op: '>', type: delta}]",
+		"missing field":    "rules: [{name: a, metric: m, op: '>'}]",
+		"duplicate name":   "rules: [{name: a, metric: m, field: f, op: '>'}, {name: a, metric: m, field: g, op: '>'}]",
+		"invalid dbname":   "rules: [{name: a, metric: m, field: f, op: '>', dbname: '('}]",
+		"invalid template": "rules: [{name: a, metric: m, field: f, op: '>', annotations: {summary: '{{ .Value'}}]",
+		"unknown notifier": "rules: [{name: a, metric: m, field: f, op: '>'}]\nnotifiers: [{type: pager}]",
+		"missing url":      "rules: [{name: a, metric: m, field: f, op: '>'}]\nnotifiers: [{type: slack}]",
+		"missing smtp to":  "rules: [{name: a, metric: m, field: f, op: '>'}]\nnotifiers: [{type: smtp, addr: 'localhost:25', from: a@b.c}]",
+	} {
+		_, err := ParseConfig([]byte(rules))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestThresholdRule(t *testing.T) {
+	recv, rec := newTestReceiver(t, `
+repeat_interval: 10m
+rules:
+  - name: ReplicationLag
+    metric: replication
+    field: replay_lag_b
+    op: ">"
+    value: 1000
+    for: 2m
+    severity: critical
+    labels: {team: dba}
+`)
+	start := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	lag := func(minutes int, value float64) {
+		recv.Evaluate(testutils.NewMeasurementEnvelope("prod", "replication",
+			map[string]any{"replay_lag_b": value, "tag_application_name": "replica1"}), start.Add(time.Duration(minutes)*time.Minute))
+		recv.Wait()
+	}
+
+	lag(0, 10)
+	lag(1, 5000)
+	lag(2, 5000)
+	assert.Empty(t, rec.take(), "the condition has to hold for 2m")
+
+	lag(3, 6000)
+	alerts := rec.take()
+	if assert.Len(t, alerts, 1) {
+		alert := alerts[0]
+		assert.Equal(t, StatusFiring, alert.Status)
+		assert.Equal(t, 6000.0, alert.Value)
+		assert.Equal(t, start.Add(time.Minute), alert.StartsAt)
+		assert.True(t, alert.EndsAt.IsZero())
+		assert.Equal(t, map[string]string{"alertname": "ReplicationLag", "dbname": "prod", "metric": "replication",
+			"severity": "critical", "team": "dba", "application_name": "replica1"}, alert.Labels)
+		assert.Equal(t, "ReplicationLag on prod: replication.replay_lag_b is 6000 (> 1000)", alert.Annotations["summary"])
+	}
+
+	lag(4, 7000)
+	assert.Empty(t, rec.take(), "firing alerts are only repeated after the repeat interval")
+	lag(13, 7000)
+	assert.Len(t, rec.take(), 1)
+
+	lag(14, 500)
+	alerts = rec.take()
+	if assert.Len(t, alerts, 1) {
+		assert.Equal(t, StatusResolved, alerts[0].Status)
+		assert.Equal(t, start.Add(time.Minute), alerts[0].StartsAt)
+		assert.Equal(t, start.Add(14*time.Minute), alerts[0].EndsAt)
+	}
+	lag(15, 500)
+	assert.Empty(t, rec.take())
+
+	// rows without the field don't change the state
+	lag(16, 5000)
+	recv.Evaluate(testutils.NewMeasurementEnvelope("prod", "replication", map[string]any{"tag_application_name": "replica1"}), start.Add(17*time.Minute))
+	lag(18, 5000)
+	assert.Len(t, rec.take(), 1)
+}
+
+func TestRateRule(t *testing.T) {
+	recv, rec := newTestReceiver(t, `
+rules:
+  - name: HighRollbackRate
+    metric: db_stats
+    field: xact_rollback
+    type: rate
+    op: ">"
+    value: 10
+`)
+	start := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	rollbacks := func(seconds int, value float64) {
+		// pgwatch's measurement time wins over the time of arrival
+		at := start.Add(time.Duration(seconds) * time.Second)
+		recv.Evaluate(testutils.NewMeasurementEnvelope("prod", "db_stats",
+			map[string]any{"xact_rollback": value, "epoch_ns": float64(at.UnixNano())}), start)
+		recv.Wait()
+	}
+
+	rollbacks(0, 1000)
+	rollbacks(60, 1300)
+	assert.Empty(t, rec.take(), "5 rollbacks per second")
+
+	rollbacks(120, 2500)
+	alerts := rec.take()
+	if assert.Len(t, alerts, 1) {
+		assert.Equal(t, StatusFiring, alerts[0].Status)
+		assert.Equal(t, 20.0, alerts[0].Value)
+	}
+
+	rollbacks(180, 0)
+	assert.Empty(t, rec.take(), "counter resets are skipped")
+	rollbacks(240, 60)
+	alerts = rec.take()
+	if assert.Len(t, alerts, 1) {
+		assert.Equal(t, StatusResolved, alerts[0].Status)
+		assert.Equal(t, 1.0, alerts[0].Value)
+	}
+}
+
+func TestSelectors(t *testing.T) {
+	recv, rec := newTestReceiver(t, `
+rules:
+  - name: TooManyBackends
+    metric: db_stats
+    field: numbackends
+    dbname: "prod-.*"
+    tags: {role: primary}
+    op: ">="
+    value: 100
+`)
+	now := time.Now()
+	msg := func(dbname string, tags map[string]string, rows ...map[string]any) {
+		envelope := testutils.NewMeasurementEnvelope(dbname, "db_stats", rows...)
+		envelope.CustomTags = tags
+		recv.Evaluate(envelope, now)
+		recv.Wait()
+	}
+
+	msg("prod-1", map[string]string{"role": "primary"}, map[string]any{"numbackends": 150})
+	msg("prod-2", map[string]string{"role": "primary"}, map[string]any{"numbackends": "120"})
+	msg("staging", map[string]string{"role": "primary"}, map[string]any{"numbackends": 150})
+	msg("prod-3", map[string]string{"role": "replica"}, map[string]any{"numbackends": 150})
+	msg("prod-4", nil, map[string]any{"numbackends": 150})
+	recv.Evaluate(testutils.NewMeasurementEnvelope("prod-5", "other", map[string]any{"numbackends": 150}), now)
+
+	var dbnames []string
+	for _, alert := range rec.take() {
+		dbnames = append(dbnames, alert.Labels["dbname"])
+		assert.Equal(t, "primary", alert.Labels["role"])
+	}
+	assert.ElementsMatch(t, []string{"prod-1", "prod-2"}, dbnames)
+
+	// rows told apart by tags are separate series, tag_ fields count as tags
+	msg("prod-6", map[string]string{"role": "primary"},
+		map[string]any{"numbackends": 150, "tag_datname": "a"},
+		map[string]any{"numbackends": 10, "tag_datname": "b"})
+	alerts := rec.take()
+	if assert.Len(t, alerts, 1) {
+		assert.Equal(t, "a", alerts[0].Labels["datname"])
+	}
+}
+
+func TestSyncMetricResolves(t *testing.T) {
+	recv, rec := newTestReceiver(t, "rules: [{name: Lag, metric: replication, field: lag, op: '>', value: 1}]")
+	recv.Evaluate(testutils.NewMeasurementEnvelope("prod", "replication", map[string]any{"lag": 5}), time.Now())
+	recv.Wait()
+	assert.Len(t, rec.take(), 1)
+
+	_, err := recv.SyncMetric(context.Background(), &pb.SyncReq{DBName: "prod", Operation: pb.SyncOp_DeleteOp})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		recv.Wait()
+		alerts := rec.take()
+		return len(alerts) == 1 && alerts[0].Status == StatusResolved
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestNotifiers(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	alerts := []Alert{{
+		Status:      StatusResolved,
+		Labels:      map[string]string{"alertname": "ReplicationLag", "dbname": "prod", "severity": "critical"},
+		Annotations: map[string]string{"summary": "replica is behind", "runbook": "https://example.com/lag"},
+		Value:       5000,
+		StartsAt:    start,
+		EndsAt:      start.Add(time.Hour),
+	}}
+
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.Error(w, "no such hook", http.StatusNotFound)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		requests <- r
+		bodies <- string(body)
+	}))
+	defer server.Close()
+
+	t.Run("webhook", func(t *testing.T) {
+		notifier := NewNotifier(NotifierConfig{Type: NotifierWebhook, URL: server.URL + "/hook"})
+		assert.NoError(t, notifier.Notify(context.Background(), alerts))
+		assert.Equal(t, "application/json", (<-requests).Header.Get("Content-Type"))
+
+		var payload struct {
+			Status string  `json:"status"`
+			Alerts []Alert `json:"alerts"`
+		}
+		assert.NoError(t, json.Unmarshal([]byte(<-bodies), &payload))
+		assert.Equal(t, StatusResolved, payload.Status)
+		assert.Equal(t, alerts, payload.Alerts)
+
+		notifier = NewNotifier(NotifierConfig{Type: NotifierWebhook, URL: server.URL + "/missing"})
+		assert.ErrorContains(t, notifier.Notify(context.Background(), alerts), "status 404: no such hook")
+	})
+
+	t.Run("slack", func(t *testing.T) {
+		notifier := NewNotifier(NotifierConfig{Type: NotifierSlack, URL: server.URL + "/services/T000/B000"})
+		assert.NoError(t, notifier.Notify(context.Background(), alerts))
+		assert.Equal(t, "/services/T000/B000", (<-requests).URL.Path)
+
+		var payload map[string]string
+		assert.NoError(t, json.Unmarshal([]byte(<-bodies), &payload))
+		assert.Equal(t, "[RESOLVED] ReplicationLag on prod (critical): replica is behind", payload["text"])
+	})
+
+	t.Run("alertmanager", func(t *testing.T) {
+		notifier := NewNotifier(NotifierConfig{Type: NotifierAlertmanager, URL: server.URL + "/"})
+		firing := append([]Alert{{Status: StatusFiring, Labels: alerts[0].Labels, StartsAt: start}}, alerts...)
+		assert.NoError(t, notifier.Notify(context.Background(), firing))
+		assert.Equal(t, "/api/v2/alerts", (<-requests).URL.Path)
+
+		var payload []map[string]any
+		assert.NoError(t, json.Unmarshal([]byte(<-bodies), &payload))
+		if assert.Len(t, payload, 2) {
+			assert.Equal(t, "ReplicationLag", payload[0]["labels"].(map[string]any)["alertname"])
+			assert.Equal(t, "2024-01-02T03:00:00Z", payload[0]["startsAt"])
+			endsAt, err := time.Parse(time.RFC3339, payload[0]["endsAt"].(string))
+			assert.NoError(t, err)
+			assert.WithinDuration(t, time.Now().Add(4*time.Minute), endsAt, time.Minute, "firing alerts end unless resent")
+			assert.Equal(t, "2024-01-02T04:00:00Z", payload[1]["endsAt"])
+			assert.NotContains(t, payload[1], "value")
+		}
+	})
+
+	t.Run("smtp", func(t *testing.T) {
+		addr, mails := testutils.StartSMTPServer(t)
+		notifier := NewNotifier(NotifierConfig{Type: NotifierSMTP, Addr: addr, From: "pgwatch@example.com", To: []string{"dba@example.com"}})
+		assert.NoError(t, notifier.Notify(context.Background(), alerts))
+
+		select {
+		case mail := <-mails:
+			assert.Contains(t, mail, "To: dba@example.com")
+			assert.Contains(t, mail, "Subject: [RESOLVED] ReplicationLag on prod (critical): replica is behind")
+			assert.Contains(t, mail, "Value: 5000\r\n")
+			assert.Contains(t, mail, "Resolved: 2024-01-02T04:00:00Z")
+			assert.Contains(t, mail, "runbook: https://example.com/lag")
+		case <-time.After(5 * time.Second):
+			t.Fatal("no mail received")
+		}
+	})
+}
+
+func TestAlertmanagerResend(t *testing.T) {
+	bodies := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+	}))
+	defer server.Close()
+
+	recv, rec := newTestReceiver(t, "rules: [{name: Lag, metric: replication, field: lag, op: '>', value: 1}]")
+	recv.Notifiers = append(recv.Notifiers, NewNotifier(NotifierConfig{Type: NotifierAlertmanager, URL: server.URL}))
+	recv.Evaluate(testutils.NewMeasurementEnvelope("prod", "replication", map[string]any{"lag": 5}), time.Now())
+	recv.Wait()
+	assert.Len(t, rec.take(), 1)
+	assert.Contains(t, <-bodies, `"alertname":"Lag"`)
+
+	// without a repeat interval only Alertmanager gets the firing alert again
+	recv.Resend()
+	recv.Wait()
+	assert.Empty(t, rec.take())
+	var payload []map[string]any
+	assert.NoError(t, json.Unmarshal([]byte(<-bodies), &payload))
+	if assert.Len(t, payload, 1) {
+		assert.Contains(t, payload[0], "endsAt")
+	}
+
+	recv.Evaluate(testutils.NewMeasurementEnvelope("prod", "replication", map[string]any{"lag": 0}), time.Now())
+	recv.Wait()
+	assert.Len(t, rec.take(), 1)
+	<-bodies
+	recv.Resend()
+	recv.Wait()
+	assert.Empty(t, bodies, "resolved alerts aren't resent")
+}
+
+func TestStaleSeries(t *testing.T) {
+	recv, rec := newTestReceiver(t, "rules: [{name: Lag, metric: replication, field: lag, op: '>', value: 1}]")
+	start := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	scrape := func(minutes int, replicas ...string) {
+		var rows []map[string]any
+		for _, replica := range replicas {
+			rows = append(rows, map[string]any{"lag": 5, "tag_application_name": replica})
+		}
+		recv.Evaluate(testutils.NewMeasurementEnvelope("prod", "replication", rows...), start.Add(time.Duration(minutes)*time.Minute))
+	}
+
+	scrape(0, "replica1", "replica2")
+	scrape(1, "replica1", "replica2")
+	recv.Wait()
+	assert.Len(t, rec.take(), 2)
+
+	// replica2 disappears, its alert resolves after three scrape intervals
+	scrape(2, "replica1")
+	scrape(3, "replica1")
+	recv.Expire(start.Add(3 * time.Minute))
+	recv.Wait()
+	assert.Empty(t, rec.take())
+
+	scrape(4, "replica1")
+	recv.Expire(start.Add(4*time.Minute + time.Second))
+	recv.Wait()
+	alerts := rec.take()
+	if assert.Len(t, alerts, 1) {
+		assert.Equal(t, StatusResolved, alerts[0].Status)
+		assert.Equal(t, "replica2", alerts[0].Labels["application_name"])
+	}
+	assert.Len(t, recv.states, 1)
+
+	// the whole metric stops being sent
+	recv.Expire(start.Add(8 * time.Minute))
+	recv.Wait()
+	assert.Len(t, rec.take(), 1)
+	assert.Empty(t, recv.states)
+	assert.Empty(t, recv.scrapes)
+}
+
+func TestCloseWhileEvaluating(t *testing.T) {
+	recv, _ := newTestReceiver(t, "rules: [{name: Lag, metric: replication, field: lag, op: '>', value: 1}]")
+
+	// measurements arriving during shutdown must not send on the closed queue
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recv.Evaluate(testutils.NewMeasurementEnvelope(fmt.Sprintf("db%d", i), "replication", map[string]any{"lag": 5}), time.Now())
+		}()
+	}
+	recv.Close()
+	wg.Wait()
+	recv.Close()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+)
+
+func main() {
+	port := flag.String("port", "-1", "Specify the port where you want your sink to receive the measurements on.")
+	rulesFile := flag.String("rules", "rules.yaml", "YAML file with the alerting rules and notifiers")
+	flag.Parse()
+
+	if *port == "-1" {
+		log.Println("[ERROR]: No Port Specified")
+		return
+	}
+
+	cfg, err := LoadConfig(*rulesFile)
+	if err != nil {
+		log.Fatal("[ERROR]: Unable to load rules ", err)
+	}
+	if len(cfg.Notifiers) == 0 {
+		log.Println("[WARNING]: No notifiers configured, alerts are only logged")
+	}
+
+	server := NewAlertReceiver(cfg)
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		server.Close()
+		os.Exit(0)
+	}()
+
+	if err := sinks.ListenAndServe(server, *port); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Notifier types
+const (
+	NotifierWebhook      = "webhook"      // POSTs alerts as JSON
+	NotifierSlack        = "slack"        // POSTs a message to a Slack compatible incoming webhook
+	NotifierSMTP         = "smtp"         // mails alerts
+	NotifierAlertmanager = "alertmanager" // POSTs alerts to the Alertmanager v2 API
+)
+
+// NotifierConfig is a channel alerts are sent to
+type NotifierConfig struct {
+	Type     string        `yaml:"type"`
+	URL      string        `yaml:"url"` // webhook, slack and alertmanager
+	Timeout  time.Duration `yaml:"timeout"`
+	Addr     string        `yaml:"addr"` // host:port of the mail server
+	From     string        `yaml:"from"`
+	To       []string      `yaml:"to"`
+	Username string        `yaml:"username"` // PLAIN authentication if set
+	Password string        `yaml:"password"` // environment variables like ${SMTP_PASSWORD} are expanded
+}
+
+func (cfg *NotifierConfig) Validate() error {
+	switch cfg.Type {
+	case NotifierWebhook, NotifierSlack, NotifierAlertmanager:
+		if cfg.URL == "" {
+			return errors.New("url is required")
+		}
+	case NotifierSMTP:
+		if cfg.Addr == "" || cfg.From == "" || len(cfg.To) == 0 {
+			return errors.New("addr, from and to are required")
+		}
+	default:
+		return fmt.Errorf("unknown type %q, expected webhook, slack, smtp or alertmanager", cfg.Type)
+	}
+	if cfg.Timeout < 0 {
+		return errors.New("timeout must not be negative")
+	}
+	return nil
+}
+
+// Notifier sends alerts to a channel
+type Notifier interface {
+	Notify(ctx context.Context, alerts []Alert) error
+}
+
+// NewNotifier creates the notifier of a validated config
+func NewNotifier(cfg NotifierConfig) Notifier {
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+
+	switch cfg.Type {
+	case NotifierSlack:
+		return &SlackNotifier{URL: cfg.URL, Client: client}
+	case NotifierSMTP:
+		return &SMTPNotifier{Addr: cfg.Addr, From: cfg.From, To: cfg.To, Username: cfg.Username, Password: os.ExpandEnv(cfg.Password)}
+	case NotifierAlertmanager:
+		return &AlertmanagerNotifier{URL: cfg.URL, Client: client}
+	default:
+		return &WebhookNotifier{URL: cfg.URL, Client: client}
+	}
+}
+
+// postJSON posts v as JSON to url and fails on responses other than 2xx
+func postJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// groupStatus is firing if any of the alerts is firing
+func groupStatus(alerts []Alert) string {
+	if slices.ContainsFunc(alerts, func(a Alert) bool { return a.Status == StatusFiring }) {
+		return StatusFiring
+	}
+	return StatusResolved
+}
+
+// describe returns a line describing an alert
+func describe(alert Alert) string {
+	return fmt.Sprintf("[%s] %s on %s (%s): %s", strings.ToUpper(alert.Status), alert.Labels["alertname"],
+		alert.Labels["dbname"], alert.Labels["severity"], alert.Annotations["summary"])
+}
+
+// WebhookNotifier posts {"status": ..., "alerts": [...]}
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, alerts []Alert) error {
+	payload := struct {
+		Status string  `json:"status"`
+		Alerts []Alert `json:"alerts"`
+	}{groupStatus(alerts), alerts}
+	if err := postJSON(ctx, n.Client, n.URL, payload); err != nil {
+		return fmt.Errorf("webhook failed: %w", err)
+	}
+	return nil
+}
+
+// SlackNotifier posts a message with a line per alert to an incoming
+// webhook of Slack, Mattermost or Rocket.Chat
+type SlackNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (n *SlackNotifier) Notify(ctx context.Context, alerts []Alert) error {
+	lines := make([]string, len(alerts))
+	for i, alert := range alerts {
+		lines[i] = describe(alert)
+	}
+	payload := map[string]string{"text": strings.Join(lines, "\n")}
+	if err := postJSON(ctx, n.Client, n.URL, payload); err != nil {
+		return fmt.Errorf("slack webhook failed: %w", err)
+	}
+	return nil
+}
+
+// AlertmanagerNotifier posts alerts to /api/v2/alerts, which groups,
+// silences and routes them like alerts of Prometheus
+type AlertmanagerNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// alertmanagerEndsAfter is how far in the future the endsAt of firing
+// alerts is, Alertmanager resolves them then unless they are resent. Like
+// Prometheus, a few resends may be missed.
+const alertmanagerEndsAfter = 4 * resendInterval
+
+func isAlertmanager(n Notifier) bool {
+	_, ok := n.(*AlertmanagerNotifier)
+	return ok
+}
+
+func (n *AlertmanagerNotifier) Notify(ctx context.Context, alerts []Alert) error {
+	type postableAlert struct {
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+		StartsAt    time.Time         `json:"startsAt"`
+		EndsAt      time.Time         `json:"endsAt,omitzero"`
+	}
+	endsAt := time.Now().Add(alertmanagerEndsAfter).UTC()
+	payload := make([]postableAlert, len(alerts))
+	for i, alert := range alerts {
+		payload[i] = postableAlert{alert.Labels, alert.Annotations, alert.StartsAt, alert.EndsAt}
+		if alert.Status == StatusFiring {
+			payload[i].EndsAt = endsAt
+		}
+	}
+	if err := postJSON(ctx, n.Client, strings.TrimRight(n.URL, "/")+"/api/v2/alerts", payload); err != nil {
+		return fmt.Errorf("alertmanager failed: %w", err)
+	}
+	return nil
+}
+
+// SMTPNotifier mails alerts as plain text
+type SMTPNotifier struct {
+	Addr     string
+	From     string
+	To       []string
+	Username string
+	Password string
+}
+
+func (n *SMTPNotifier) Notify(_ context.Context, alerts []Alert) error {
+	subject := describe(alerts[0])
+	if len(alerts) > 1 {
+		subject = fmt.Sprintf("[%s] %d pgwatch alerts", strings.ToUpper(groupStatus(alerts)), len(alerts))
+	}
+
+	var body strings.Builder
+	for _, alert := range alerts {
+		fmt.Fprintf(&body, "%s\n\n", describe(alert))
+		fmt.Fprintf(&body, "Value: %s\nStarted: %s\n", formatValue(alert.Value), alert.StartsAt.Format(time.RFC3339))
+		if !alert.EndsAt.IsZero() {
+			fmt.Fprintf(&body, "Resolved: %s\n", alert.EndsAt.Format(time.RFC3339))
+		}
+		for _, name := range slices.Sorted(maps.Keys(alert.Labels)) {
+			fmt.Fprintf(&body, "%s: %s\n", name, alert.Labels[name])
+		}
+		for _, name := range slices.Sorted(maps.Keys(alert.Annotations)) {
+			if name != "summary" {
+				fmt.Fprintf(&body, "%s: %s\n", name, alert.Annotations[name])
+			}
+		}
+		body.WriteString("\n")
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body.String(), "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if n.Username != "" {
+		host, _, err := net.SplitHostPort(n.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", n.Username, n.Password, host)
+	}
+	if err := smtp.SendMail(n.Addr, auth, n.From, n.To, msg.Bytes()); err != nil {
+		return fmt.Errorf("unable to send mail: %w", err)
+	}
+	return nil
+}
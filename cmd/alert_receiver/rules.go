@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"google.golang.org/protobuf/types/known/structpb"
+	"gopkg.in/yaml.v3"
+)
+
+// Rule types
+const (
+	RuleThreshold = "threshold" // compares the value of a field
+	RuleRate      = "rate"      // compares the per second change of a field
+)
+
+const defaultSummary = `{{ .Labels.alertname }} on {{ .Labels.dbname }}: {{ .Labels.metric }}.{{ .Field }} is {{ .Value }} ({{ .Op }} {{ .Threshold }})`
+
+// Config is the YAML file with the alerting rules and the channels alerts
+// are sent to
+type Config struct {
+	RepeatInterval time.Duration    `yaml:"repeat_interval"` // firing alerts are sent again after this, 0 sends them once
+	Rules          []*Rule          `yaml:"rules"`
+	Notifiers      []NotifierConfig `yaml:"notifiers"`
+}
+
+// Rule fires when a field of a metric matches a condition for a duration
+type Rule struct {
+	Name        string            `yaml:"name"`
+	Metric      string            `yaml:"metric"`
+	Field       string            `yaml:"field"`
+	Type        string            `yaml:"type"` // threshold (default) or rate
+	Op          string            `yaml:"op"`   // >, >=, <, <=, == or !=
+	Value       float64           `yaml:"value"`
+	For         time.Duration     `yaml:"for"`
+	DBName      string            `yaml:"dbname"` // regular expression matching the whole name, all databases if empty
+	Tags        map[string]string `yaml:"tags"`   // regular expressions matching whole tag values
+	Severity    string            `yaml:"severity"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"` // text/templates, summary defaults to defaultSummary
+
+	dbname      *regexp.Regexp
+	tags        map[string]*regexp.Regexp
+	annotations map[string]*template.Template
+}
+
+// LoadConfig reads and validates the rules file at path
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+// ParseConfig parses and validates a rules file, unknown keys are errors
+// so typos don't silently disable rules
+func ParseConfig(data []byte) (*Config, error) {
+	cfg := &Config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("invalid rules file: %w", err)
+	}
+	return cfg, cfg.Validate()
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.RepeatInterval < 0 {
+		return errors.New("repeat_interval must not be negative")
+	}
+	if len(cfg.Rules) == 0 {
+		return errors.New("no rules defined")
+	}
+
+	var errs []error
+	names := make(map[string]bool)
+	for i, rule := range cfg.Rules {
+		if names[rule.Name] {
+			errs = append(errs, fmt.Errorf("rule %q defined twice", rule.Name))
+		}
+		names[rule.Name] = true
+		if err := rule.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("rule %d (%s): %w", i+1, rule.Name, err))
+		}
+	}
+	for i := range cfg.Notifiers {
+		if err := cfg.Notifiers[i].Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("notifier %d (%s): %w", i+1, cfg.Notifiers[i].Type, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// compile validates the rule, sets defaults and compiles its selectors
+// and annotations
+func (rule *Rule) compile() (err error) {
+	switch {
+	case rule.Name == "":
+		return errors.New("name is required")
+	case rule.Metric == "" || rule.Field == "":
+		return errors.New("metric and field are required")
+	case rule.For < 0:
+		return errors.New("for must not be negative")
+	}
+	if rule.Type == "" {
+		rule.Type = RuleThreshold
+	}
+	if rule.Type != RuleThreshold && rule.Type != RuleRate {
+		return fmt.Errorf("unknown type %q, expected threshold or rate", rule.Type)
+	}
+	if _, ok := comparisons[rule.Op]; !ok {
+		return fmt.Errorf("unknown op %q, expected >, >=, <, <=, == or !=", rule.Op)
+	}
+	if rule.Severity == "" {
+		rule.Severity = "warning"
+	}
+
+	if rule.DBName != "" {
+		if rule.dbname, err = regexp.Compile("^(?:" + rule.DBName + ")$"); err != nil {
+			return fmt.Errorf("invalid dbname selector: %w", err)
+		}
+	}
+	rule.tags = make(map[string]*regexp.Regexp, len(rule.Tags))
+	for tag, pattern := range rule.Tags {
+		if rule.tags[tag], err = regexp.Compile("^(?:" + pattern + ")$"); err != nil {
+			return fmt.Errorf("invalid selector of tag %s: %w", tag, err)
+		}
+	}
+
+	rule.annotations = make(map[string]*template.Template, len(rule.Annotations)+1)
+	if _, ok := rule.Annotations["summary"]; !ok {
+		rule.annotations["summary"] = template.Must(template.New("summary").Option("missingkey=zero").Parse(defaultSummary))
+	}
+	for name, text := range rule.Annotations {
+		if rule.annotations[name], err = template.New(name).Option("missingkey=zero").Parse(text); err != nil {
+			return fmt.Errorf("invalid annotation %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+var comparisons = map[string]func(a, b float64) bool{
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+// matches reports whether the rule applies to measurements of a database
+func (rule *Rule) matches(dbname, metric string) bool {
+	return rule.Metric == metric && (rule.dbname == nil || rule.dbname.MatchString(dbname))
+}
+
+// matchesTags reports whether tags satisfy the tag selectors, a missing
+// tag only matches selectors accepting an empty value
+func (rule *Rule) matchesTags(tags map[string]string) bool {
+	for tag, selector := range rule.tags {
+		if !selector.MatchString(tags[tag]) {
+			return false
+		}
+	}
+	return true
+}
+
+// check reports whether value meets the rule's condition
+func (rule *Rule) check(value float64) bool {
+	return comparisons[rule.Op](value, rule.Value)
+}
+
+// annotate renders the annotations of an alert of the rule
+func (rule *Rule) annotate(labels map[string]string, value float64) map[string]string {
+	data := struct {
+		Labels    map[string]string
+		Field     string
+		Op        string
+		Value     string
+		Threshold string
+	}{labels, rule.Field, rule.Op, formatValue(value), formatValue(rule.Value)}
+
+	annotations := make(map[string]string, len(rule.annotations))
+	for name, tmpl := range rule.annotations {
+		var text bytes.Buffer
+		if err := tmpl.Execute(&text, data); err != nil {
+			annotations[name] = fmt.Sprintf("unable to render %s: %s", name, err)
+			continue
+		}
+		annotations[name] = text.String()
+	}
+	return annotations
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// rowTags returns the custom tags of the envelope and the tag_ fields of a
+// row without their prefix
+func rowTags(customTags map[string]string, fields map[string]*structpb.Value) map[string]string {
+	tags := make(map[string]string, len(customTags))
+	for name, value := range customTags {
+		tags[name] = value
+	}
+	for name, value := range fields {
+		if tag, ok := strings.CutPrefix(name, "tag_"); ok && tag != "" {
+			if s, ok := value.GetKind().(*structpb.Value_StringValue); ok {
+				tags[tag] = s.StringValue
+			} else {
+				tags[tag] = fmt.Sprint(value.AsInterface())
+			}
+		}
+	}
+	return tags
+}
+
+// numericValue returns the value of a number, bool or numeric string field
+func numericValue(value *structpb.Value) (float64, bool) {
+	switch v := value.GetKind().(type) {
+	case *structpb.Value_NumberValue:
+		return v.NumberValue, true
+	case *structpb.Value_BoolValue:
+		if v.BoolValue {
+			return 1, true
+		}
+		return 0, true
+	case *structpb.Value_StringValue:
+		f, err := strconv.ParseFloat(v.StringValue, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
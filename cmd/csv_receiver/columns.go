@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// tagPrefix is prepended to custom tag columns so they
+// don't clash with measurement fields of the same name
+const tagPrefix = "tags."
+
+// flatten converts a measurement into column/value pairs. Nested
+// objects are flattened using dotted names, lists are JSON encoded.
+func flatten(prefix string, data *structpb.Struct, row map[string]string) {
+	for name, value := range data.GetFields() {
+		switch v := value.GetKind().(type) {
+		case *structpb.Value_StructValue:
+			flatten(prefix+name+".", v.StructValue, row)
+		default:
+			row[prefix+name] = formatValue(value)
+		}
+	}
+}
+
+func formatValue(value *structpb.Value) string {
+	switch v := value.GetKind().(type) {
+	case *structpb.Value_NumberValue:
+		return strconv.FormatFloat(v.NumberValue, 'f', -1, 64)
+	case *structpb.Value_StringValue:
+		return v.StringValue
+	case *structpb.Value_BoolValue:
+		return strconv.FormatBool(v.BoolValue)
+	case *structpb.Value_ListValue:
+		encoded, err := json.Marshal(v.ListValue.AsSlice())
+		if err == nil {
+			return string(encoded)
+		}
+	}
+	return ""
+}
+
+// flattenRows returns one column/value map per measurement of msg
+func flattenRows(msg *pb.MeasurementEnvelope) []map[string]string {
+	rows := make([]map[string]string, 0, len(msg.GetData()))
+	for _, data := range msg.GetData() {
+		row := make(map[string]string)
+		flatten("", data, row)
+		for tag, value := range msg.GetCustomTags() {
+			row[tagPrefix+tag] = value
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// newColumns returns the columns of rows missing from header. The first
+// header lists data fields before tags, new columns are always appended
+// so existing columns keep their position.
+func newColumns(header []string, rows []map[string]string) []string {
+	known := make(map[string]bool, len(header))
+	for _, column := range header {
+		known[column] = true
+	}
+
+	var added []string
+	for _, row := range rows {
+		for column := range row {
+			if !known[column] {
+				known[column] = true
+				added = append(added, column)
+			}
+		}
+	}
+
+	sort.Slice(added, func(i, j int) bool {
+		iTag, jTag := isTagColumn(added[i]), isTagColumn(added[j])
+		if iTag != jTag {
+			return jTag
+		}
+		return added[i] < added[j]
+	})
+	return added
+}
+
+func isTagColumn(column string) bool {
+	return strings.HasPrefix(column, tagPrefix)
+}
+
+func record(header []string, row map[string]string) []string {
+	rec := make([]string, len(header))
+	for i, column := range header {
+		rec[i] = row[column]
+	}
+	return rec
+}
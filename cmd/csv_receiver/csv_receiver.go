@@ -3,28 +3,69 @@ package main
 import (
 	"context"
 	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
 )
 
+type Config struct {
+	MaxFileSize int64 // rotate files once they reach this many bytes, 0 disables
+	RotateDaily bool  // rotate files when the day changes
+	Gzip        bool  // compress rotated files
+}
+
 type CSVReceiver struct {
 	FullPath string
+	Cfg      Config
+	files    map[metricKey]*metricFile
+	mu       sync.Mutex
 	sinks.SyncMetricHandler
 }
 
+type metricKey struct {
+	DBName     string
+	MetricName string
+}
+
+// metricFile is the open CSV file of a database metric
+type metricFile struct {
+	path   string
+	file   *os.File
+	size   int64
+	opened time.Time
+	header []string
+	writer *csv.Writer
+}
+
+func (f *metricFile) Write(p []byte) (int, error) {
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
 /*
 * Structure for CSV storage:
 *   - Database Name
 *       - Metric1.csv
+*       - Metric1-2024-01-01.csv.gz (rotated)
 *       - Metric2.csv
  */
 
-func NewCSVReceiver(fullPath string) (tr *CSVReceiver) {
+func NewCSVReceiver(fullPath string, cfg Config) (tr *CSVReceiver) {
 	tr = &CSVReceiver{
 		FullPath:          fullPath,
+		Cfg:               cfg,
+		files:             make(map[metricKey]*metricFile),
 		SyncMetricHandler: sinks.NewSyncMetricHandler(1024),
 	}
 
@@ -33,45 +74,252 @@ func NewCSVReceiver(fullPath string) (tr *CSVReceiver) {
 	return tr
 }
 
-func (r CSVReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
-	dbDir := r.FullPath + "/" + msg.GetDBName()
-	metricFile := dbDir + msg.GetMetricName() + ".csv"
-
-	// Create Database folder if does not exist
-	err := os.MkdirAll(dbDir, os.ModePerm)
-	if err != nil {
-		return nil, err
+func (r *CSVReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
+	key := metricKey{DBName: msg.GetDBName(), MetricName: msg.GetMetricName()}
+	rows := flattenRows(msg)
+	if len(rows) == 0 {
+		return &pb.Reply{}, nil
 	}
 
-	file, err := os.OpenFile(metricFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, err := r.file(key)
 	if err != nil {
-		log.Fatal("Unable to access file. Error: " + err.Error())
+		log.Println("[ERROR]: Unable to access CSV file. Error: " + err.Error())
 		return nil, err
 	}
 
-	writer := csv.NewWriter(file)
+	added := newColumns(f.header, rows)
+	if f.size > 0 && r.shouldRotate(f) {
+		header := f.header
+		if err = r.rotate(key); err != nil {
+			return nil, err
+		}
+		if f, err = r.file(key); err != nil {
+			return nil, err
+		}
+		f.header = header
+	}
 
-	customTagsJSON, _ := sinks.GetJson(msg.GetCustomTags())
-	for _, measurement := range msg.GetData() {
-		measurementJson, err := sinks.GetJson(measurement)
-		if err != nil {
-			continue
+	if f.size == 0 {
+		f.header = append(f.header, added...)
+		if err = f.writer.Write(f.header); err != nil {
+			return nil, err
 		}
-		record := []string{
-			msg.GetMetricName(),
-			measurementJson,
-			customTagsJSON,
+	} else if len(added) > 0 {
+		if err = f.addColumns(added); err != nil {
+			log.Println("[ERROR]: Unable to add columns to CSV file " + f.path + " Error: " + err.Error())
+			return nil, err
 		}
+	}
 
-		if err := writer.Write(record); err != nil {
-			log.Println("Unable to write to CSV file " + metricFile + "Error: " + err.Error())
+	for _, row := range rows {
+		if err = f.writer.Write(record(f.header, row)); err != nil {
+			log.Println("[ERROR]: Unable to write to CSV file " + f.path + " Error: " + err.Error())
 			return nil, err
 		}
 	}
 
-	writer.Flush()
-	if err := writer.Error(); err != nil {
+	f.writer.Flush()
+	if err := f.writer.Error(); err != nil {
 		return nil, err
 	}
 	return &pb.Reply{}, nil
-}
\ No newline at end of file
+}
+
+// file returns the open file of a database metric, opening it if needed.
+// The header of an existing file is reused so appended rows line up.
+func (r *CSVReceiver) file(key metricKey) (*metricFile, error) {
+	if f, ok := r.files[key]; ok {
+		return f, nil
+	}
+
+	if !filepath.IsLocal(key.DBName) || !filepath.IsLocal(key.MetricName) || filepath.Base(key.MetricName) != key.MetricName {
+		return nil, fmt.Errorf("invalid database or metric name: %s/%s", key.DBName, key.MetricName)
+	}
+
+	dbDir := filepath.Join(r.FullPath, key.DBName)
+	if err := os.MkdirAll(dbDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dbDir, key.MetricName+".csv")
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	f := &metricFile{
+		path:   path,
+		file:   file,
+		size:   stat.Size(),
+		opened: time.Now(),
+	}
+	if f.size > 0 {
+		reader := csv.NewReader(file)
+		if f.header, err = reader.Read(); err != nil {
+			_ = file.Close()
+			return nil, fmt.Errorf("unable to read header of %s: %w", path, err)
+		}
+		f.opened = startTime(f.header, reader, stat.ModTime())
+		if _, err = file.Seek(0, io.SeekEnd); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+	f.writer = csv.NewWriter(f)
+
+	r.files[key] = f
+	return f, nil
+}
+
+// startTime returns when a reopened file was started using the epoch_ns
+// column of its first row. Files without one fall back to modified.
+func startTime(header []string, reader *csv.Reader, modified time.Time) time.Time {
+	column := slices.Index(header, "epoch_ns")
+	if column < 0 {
+		return modified
+	}
+	row, err := reader.Read()
+	if err != nil {
+		return modified
+	}
+	ns, err := strconv.ParseFloat(row[column], 64)
+	if err != nil || ns <= 0 {
+		return modified
+	}
+	return time.Unix(0, int64(ns))
+}
+
+// addColumns rewrites the file with the added columns appended to its
+// header, rows already written get empty cells for them
+func (f *metricFile) addColumns(added []string) error {
+	f.writer.Flush()
+	if err := f.writer.Error(); err != nil {
+		return err
+	}
+
+	src, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = src.Close() }()
+
+	tmp := f.path + ".tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	header := append(slices.Clone(f.header), added...)
+	err = errors.Join(copyRecords(csv.NewWriter(dst), csv.NewReader(src), header), dst.Close())
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, f.path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	// the old file is gone, append to the new one from now on
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	_ = f.file.Close()
+	f.file = file
+	f.size = stat.Size()
+	f.header = header
+	return nil
+}
+
+// copyRecords writes header followed by the records after the header of
+// src, padded to the length of header
+func copyRecords(dst *csv.Writer, src *csv.Reader, header []string) error {
+	if _, err := src.Read(); err != nil {
+		return err
+	}
+	if err := dst.Write(header); err != nil {
+		return err
+	}
+	for {
+		rec, err := src.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		rec = append(rec, make([]string, len(header)-len(rec))...)
+		if err = dst.Write(rec); err != nil {
+			return err
+		}
+	}
+	dst.Flush()
+	return dst.Error()
+}
+
+func (r *CSVReceiver) shouldRotate(f *metricFile) bool {
+	if r.Cfg.MaxFileSize > 0 && f.size >= r.Cfg.MaxFileSize {
+		return true
+	}
+	return r.Cfg.RotateDaily && f.opened.Format(time.DateOnly) != time.Now().Format(time.DateOnly)
+}
+
+// rotate closes the current file of a metric and moves it aside
+// as <metric>-<date>[.n].csv, compressing it if configured
+func (r *CSVReceiver) rotate(key metricKey) error {
+	f := r.files[key]
+	delete(r.files, key)
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	base := f.path[:len(f.path)-len(".csv")] + "-" + f.opened.Format(time.DateOnly)
+	rotated := base + ".csv"
+	for n := 1; exists(rotated) || exists(rotated+".gz"); n++ {
+		rotated = fmt.Sprintf("%s.%d.csv", base, n)
+	}
+
+	if err := os.Rename(f.path, rotated); err != nil {
+		return err
+	}
+	log.Println("[INFO]: Rotated CSV file " + rotated)
+
+	if r.Cfg.Gzip {
+		return sinks.GzipFile(rotated)
+	}
+	return nil
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Close flushes and closes all open files
+func (r *CSVReceiver) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var err error
+	for key, f := range r.files {
+		f.writer.Flush()
+		err = errors.Join(err, f.writer.Error(), f.file.Close())
+		delete(r.files, key)
+	}
+	return err
+}
@@ -1,20 +1,46 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
+	"encoding/csv"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
 	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
+func readCSV(t *testing.T, path string) [][]string {
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+	defer func() { _ = file.Close() }()
+
+	records, err := csv.NewReader(file).ReadAll()
+	assert.NoError(t, err)
+	return records
+}
+
+func newMeasurements(t *testing.T, tags map[string]string, data ...map[string]any) *pb.MeasurementEnvelope {
+	msg := &pb.MeasurementEnvelope{DBName: "test", MetricName: "db_stats", CustomTags: tags}
+	for _, fields := range data {
+		s, err := structpb.NewStruct(fields)
+		assert.NoError(t, err)
+		msg.Data = append(msg.Data, s)
+	}
+	return msg
+}
+
 func TestUpdateMeasurements(t *testing.T) {
 	fullPath, err := os.Getwd()
 	if err != nil {
 		panic(err)
 	}
-	recv := NewCSVReceiver(fullPath)
+	recv := NewCSVReceiver(fullPath, Config{})
 
 	// Call Update Measurements with dummy data
 	msg := testutils.GetTestMeasurementEnvelope()
@@ -22,11 +48,143 @@ func TestUpdateMeasurements(t *testing.T) {
 	assert.NoError(t, err)
 	defer func() { _ = os.RemoveAll(fullPath + "/" + msg.DBName) }()
 
-	// Check if database folder and metric files are created 
+	// Check if database folder and metric files are created
 	dbDir := fullPath + "/" + msg.GetDBName()
 	_, err = os.Stat(dbDir)
 	assert.False(t, os.IsNotExist(err), "Database Directory does not exist")
 
-	metricFile := dbDir + msg.GetMetricName() + ".csv"
+	metricFile := dbDir + "/" + msg.GetMetricName() + ".csv"
 	assert.FileExistsf(t, metricFile, "CSV file for metric %s doesn't exist", msg.GetMetricName())
-}
\ No newline at end of file
+	assert.NoError(t, recv.Close())
+
+	records := readCSV(t, metricFile)
+	assert.Equal(t, [][]string{{"key", "tags.tagName"}, {"val", "tagValue"}}, records)
+}
+
+func TestFlattenedColumns(t *testing.T) {
+	root := t.TempDir()
+	recv := NewCSVReceiver(root, Config{})
+	ctx := context.Background()
+
+	msg := newMeasurements(t, map[string]string{"env": "prod"},
+		map[string]any{"numbackends": 3, "state": "active", "conf": map[string]any{"a": true}},
+		map[string]any{"numbackends": 4.5, "list": []any{1, "x"}},
+	)
+	_, err := recv.UpdateMeasurements(ctx, msg)
+	assert.NoError(t, err)
+
+	// same columns in a different order are appended to the same file
+	msg = newMeasurements(t, map[string]string{"env": "prod"},
+		map[string]any{"state": "idle", "numbackends": 1},
+	)
+	_, err = recv.UpdateMeasurements(ctx, msg)
+	assert.NoError(t, err)
+	assert.NoError(t, recv.Close())
+
+	records := readCSV(t, filepath.Join(root, "test", "db_stats.csv"))
+	assert.Equal(t, [][]string{
+		{"conf.a", "list", "numbackends", "state", "tags.env"},
+		{"true", "", "3", "active", "prod"},
+		{"", `[1,"x"]`, "4.5", "", "prod"},
+		{"", "", "1", "idle", "prod"},
+	}, records)
+}
+
+func TestNewColumns(t *testing.T) {
+	root := t.TempDir()
+	recv := NewCSVReceiver(root, Config{})
+	ctx := context.Background()
+
+	_, err := recv.UpdateMeasurements(ctx, newMeasurements(t, nil, map[string]any{"b": 1}))
+	assert.NoError(t, err)
+	_, err = recv.UpdateMeasurements(ctx, newMeasurements(t, nil, map[string]any{"a": 2, "b": 3}))
+	assert.NoError(t, err)
+	_, err = recv.UpdateMeasurements(ctx, newMeasurements(t, nil, map[string]any{"b": 4}))
+	assert.NoError(t, err)
+	assert.NoError(t, recv.Close())
+
+	rotated, err := filepath.Glob(filepath.Join(root, "test", "db_stats-*"))
+	assert.NoError(t, err)
+	assert.Empty(t, rotated, "new columns shouldn't rotate the file")
+
+	// existing columns keep their position, earlier rows get empty cells
+	records := readCSV(t, filepath.Join(root, "test", "db_stats.csv"))
+	assert.Equal(t, [][]string{{"b", "a"}, {"1", ""}, {"3", "2"}, {"4", ""}}, records)
+}
+
+func TestReopenReusesHeader(t *testing.T) {
+	root := t.TempDir()
+	ctx := context.Background()
+
+	recv := NewCSVReceiver(root, Config{})
+	_, err := recv.UpdateMeasurements(ctx, newMeasurements(t, nil, map[string]any{"b": 1, "a": 2}))
+	assert.NoError(t, err)
+	assert.NoError(t, recv.Close())
+
+	recv = NewCSVReceiver(root, Config{})
+	_, err = recv.UpdateMeasurements(ctx, newMeasurements(t, nil, map[string]any{"a": 3, "b": 4}))
+	assert.NoError(t, err)
+	assert.NoError(t, recv.Close())
+
+	records := readCSV(t, filepath.Join(root, "test", "db_stats.csv"))
+	assert.Equal(t, [][]string{{"a", "b"}, {"2", "1"}, {"3", "4"}}, records)
+}
+
+func TestReopenKeepsStartDate(t *testing.T) {
+	root := t.TempDir()
+	ctx := context.Background()
+	yesterday := time.Now().AddDate(0, 0, -1)
+
+	recv := NewCSVReceiver(root, Config{RotateDaily: true})
+	_, err := recv.UpdateMeasurements(ctx, newMeasurements(t, nil, map[string]any{"epoch_ns": yesterday.UnixNano(), "value": 1}))
+	assert.NoError(t, err)
+	assert.NoError(t, recv.Close())
+
+	// the file was modified today but started yesterday
+	recv = NewCSVReceiver(root, Config{RotateDaily: true})
+	_, err = recv.UpdateMeasurements(ctx, newMeasurements(t, nil, map[string]any{"epoch_ns": time.Now().UnixNano(), "value": 2}))
+	assert.NoError(t, err)
+	assert.NoError(t, recv.Close())
+
+	rotated := filepath.Join(root, "test", "db_stats-"+yesterday.Format(time.DateOnly)+".csv")
+	assert.FileExists(t, rotated)
+	assert.Len(t, readCSV(t, rotated), 2)
+	assert.Len(t, readCSV(t, filepath.Join(root, "test", "db_stats.csv")), 2)
+}
+
+func TestRotateBySizeWithGzip(t *testing.T) {
+	root := t.TempDir()
+	recv := NewCSVReceiver(root, Config{MaxFileSize: 1, Gzip: true})
+	ctx := context.Background()
+
+	for i := range 3 {
+		_, err := recv.UpdateMeasurements(ctx, newMeasurements(t, nil, map[string]any{"value": i}))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, recv.Close())
+
+	rotated, err := filepath.Glob(filepath.Join(root, "test", "db_stats-*.csv.gz"))
+	assert.NoError(t, err)
+	assert.Len(t, rotated, 2)
+
+	file, err := os.Open(rotated[0])
+	assert.NoError(t, err)
+	defer func() { _ = file.Close() }()
+	zr, err := gzip.NewReader(file)
+	assert.NoError(t, err)
+	records, err := csv.NewReader(zr).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, "value", records[0][0])
+
+	leftovers, err := filepath.Glob(filepath.Join(root, "test", "db_stats-*.csv"))
+	assert.NoError(t, err)
+	assert.Empty(t, leftovers, "rotated files should be compressed")
+}
+
+func TestInvalidMetricName(t *testing.T) {
+	recv := NewCSVReceiver(t.TempDir(), Config{})
+	msg := testutils.GetTestMeasurementEnvelope()
+	msg.MetricName = "../escape"
+	_, err := recv.UpdateMeasurements(context.Background(), msg)
+	assert.Error(t, err)
+}
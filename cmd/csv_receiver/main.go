@@ -3,6 +3,9 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 )
@@ -10,6 +13,9 @@ import (
 func main() {
 	port := flag.String("port", "-1", "Specify the port where you want your sink to receive the measurements on.")
 	StorageFolder := flag.String("rootFolder", ".", "Only for formats like CSV...\n")
+	maxFileSize := flag.Int64("maxFileSize", 0, "Rotate CSV files once they reach this many bytes. 0 disables")
+	rotateDaily := flag.Bool("rotateDaily", false, "Rotate CSV files when the day changes")
+	gzip := flag.Bool("gzip", false, "Compress rotated CSV files with gzip")
 	flag.Parse()
 
 	if *port == "-1" {
@@ -17,7 +23,23 @@ func main() {
 		return
 	}
 
-	server := NewCSVReceiver(*StorageFolder)
+	cfg := Config{
+		MaxFileSize: *maxFileSize,
+		RotateDaily: *rotateDaily,
+		Gzip:        *gzip,
+	}
+	server := NewCSVReceiver(*StorageFolder, cfg)
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		if err := server.Close(); err != nil {
+			log.Println("[ERROR]: Unable to close CSV files: ", err)
+		}
+		os.Exit(0)
+	}()
+
 	if err := sinks.ListenAndServe(server, *port); err != nil {
 		log.Fatal(err)
 	}
@@ -3,108 +3,258 @@ package main
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/objectstore"
 	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"github.com/marcboeker/go-duckdb"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 type DuckDBReceiver struct {
-	Ctx       context.Context
-	Conn      *sql.DB
-	dbPath    string
-	TableName string
+	Ctx         context.Context
+	Conn        *sql.DB
+	dbPath      string
+	TablePrefix string
+	defs        MetricDefs
+	tables      map[string]*table
+	mu          sync.Mutex
+	store       objectstore.Store
+	exportCfg   ExportConfig
+	stop        chan struct{}
+	closeOnce   sync.Once
 	sinks.SyncMetricHandler
 }
 
-func (dbr *DuckDBReceiver) initializeTable() error {
+// NewDBDuckReceiver stores the measurements of each metric in its own table,
+// named after the metric and prefixed with tablePrefix if it is set
+func NewDBDuckReceiver(dbPath string, tablePrefix string, defs MetricDefs) (dbr *DuckDBReceiver, err error) {
 	// Allow only alphanumeric and underscores in table names
-	validateTableName := regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
-	if !validateTableName.MatchString(dbr.TableName) {
-		return fmt.Errorf("invalid table name: potential SQL injection risk")
+	validateTableName := regexp.MustCompile(`^[a-zA-Z0-9_]*$`)
+	if !validateTableName.MatchString(tablePrefix) {
+		return nil, fmt.Errorf("invalid table prefix: potential SQL injection risk")
+	}
+	if err = defs.Validate(); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("duckdb", dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	dbr = &DuckDBReceiver{
+		Conn:              db,
+		dbPath:            dbPath,
+		TablePrefix:       tablePrefix,
+		defs:              defs,
+		tables:            make(map[string]*table),
+		stop:              make(chan struct{}),
+		Ctx:               context.Background(),
+		SyncMetricHandler: sinks.NewSyncMetricHandler(1024),
+	}
+
+	// create tables of defined metrics upfront
+	for metric := range defs {
+		if _, err = dbr.ensureTable(dbr.Ctx, metric); err != nil {
+			_ = db.Close()
+			return nil, err
+		}
 	}
 
-	createTableQuery := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (dbname VARCHAR, metric_name VARCHAR, data JSON, custom_tags JSON, timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY (dbname, timestamp))`, dbr.TableName)
+	go dbr.HandleSyncMetric()
+	return dbr, nil
+}
 
-	_, err := dbr.Conn.Exec(createTableQuery)
+// ensureTable creates the table of metric if needed and returns its layout
+func (r *DuckDBReceiver) ensureTable(ctx context.Context, metric string) (*table, error) {
+	name := tableName(r.TablePrefix, metric)
+	if t, ok := r.tables[name]; ok {
+		return t, nil
+	}
+
+	columns := append([]column{}, reservedColumns...)
+	for _, field := range sinks.SortedKeys(r.defs[metric]) {
+		columns = append(columns, column{columnName(field), r.defs[metric][field]})
+	}
+
+	definitions := make([]string, 0, len(columns)+1)
+	for _, col := range columns {
+		definitions = append(definitions, quoteIdent(col.name)+" "+col.dataType)
+	}
+	definitions = append(definitions, primaryKey)
+
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", quoteIdent(name), strings.Join(definitions, ", "))
+	if _, err := r.Conn.ExecContext(ctx, query); err != nil {
+		return nil, fmt.Errorf("unable to create table %s: %w", name, err)
+	}
+
+	// the table may already exist with a different layout
+	t, err := r.loadTable(ctx, name)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	log.Print("Table successfully created")
-	return nil
+	r.tables[name] = t
+	log.Println("[INFO]: Using table " + name + " for metric " + metric)
+	return t, nil
 }
 
-func NewDBDuckReceiver(dbPath string, tableName string) (dbr *DuckDBReceiver, err error) {
-	// close fatally if table isnt created, or if receiver isnt initailized properly
-	db, err := sql.Open("duckdb", dbPath)
+func (r *DuckDBReceiver) loadTable(ctx context.Context, name string) (*table, error) {
+	rows, err := r.Conn.QueryContext(ctx, `SELECT column_name, data_type FROM duckdb_columns()
+		WHERE schema_name = 'main' AND table_name = ? ORDER BY column_index`, name)
 	if err != nil {
 		return nil, err
 	}
+	defer func() { _ = rows.Close() }()
 
-	dbr = &DuckDBReceiver{
-		Conn:      db,
-		dbPath:    dbPath,
-		TableName: tableName,
-		Ctx:       context.Background(),
+	t := newTable(name, nil)
+	for rows.Next() {
+		var col column
+		if err = rows.Scan(&col.name, &col.dataType); err != nil {
+			return nil, err
+		}
+		t.add(col)
+	}
+	return t, rows.Err()
+}
+
+// ensureColumns adds columns for new fields and widens columns to VARCHAR
+// when a field's values no longer fit their type
+func (r *DuckDBReceiver) ensureColumns(ctx context.Context, t *table, metric string, data []*structpb.Struct) error {
+	for _, row := range data {
+		fields := row.GetFields()
+		for _, field := range sinks.SortedKeys(fields) {
+			if field == "epoch_ns" {
+				continue
+			}
+			name := columnName(field)
+			value := fields[field]
+
+			if pos, ok := t.lookup(name); ok {
+				if _, fits := convertValue(t.columns[pos].dataType, value); fits {
+					continue
+				}
+				query := fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE VARCHAR", quoteIdent(t.name), quoteIdent(t.columns[pos].name))
+				if _, err := r.Conn.ExecContext(ctx, query); err != nil {
+					return fmt.Errorf("unable to widen column %s of %s: %w", name, t.name, err)
+				}
+				log.Printf("[WARNING]: Column %s of %s changed from %s to VARCHAR", name, t.name, t.columns[pos].dataType)
+				t.columns[pos].dataType = typeVarchar
+				continue
+			}
+
+			dataType, defined := r.defs[metric][field]
+			if !defined {
+				dataType = inferType(value)
+			}
+			if dataType == "" {
+				// nulls don't tell the type, wait for a value
+				continue
+			}
+
+			query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", quoteIdent(t.name), quoteIdent(name), dataType)
+			if _, err := r.Conn.ExecContext(ctx, query); err != nil {
+				return fmt.Errorf("unable to add column %s to %s: %w", name, t.name, err)
+			}
+			log.Printf("[INFO]: Added column %s %s to %s", name, dataType, t.name)
+			t.add(column{name, dataType})
+		}
 	}
+	return nil
+}
 
-	err = dbr.initializeTable()
+// rows converts the measurements of msg to rows in table order
+func (r *DuckDBReceiver) rows(t *table, msg *pb.MeasurementEnvelope) ([][]driver.Value, error) {
+	customTagsJSON, err := json.Marshal(msg.GetCustomTags())
 	if err != nil {
 		return nil, err
 	}
 
-	go dbr.HandleSyncMetric()
-	return dbr, nil
+	rows := make([][]driver.Value, 0, len(msg.GetData()))
+	for i, measurement := range msg.GetData() {
+		values := make([]driver.Value, len(t.columns))
+		for _, reserved := range []struct {
+			name  string
+			value driver.Value
+		}{
+			{"dbname", msg.GetDBName()},
+			{"metric_name", msg.GetMetricName()},
+			{"timestamp", sinks.MeasurementTime(measurement, time.Now().UTC())},
+			{"row_idx", int32(i)},
+			{"custom_tags", string(customTagsJSON)},
+		} {
+			pos, ok := t.lookup(reserved.name)
+			if !ok {
+				return nil, fmt.Errorf("table %s has no %s column", t.name, reserved.name)
+			}
+			values[pos] = reserved.value
+		}
+
+		for field, value := range measurement.GetFields() {
+			pos, ok := t.lookup(columnName(field))
+			if !ok {
+				continue
+			}
+			converted, fits := convertValue(t.columns[pos].dataType, value)
+			if !fits {
+				return nil, fmt.Errorf("value of %s doesn't fit column type %s", field, t.columns[pos].dataType)
+			}
+			values[pos] = converted
+		}
+		rows = append(rows, values)
+	}
+	return rows, nil
 }
 
 func (r *DuckDBReceiver) InsertMeasurements(ctx context.Context, data *pb.MeasurementEnvelope) error {
-	customTagsJSON, _ := json.Marshal(data.GetCustomTags())
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	// use direct SQL approach - just use the existing connection with the standard insert statement
-	tx, err := r.Conn.BeginTx(ctx, nil)
+	t, err := r.ensureTable(ctx, data.GetMetricName())
 	if err != nil {
-		log.Printf("Error beginning transaction: %v", err)
+		return err
+	}
+	if err = r.ensureColumns(ctx, t, data.GetMetricName(), data.GetData()); err != nil {
+		// reload the layout next time, the table may be partially altered
+		delete(r.tables, t.name)
 		return err
 	}
 
-	stmt, err := tx.Prepare("INSERT INTO " + r.TableName +
-		" (dbname, metric_name, data, custom_tags, timestamp) VALUES (?, ?, ?, ?, ?)")
+	rows, err := r.rows(t, data)
 	if err != nil {
-		log.Printf("error from preparing statement: %v", err)
-		_ = tx.Rollback()
 		return err
 	}
-	defer func() {_ = stmt.Close()}()
 
-	for _, measurement := range data.GetData() {
-		measurementJson, err := sinks.GetJson(measurement)
-		if err != nil {
-			continue
-		}
-		_, err = stmt.Exec(
-			data.GetDBName(),
-			data.GetMetricName(),
-			measurementJson,
-			customTagsJSON,
-			time.Now(),
-		)
+	conn, err := r.Conn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
 
+	// the appender writes whole data chunks, which is much faster than
+	// inserting row by row
+	return conn.Raw(func(driverConn any) error {
+		appender, err := duckdb.NewAppenderFromConn(driverConn.(driver.Conn), "", t.name)
 		if err != nil {
-			log.Printf("error from insert: %v", err)
-			_ = tx.Rollback()
 			return err
 		}
-	}
-
-	if err := tx.Commit(); err != nil {
-		log.Printf("error from committing transaction: %v", err)
-		return err
-	}
-	return nil
+		for _, row := range rows {
+			if err = appender.AppendRow(row...); err != nil {
+				_ = appender.Close()
+				return err
+			}
+		}
+		return appender.Close()
+	})
 }
 
 func (r *DuckDBReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
@@ -113,9 +263,22 @@ func (r *DuckDBReceiver) UpdateMeasurements(ctx context.Context, msg *pb.Measure
 
 	err := r.InsertMeasurements(ctx, msg)
 	if err != nil {
+		log.Println("[ERROR]: Unable to insert measurements: " + err.Error())
 		return nil, err
 	}
 
 	log.Println("[INFO]: Inserted batch at : " + time.Now().String())
 	return &pb.Reply{}, nil
-}
\ No newline at end of file
+}
+
+// Close stops exports and closes the database
+func (r *DuckDBReceiver) Close() (err error) {
+	r.closeOnce.Do(func() {
+		close(r.stop)
+		if r.store != nil {
+			err = r.store.Close()
+		}
+		err = errors.Join(err, r.Conn.Close())
+	})
+	return err
+}
@@ -2,107 +2,435 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
-	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
 	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
-var dbPath string
+var testDir string
 
 func TestMain(m *testing.M) {
 	currentDir, err := os.Getwd()
 	if err != nil {
 		panic(err)
 	}
-	testDir := filepath.Join(currentDir, "test_tmp")
+	testDir = filepath.Join(currentDir, "test_tmp")
 
 	err = os.MkdirAll(testDir, 0755)
 	if err != nil {
 		panic(err)
 	}
-	dbPath = filepath.Join(testDir, "pgwatch_test.duckdb")
 
 	exitCode := m.Run()
 	_ = os.RemoveAll(testDir)
 	os.Exit(exitCode)
 }
 
-func TestInitialize(t *testing.T) {
-	dbr, err := NewDBDuckReceiver(dbPath, "measurements")
+func newTestReceiver(t *testing.T, defs MetricDefs) *DuckDBReceiver {
+	dbr, err := NewDBDuckReceiver(filepath.Join(testDir, t.Name()+".duckdb"), "", defs)
 	assert.NoError(t, err, "error creating duckdb receiver")
+	t.Cleanup(func() { _ = dbr.Close() })
+	return dbr
+}
 
-	// assert the table creation
-	rows, err := dbr.Conn.Query("SELECT name FROM sqlite_master WHERE type='table' AND name='measurements'")
-	assert.NoError(t, err, "could not to query tables")
-	defer func() {_ = rows.Close()}()
+func getColumns(t *testing.T, dbr *DuckDBReceiver, table string) map[string]string {
+	rows, err := dbr.Conn.Query("SELECT column_name, data_type FROM duckdb_columns() WHERE table_name = ?", table)
+	assert.NoError(t, err, "Failed to get table information")
+	defer func() { _ = rows.Close() }()
 
-	tableExists := rows.Next()
-	assert.True(t, tableExists, "Measurements table was not created")
+	columns := make(map[string]string)
+	for rows.Next() {
+		var name, dataType string
+		assert.NoError(t, rows.Scan(&name, &dataType))
+		columns[name] = dataType
+	}
+	return columns
+}
 
-	// assert the structure
-	// note - pk and notnull are not INT types but bool types in duckdb
-	columns, err := dbr.Conn.Query("PRAGMA table_info(measurements)")
-	assert.NoError(t, err, "Failed to get table information")
-	defer func() {_ = columns.Close()}()
-
-	columnNames := make(map[string]bool)
-	for columns.Next() {
-		var cid int
-		var name, type_name string
-		var notnull bool
-		var dflt_value interface{}
-		var pk bool
-
-		err = columns.Scan(&cid, &name, &type_name, &notnull, &dflt_value, &pk)
-		assert.NoError(t, err, "Failed to scan column information")
-		columnNames[name] = true
+func newEnvelope(t *testing.T, metric string, data ...map[string]any) *pb.MeasurementEnvelope {
+	msg := &pb.MeasurementEnvelope{
+		DBName:     "test",
+		MetricName: metric,
+		CustomTags: map[string]string{"tagName": "tagValue"},
 	}
+	for _, row := range data {
+		st, err := structpb.NewStruct(row)
+		assert.NoError(t, err)
+		msg.Data = append(msg.Data, st)
+	}
+	return msg
+}
+
+func TestInitialize(t *testing.T) {
+	dbr := newTestReceiver(t, nil)
+
+	_, err := dbr.UpdateMeasurements(context.Background(), testutils.GetTestMeasurementEnvelope())
+	assert.NoError(t, err)
 
-	// assert required columns exist (in this setting.)
-	requiredColumns := []string{"dbname", "metric_name", "data", "custom_tags", "timestamp"}
-	for _, col := range requiredColumns {
-		assert.True(t, columnNames[col], fmt.Sprintf("Required column '%s' missing from table", col))
+	// every metric gets its own table with typed columns
+	columns := getColumns(t, dbr, "testmetric")
+	requiredColumns := map[string]string{
+		"dbname":      "VARCHAR",
+		"metric_name": "VARCHAR",
+		"timestamp":   "TIMESTAMP",
+		"row_idx":     "INTEGER",
+		"custom_tags": "JSON",
+		"key":         "VARCHAR",
+	}
+	for name, dataType := range requiredColumns {
+		assert.Equal(t, dataType, columns[name], fmt.Sprintf("Column '%s' missing or of wrong type", name))
 	}
 }
 
 func TestUpdateMeasurements(t *testing.T) {
-	dbr, err := NewDBDuckReceiver(dbPath, "measurements")
-	assert.NoError(t, err, "error creating duckdb receiver")
+	dbr := newTestReceiver(t, nil)
 
 	for cnt := range 5 {
 		// Call Update Measurements with dummy data
 		msg := testutils.GetTestMeasurementEnvelope()
-		_, err = dbr.UpdateMeasurements(context.Background(), msg)
+		_, err := dbr.UpdateMeasurements(context.Background(), msg)
 		assert.NoError(t, err)
 
 		// verify data was inserted
-		rows, err := dbr.Conn.Query("SELECT dbname, metric_name, data, custom_tags FROM measurements")
+		rows, err := dbr.Conn.Query(`SELECT dbname, metric_name, key, custom_tags FROM testmetric`)
 		assert.NoError(t, err, "Failed to query database")
-		defer func(){_ = rows.Close()}()
 
 		rowCount := 0
 		for rows.Next() {
-			var dbname, metricName, customTags string
-			var data map[string]any
-			err := rows.Scan(&dbname, &metricName, &data, &customTags)
+			var dbname, metricName, key, customTags string
+			err := rows.Scan(&dbname, &metricName, &key, &customTags)
 			assert.NoError(t, err, "Failed to scan row")
 
-			customTagsJSON, _ := sinks.GetJson(msg.GetCustomTags())
-			measurementJson, _ := sinks.GetJson(msg.GetData()[0])
-			dataJson, _ := sinks.GetJson(data)
-
 			assert.Equal(t, msg.GetDBName(), dbname)
 			assert.Equal(t, msg.GetMetricName(), metricName)
-			assert.Equal(t, customTagsJSON, customTags)
-			assert.Equal(t, measurementJson, dataJson)
+			assert.Equal(t, `{"tagName":"tagValue"}`, customTags)
+			assert.Equal(t, "val", key)
 
 			rowCount++
 		}
-		assert.Equalf(t, rowCount, cnt + 1, "Expected %v rows got %v", cnt + 1, rowCount)
+		_ = rows.Close()
+		assert.Equalf(t, rowCount, cnt+1, "Expected %v rows got %v", cnt+1, rowCount)
 	}
-}
\ No newline at end of file
+}
+
+func TestMultipleRows(t *testing.T) {
+	dbr := newTestReceiver(t, nil)
+
+	// rows of an envelope share epoch_ns but must not collide on the primary key
+	msg := newEnvelope(t, "table_stats",
+		map[string]any{"epoch_ns": 1e18, "relname": "a", "seq_scan": 1},
+		map[string]any{"epoch_ns": 1e18, "relname": "b", "seq_scan": 2},
+		map[string]any{"epoch_ns": 1e18, "relname": "c", "seq_scan": 3},
+	)
+	_, err := dbr.UpdateMeasurements(context.Background(), msg)
+	assert.NoError(t, err)
+
+	var count int
+	var total float64
+	err = dbr.Conn.QueryRow("SELECT count(*), sum(seq_scan) FROM table_stats").Scan(&count, &total)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, 6.0, total)
+
+	// the same envelope again is a duplicate
+	_, err = dbr.UpdateMeasurements(context.Background(), msg)
+	assert.Error(t, err)
+}
+
+func TestNewFields(t *testing.T) {
+	dbr := newTestReceiver(t, nil)
+
+	_, err := dbr.UpdateMeasurements(context.Background(), newEnvelope(t, "db_stats",
+		map[string]any{"numbackends": 1}))
+	assert.NoError(t, err)
+
+	_, err = dbr.UpdateMeasurements(context.Background(), newEnvelope(t, "db_stats",
+		map[string]any{"numbackends": 2, "in_recovery": true, "settings": map[string]any{"a": "b"}}))
+	assert.NoError(t, err)
+
+	columns := getColumns(t, dbr, "db_stats")
+	assert.Equal(t, "DOUBLE", columns["numbackends"])
+	assert.Equal(t, "BOOLEAN", columns["in_recovery"])
+	assert.Equal(t, "JSON", columns["settings"])
+
+	var nulls int
+	err = dbr.Conn.QueryRow("SELECT count(*) FROM db_stats WHERE in_recovery IS NULL").Scan(&nulls)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, nulls)
+
+	// a string in a numeric column widens it
+	_, err = dbr.UpdateMeasurements(context.Background(), newEnvelope(t, "db_stats",
+		map[string]any{"numbackends": "many"}))
+	assert.NoError(t, err)
+	assert.Equal(t, "VARCHAR", getColumns(t, dbr, "db_stats")["numbackends"])
+
+	// reserved names are kept apart from the table's own columns
+	_, err = dbr.UpdateMeasurements(context.Background(), newEnvelope(t, "db_stats",
+		map[string]any{"dbname": "postgres"}))
+	assert.NoError(t, err)
+	assert.Equal(t, "VARCHAR", getColumns(t, dbr, "db_stats")["data_dbname"])
+}
+
+func TestMetricDefs(t *testing.T) {
+	defs := MetricDefs{"wal": {"xlog_location_b": "bigint"}}
+	dbr := newTestReceiver(t, defs)
+
+	// defined metrics get their tables upfront
+	assert.Equal(t, "BIGINT", getColumns(t, dbr, "wal")["xlog_location_b"])
+
+	_, err := dbr.UpdateMeasurements(context.Background(), newEnvelope(t, "wal",
+		map[string]any{"xlog_location_b": 123456789, "in_recovery": false}))
+	assert.NoError(t, err)
+
+	var location int64
+	err = dbr.Conn.QueryRow("SELECT xlog_location_b FROM wal").Scan(&location)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(123456789), location)
+
+	assert.Error(t, MetricDefs{"wal": {"a": "POINT"}}.Validate())
+}
+
+func newTestQueryServer(t *testing.T) (*DuckDBReceiver, *httptest.Server) {
+	dbr := newTestReceiver(t, nil)
+	for range 3 {
+		msg := newEnvelope(t, "db_stats", map[string]any{"numbackends": 1}, map[string]any{"numbackends": 2})
+		_, err := dbr.UpdateMeasurements(context.Background(), msg)
+		assert.NoError(t, err)
+		time.Sleep(time.Millisecond)
+	}
+
+	queries := map[string]CannedQuery{
+		"backends": {SQL: "SELECT numbackends FROM db_stats WHERE dbname = $dbname ORDER BY numbackends"},
+	}
+	cfg := QueryConfig{Token: "secret", Timeout: 5 * time.Second, MaxRows: 4}
+	qs, err := NewQueryServer(dbr.Conn, cfg, queries)
+	assert.NoError(t, err)
+
+	server := httptest.NewServer(qs.Handler())
+	t.Cleanup(server.Close)
+	return dbr, server
+}
+
+func query(t *testing.T, method, target, body string) *http.Response {
+	req, err := http.NewRequest(method, target, strings.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = res.Body.Close() })
+	return res
+}
+
+func TestQueryServer(t *testing.T) {
+	dbr, server := newTestQueryServer(t)
+
+	t.Run("json", func(t *testing.T) {
+		res := query(t, http.MethodPost, server.URL+"/query", "SELECT dbname, numbackends FROM db_stats ORDER BY numbackends;")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "true", res.Header.Get("X-Truncated"))
+
+		var result struct {
+			Columns []struct {
+				Name string `json:"name"`
+				Type string `json:"type"`
+			} `json:"columns"`
+			Rows      [][]any `json:"rows"`
+			Truncated bool    `json:"truncated"`
+		}
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+		assert.Equal(t, "numbackends", result.Columns[1].Name)
+		assert.Equal(t, "DOUBLE", result.Columns[1].Type)
+		assert.Len(t, result.Rows, 4)
+		assert.True(t, result.Truncated)
+		assert.Equal(t, []any{"test", 1.0}, result.Rows[0])
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		res := query(t, http.MethodGet, server.URL+"/query?format=csv&sql="+url.QueryEscape("SELECT count(*) AS n FROM db_stats"), "")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		body, _ := io.ReadAll(res.Body)
+		assert.Equal(t, "n\n6\n", string(body))
+		assert.Empty(t, res.Header.Get("X-Truncated"))
+	})
+
+	t.Run("arrow", func(t *testing.T) {
+		res := query(t, http.MethodGet, server.URL+"/queries/backends?format=arrow&dbname=test", "")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "true", res.Header.Get("X-Truncated"))
+
+		reader, err := ipc.NewReader(res.Body)
+		assert.NoError(t, err)
+		defer reader.Release()
+		var rows int64
+		for reader.Next() {
+			rows += reader.Record().NumRows()
+		}
+		assert.Equal(t, int64(4), rows)
+	})
+
+	t.Run("canned parameters", func(t *testing.T) {
+		res := query(t, http.MethodGet, server.URL+"/queries/backends?dbname=other", "")
+		body, _ := io.ReadAll(res.Body)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Contains(t, string(body), `"rows":[]`)
+
+		res = query(t, http.MethodGet, server.URL+"/queries/backends", "")
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+		res = query(t, http.MethodGet, server.URL+"/queries/unknown", "")
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	})
+
+	t.Run("read only", func(t *testing.T) {
+		for _, sql := range []string{
+			"DELETE FROM db_stats",
+			"DROP TABLE db_stats",
+			"SELECT 1; DROP TABLE db_stats",
+			"SELECT 1; DROP TABLE db_stats; SELECT 1",
+		} {
+			res := query(t, http.MethodPost, server.URL+"/query", sql)
+			assert.Equal(t, http.StatusBadRequest, res.StatusCode, sql)
+		}
+
+		var count int
+		assert.NoError(t, dbr.Conn.QueryRow("SELECT count(*) FROM db_stats").Scan(&count))
+		assert.Equal(t, 6, count)
+
+		// semicolons in literals and comments are fine
+		res := query(t, http.MethodPost, server.URL+"/query", "SELECT ';' AS a -- ; DROP\n;")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	})
+
+	t.Run("no external access", func(t *testing.T) {
+		for _, sql := range []string{
+			"SELECT * FROM read_text('/etc/hostname')",
+			"SELECT * FROM glob('/etc/*')",
+			"SELECT * FROM '/etc/passwd'",
+			"SELECT * FROM db_stats WHERE dbname IN (SELECT content FROM read_text('/etc/hostname'))",
+			"SELECT * FROM (WITH \"/etc/passwd\" AS (SELECT 1) SELECT 1), '/etc/passwd'",
+		} {
+			res := query(t, http.MethodPost, server.URL+"/query", sql)
+			body, _ := io.ReadAll(res.Body)
+			assert.Equal(t, http.StatusBadRequest, res.StatusCode, sql)
+			assert.Regexp(t, "not allowed|unknown table", string(body), sql)
+		}
+
+		res := query(t, http.MethodPost, server.URL+"/query", "WITH s AS (SELECT * FROM main.db_stats) SELECT count(*) FROM s, range(2)")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	})
+
+	t.Run("auth", func(t *testing.T) {
+		res, err := http.Get(server.URL + "/queries")
+		assert.NoError(t, err)
+		_ = res.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+		for addr, ok := range map[string]bool{"localhost:8090": true, "127.0.0.1:8090": true, "[::1]:8090": true, ":8090": false, "0.0.0.0:8090": false, "example.com:8090": false} {
+			_, err = NewQueryServer(dbr.Conn, QueryConfig{Addr: addr, Timeout: time.Second, MaxRows: 1}, nil)
+			assert.Equal(t, ok, err == nil, addr)
+		}
+	})
+}
+
+func TestQueryTimeout(t *testing.T) {
+	dbr := newTestReceiver(t, nil)
+	qs, err := NewQueryServer(dbr.Conn, QueryConfig{Addr: "localhost:0", Timeout: 50 * time.Millisecond, MaxRows: 10}, nil)
+	assert.NoError(t, err)
+	server := httptest.NewServer(qs.Handler())
+	defer server.Close()
+
+	res := query(t, http.MethodPost, server.URL+"/query", "SELECT count(*) FROM range(100000000000) a")
+	assert.Equal(t, http.StatusGatewayTimeout, res.StatusCode)
+}
+
+func TestExport(t *testing.T) {
+	dbr := newTestReceiver(t, nil)
+	exportDir := filepath.Join(testDir, t.Name())
+	store, err := OpenExportStore(context.Background(), exportDir)
+	assert.NoError(t, err)
+
+	cfg := ExportConfig{Interval: time.Hour, Partition: time.Hour, Retention: 2 * time.Hour}
+	assert.Error(t, dbr.StartExport(store, ExportConfig{}))
+	assert.NoError(t, dbr.StartExport(store, cfg))
+
+	now := time.Date(2025, 1, 2, 12, 30, 0, 0, time.UTC)
+	for _, ts := range []time.Time{
+		now.Add(-4 * time.Hour),
+		now.Add(-3 * time.Hour),
+		now.Add(-3*time.Hour + time.Minute),
+		now.Add(-time.Hour),
+		now,
+	} {
+		msg := newEnvelope(t, "db_stats", map[string]any{"epoch_ns": float64(ts.UnixNano()), "numbackends": 1})
+		_, err = dbr.UpdateMeasurements(context.Background(), msg)
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, dbr.Export(context.Background(), now))
+
+	// the current hour is still open
+	keys, err := store.List(context.Background(), "db_stats/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"db_stats/date=2025-01-02/db_stats-20250102T080000.parquet",
+		"db_stats/date=2025-01-02/db_stats-20250102T090000.parquet",
+		"db_stats/date=2025-01-02/db_stats-20250102T110000.parquet",
+	}, keys)
+
+	var count int
+	err = dbr.Conn.QueryRow("SELECT count(*) FROM read_parquet(?)", filepath.Join(exportDir, "db_stats/date=2025-01-02/db_stats-20250102T090000.parquet")).Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// only exported rows older than the retention are deleted
+	err = dbr.Conn.QueryRow("SELECT count(*) FROM db_stats").Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// exported partitions aren't exported twice
+	assert.NoError(t, dbr.Export(context.Background(), now.Add(time.Hour)))
+	keys, err = store.List(context.Background(), "db_stats/")
+	assert.NoError(t, err)
+	assert.Len(t, keys, 4)
+
+	// late rows of a kept partition replace its file, those of a deleted
+	// partition go to a new file
+	for _, ts := range []time.Time{now.Add(-4*time.Hour + time.Minute), now.Add(-time.Hour + time.Minute)} {
+		msg := newEnvelope(t, "db_stats", map[string]any{"epoch_ns": float64(ts.UnixNano()), "numbackends": 2})
+		_, err = dbr.UpdateMeasurements(context.Background(), msg)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, dbr.Export(context.Background(), now.Add(time.Hour)))
+	keys, err = store.List(context.Background(), "db_stats/")
+	assert.NoError(t, err)
+	assert.Contains(t, keys, "db_stats/date=2025-01-02/db_stats-20250102T080000-1.parquet")
+	assert.Len(t, keys, 5)
+
+	for file, rows := range map[string]int{"db_stats-20250102T080000.parquet": 1, "db_stats-20250102T080000-1.parquet": 1, "db_stats-20250102T110000.parquet": 2} {
+		err = dbr.Conn.QueryRow("SELECT count(*) FROM read_parquet(?)", filepath.Join(exportDir, "db_stats/date=2025-01-02", file)).Scan(&count)
+		assert.NoError(t, err)
+		assert.Equal(t, rows, count, file)
+	}
+
+	// the late row was deleted once exported, the kept partition wasn't
+	err = dbr.Conn.QueryRow("SELECT count(*) FROM db_stats WHERE timestamp < ?", now.Add(-3*time.Hour)).Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	assert.NoError(t, dbr.Close())
+	assert.NoError(t, dbr.Close())
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/objectstore"
+)
+
+// exportsTable records the exported partitions of each metric table
+const exportsTable = "_parquet_exports"
+
+const exportTimeFormat = "2006-01-02 15:04:05"
+
+type ExportConfig struct {
+	Interval  time.Duration // how often closed partitions are exported
+	Partition time.Duration // time span covered by each exported file, e.g. 1h or 24h
+	Retention time.Duration // exported rows older than this are deleted, 0 deletes them right away
+}
+
+func (cfg *ExportConfig) Validate() error {
+	if cfg.Interval <= 0 {
+		return errors.New("export interval must be positive")
+	}
+	if cfg.Partition < time.Second {
+		return errors.New("export partition must be at least a second")
+	}
+	if cfg.Retention < 0 {
+		return errors.New("retention must not be negative")
+	}
+	return nil
+}
+
+// OpenExportStore returns the store exports are written to, target is
+// either a local directory or an object store URL
+func OpenExportStore(ctx context.Context, target string) (objectstore.Store, error) {
+	if strings.Contains(target, "://") {
+		return objectstore.New(ctx, target)
+	}
+	return objectstore.NewLocalStore(target)
+}
+
+// StartExport periodically copies closed time partitions of all metric
+// tables to Parquet files in store, then deletes exported rows older than
+// the retention and checkpoints the database
+func (r *DuckDBReceiver) StartExport(store objectstore.Store, cfg ExportConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (table_name VARCHAR, partition_start TIMESTAMP,
+		generation INTEGER, exported_rows BIGINT, PRIMARY KEY (table_name, partition_start))`, quoteIdent(exportsTable))
+	if _, err := r.Conn.Exec(query); err != nil {
+		return err
+	}
+
+	r.store = store
+	r.exportCfg = cfg
+	go r.exportPeriodically()
+	return nil
+}
+
+func (r *DuckDBReceiver) exportPeriodically() {
+	ticker := time.NewTicker(r.exportCfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			if err := r.Export(r.Ctx, time.Now()); err != nil {
+				log.Println("[ERROR]: Export failed: " + err.Error())
+			}
+		}
+	}
+}
+
+// Export exports all partitions that ended before now and deletes those
+// that ended before the retention
+func (r *DuckDBReceiver) Export(ctx context.Context, now time.Time) error {
+	tables, err := r.metricTables(ctx)
+	if err != nil {
+		return err
+	}
+
+	closedUntil := r.partitionStart(now)
+	deleteBefore := now.UTC().Add(-r.exportCfg.Retention)
+
+	tmpDir, err := os.MkdirTemp("", "duckdb-export-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	for _, table := range tables {
+		if err2 := r.exportTable(ctx, table, closedUntil, deleteBefore, tmpDir); err2 != nil {
+			err = errors.Join(err, fmt.Errorf("table %s: %w", table, err2))
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err2 := r.Conn.ExecContext(ctx, "CHECKPOINT"); err2 != nil {
+		err = errors.Join(err, fmt.Errorf("checkpoint failed: %w", err2))
+	}
+	return err
+}
+
+// partitionStart returns the start of the partition t falls into
+func (r *DuckDBReceiver) partitionStart(t time.Time) time.Time {
+	size := r.exportCfg.Partition.Microseconds()
+	return time.UnixMicro(t.UnixMicro() / size * size).UTC()
+}
+
+// metricTables returns the tables created by the receiver
+func (r *DuckDBReceiver) metricTables(ctx context.Context) ([]string, error) {
+	rows, err := r.Conn.QueryContext(ctx, `SELECT table_name FROM duckdb_columns()
+		WHERE schema_name = 'main' AND column_name = 'row_idx' ORDER BY table_name`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	return tables, rows.Err()
+}
+
+// partition is a time partition of a metric table with rows
+type partition struct {
+	start      time.Time
+	rows       int64         // rows in the table
+	generation int           // files written for partition rows deleted earlier
+	exported   sql.NullInt64 // rows in the file of the current generation
+}
+
+// exportTable exports the partitions of table that ended before
+// closedUntil and weren't exported with all of their rows yet, then deletes
+// exported partitions that ended before deleteBefore. Partitions that
+// received rows since their export are exported again; once a partition's
+// rows are deleted, rows arriving later go to a file of the next
+// generation, <table>-<start>-<generation>.parquet.
+func (r *DuckDBReceiver) exportTable(ctx context.Context, table string, closedUntil, deleteBefore time.Time, tmpDir string) error {
+	partitions, err := r.partitions(ctx, table, closedUntil)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range partitions {
+		end := p.start.Add(r.exportCfg.Partition)
+		if !p.exported.Valid || p.exported.Int64 != p.rows {
+			written, err := r.exportPartition(ctx, table, p.start, end, p.generation, tmpDir)
+			if err != nil {
+				return err
+			}
+			_, err = r.Conn.ExecContext(ctx, "INSERT OR REPLACE INTO "+quoteIdent(exportsTable)+" VALUES (?, ?, ?, ?)",
+				table, p.start, p.generation, written)
+			if err != nil {
+				return err
+			}
+			p.exported = sql.NullInt64{Int64: written, Valid: true}
+		}
+
+		if !end.After(deleteBefore) {
+			if err = r.deleteExported(ctx, table, p, end); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// partitions returns the partitions of table with rows before closedUntil
+func (r *DuckDBReceiver) partitions(ctx context.Context, table string, closedUntil time.Time) ([]partition, error) {
+	query := fmt.Sprintf(`SELECT p.start, p.rows, coalesce(e.generation, 0), e.exported_rows
+		FROM (SELECT make_timestamp(epoch_us(timestamp) // $1 * $1) AS start, count(*) AS rows
+			FROM %s WHERE timestamp < $2 GROUP BY ALL) p
+		LEFT JOIN %s e ON e.table_name = $3 AND e.partition_start = p.start
+		ORDER BY p.start`, quoteIdent(table), quoteIdent(exportsTable))
+	rows, err := r.Conn.QueryContext(ctx, query, r.exportCfg.Partition.Microseconds(), closedUntil, table)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var partitions []partition
+	for rows.Next() {
+		var p partition
+		if err = rows.Scan(&p.start, &p.rows, &p.generation, &p.exported); err != nil {
+			return nil, err
+		}
+		p.start = p.start.UTC()
+		partitions = append(partitions, p)
+	}
+	return partitions, rows.Err()
+}
+
+// exportPartition copies the rows of table between start and end to
+// <table>/date=<day>/<table>-<start>.parquet, or with a -<generation>
+// suffix for later generations, and returns how many rows were copied
+func (r *DuckDBReceiver) exportPartition(ctx context.Context, table string, start, end time.Time, generation int, tmpDir string) (int64, error) {
+	name := table + "-" + start.Format("20060102T150405")
+	if generation > 0 {
+		name += fmt.Sprintf("-%d", generation)
+	}
+	name += ".parquet"
+	tmpFile := filepath.Join(tmpDir, name)
+
+	query := fmt.Sprintf(`COPY (SELECT * FROM %s WHERE timestamp >= TIMESTAMP '%s' AND timestamp < TIMESTAMP '%s' ORDER BY timestamp, dbname, row_idx)
+		TO '%s' (FORMAT PARQUET, COMPRESSION ZSTD)`,
+		quoteIdent(table), start.Format(exportTimeFormat), end.Format(exportTimeFormat), strings.ReplaceAll(tmpFile, "'", "''"))
+	res, err := r.Conn.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = os.Remove(tmpFile) }()
+	written, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.Open(tmpFile)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = file.Close() }()
+
+	key := table + "/date=" + start.Format("2006-01-02") + "/" + name
+	if err = r.store.Put(ctx, key, file, objectstore.PutOptions{ContentType: "application/vnd.apache.parquet"}); err != nil {
+		return 0, err
+	}
+	log.Printf("[INFO]: Exported %d rows of %s from %s to %s", written, table, start.Format(time.RFC3339), key)
+	return written, nil
+}
+
+// deleteExported deletes the rows of partition p if all of them have been
+// exported, otherwise they are exported again next time
+func (r *DuckDBReceiver) deleteExported(ctx context.Context, table string, p partition, end time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var rows int64
+	query := "SELECT count(*) FROM " + quoteIdent(table) + " WHERE timestamp >= ? AND timestamp < ?"
+	if err := r.Conn.QueryRowContext(ctx, query, p.start, end).Scan(&rows); err != nil {
+		return err
+	}
+	if rows != p.exported.Int64 {
+		return nil
+	}
+
+	tx, err := r.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if _, err = tx.ExecContext(ctx, "DELETE FROM "+quoteIdent(table)+" WHERE timestamp >= ? AND timestamp < ?", p.start, end); err != nil {
+		return fmt.Errorf("unable to delete exported rows of %s: %w", table, err)
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE "+quoteIdent(exportsTable)+" SET generation = generation + 1, exported_rows = 0 WHERE table_name = ? AND partition_start = ?",
+		table, p.start)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("[INFO]: Deleted %d exported rows of %s from %s", rows, table, p.start.Format(time.RFC3339))
+	return nil
+}
@@ -1,17 +1,30 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/destrex271/pgwatch3_rpc_server/sinks"
-	_ "github.com/marcboeker/go-duckdb"
 )
 
 func main() {
 	port := flag.String("port", "-1", "Specify the port where you want your sink to receive the measurements on.")
 	dbPath := flag.String("dbPath", "metrics.duckdb", "Path to the DuckDB database file")
-	tableName := flag.String("tableName", "measurements", "Name of the measurements table")
+	tablePrefix := flag.String("tablePrefix", "", "Prefix of the per metric table names")
+	metricDefs := flag.String("metricDefs", "", "JSON file with column types of metrics, other columns are inferred from the data")
+	httpAddr := flag.String("httpAddr", "", "Address of the read-only HTTP query endpoint, e.g. localhost:8090. Disabled if empty")
+	queryTimeout := flag.Duration("queryTimeout", 30*time.Second, "Cancel HTTP queries after this long")
+	maxRows := flag.Int("maxRows", 10000, "Maximum number of rows returned by HTTP queries")
+	cannedQueries := flag.String("cannedQueries", "", "JSON file with named queries served under /queries/<name>")
+	exportTo := flag.String("exportTo", "", "Directory or object store URL closed partitions are exported to as Parquet, e.g. s3://bucket/prefix. Disabled if empty")
+	exportInterval := flag.Duration("exportInterval", 10*time.Minute, "How often closed partitions are exported")
+	exportPartition := flag.Duration("exportPartition", time.Hour, "Time span covered by each exported file")
+	retention := flag.Duration("retention", 24*time.Hour, "Delete exported rows older than this")
 	flag.Parse()
 
 	if *port == "-1" {
@@ -19,11 +32,72 @@ func main() {
 		return
 	}
 
-	server, err := NewDBDuckReceiver(*dbPath, *tableName)
+	var defs MetricDefs
+	if *metricDefs != "" {
+		var err error
+		if defs, err = LoadMetricDefs(*metricDefs); err != nil {
+			log.Fatal("[ERROR]: Unable to load metric definitions: ", err)
+		}
+	}
+
+	server, err := NewDBDuckReceiver(*dbPath, *tablePrefix, defs)
 	if err != nil {
 		log.Fatal("[ERROR]: Unable to create DuckDB receiver: ", err)
 	}
 
+	if *exportTo != "" {
+		store, err := OpenExportStore(context.Background(), *exportTo)
+		if err != nil {
+			log.Fatal("[ERROR]: Unable to open export store: ", err)
+		}
+		cfg := ExportConfig{
+			Interval:  *exportInterval,
+			Partition: *exportPartition,
+			Retention: *retention,
+		}
+		if err = server.StartExport(store, cfg); err != nil {
+			log.Fatal("[ERROR]: Unable to start exports: ", err)
+		}
+	}
+
+	var queryServer *QueryServer
+	if *httpAddr != "" {
+		var queries map[string]CannedQuery
+		if *cannedQueries != "" {
+			if queries, err = LoadCannedQueries(*cannedQueries); err != nil {
+				log.Fatal("[ERROR]: Unable to load canned queries: ", err)
+			}
+		}
+
+		cfg := QueryConfig{
+			Addr:    *httpAddr,
+			Token:   os.Getenv("DUCKDB_QUERY_TOKEN"),
+			Timeout: *queryTimeout,
+			MaxRows: *maxRows,
+		}
+		if queryServer, err = NewQueryServer(server.Conn, cfg, queries); err != nil {
+			log.Fatal("[ERROR]: Unable to create query endpoint: ", err)
+		}
+		go func() {
+			if err := queryServer.ListenAndServe(); err != nil {
+				log.Fatal("[ERROR]: Query endpoint failed: ", err)
+			}
+		}()
+	}
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		if queryServer != nil {
+			_ = queryServer.Close()
+		}
+		if err := server.Close(); err != nil {
+			log.Println("[ERROR]: Unable to close database: ", err)
+		}
+		os.Exit(0)
+	}()
+
 	if err := sinks.ListenAndServe(server, *port); err != nil {
 		log.Fatal(err)
 	}
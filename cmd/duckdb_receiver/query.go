@@ -0,0 +1,622 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/marcboeker/go-duckdb"
+)
+
+// Formats query results can be returned in
+const (
+	FormatJSON  = "json"
+	FormatCSV   = "csv"
+	FormatArrow = "arrow"
+)
+
+const maxQueryLength = 1 << 20
+
+var (
+	errBadQuery      = errors.New("bad query")
+	errUnknownFormat = errors.New("unknown format, use json, csv or arrow")
+)
+
+type QueryConfig struct {
+	Addr    string        // listen address, e.g. localhost:8090
+	Token   string        // bearer token required from clients, empty disables auth on loopback addresses
+	Timeout time.Duration // queries are cancelled after this long
+	MaxRows int           // results are truncated after this many rows
+}
+
+// CannedQuery is a named query analysts can run without writing SQL.
+// Parameters are referenced as $name and filled from the URL query.
+type CannedQuery struct {
+	Description string `json:"description"`
+	SQL         string `json:"sql"`
+}
+
+// LoadCannedQueries reads canned queries from a JSON file, e.g.
+// {"recent": {"description": "...", "sql": "SELECT ... WHERE dbname = $dbname"}}
+func LoadCannedQueries(path string) (map[string]CannedQuery, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var queries map[string]CannedQuery
+	if err = json.Unmarshal(content, &queries); err != nil {
+		return nil, fmt.Errorf("invalid canned queries in %s: %w", path, err)
+	}
+	return queries, nil
+}
+
+// QueryServer answers read-only SQL queries against the receiver's
+// database over HTTP, as no other process can open the file meanwhile
+type QueryServer struct {
+	db      *sql.DB
+	cfg     QueryConfig
+	queries map[string]CannedQuery
+	server  *http.Server
+}
+
+func NewQueryServer(db *sql.DB, cfg QueryConfig, queries map[string]CannedQuery) (*QueryServer, error) {
+	if cfg.Timeout <= 0 {
+		return nil, errors.New("query timeout must be positive")
+	}
+	if cfg.MaxRows <= 0 {
+		return nil, errors.New("max rows must be positive")
+	}
+	if cfg.Token == "" && !isLoopback(cfg.Addr) {
+		return nil, fmt.Errorf("a token is required to serve queries on %s, set DUCKDB_QUERY_TOKEN or bind to localhost", cfg.Addr)
+	}
+	for name, query := range queries {
+		if _, err := singleStatement(query.SQL); err != nil {
+			return nil, fmt.Errorf("canned query %s: %w", name, err)
+		}
+	}
+
+	qs := &QueryServer{db: db, cfg: cfg, queries: queries}
+	qs.server = &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           qs.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return qs, nil
+}
+
+func (qs *QueryServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /query", qs.handleQuery)
+	mux.HandleFunc("POST /query", qs.handleQuery)
+	mux.HandleFunc("GET /queries", qs.handleList)
+	mux.HandleFunc("GET /queries/{name}", qs.handleCanned)
+	return qs.authenticate(mux)
+}
+
+func (qs *QueryServer) ListenAndServe() error {
+	log.Println("[INFO]: Serving queries on " + qs.cfg.Addr)
+	if err := qs.server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (qs *QueryServer) Close() error {
+	return qs.server.Close()
+}
+
+func (qs *QueryServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if qs.cfg.Token != "" {
+			token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(qs.cfg.Token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleQuery runs the SQL from the sql parameter or the request body
+func (qs *QueryServer) handleQuery(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("sql")
+	if r.Method == http.MethodPost {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxQueryLength))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query = string(body)
+	}
+	qs.serve(w, r, query)
+}
+
+func (qs *QueryServer) handleList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(qs.queries)
+}
+
+func (qs *QueryServer) handleCanned(w http.ResponseWriter, r *http.Request) {
+	query, ok := qs.queries[r.PathValue("name")]
+	if !ok {
+		http.Error(w, "unknown query "+r.PathValue("name"), http.StatusNotFound)
+		return
+	}
+	qs.serve(w, r, query.SQL)
+}
+
+func (qs *QueryServer) serve(w http.ResponseWriter, r *http.Request, query string) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = FormatJSON
+	}
+	if format != FormatJSON && format != FormatCSV && format != FormatArrow {
+		http.Error(w, errUnknownFormat.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// all other parameters are query parameters
+	params := make(map[string]string)
+	for name, values := range r.URL.Query() {
+		if name != "sql" && name != "format" && len(values) > 0 {
+			params[name] = values[0]
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), qs.cfg.Timeout)
+	defer cancel()
+
+	err := qs.run(ctx, query, params, format, w)
+	switch {
+	case err == nil:
+		return
+	case errors.Is(err, errBadQuery):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil:
+		http.Error(w, "query timed out after "+qs.cfg.Timeout.String(), http.StatusGatewayTimeout)
+	default:
+		log.Println("[ERROR]: Query failed: " + err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// run executes query in a transaction that is always rolled back. Only
+// single SELECT statements are accepted, at most MaxRows rows are returned.
+func (qs *QueryServer) run(ctx context.Context, query string, params map[string]string, format string, w http.ResponseWriter) error {
+	query, err := singleStatement(query)
+	if err != nil {
+		return err
+	}
+
+	conn, err := qs.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	return conn.Raw(func(driverConn any) error {
+		c := driverConn.(*duckdb.Conn)
+		if _, err := c.ExecContext(ctx, "BEGIN TRANSACTION", nil); err != nil {
+			return err
+		}
+		defer func() { _, _ = c.ExecContext(context.Background(), "ROLLBACK", nil) }()
+
+		// check before preparing, binding already opens files
+		if err := checkTables(ctx, c, query); err != nil {
+			return err
+		}
+		args, err := bindParams(ctx, c, query, params)
+		if err != nil {
+			return err
+		}
+
+		// fetch one row more than allowed to tell if the result is truncated
+		limited := fmt.Sprintf("SELECT * FROM (\n%s\n) LIMIT %d", query, qs.cfg.MaxRows+1)
+		if format == FormatArrow {
+			return qs.writeArrow(ctx, c, limited, args, w)
+		}
+
+		rows, err := c.QueryContext(ctx, limited, args)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = rows.Close() }()
+		return qs.writeRows(rows, format, w)
+	})
+}
+
+// bindParams checks that query is a SELECT and returns its parameters
+// in order, taken from params by name
+func bindParams(ctx context.Context, c *duckdb.Conn, query string, params map[string]string) ([]driver.NamedValue, error) {
+	prepared, err := c.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errBadQuery, err)
+	}
+	stmt := prepared.(*duckdb.Stmt)
+	defer func() { _ = stmt.Close() }()
+
+	stmtType, err := stmt.StatementType()
+	if err != nil {
+		return nil, err
+	}
+	if stmtType != duckdb.STATEMENT_TYPE_SELECT {
+		return nil, fmt.Errorf("%w: only SELECT statements are allowed", errBadQuery)
+	}
+
+	args := make([]driver.NamedValue, stmt.NumInput())
+	for i := range args {
+		name, err := stmt.ParamName(i + 1)
+		if err != nil {
+			return nil, err
+		}
+		value, ok := params[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: missing parameter %s", errBadQuery, name)
+		}
+		args[i] = driver.NamedValue{Ordinal: i + 1, Value: value}
+	}
+	return args, nil
+}
+
+// tableFunctions are the table functions queries may use, all others like
+// read_text, read_parquet or glob can read files and URLs
+var tableFunctions = map[string]bool{"range": true, "generate_series": true, "unnest": true}
+
+// checkTables rejects queries reading anything but the tables and views of
+// the database. Besides table functions, DuckDB also reads files and URLs
+// used like tables, e.g. FROM '/etc/passwd', unless a table of that name
+// exists.
+func checkTables(ctx context.Context, c *duckdb.Conn, query string) error {
+	rows, err := c.QueryContext(ctx, "SELECT json_serialize_sql(?::VARCHAR)", []driver.NamedValue{{Ordinal: 1, Value: query}})
+	if err != nil {
+		return err
+	}
+	values := make([]driver.Value, 1)
+	err = rows.Next(values)
+	_ = rows.Close()
+	if err != nil {
+		return err
+	}
+	tree, ok := values[0].(map[string]any)
+	if !ok {
+		return fmt.Errorf("unexpected syntax tree %T", values[0])
+	}
+	if failed, _ := tree["error"].(bool); failed {
+		return fmt.Errorf("%w: %v", errBadQuery, tree["error_message"])
+	}
+
+	tables := make(map[string]bool)
+	rows, err = c.QueryContext(ctx, `SELECT database_name, schema_name, table_name FROM duckdb_tables()
+		UNION ALL SELECT database_name, schema_name, view_name FROM duckdb_views()`, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+	values = make([]driver.Value, 3)
+	for {
+		err = rows.Next(values)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		catalog, schema, name := values[0].(string), values[1].(string), values[2].(string)
+		for _, key := range []string{name, schema + "." + name, catalog + "." + schema + "." + name} {
+			tables[strings.ToLower(key)] = true
+		}
+	}
+	return checkTableRefs(tree["statements"], tables, nil)
+}
+
+// checkTableRefs walks the syntax tree of a query, ctes are the names of
+// the common table expressions in scope
+func checkTableRefs(node any, tables map[string]bool, ctes map[string]bool) error {
+	switch node := node.(type) {
+	case map[string]any:
+		if cteMap, ok := node["cte_map"].(map[string]any); ok {
+			entries, _ := cteMap["map"].([]any)
+			if len(entries) > 0 {
+				scope := make(map[string]bool, len(ctes)+len(entries))
+				for name := range ctes {
+					scope[name] = true
+				}
+				for _, entry := range entries {
+					if name, ok := entry.(map[string]any)["key"].(string); ok {
+						scope[strings.ToLower(name)] = true
+					}
+				}
+				ctes = scope
+			}
+		}
+
+		switch node["type"] {
+		case "TABLE_FUNCTION":
+			function, _ := node["function"].(map[string]any)
+			name, _ := function["function_name"].(string)
+			if !tableFunctions[strings.ToLower(name)] {
+				return fmt.Errorf("%w: table function %s is not allowed", errBadQuery, name)
+			}
+		case "BASE_TABLE":
+			var parts []string
+			for _, key := range []string{"catalog_name", "schema_name", "table_name"} {
+				if part, _ := node[key].(string); part != "" {
+					parts = append(parts, part)
+				}
+			}
+			name := strings.ToLower(strings.Join(parts, "."))
+			if !tables[name] && !(len(parts) == 1 && ctes[name]) {
+				return fmt.Errorf("%w: unknown table %s", errBadQuery, strings.Join(parts, "."))
+			}
+		}
+
+		for _, child := range node {
+			if err := checkTableRefs(child, tables, ctes); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for _, child := range node {
+			if err := checkTableRefs(child, tables, ctes); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isLoopback reports whether addr only accepts connections from this host
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (qs *QueryServer) writeRows(rows driver.Rows, format string, w http.ResponseWriter) error {
+	columns := rows.Columns()
+	types := make([]string, len(columns))
+	if typed, ok := rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		for i := range columns {
+			types[i] = typed.ColumnTypeDatabaseTypeName(i)
+		}
+	}
+
+	var result [][]driver.Value
+	for {
+		values := make([]driver.Value, len(columns))
+		err := rows.Next(values)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		result = append(result, values)
+	}
+
+	truncated := len(result) > qs.cfg.MaxRows
+	if truncated {
+		result = result[:qs.cfg.MaxRows]
+		w.Header().Set("X-Truncated", "true")
+	}
+
+	if format == FormatCSV {
+		w.Header().Set("Content-Type", "text/csv")
+		writer := csv.NewWriter(w)
+		_ = writer.Write(columns)
+		for _, values := range result {
+			record := make([]string, len(values))
+			for i, value := range values {
+				record[i] = csvValue(value)
+			}
+			_ = writer.Write(record)
+		}
+		writer.Flush()
+		return nil
+	}
+
+	type columnInfo struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+	response := struct {
+		Columns   []columnInfo `json:"columns"`
+		Rows      [][]any      `json:"rows"`
+		Truncated bool         `json:"truncated"`
+	}{Rows: make([][]any, 0, len(result)), Truncated: truncated}
+	for i, name := range columns {
+		response.Columns = append(response.Columns, columnInfo{name, types[i]})
+	}
+	for _, values := range result {
+		row := make([]any, len(values))
+		for i, value := range values {
+			row[i] = jsonValue(value)
+		}
+		response.Rows = append(response.Rows, row)
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+	return nil
+}
+
+func (qs *QueryServer) writeArrow(ctx context.Context, c *duckdb.Conn, query string, args []driver.NamedValue, w http.ResponseWriter) error {
+	ar, err := duckdb.NewArrowFromConn(c)
+	if err != nil {
+		return err
+	}
+
+	values := make([]any, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	reader, err := ar.QueryContext(ctx, query, values...)
+	if err != nil {
+		return err
+	}
+	defer reader.Release()
+
+	var records []arrow.Record
+	defer func() {
+		for _, record := range records {
+			record.Release()
+		}
+	}()
+
+	// the query returns at most MaxRows+1 rows
+	var rows int64
+	limit := int64(qs.cfg.MaxRows)
+	for reader.Next() {
+		record := reader.Record()
+		if rows+record.NumRows() > limit {
+			w.Header().Set("X-Truncated", "true")
+			if keep := limit - rows; keep > 0 {
+				records = append(records, record.NewSlice(0, keep))
+			}
+			break
+		}
+		record.Retain()
+		records = append(records, record)
+		rows += record.NumRows()
+	}
+	if err = reader.Err(); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apache.arrow.stream")
+	writer := ipc.NewWriter(w, ipc.WithSchema(reader.Schema()))
+	for _, record := range records {
+		if err = writer.Write(record); err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+// singleStatement returns query without a trailing semicolon, or an error
+// if it contains more than one statement. The driver executes all but the
+// last statement while preparing, so they must never reach it.
+func singleStatement(query string) (string, error) {
+	end := -1
+	for i := 0; i < len(query); i++ {
+		switch {
+		case query[i] == '\'' || query[i] == '"':
+			quote := query[i]
+			for i++; i < len(query) && query[i] != quote; i++ {
+			}
+		case strings.HasPrefix(query[i:], "--"):
+			for ; i < len(query) && query[i] != '\n'; i++ {
+			}
+		case strings.HasPrefix(query[i:], "/*"):
+			closing := strings.Index(query[i+2:], "*/")
+			if closing < 0 {
+				return "", fmt.Errorf("%w: unterminated comment", errBadQuery)
+			}
+			i += closing + 3
+		case strings.HasPrefix(query[i:], "$$"):
+			closing := strings.Index(query[i+2:], "$$")
+			if closing < 0 {
+				return "", fmt.Errorf("%w: unterminated string", errBadQuery)
+			}
+			i += closing + 3
+		case query[i] == ';':
+			if end < 0 {
+				end = i
+			}
+		case end >= 0 && !isSpace(query[i]):
+			return "", fmt.Errorf("%w: only a single statement is allowed", errBadQuery)
+		}
+	}
+
+	if end >= 0 {
+		query = query[:end]
+	}
+	if strings.TrimSpace(query) == "" {
+		return "", fmt.Errorf("%w: empty query", errBadQuery)
+	}
+	return query, nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// jsonValue converts values the driver returns to ones encoding/json handles
+func jsonValue(value any) any {
+	switch v := value.(type) {
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Sprint(v)
+		}
+	case float32:
+		return jsonValue(float64(v))
+	case duckdb.Decimal:
+		return v.Float64()
+	case duckdb.Map:
+		m := make(map[string]any, len(v))
+		for key, item := range v {
+			m[fmt.Sprint(key)] = jsonValue(item)
+		}
+		return m
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for key, item := range v {
+			m[key] = jsonValue(item)
+		}
+		return m
+	case []any:
+		items := make([]any, len(v))
+		for i, item := range v {
+			items[i] = jsonValue(item)
+		}
+		return items
+	}
+	return value
+}
+
+func csvValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case duckdb.Map, map[string]any, []any:
+		encoded, err := json.Marshal(jsonValue(v))
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(encoded)
+	}
+	return fmt.Sprint(jsonValue(value))
+}
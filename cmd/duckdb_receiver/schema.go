@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Column types measurement fields can be stored as
+const (
+	typeDouble  = "DOUBLE"
+	typeBigint  = "BIGINT"
+	typeBoolean = "BOOLEAN"
+	typeVarchar = "VARCHAR"
+	typeJSON    = "JSON"
+)
+
+var validTypes = map[string]bool{
+	typeDouble:  true,
+	typeBigint:  true,
+	typeBoolean: true,
+	typeVarchar: true,
+	typeJSON:    true,
+}
+
+type column struct {
+	name     string
+	dataType string
+}
+
+// reservedColumns start every metric table, measurement fields with the
+// same name are stored as data_<name>
+var reservedColumns = []column{
+	{"dbname", typeVarchar},
+	{"metric_name", typeVarchar},
+	{"timestamp", "TIMESTAMP"},
+	{"row_idx", "INTEGER"},
+	{"custom_tags", typeJSON},
+}
+
+const primaryKey = "PRIMARY KEY (dbname, metric_name, timestamp, row_idx)"
+
+// MetricDefs pins the column types of metrics, e.g.
+// {"db_stats": {"numbackends": "BIGINT", "blks_hit": "BIGINT"}}.
+// Columns missing from a definition are inferred from the data.
+type MetricDefs map[string]map[string]string
+
+// LoadMetricDefs reads metric definitions from a JSON file
+func LoadMetricDefs(path string) (MetricDefs, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var defs MetricDefs
+	if err = json.Unmarshal(content, &defs); err != nil {
+		return nil, fmt.Errorf("invalid metric definitions in %s: %w", path, err)
+	}
+	return defs, defs.Validate()
+}
+
+func (defs MetricDefs) Validate() error {
+	for metric, columns := range defs {
+		for name, dataType := range columns {
+			upper := strings.ToUpper(dataType)
+			if !validTypes[upper] {
+				return fmt.Errorf("metric %s: unsupported type %s for column %s", metric, dataType, name)
+			}
+			columns[name] = upper
+		}
+	}
+	return nil
+}
+
+// table is the cached layout of a metric table, columns are in table order
+type table struct {
+	name    string
+	columns []column
+	index   map[string]int
+}
+
+func newTable(name string, columns []column) *table {
+	t := &table{name: name, index: make(map[string]int)}
+	for _, col := range columns {
+		t.add(col)
+	}
+	return t
+}
+
+func (t *table) add(col column) {
+	t.index[strings.ToLower(col.name)] = len(t.columns)
+	t.columns = append(t.columns, col)
+}
+
+func (t *table) lookup(name string) (int, bool) {
+	pos, ok := t.index[strings.ToLower(name)]
+	return pos, ok
+}
+
+// columnName maps a measurement field to its column
+func columnName(field string) string {
+	for _, col := range reservedColumns {
+		if strings.EqualFold(col.name, field) {
+			return "data_" + field
+		}
+	}
+	return field
+}
+
+var invalidTableChars = regexp.MustCompile(`[^a-z0-9_]`)
+
+// tableName returns the table measurements of metric are stored in
+func tableName(prefix, metric string) string {
+	name := strings.ToLower(metric)
+	if prefix != "" {
+		name = prefix + "_" + name
+	}
+	return invalidTableChars.ReplaceAllString(name, "_")
+}
+
+// quoteIdent quotes a table or column name for use in SQL statements
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// inferType returns the column type for v, or "" for nulls
+func inferType(v *structpb.Value) string {
+	switch v.GetKind().(type) {
+	case *structpb.Value_NumberValue:
+		return typeDouble
+	case *structpb.Value_BoolValue:
+		return typeBoolean
+	case *structpb.Value_StringValue:
+		return typeVarchar
+	case *structpb.Value_StructValue, *structpb.Value_ListValue:
+		return typeJSON
+	}
+	return ""
+}
+
+// convertValue converts v for a column of dataType, ok is false if the
+// column has to be widened to VARCHAR first
+func convertValue(dataType string, v *structpb.Value) (value driver.Value, ok bool) {
+	if _, isNull := v.GetKind().(*structpb.Value_NullValue); isNull || v == nil {
+		return nil, true
+	}
+
+	switch dataType {
+	case typeDouble, typeBigint:
+		n, isNumber := v.GetKind().(*structpb.Value_NumberValue)
+		if !isNumber {
+			return nil, false
+		}
+		if dataType == typeBigint {
+			return int64(n.NumberValue), true
+		}
+		return n.NumberValue, true
+	case typeBoolean:
+		b, isBool := v.GetKind().(*structpb.Value_BoolValue)
+		if !isBool {
+			return nil, false
+		}
+		return b.BoolValue, true
+	case typeVarchar:
+		if s, isString := v.GetKind().(*structpb.Value_StringValue); isString {
+			return s.StringValue, true
+		}
+		fallthrough
+	case typeJSON:
+		encoded, err := json.Marshal(v.AsInterface())
+		if err != nil {
+			return nil, false
+		}
+		return string(encoded), true
+	}
+	return nil, false
+}
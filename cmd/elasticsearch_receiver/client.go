@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+type ClientConfig struct {
+	Addresses          []string // ignored if CloudID is set
+	CloudID            string
+	Username           string
+	Password           string
+	APIKey             string // base64 encoded "id:api_key"
+	BearerToken        string // service account or OAuth token
+	CACertPath         string // system roots are used if empty
+	InsecureSkipVerify bool   // don't verify server certificates, for labs only
+	OpenSearch         bool   // talk to OpenSearch instead of Elasticsearch
+}
+
+func (cfg *ClientConfig) Validate() error {
+	methods := 0
+	for _, secret := range []string{cfg.Password, cfg.APIKey, cfg.BearerToken} {
+		if secret != "" {
+			methods++
+		}
+	}
+	if methods > 1 {
+		return errors.New("only one of password, API key and bearer token can be set")
+	}
+	if cfg.OpenSearch && cfg.CloudID != "" {
+		return errors.New("cloud ID is not supported in OpenSearch mode")
+	}
+	if cfg.CloudID == "" && len(cfg.Addresses) == 0 {
+		return errors.New("either addresses or cloud ID must be set")
+	}
+	return nil
+}
+
+// openSearchTransport marks OpenSearch responses as coming from
+// Elasticsearch, as the client refuses to talk to other products
+type openSearchTransport struct {
+	http.RoundTripper
+}
+
+func (t openSearchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.RoundTripper.RoundTrip(req)
+	if res != nil {
+		res.Header.Set("X-Elastic-Product", "Elasticsearch")
+	}
+	return res, err
+}
+
+func newClient(cfg ClientConfig) (*elasticsearch.Client, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CACertPath != "" {
+		cacert, err := os.ReadFile(cfg.CACertPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(cacert) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CACertPath)
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	esCfg := elasticsearch.Config{
+		Username:     cfg.Username,
+		Password:     cfg.Password,
+		APIKey:       cfg.APIKey,
+		ServiceToken: cfg.BearerToken,
+		Transport:    transport,
+	}
+	if cfg.CloudID != "" {
+		esCfg.CloudID = cfg.CloudID
+	} else {
+		esCfg.Addresses = cfg.Addresses
+	}
+	if cfg.OpenSearch {
+		esCfg.Transport = openSearchTransport{transport}
+	}
+
+	return elasticsearch.NewClient(esCfg)
+}
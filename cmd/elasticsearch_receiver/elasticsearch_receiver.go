@@ -6,88 +6,179 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
+	"log"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
 	"github.com/elastic/go-elasticsearch/v8"
-	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
 )
 
+type IndexConfig struct {
+	Prefix        string        // indices are named <prefix>-<dbname>_<metric>
+	DataStreams   bool          // write to data streams instead of indices
+	DateFormat    string        // Go time layout appended to index names, ignored for data streams
+	ILMPolicy     string        // name of the ILM policy attached to indices, empty disables ILM
+	Retention     string        // delete indices after this long, e.g. 30d, empty keeps them
+	FlushInterval time.Duration // how often buffered documents are sent
+}
+
+// retentionFormat matches the time units ILM and ISM accept
+var retentionFormat = regexp.MustCompile(`^[0-9]+(d|h|m|s|ms|micros|nanos)$`)
+
+func (cfg *IndexConfig) Validate() error {
+	if cfg.Prefix == "" {
+		return errors.New("index prefix must not be empty")
+	}
+	if cfg.Retention != "" && !retentionFormat.MatchString(cfg.Retention) {
+		return fmt.Errorf("invalid retention %q, expected a number followed by d, h, m or s", cfg.Retention)
+	}
+	return nil
+}
+
 type ESReceiver struct {
 	esClient *elasticsearch.Client
+	indexer  esutil.BulkIndexer
+	cfg      IndexConfig
 	sinks.SyncMetricHandler
 }
 
-func NewESReceiver(addrs []string, username, password, cacertPath string) (*ESReceiver, error) {
-	cacert, err := os.ReadFile(cacertPath)
+// Document is the indexed representation of a single measurement
+type Document struct {
+	Timestamp  time.Time         `json:"@timestamp"`
+	DBName     string            `json:"dbname"`
+	MetricName string            `json:"metric"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	Data       map[string]any    `json:"data"`
+}
+
+func NewESReceiver(clientCfg ClientConfig, indexCfg IndexConfig) (*ESReceiver, error) {
+	if err := indexCfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	esClient, err := newClient(clientCfg)
 	if err != nil {
 		return nil, err
 	}
 
-	esCfg := elasticsearch.Config{
-		Addresses: addrs,
-		Username: username,
-		Password: password,
-		CACert: cacert,
+	// Heath Check Ping call
+	res, err := esClient.Info()
+	if err = checkResponse(res, err); err != nil {
+		return nil, fmt.Errorf("failed to connect to Elasticsearch: %w", err)
 	}
 
-	esClient, err := elasticsearch.NewClient(esCfg)
-	if err != nil {
+	if err = installTemplates(context.Background(), esClient, indexCfg, clientCfg.OpenSearch); err != nil {
 		return nil, err
 	}
 
-	// Heath Check Ping call
-	_, err = esClient.Info()
+	indexer, err := newBulkIndexer(esClient, indexCfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to Elasticsearch: %w", err)
+		return nil, err
 	}
 
 	es := &ESReceiver{
 		esClient: esClient,
+		indexer:  indexer,
+		cfg:      indexCfg,
 		SyncMetricHandler: sinks.NewSyncMetricHandler(1024),
 	}
 	go es.HandleSyncMetric()
 	return es, nil
 }
 
+// newBulkIndexer returns an indexer sending documents every
+// cfg.FlushInterval. It counts failed documents, see ESReceiver.Stats.
+func newBulkIndexer(client *elasticsearch.Client, cfg IndexConfig) (esutil.BulkIndexer, error) {
+	return esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
+		Client:        client,
+		FlushInterval: cfg.FlushInterval,
+		OnError: func(ctx context.Context, err error) {
+			log.Println("[ERROR]: Bulk indexing failed: ", err)
+		},
+	})
+}
+
+var invalidIndexChars = strings.NewReplacer(
+	`\`, "_", "/", "_", "*", "_", "?", "_", `"`, "_", "<", "_",
+	">", "_", "|", "_", " ", "_", ",", "_", "#", "_", ":", "_",
+)
+
+// indexName returns the index or data stream a measurement taken at t is
+// written to. Date based names make indices easy to drop as they age.
+func (es *ESReceiver) indexName(dbName, metricName string, t time.Time) string {
+	name := es.cfg.Prefix + "-" + dbName + "_" + metricName
+	if !es.cfg.DataStreams && es.cfg.DateFormat != "" {
+		name += "-" + t.UTC().Format(es.cfg.DateFormat)
+	}
+	return invalidIndexChars.Replace(strings.ToLower(name))
+}
+
 func (es *ESReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
+	// data streams only accept create operations
+	action := "index"
+	if es.cfg.DataStreams {
+		action = "create"
+	}
+
 	var err error
 	for _, dataItem := range msg.GetData() {
-		jsonData, err2 := json.Marshal(dataItem)
-		if err2 != nil {
-			err = errors.Join(err, err2)
-			continue
+		doc := Document{
+			Timestamp:  sinks.MeasurementTime(dataItem, time.Now().UTC()),
+			DBName:     msg.GetDBName(),
+			MetricName: msg.GetMetricName(),
+			Tags:       msg.GetCustomTags(),
+			Data:       dataItem.AsMap(),
 		}
 
-		indexName := strings.ToLower(msg.GetDBName() + "_" + msg.GetMetricName())
-		req := esapi.IndexRequest{
-			Index: indexName, 
-			Body: bytes.NewReader(jsonData),
-		}
-
-		res, err2 := req.Do(ctx, es.esClient)
+		jsonData, err2 := json.Marshal(doc)
 		if err2 != nil {
 			err = errors.Join(err, err2)
 			continue
 		}
 
-		if res != nil {
-			if res.IsError() {
-				var errorBody map[string]any
-				if err2 = json.NewDecoder(res.Body).Decode(&errorBody); err2 == nil {
-					err = errors.Join(err, fmt.Errorf("elasticsearch error [%s]: %v", res.Status(), errorBody))
-				} else {
-					err = errors.Join(err, fmt.Errorf("elasticsearch error [%s]", res.Status()))
+		err2 = es.indexer.Add(ctx, esutil.BulkIndexerItem{
+			Index:  es.indexName(doc.DBName, doc.MetricName, doc.Timestamp),
+			Action: action,
+			Body:   bytes.NewReader(jsonData),
+			OnFailure: func(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem, err error) {
+				if err != nil {
+					log.Printf("[ERROR]: Unable to index measurement in %s: %v", item.Index, err)
+					return
 				}
-			}
-			_ = res.Body.Close()
+				log.Printf("[ERROR]: Unable to index measurement in %s: %s: %s", item.Index, res.Error.Type, res.Error.Reason)
+			},
+		})
+		if err2 != nil {
+			err = errors.Join(err, err2)
 		}
 	}
 
 	if err != nil {
 		return nil, err
 	}
-	return &pb.Reply{Logmsg: "Measurement Indexed."}, nil
-}
\ No newline at end of file
+	// documents are indexed in the background, so earlier failures are
+	// all that can be reported
+	if _, failed := es.Stats(); failed > 0 {
+		return &pb.Reply{Logmsg: fmt.Sprintf("Measurements queued for indexing, %d measurements failed to be indexed so far.", failed)}, nil
+	}
+	return &pb.Reply{Logmsg: "Measurements queued for indexing."}, nil
+}
+
+// Stats returns the number of indexed measurements and of those that
+// failed to be indexed
+func (es *ESReceiver) Stats() (indexed, failed uint64) {
+	stats := es.indexer.Stats()
+	return stats.NumIndexed + stats.NumCreated, stats.NumFailed
+}
+
+// Close sends all buffered documents and stops the bulk indexer
+func (es *ESReceiver) Close(ctx context.Context) error {
+	err := es.indexer.Close(ctx)
+	indexed, failed := es.Stats()
+	log.Printf("[INFO]: %d measurements indexed, %d failed", indexed, failed)
+	return err
+}
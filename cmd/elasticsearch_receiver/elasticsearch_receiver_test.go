@@ -6,13 +6,17 @@ import (
 	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	es8 "github.com/elastic/go-elasticsearch/v8"
 	"github.com/stretchr/testify/assert"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/modules/elasticsearch"
@@ -65,12 +69,20 @@ func TestNewESReceiver(t *testing.T) {
 	}
 	defer func() {_ = os.Remove(ESCAPath)}()
 
-	ESReceiver, err := NewESReceiver(
-		[]string{esContainer.Settings.Address},
-		"elastic",
-		esContainer.Settings.Password,
-		ESCAPath,
-	)	
+	indexCfg := IndexConfig{
+		Prefix:        "pgwatch",
+		DateFormat:    "2006.01.02",
+		ILMPolicy:     "pgwatch",
+		Retention:     "30d",
+		FlushInterval: 100 * time.Millisecond,
+	}
+	clientCfg := ClientConfig{
+		Addresses:  []string{esContainer.Settings.Address},
+		Username:   "elastic",
+		Password:   esContainer.Settings.Password,
+		CACertPath: ESCAPath,
+	}
+	ESReceiver, err := NewESReceiver(clientCfg, indexCfg)
 	a.NoError(err)
 	a.NotNil(ESReceiver)
 
@@ -85,7 +97,7 @@ func TestNewESReceiver(t *testing.T) {
 		msg := testutils.GetTestMeasurementEnvelope()
 		reply, err := ESReceiver.UpdateMeasurements(context.Background(), msg)
 		a.NoError(err)
-		a.Equal(reply.GetLogmsg(), "Measurement Indexed.")
+		a.Equal(reply.GetLogmsg(), "Measurements queued for indexing.")
 
 		// wait for the data to be indexed
 		time.Sleep(2 * time.Second)
@@ -100,4 +112,163 @@ func TestNewESReceiver(t *testing.T) {
 		_ = json.NewDecoder(resp.Body).Decode(&data)
 		a.Equal(float64(1), data["count"])
 	})
-}
\ No newline at end of file
+
+	t.Run("Test ES Receiver installs templates", func(t *testing.T) {
+		for _, path := range []string{"/_index_template/pgwatch", "/_component_template/pgwatch-mappings", "/_ilm/policy/pgwatch"} {
+			req, err := http.NewRequest("GET", esContainer.Settings.Address + path, nil)
+			a.NoError(err)
+			req.SetBasicAuth("elastic", esContainer.Settings.Password)
+			resp, err := esHttpClient.Do(req)
+			a.NoError(err)
+			a.Equal(http.StatusOK, resp.StatusCode, path)
+			_ = resp.Body.Close()
+		}
+	})
+
+	a.NoError(ESReceiver.Close(context.Background()))
+}
+
+func TestIndexName(t *testing.T) {
+	ts := time.Date(2024, 5, 17, 23, 0, 0, 0, time.UTC)
+
+	es := &ESReceiver{cfg: IndexConfig{Prefix: "pgwatch", DateFormat: "2006.01.02"}}
+	assert.Equal(t, "pgwatch-my_db_db_stats-2024.05.17", es.indexName("My DB", "db_stats", ts))
+
+	es.cfg.DataStreams = true
+	assert.Equal(t, "pgwatch-my_db_db_stats", es.indexName("My DB", "db_stats", ts))
+}
+
+func TestIndexConfigValidate(t *testing.T) {
+	cfg := IndexConfig{Prefix: "pgwatch", Retention: "30d"}
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Retention = ""
+	assert.NoError(t, cfg.Validate(), "indices are kept without retention")
+
+	cfg.Retention = "30 days"
+	assert.Error(t, cfg.Validate())
+
+	cfg = IndexConfig{Retention: "30d"}
+	assert.Error(t, cfg.Validate(), "prefix is required")
+}
+
+func TestPoliciesWithoutRetention(t *testing.T) {
+	cfg := IndexConfig{Prefix: "pgwatch", Retention: "7d"}
+	phases := lifecyclePolicy(cfg)["policy"].(map[string]any)["phases"].(map[string]any)
+	assert.Equal(t, "7d", phases["delete"].(map[string]any)["min_age"])
+	states := ismPolicy(cfg)["policy"].(map[string]any)["states"].([]any)
+	assert.Len(t, states, 2)
+
+	cfg.Retention = ""
+	phases = lifecyclePolicy(cfg)["policy"].(map[string]any)["phases"].(map[string]any)
+	assert.NotContains(t, phases, "delete")
+	states = ismPolicy(cfg)["policy"].(map[string]any)["states"].([]any)
+	assert.Len(t, states, 1)
+	assert.Empty(t, states[0].(map[string]any)["transitions"])
+}
+
+func TestBulkFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = w.Write([]byte(`{"errors":true,"items":[{"index":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}]}`))
+	}))
+	defer server.Close()
+
+	client, err := es8.NewClient(es8.Config{Addresses: []string{server.URL}})
+	assert.NoError(t, err)
+	cfg := IndexConfig{Prefix: "pgwatch", FlushInterval: 10 * time.Millisecond}
+	indexer, err := newBulkIndexer(client, cfg)
+	assert.NoError(t, err)
+	es := &ESReceiver{esClient: client, indexer: indexer, cfg: cfg}
+
+	reply, err := es.UpdateMeasurements(context.Background(), testutils.GetTestMeasurementEnvelope())
+	assert.NoError(t, err)
+	assert.Equal(t, "Measurements queued for indexing.", reply.GetLogmsg())
+	assert.Eventually(t, func() bool {
+		_, failed := es.Stats()
+		return failed == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// later replies report the failure
+	reply, err = es.UpdateMeasurements(context.Background(), testutils.GetTestMeasurementEnvelope())
+	assert.NoError(t, err)
+	assert.Equal(t, "Measurements queued for indexing, 1 measurements failed to be indexed so far.", reply.GetLogmsg())
+
+	assert.NoError(t, es.Close(context.Background()))
+	indexed, failed := es.Stats()
+	assert.Zero(t, indexed)
+	assert.Equal(t, uint64(2), failed)
+}
+
+func TestClientConfigValidate(t *testing.T) {
+	cfg := ClientConfig{Addresses: []string{"https://localhost:9200"}, Password: "secret", APIKey: "key"}
+	assert.Error(t, cfg.Validate(), "multiple auth methods should be rejected")
+
+	cfg = ClientConfig{}
+	assert.Error(t, cfg.Validate(), "addresses or cloud ID are required")
+
+	cfg = ClientConfig{CloudID: "deployment:abc", OpenSearch: true}
+	assert.Error(t, cfg.Validate())
+
+	cfg = ClientConfig{Addresses: []string{"https://localhost:9200"}, BearerToken: "token", InsecureSkipVerify: true}
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestNewESReceiverAuth(t *testing.T) {
+	a := assert.New(t)
+
+	// without a CA file the container's self-signed certificate is rejected
+	_, err := NewESReceiver(ClientConfig{
+		Addresses: []string{esContainer.Settings.Address},
+		Username:  "elastic",
+		Password:  esContainer.Settings.Password,
+	}, IndexConfig{Prefix: "pgwatch"})
+	a.Error(err)
+
+	_, err = NewESReceiver(ClientConfig{
+		Addresses:          []string{esContainer.Settings.Address},
+		Username:           "elastic",
+		Password:           esContainer.Settings.Password,
+		InsecureSkipVerify: true,
+	}, IndexConfig{Prefix: "pgwatch"})
+	a.NoError(err)
+
+	// API key authentication
+	req, err := http.NewRequest("POST", esContainer.Settings.Address+"/_security/api_key", strings.NewReader(`{"name":"pgwatch"}`))
+	a.NoError(err)
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("elastic", esContainer.Settings.Password)
+	resp, err := esHttpClient.Do(req)
+	a.NoError(err)
+	var apiKey map[string]any
+	a.NoError(json.NewDecoder(resp.Body).Decode(&apiKey))
+	_ = resp.Body.Close()
+
+	_, err = NewESReceiver(ClientConfig{
+		Addresses:          []string{esContainer.Settings.Address},
+		APIKey:             fmt.Sprint(apiKey["encoded"]),
+		InsecureSkipVerify: true,
+	}, IndexConfig{Prefix: "pgwatch"})
+	a.NoError(err)
+}
+
+func TestOpenSearchTransport(t *testing.T) {
+	// a server that answers like OpenSearch, without the X-Elastic-Product header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"version":{"distribution":"opensearch","number":"2.11.0"}}`))
+	}))
+	defer server.Close()
+
+	client, err := newClient(ClientConfig{Addresses: []string{server.URL}})
+	assert.NoError(t, err)
+	_, err = client.Info()
+	assert.Error(t, err, "the product check should reject OpenSearch")
+
+	client, err = newClient(ClientConfig{Addresses: []string{server.URL}, OpenSearch: true})
+	assert.NoError(t, err)
+	res, err := client.Info()
+	assert.NoError(t, checkResponse(res, err))
+}
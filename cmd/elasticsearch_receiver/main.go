@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 )
@@ -13,17 +17,54 @@ func main() {
 	port := flag.String("port", "", "Port number for the server to listen on.")
 	addrsString := flag.String("addrs", "https://localhost:9200", "A comma separated list of Elasticsearch nodes to use.")
 	username := flag.String("user", "elastic", "Username for HTTP Basic Authentication.")
-	cacertPath := flag.String("ca-file", "./http_ca.crt", "Certificate Authority file path.")
+	cacertPath := flag.String("ca-file", "", "Certificate Authority file path. The system roots are used if empty.")
+	cloudID := flag.String("cloud-id", "", "Elastic Cloud deployment ID, used instead of -addrs.")
+	insecure := flag.Bool("insecure-skip-verify", false, "Don't verify the server certificate. Only use this for testing.")
+	openSearch := flag.Bool("opensearch", false, "Enable OpenSearch compatibility mode.")
+	indexPrefix := flag.String("index-prefix", "pgwatch", "Prefix of index and data stream names, templates are installed for <prefix>-*.")
+	dataStreams := flag.Bool("data-streams", false, "Write measurements to data streams instead of date based indices.")
+	dateFormat := flag.String("index-date-format", "2006.01.02", "Go time layout appended to index names. Empty disables date based indices.")
+	ilmPolicy := flag.String("ilm-policy", "pgwatch", "ILM policy attached to indices. Empty disables ILM.")
+	retention := flag.String("retention", "30d", "Delete indices after this long using the ILM policy.")
+	flushInterval := flag.Duration("flush-interval", 5*time.Second, "How often buffered measurements are sent to Elasticsearch.")
 	flag.Parse()
-	password := os.Getenv("ELASTIC_PASSWORD")
+	clientCfg := ClientConfig{
+		Addresses:          strings.Split(*addrsString, ","),
+		CloudID:            *cloudID,
+		Username:           *username,
+		Password:           os.Getenv("ELASTIC_PASSWORD"),
+		APIKey:             os.Getenv("ELASTIC_API_KEY"),
+		BearerToken:        os.Getenv("ELASTIC_BEARER_TOKEN"),
+		CACertPath:         *cacertPath,
+		InsecureSkipVerify: *insecure,
+		OpenSearch:         *openSearch,
+	}
 
-	addrsList := strings.Split(*addrsString, ",")
+	indexCfg := IndexConfig{
+		Prefix:        *indexPrefix,
+		DataStreams:   *dataStreams,
+		DateFormat:    *dateFormat,
+		ILMPolicy:     *ilmPolicy,
+		Retention:     *retention,
+		FlushInterval: *flushInterval,
+	}
 
-	server, err := NewESReceiver(addrsList, *username, password, *cacertPath)
+	server, err := NewESReceiver(clientCfg, indexCfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// send buffered measurements on shutdown
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		if err := server.Close(context.Background()); err != nil {
+			log.Println("[ERROR]: Unable to flush measurements: ", err)
+		}
+		os.Exit(0)
+	}()
+
 	if err := sinks.ListenAndServe(server, *port); err != nil {
 		log.Fatal(err)
 	}
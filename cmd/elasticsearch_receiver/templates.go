@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// mappingsTemplate maps all numeric measurement fields to double, so the
+// first document doesn't decide between long and double for a field,
+// and all strings and tags to keyword
+var mappingsTemplate = map[string]any{
+	"template": map[string]any{
+		"mappings": map[string]any{
+			"dynamic_templates": []any{
+				map[string]any{"tags": map[string]any{
+					"path_match": "tags.*",
+					"mapping":    map[string]any{"type": "keyword"},
+				}},
+				map[string]any{"longs": map[string]any{
+					"path_match":         "data.*",
+					"match_mapping_type": "long",
+					"mapping":            map[string]any{"type": "double"},
+				}},
+				map[string]any{"doubles": map[string]any{
+					"path_match":         "data.*",
+					"match_mapping_type": "double",
+					"mapping":            map[string]any{"type": "double"},
+				}},
+				map[string]any{"strings": map[string]any{
+					"path_match":         "data.*",
+					"match_mapping_type": "string",
+					"mapping":            map[string]any{"type": "keyword", "ignore_above": 1024},
+				}},
+			},
+			"properties": map[string]any{
+				"@timestamp": map[string]any{"type": "date"},
+				"dbname":     map[string]any{"type": "keyword"},
+				"metric":     map[string]any{"type": "keyword"},
+				"tags":       map[string]any{"type": "object"},
+				"data":       map[string]any{"type": "object"},
+			},
+		},
+	},
+}
+
+// lifecyclePolicy deletes indices after cfg.Retention, they are kept if it
+// is empty. Data streams also roll over daily since their backing indices
+// aren't date based.
+func lifecyclePolicy(cfg IndexConfig) map[string]any {
+	hot := map[string]any{"actions": map[string]any{}}
+	if cfg.DataStreams {
+		hot["actions"] = map[string]any{
+			"rollover": map[string]any{
+				"max_age":                "1d",
+				"max_primary_shard_size": "50gb",
+			},
+		}
+	}
+
+	phases := map[string]any{"hot": hot}
+	if cfg.Retention != "" {
+		phases["delete"] = map[string]any{
+			"min_age": cfg.Retention,
+			"actions": map[string]any{"delete": map[string]any{}},
+		}
+	}
+	return map[string]any{
+		"policy": map[string]any{"phases": phases},
+	}
+}
+
+// ismPolicy is the OpenSearch Index State Management equivalent of
+// lifecyclePolicy, it is attached to new indices by its ism_template
+func ismPolicy(cfg IndexConfig) map[string]any {
+	hotActions := []any{}
+	if cfg.DataStreams {
+		hotActions = append(hotActions, map[string]any{
+			"rollover": map[string]any{"min_index_age": "1d"},
+		})
+	}
+
+	hot := map[string]any{
+		"name":        "hot",
+		"actions":     hotActions,
+		"transitions": []any{},
+	}
+	states := []any{hot}
+	if cfg.Retention != "" {
+		hot["transitions"] = []any{map[string]any{
+			"state_name": "delete",
+			"conditions": map[string]any{"min_index_age": cfg.Retention},
+		}}
+		states = append(states, map[string]any{
+			"name":        "delete",
+			"actions":     []any{map[string]any{"delete": map[string]any{}}},
+			"transitions": []any{},
+		})
+	}
+
+	return map[string]any{
+		"policy": map[string]any{
+			"description":   "pgwatch measurements retention",
+			"default_state": "hot",
+			"states":        states,
+			"ism_template": []any{map[string]any{
+				"index_patterns": []string{cfg.Prefix + "-*"},
+				"priority":       100,
+			}},
+		},
+	}
+}
+
+func indexTemplate(cfg IndexConfig, openSearch bool) map[string]any {
+	composedOf := []string{cfg.Prefix + "-mappings"}
+	if cfg.ILMPolicy != "" && !openSearch {
+		composedOf = append(composedOf, cfg.Prefix+"-settings")
+	}
+
+	template := map[string]any{
+		"index_patterns": []string{cfg.Prefix + "-*"},
+		"composed_of":    composedOf,
+		"priority":       200,
+		"_meta":          map[string]any{"managed_by": "pgwatch elasticsearch_receiver"},
+	}
+	if cfg.DataStreams {
+		template["data_stream"] = map[string]any{}
+	}
+	return template
+}
+
+// installTemplates creates or updates the ILM policy, the component
+// templates and the index template used by the receiver's indices
+func installTemplates(ctx context.Context, client *elasticsearch.Client, cfg IndexConfig, openSearch bool) error {
+	if cfg.ILMPolicy != "" && openSearch {
+		if err := putISMPolicy(ctx, client, cfg); err != nil {
+			return err
+		}
+	} else if cfg.ILMPolicy != "" {
+		body, err := jsonBody(lifecyclePolicy(cfg))
+		if err != nil {
+			return err
+		}
+		req := esapi.ILMPutLifecycleRequest{Policy: cfg.ILMPolicy, Body: body}
+		if err = checkResponse(req.Do(ctx, client)); err != nil {
+			return fmt.Errorf("unable to install ILM policy %s: %w", cfg.ILMPolicy, err)
+		}
+
+		settings := map[string]any{
+			"template": map[string]any{
+				"settings": map[string]any{"index.lifecycle.name": cfg.ILMPolicy},
+			},
+		}
+		if err = putComponentTemplate(ctx, client, cfg.Prefix+"-settings", settings); err != nil {
+			return err
+		}
+	}
+
+	if err := putComponentTemplate(ctx, client, cfg.Prefix+"-mappings", mappingsTemplate); err != nil {
+		return err
+	}
+
+	body, err := jsonBody(indexTemplate(cfg, openSearch))
+	if err != nil {
+		return err
+	}
+	req := esapi.IndicesPutIndexTemplateRequest{Name: cfg.Prefix, Body: body}
+	if err = checkResponse(req.Do(ctx, client)); err != nil {
+		return fmt.Errorf("unable to install index template %s: %w", cfg.Prefix, err)
+	}
+
+	log.Println("[INFO]: Installed index templates for " + cfg.Prefix + "-*")
+	return nil
+}
+
+// putISMPolicy creates the ISM policy, existing policies are kept
+// as updating them requires their sequence number
+func putISMPolicy(ctx context.Context, client *elasticsearch.Client, cfg IndexConfig) error {
+	body, err := jsonBody(ismPolicy(cfg))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, "/_plugins/_ism/policies/"+url.PathEscape(cfg.ILMPolicy), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.Perform(req)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode == http.StatusConflict {
+		_ = res.Body.Close()
+		log.Println("[INFO]: ISM policy " + cfg.ILMPolicy + " already exists, leaving it unchanged")
+		return nil
+	}
+	if err = checkResponse(&esapi.Response{StatusCode: res.StatusCode, Header: res.Header, Body: res.Body}, nil); err != nil {
+		return fmt.Errorf("unable to install ISM policy %s: %w", cfg.ILMPolicy, err)
+	}
+	return nil
+}
+
+func putComponentTemplate(ctx context.Context, client *elasticsearch.Client, name string, template map[string]any) error {
+	body, err := jsonBody(template)
+	if err != nil {
+		return err
+	}
+	req := esapi.ClusterPutComponentTemplateRequest{Name: name, Body: body}
+	if err = checkResponse(req.Do(ctx, client)); err != nil {
+		return fmt.Errorf("unable to install component template %s: %w", name, err)
+	}
+	return nil
+}
+
+func jsonBody(v any) (io.Reader, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+// checkResponse returns an error if the request failed, the body is closed
+func checkResponse(res *esapi.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		var errorBody map[string]any
+		if err = json.NewDecoder(res.Body).Decode(&errorBody); err == nil {
+			return fmt.Errorf("elasticsearch error [%s]: %v", res.Status(), errorBody)
+		}
+		return fmt.Errorf("elasticsearch error [%s]", res.Status())
+	}
+	return nil
+}
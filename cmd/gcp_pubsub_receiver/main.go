@@ -3,6 +3,10 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 )
@@ -10,14 +14,47 @@ import (
 func main() {
 	port := flag.String("port", "", "Port number for the server to listen on.")
 	projectID := flag.String("project-id", "", "GCP Project Id.")
+	topic := flag.String("topic", "pgwatch", "Topic Id, {dbname} is replaced by the database name, e.g. pgwatch-{dbname}.")
+	dbTopics := flag.String("db-topics", "", "Comma separated topic Ids of single databases overriding --topic, e.g. db1=topic1,db2=topic2.")
+	orderingKeys := flag.Bool("ordering-keys", false, "Deliver the messages of a database and metric in order.")
+	async := flag.Bool("async", false, "Don't wait for publish results, failures are only logged.")
 	flag.Parse()
 
-	server, err := NewPubsubReceiver(*projectID)
+	topics := make(map[string]string)
+	for _, entry := range strings.Split(*dbTopics, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		dbName, topicID, ok := strings.Cut(entry, "=")
+		if !ok {
+			log.Fatalf("[ERROR]: Invalid --db-topics entry %q, expected <dbname>=<topic>", entry)
+		}
+		topics[strings.TrimSpace(dbName)] = strings.TrimSpace(topicID)
+	}
+
+	server, err := NewPubsubReceiver(Config{
+		ProjectID:    *projectID,
+		Topic:        *topic,
+		DBTopics:     topics,
+		OrderingKeys: *orderingKeys,
+		Async:        *async,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// publish outstanding messages on shutdown
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		if err := server.Close(); err != nil {
+			log.Println("[ERROR]: Unable to close Pub/Sub client: " + err.Error())
+		}
+		os.Exit(0)
+	}()
+
 	if err := sinks.ListenAndServe(server, *port); err != nil {
 		log.Fatal(err)
 	}
-}
\ No newline at end of file
+}
@@ -3,53 +3,222 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"cloud.google.com/go/pubsub/v2"
 	"cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
 	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+type Config struct {
+	ProjectID    string
+	Topic        string            // topic ID, {dbname} is replaced by the database name
+	DBTopics     map[string]string // topic IDs of single databases, overriding Topic
+	OrderingKeys bool              // deliver the messages of a database and metric in order
+	Async        bool              // don't wait for publish results, failures are logged and counted
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.ProjectID == "" {
+		return errors.New("project id is required")
+	}
+	if cfg.Topic == "" {
+		return errors.New("topic is required")
+	}
+	return nil
+}
+
 type PubsubReceiver struct {
-	client *pubsub.Client
-	publisher *pubsub.Publisher
+	client     *pubsub.Client
+	cfg        Config
+	publishers map[string]*pubsub.Publisher // by topic ID
+	mu         sync.Mutex
+	pending    sync.WaitGroup // results of async publishes
+	published  atomic.Int64
+	failed     atomic.Int64
 	sinks.SyncMetricHandler
 }
 
-func NewPubsubReceiver(projectID string) (*PubsubReceiver, error) {
-	ctx := context.Background()
-
-	client, err := pubsub.NewClient(ctx, projectID)
-	if err != nil {
+func NewPubsubReceiver(cfg Config) (*PubsubReceiver, error) {
+	if err := cfg.Validate(); err != nil {
 		return nil, err
 	}
 
-	topicName := fmt.Sprintf("projects/%s/topics/pgwatch", projectID)
-	topic, err := client.TopicAdminClient.CreateTopic(ctx, &pubsubpb.Topic{
-		Name: topicName,
-	})
+	ctx := context.Background()
+	client, err := pubsub.NewClient(ctx, cfg.ProjectID)
 	if err != nil {
 		return nil, err
 	}
 
-	publisher := client.Publisher(topic.GetName())
 	pr := &PubsubReceiver{
-		client: client,
-		publisher: publisher,
+		client:            client,
+		cfg:               cfg,
+		publishers:        make(map[string]*pubsub.Publisher),
 		SyncMetricHandler: sinks.NewSyncMetricHandler(1024),
 	}
 
+	// topics known upfront are checked right away, per database topics
+	// are created with the first measurement of the database
+	topics := sortedValues(cfg.DBTopics)
+	if !strings.Contains(cfg.Topic, "{dbname}") {
+		topics = append(topics, cfg.Topic)
+	}
+	for _, topic := range topics {
+		if _, err = pr.publisher(ctx, topic); err != nil {
+			return nil, errors.Join(err, client.Close())
+		}
+	}
+
 	go pr.HandleSyncMetric()
 	return pr, nil
 }
 
+var invalidTopicChars = regexp.MustCompile(`[^A-Za-z0-9_.~+%-]`)
+
+// topicID returns the ID of the topic the measurements of dbName go to
+func (r *PubsubReceiver) topicID(dbName string) string {
+	if topic, ok := r.cfg.DBTopics[dbName]; ok {
+		return topic
+	}
+	return strings.ReplaceAll(r.cfg.Topic, "{dbname}", invalidTopicChars.ReplaceAllString(dbName, "-"))
+}
+
+// publisher returns the publisher of topicID, creating the topic if it
+// doesn't exist yet
+func (r *PubsubReceiver) publisher(ctx context.Context, topicID string) (*pubsub.Publisher, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if publisher, ok := r.publishers[topicID]; ok {
+		return publisher, nil
+	}
+
+	name := fmt.Sprintf("projects/%s/topics/%s", r.cfg.ProjectID, topicID)
+	if err := r.ensureTopic(ctx, name); err != nil {
+		return nil, fmt.Errorf("unable to create topic %s: %w", name, err)
+	}
+
+	publisher := r.client.Publisher(name)
+	publisher.EnableMessageOrdering = r.cfg.OrderingKeys
+	r.publishers[topicID] = publisher
+	return publisher, nil
+}
+
+// ensureTopic reuses an existing topic or creates it
+func (r *PubsubReceiver) ensureTopic(ctx context.Context, name string) error {
+	_, err := r.client.TopicAdminClient.GetTopic(ctx, &pubsubpb.GetTopicRequest{Topic: name})
+	if status.Code(err) != codes.NotFound {
+		return err
+	}
+
+	_, err = r.client.TopicAdminClient.CreateTopic(ctx, &pubsubpb.Topic{Name: name})
+	// another receiver may have created it in the meantime
+	if status.Code(err) == codes.AlreadyExists {
+		return nil
+	}
+	if err == nil {
+		log.Println("[INFO]: Created topic " + name)
+	}
+	return err
+}
+
+// attributes lets subscribers filter messages without decoding them
+func attributes(msg *pb.MeasurementEnvelope) map[string]string {
+	attrs := map[string]string{
+		"dbname":      msg.GetDBName(),
+		"metric_name": msg.GetMetricName(),
+	}
+	for key, value := range msg.GetCustomTags() {
+		attrs["tag_"+key] = value
+	}
+	return attrs
+}
+
 func (r *PubsubReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
 	data, err := json.Marshal(msg)
 	if err != nil {
 		return nil, err
 	}
 
-	_ = r.publisher.Publish(ctx, &pubsub.Message{Data: data})
+	publisher, err := r.publisher(ctx, r.topicID(msg.GetDBName()))
+	if err != nil {
+		return nil, err
+	}
+
+	message := &pubsub.Message{Data: data, Attributes: attributes(msg)}
+	if r.cfg.OrderingKeys {
+		message.OrderingKey = msg.GetDBName() + "/" + msg.GetMetricName()
+	}
+	result := publisher.Publish(ctx, message)
+
+	if r.cfg.Async {
+		r.pending.Add(1)
+		go func() {
+			defer r.pending.Done()
+			_, err := result.Get(context.Background())
+			if err = r.track(publisher, message.OrderingKey, err); err != nil {
+				log.Println("[ERROR]: " + err.Error())
+			}
+		}()
+		return &pb.Reply{Logmsg: "Message queued for publishing."}, nil
+	}
+
+	_, err = result.Get(ctx)
+	if err = r.track(publisher, message.OrderingKey, err); err != nil {
+		return nil, err
+	}
 	return &pb.Reply{Logmsg: "Message published."}, nil
-}
\ No newline at end of file
+}
+
+// track counts the result of a publish. Publishing of an ordering key
+// stops after a failure, so it is resumed to not block later messages.
+func (r *PubsubReceiver) track(publisher *pubsub.Publisher, orderingKey string, err error) error {
+	if err == nil {
+		r.published.Add(1)
+		return nil
+	}
+
+	r.failed.Add(1)
+	if orderingKey != "" {
+		publisher.ResumePublish(orderingKey)
+	}
+	return fmt.Errorf("unable to publish to %s: %w", publisher, err)
+}
+
+// Stats returns the number of published and failed messages
+func (r *PubsubReceiver) Stats() (published, failed int64) {
+	return r.published.Load(), r.failed.Load()
+}
+
+// Close publishes outstanding messages and waits for their results
+func (r *PubsubReceiver) Close() error {
+	r.mu.Lock()
+	for _, publisher := range r.publishers {
+		publisher.Stop()
+	}
+	r.mu.Unlock()
+	r.pending.Wait()
+
+	published, failed := r.Stats()
+	log.Printf("[INFO]: %d messages published, %d failed", published, failed)
+	return r.client.Close()
+}
+
+func sortedValues(m map[string]string) []string {
+	values := make([]string, 0, len(m))
+	for _, value := range m {
+		values = append(values, value)
+	}
+	slices.Sort(values)
+	return slices.Compact(values)
+}
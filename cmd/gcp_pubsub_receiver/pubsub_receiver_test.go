@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/pubsub/v2"
 	"cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
@@ -15,6 +16,7 @@ import (
 	"github.com/testcontainers/testcontainers-go"
 	tcpubsub "github.com/testcontainers/testcontainers-go/modules/gcloud/pubsub"
 	"github.com/testcontainers/testcontainers-go/wait"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 var pubsubContainer *tcpubsub.Container
@@ -50,21 +52,29 @@ func TestMain(m *testing.M) {
 func TestPubsubReceiver(t *testing.T) {
 	a := assert.New(t)
 
-	psr, err := NewPubsubReceiver(pubsubContainer.ProjectID())
+	psr, err := NewPubsubReceiver(Config{ProjectID: pubsubContainer.ProjectID(), Topic: "pgwatch"})
 	a.NoError(err)
 	a.NotNil(psr)
 
+	t.Run("Test Pub/Sub Receiver reuses existing topic", func(t *testing.T) {
+		other, err := NewPubsubReceiver(Config{ProjectID: pubsubContainer.ProjectID(), Topic: "pgwatch"})
+		a.NoError(err)
+		a.NoError(other.Close())
+	})
+
 	t.Run("Test Pub/Sub Receiver UpdateMeasurements()", func(t *testing.T) {
 		// To read the published message from the Pub/Sub server.
-		sub, err := CreateSubscription(psr)
+		sub, err := CreateSubscription(psr, "pgwatch", "test-sub", false)
 		a.NoError(err)
 
 		msg := testutils.GetTestMeasurementEnvelope()
 		reply, err := psr.UpdateMeasurements(context.Background(), msg)
-		psr.publisher.Flush()
 
 		a.NoError(err)
 		a.Equal(reply.GetLogmsg(), "Message published.")
+		published, failed := psr.Stats()
+		a.Equal(int64(1), published)
+		a.Equal(int64(0), failed)
 
 		ctx, cancel := context.WithCancel(context.Background())
 		err = sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
@@ -81,6 +91,12 @@ func TestPubsubReceiver(t *testing.T) {
 				a.Equal(item.AsMap(), recvd_item)
 			}
 
+			a.Equal(map[string]string{
+				"dbname":      msg.GetDBName(),
+				"metric_name": msg.GetMetricName(),
+				"tag_tagName": "tagValue",
+			}, m.Attributes)
+
 			m.Ack()
 			// cancel the ctx to force Receive() to return
 			cancel()
@@ -88,22 +104,96 @@ func TestPubsubReceiver(t *testing.T) {
 		a.NoError(err)
 	})
 
+	t.Run("Test Pub/Sub Receiver reports failed publishes", func(t *testing.T) {
+		err := psr.client.TopicAdminClient.DeleteTopic(context.Background(), &pubsubpb.DeleteTopicRequest{
+			Topic: fmt.Sprintf("projects/%s/topics/pgwatch", pubsubContainer.ProjectID()),
+		})
+		a.NoError(err)
+
+		_, err = psr.UpdateMeasurements(context.Background(), testutils.GetTestMeasurementEnvelope())
+		a.Error(err)
+		_, failed := psr.Stats()
+		a.Equal(int64(1), failed)
+	})
+
 	t.Run("Test calling SyncMetric() from Pub/Sub Receiver", func(t *testing.T) {
 		req := testutils.GetTestRPCSyncRequest()
 		reply, err := psr.SyncMetric(context.Background(), req)
 		a.NoError(err)
 		a.Equal(reply.GetLogmsg(), fmt.Sprintf("gRPC Receiver Synced: DBName %s MetricName %s Operation %s", req.GetDBName(), req.GetMetricName(), "Add"))
 	})
+
+	a.NoError(psr.Close())
+}
+
+func TestPubsubReceiverTopicPerDB(t *testing.T) {
+	a := assert.New(t)
+
+	psr, err := NewPubsubReceiver(Config{
+		ProjectID:    pubsubContainer.ProjectID(),
+		Topic:        "pgwatch-{dbname}",
+		DBTopics:     map[string]string{"main_db": "pgwatch-main"},
+		OrderingKeys: true,
+		Async:        true,
+	})
+	a.NoError(err)
+
+	a.Equal("pgwatch-test", psr.topicID("test"))
+	a.Equal("pgwatch-my-db", psr.topicID("my db"))
+	a.Equal("pgwatch-main", psr.topicID("main_db"))
+
+	// the topic of a database is created with its first measurement
+	msg := testutils.GetTestMeasurementEnvelope()
+	reply, err := psr.UpdateMeasurements(context.Background(), msg)
+	a.NoError(err)
+	a.Equal("Message queued for publishing.", reply.GetLogmsg())
+
+	sub, err := CreateSubscription(psr, "pgwatch-test", "test-sub-ordered", true)
+	a.NoError(err)
+
+	const count = 5
+	for i := range count {
+		msg.Data[0].Fields["seq"] = structpb.NewNumberValue(float64(i))
+		_, err = psr.UpdateMeasurements(context.Background(), msg)
+		a.NoError(err)
+	}
+
+	// messages of a database and metric arrive in order
+	var seqs []float64
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err = sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+		a.Equal("test/testMetric", m.OrderingKey)
+
+		var recvd_msg map[string]any
+		a.NoError(json.Unmarshal(m.Data, &recvd_msg))
+		item := recvd_msg["Data"].([]any)[0].(map[string]any)
+		seqs = append(seqs, item["seq"].(float64))
+
+		m.Ack()
+		if len(seqs) == count {
+			cancel()
+		}
+	})
+	a.NoError(err)
+	a.Equal([]float64{0, 1, 2, 3, 4}, seqs)
+
+	// Close waits for the results of all publishes
+	a.NoError(psr.Close())
+	published, failed := psr.Stats()
+	a.Equal(int64(count+1), published)
+	a.Equal(int64(0), failed)
 }
 
-func CreateSubscription(psr *PubsubReceiver) (*pubsub.Subscriber, error){
-	subName := fmt.Sprintf("projects/%s/subscriptions/test-sub", pubsubContainer.ProjectID())
-	topicName := fmt.Sprintf("projects/%s/topics/pgwatch", pubsubContainer.ProjectID())
+func CreateSubscription(psr *PubsubReceiver, topicID, subID string, ordered bool) (*pubsub.Subscriber, error) {
+	subName := fmt.Sprintf("projects/%s/subscriptions/%s", pubsubContainer.ProjectID(), subID)
+	topicName := fmt.Sprintf("projects/%s/topics/%s", pubsubContainer.ProjectID(), topicID)
 
 	subscription, err := psr.client.SubscriptionAdminClient.CreateSubscription(context.Background(),
 		&pubsubpb.Subscription{
-			Name: subName,
-			Topic: topicName,
+			Name:                  subName,
+			Topic:                 topicName,
+			EnableMessageOrdering: ordered,
 		},
 	)
 	if err != nil {
@@ -112,4 +202,4 @@ func CreateSubscription(psr *PubsubReceiver) (*pubsub.Subscriber, error){
 
 	sub := psr.client.Subscriber(subscription.GetName())
 	return sub, nil
-}
\ No newline at end of file
+}
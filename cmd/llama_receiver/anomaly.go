@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+)
+
+// Anomaly detection methods
+const (
+	DetectorNone = "none"
+	DetectorEWMA = "ewma"
+	DetectorMAD  = "mad"
+)
+
+// maxSeries bounds the memory used by a detector, values of new series are
+// ignored once it is reached
+const maxSeries = 100000
+
+type DetectorConfig struct {
+	Method    string  // ewma, mad or none to generate insights for every batch instead
+	Threshold float64 // z-score above which a value is anomalous
+	Alpha     float64 // EWMA smoothing factor, higher values adapt faster
+	Window    int     // values per series the median absolute deviation is computed from
+	WarmUp    int     // values a series needs before it can be anomalous
+}
+
+func (cfg *DetectorConfig) Validate() error {
+	switch cfg.Method {
+	case DetectorNone, "":
+		return nil
+	case DetectorEWMA:
+		if cfg.Alpha <= 0 || cfg.Alpha >= 1 {
+			return errors.New("EWMA alpha must be between 0 and 1")
+		}
+	case DetectorMAD:
+		if cfg.Window < 3 {
+			return errors.New("MAD window must be at least 3")
+		}
+	default:
+		return fmt.Errorf("unknown anomaly detector %q, expected %s, %s or %s", cfg.Method, DetectorEWMA, DetectorMAD, DetectorNone)
+	}
+	if cfg.Threshold <= 0 {
+		return errors.New("anomaly threshold must be positive")
+	}
+	if cfg.WarmUp < 0 {
+		return errors.New("warm up must not be negative")
+	}
+	return nil
+}
+
+// Anomaly is a value deviating from the baseline of its series
+type Anomaly struct {
+	MetricName string  `json:"metric_name"`
+	Field      string  `json:"field"`
+	Series     string  `json:"series,omitempty"` // tag values of the row, e.g. queryid=42
+	Value      float64 `json:"value"`
+	Baseline   float64 `json:"baseline"`  // EWMA or median of the series
+	Deviation  float64 `json:"deviation"` // standard deviation or scaled MAD of the series
+	Score      float64 `json:"score"`     // distance from the baseline in deviations
+	Method     string  `json:"method"`
+}
+
+// series holds the state of one numeric field of a metric's row
+type series struct {
+	count    int
+	mean     float64
+	variance float64
+	values   []float64 // most recent values, oldest first, for MAD
+}
+
+// Detector finds anomalies per database, metric and numeric field. Rows
+// of metrics returning several rows are told apart by their tag_ fields.
+type Detector struct {
+	cfg    DetectorConfig
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// NewDetector returns nil if detection is disabled
+func NewDetector(cfg DetectorConfig) (*Detector, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Method == DetectorNone || cfg.Method == "" {
+		return nil, nil
+	}
+	return &Detector{cfg: cfg, series: make(map[string]*series)}, nil
+}
+
+// Observe adds the numeric fields of msg to their series and returns the
+// values that are anomalous
+func (d *Detector) Observe(msg *pb.MeasurementEnvelope) []Anomaly {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var anomalies []Anomaly
+	for _, row := range msg.GetData() {
+		fields := row.AsMap()
+		rowKey := seriesName(fields)
+		for _, field := range sinks.SortedKeys(fields) {
+			value, ok := fields[field].(float64)
+			if !ok || field == "epoch_ns" || strings.HasPrefix(field, "tag_") {
+				continue
+			}
+
+			key := msg.GetDBName() + "\x00" + msg.GetMetricName() + "\x00" + field + "\x00" + rowKey
+			s, ok := d.series[key]
+			if !ok {
+				if len(d.series) >= maxSeries {
+					continue
+				}
+				s = &series{}
+				d.series[key] = s
+			}
+
+			baseline, deviation, score := d.score(s, value)
+			if s.count > d.cfg.WarmUp && math.Abs(score) > d.cfg.Threshold {
+				anomalies = append(anomalies, Anomaly{
+					MetricName: msg.GetMetricName(),
+					Field:      field,
+					Series:     rowKey,
+					Value:      value,
+					Baseline:   baseline,
+					Deviation:  deviation,
+					Score:      score,
+					Method:     d.cfg.Method,
+				})
+			}
+		}
+	}
+	return anomalies
+}
+
+// score compares value to the series, then adds it to the series
+func (d *Detector) score(s *series, value float64) (baseline, deviation, score float64) {
+	s.count++
+	if s.count == 1 {
+		s.mean = value
+		s.values = append(s.values, value)
+		return value, 0, 0
+	}
+
+	switch d.cfg.Method {
+	case DetectorEWMA:
+		baseline = s.mean
+		deviation = math.Sqrt(s.variance)
+		diff := value - s.mean
+		s.mean += d.cfg.Alpha * diff
+		s.variance = (1 - d.cfg.Alpha) * (s.variance + d.cfg.Alpha*diff*diff)
+	case DetectorMAD:
+		baseline = median(s.values)
+		deviations := make([]float64, len(s.values))
+		for i, v := range s.values {
+			deviations[i] = math.Abs(v - baseline)
+		}
+		// scaled to estimate the standard deviation of normal data
+		deviation = 1.4826 * median(deviations)
+		s.values = append(s.values, value)
+		if len(s.values) > d.cfg.Window {
+			s.values = s.values[1:]
+		}
+	}
+
+	// a series that never changed has no deviation, any change of it is
+	// measured against a small fraction of its value
+	spread := max(deviation, 0.01*math.Abs(baseline), 1e-9)
+	return baseline, deviation, (value - baseline) / spread
+}
+
+// seriesName identifies a row by its tag_ fields
+func seriesName(fields map[string]any) string {
+	var tags []string
+	for _, field := range sinks.SortedKeys(fields) {
+		if strings.HasPrefix(field, "tag_") {
+			tags = append(tags, fmt.Sprintf("%s=%v", strings.TrimPrefix(field, "tag_"), fields[field]))
+		}
+	}
+	return strings.Join(tags, ",")
+}
+
+func median(values []float64) float64 {
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
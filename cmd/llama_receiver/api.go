@@ -0,0 +1,573 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Pagination of insight listings
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// heartbeatInterval keeps idle event streams from being closed by proxies
+var heartbeatInterval = 15 * time.Second
+
+// InsightRecord is a stored insight as served by the API
+type InsightRecord struct {
+	ID         int64     `json:"id"`
+	DatabaseID int64     `json:"database_id"`
+	DBName     string    `json:"dbname"`
+	MetricName string    `json:"metric_name"`
+	Summary    string    `json:"summary"`
+	Severity   string    `json:"severity"`
+	CreatedAt  time.Time `json:"created_at"`
+	Findings   []Finding `json:"findings"`
+}
+
+// InsightBroadcaster fans out newly stored insights to event stream
+// subscribers. Subscribers that don't keep up miss insights instead of
+// blocking insight generation.
+type InsightBroadcaster struct {
+	mu          sync.Mutex
+	subscribers map[chan InsightRecord]struct{}
+}
+
+func NewInsightBroadcaster() *InsightBroadcaster {
+	return &InsightBroadcaster{subscribers: make(map[chan InsightRecord]struct{})}
+}
+
+// Subscribe returns a channel receiving new insights until cancel is called
+func (b *InsightBroadcaster) Subscribe() (ch chan InsightRecord, cancel func()) {
+	ch = make(chan InsightRecord, 16)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subscribers, ch)
+		b.mu.Unlock()
+	}
+}
+
+func (b *InsightBroadcaster) Publish(insight InsightRecord) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- insight:
+		default:
+			log.Println("[WARNING]: Dropping insight for slow event stream subscriber")
+		}
+	}
+}
+
+// API serves the stored databases and insights over HTTP
+type API struct {
+	pool        *pgxpool.Pool
+	broadcaster *InsightBroadcaster
+	corsOrigin  string
+	mux         *http.ServeMux
+}
+
+// NewAPI returns the insights API, corsOrigin is allowed to call it from
+// browsers, e.g. the dashboard, if not empty
+func NewAPI(pool *pgxpool.Pool, broadcaster *InsightBroadcaster, corsOrigin string) *API {
+	api := &API{pool: pool, broadcaster: broadcaster, corsOrigin: corsOrigin, mux: http.NewServeMux()}
+	api.mux.HandleFunc("GET /api/databases", api.getDatabases)
+	api.mux.HandleFunc("GET /api/databases/{id}/insights", api.getInsights)
+	api.mux.HandleFunc("GET /api/databases/{id}/metrics/{metric}/insights", api.getInsights)
+	api.mux.HandleFunc("GET /api/insights/stream", api.streamInsights)
+	api.mux.HandleFunc("GET /api/insights/{id}", api.getInsight)
+	api.mux.HandleFunc("GET /api/databases/{id}/reports", api.getReports)
+	api.mux.HandleFunc("GET /api/reports/{id}", api.getReport)
+	api.mux.HandleFunc("GET /api/databases/{id}/jobs", api.getJobs)
+	api.mux.HandleFunc("GET /api/jobs/{id}", api.getJob)
+	return api
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.corsOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", a.corsOrigin)
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves the API on addr until ctx is done
+func (a *API) ListenAndServe(ctx context.Context, addr string) error {
+	server := &http.Server{Addr: addr, Handler: a, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	log.Println("[INFO]: Serving insights API on " + addr)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+type databaseRecord struct {
+	ID               int64      `json:"id"`
+	Name             string     `json:"name"`
+	MeasurementCount int64      `json:"measurement_count"`
+	InsightCount     int64      `json:"insight_count"`
+	LastInsightAt    *time.Time `json:"last_insight_at"`
+}
+
+func (a *API) getDatabases(w http.ResponseWriter, r *http.Request) {
+	rows, err := a.pool.Query(r.Context(), `SELECT db.id, db.dbname,
+		(SELECT COUNT(*) FROM measurements WHERE database_id = db.id),
+		(SELECT COUNT(*) FROM insights WHERE database_id = db.id),
+		(SELECT max(created_at) FROM insights WHERE database_id = db.id)
+		FROM db ORDER BY db.dbname`)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	databases, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (d databaseRecord, err error) {
+		err = row.Scan(&d.ID, &d.Name, &d.MeasurementCount, &d.InsightCount, &d.LastInsightAt)
+		return d, err
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, databases)
+}
+
+// InsightFilter selects insights of a database
+type InsightFilter struct {
+	DatabaseID  int64
+	MetricName  string // all metrics if empty
+	From, To    time.Time
+	MinSeverity string
+	Limit       int
+	Offset      int
+}
+
+// parseInsightFilter reads the filter from the path values and the
+// limit, offset, from, to and min_severity query parameters
+func parseInsightFilter(r *http.Request) (f InsightFilter, err error) {
+	if f.DatabaseID, err = strconv.ParseInt(r.PathValue("id"), 10, 64); err != nil {
+		return f, fmt.Errorf("invalid database id %q", r.PathValue("id"))
+	}
+	f.MetricName = r.PathValue("metric")
+
+	query := r.URL.Query()
+	f.Limit, f.Offset = defaultPageSize, 0
+	if v := query.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit <= 0 || f.Limit > maxPageSize {
+			return f, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		if f.Offset, err = strconv.Atoi(v); err != nil || f.Offset < 0 {
+			return f, errors.New("offset must not be negative")
+		}
+	}
+	for param, t := range map[string]*time.Time{"from": &f.From, "to": &f.To} {
+		if v := query.Get(param); v != "" {
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				return f, fmt.Errorf("%s must be an RFC 3339 time, e.g. 2024-01-02T15:04:05Z", param)
+			}
+		}
+	}
+	if f.MinSeverity = query.Get("min_severity"); f.MinSeverity != "" && severityLevel(f.MinSeverity) < 0 {
+		return f, fmt.Errorf("unknown severity %q", f.MinSeverity)
+	}
+	return f, nil
+}
+
+// where returns the conditions and arguments of the filter
+func (f *InsightFilter) where() (string, []any) {
+	conditions := "insights.database_id = $1"
+	args := []any{f.DatabaseID}
+	add := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions += fmt.Sprintf(" AND "+condition, len(args))
+	}
+	if f.MetricName != "" {
+		add("insights.metric_name = $%d", f.MetricName)
+	}
+	if !f.From.IsZero() {
+		add("insights.created_at >= $%d", f.From.UTC())
+	}
+	if !f.To.IsZero() {
+		add("insights.created_at < $%d", f.To.UTC())
+	}
+	if f.MinSeverity != "" {
+		add("insights.severity_level >= $%d", severityLevel(f.MinSeverity))
+	}
+	return conditions, args
+}
+
+type insightPage struct {
+	Insights []InsightRecord `json:"insights"`
+	Total    int64           `json:"total"`
+	Limit    int             `json:"limit"`
+	Offset   int             `json:"offset"`
+}
+
+func (a *API) getInsights(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseInsightFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	conditions, args := filter.where()
+	page := insightPage{Limit: filter.Limit, Offset: filter.Offset}
+	err = a.pool.QueryRow(r.Context(), "SELECT COUNT(*) FROM insights WHERE "+conditions, args...).Scan(&page.Total)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	args = append(args, filter.Limit, filter.Offset)
+	query := fmt.Sprintf("%s WHERE %s ORDER BY insights.created_at DESC, insights.id DESC LIMIT $%d OFFSET $%d",
+		insightQuery, conditions, len(args)-1, len(args))
+	if page.Insights, err = a.queryInsights(r.Context(), query, args...); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (a *API) getInsight(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid insight id %q", r.PathValue("id")))
+		return
+	}
+
+	insights, err := a.queryInsights(r.Context(), insightQuery+" WHERE insights.id = $1", id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(insights) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("insight %d not found", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, insights[0])
+}
+
+type reportRecord struct {
+	ID         int64     `json:"id"`
+	DatabaseID int64     `json:"database_id"`
+	Period     string    `json:"period"`
+	From       time.Time `json:"period_start"`
+	To         time.Time `json:"period_end"`
+	Severity   string    `json:"severity"`
+	CreatedAt  time.Time `json:"created_at"`
+	Markdown   string    `json:"markdown,omitempty"`
+	HTML       string    `json:"html,omitempty"`
+}
+
+type reportPage struct {
+	Reports []reportRecord `json:"reports"`
+	Total   int64          `json:"total"`
+	Limit   int            `json:"limit"`
+	Offset  int            `json:"offset"`
+}
+
+// getReports lists the reports of a database without their content, newest
+// first. from and to select reports overlapping that time span.
+func (a *API) getReports(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseInsightFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	conditions := "database_id = $1 AND period_end > $2 AND period_start < $3"
+	to := filter.To
+	if to.IsZero() {
+		to = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	args := []any{filter.DatabaseID, filter.From.UTC(), to.UTC()}
+	if filter.MinSeverity != "" {
+		args = append(args, severityLevel(filter.MinSeverity))
+		conditions += " AND severity_level >= $4"
+	}
+
+	page := reportPage{Limit: filter.Limit, Offset: filter.Offset}
+	err = a.pool.QueryRow(r.Context(), "SELECT COUNT(*) FROM reports WHERE "+conditions, args...).Scan(&page.Total)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	args = append(args, filter.Limit, filter.Offset)
+	rows, err := a.pool.Query(r.Context(), fmt.Sprintf(`SELECT id, database_id, period, period_start, period_end, severity, created_at
+		FROM reports WHERE %s ORDER BY period_end DESC, id DESC LIMIT $%d OFFSET $%d`, conditions, len(args)-1, len(args)), args...)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	page.Reports, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (rep reportRecord, err error) {
+		err = row.Scan(&rep.ID, &rep.DatabaseID, &rep.Period, &rep.From, &rep.To, &rep.Severity, &rep.CreatedAt)
+		return rep, err
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// getReport returns a report as JSON, or only its content if the format
+// query parameter is markdown or html
+func (a *API) getReport(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid report id %q", r.PathValue("id")))
+		return
+	}
+
+	var rep reportRecord
+	err = a.pool.QueryRow(r.Context(), `SELECT id, database_id, period, period_start, period_end, severity, created_at, markdown, html
+		FROM reports WHERE id = $1`, id).Scan(&rep.ID, &rep.DatabaseID, &rep.Period, &rep.From, &rep.To, &rep.Severity, &rep.CreatedAt, &rep.Markdown, &rep.HTML)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("report %d not found", id))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "markdown":
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		_, _ = w.Write([]byte(rep.Markdown))
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(rep.HTML))
+	case "", "json":
+		writeJSON(w, http.StatusOK, rep)
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown format %q, expected json, markdown or html", format))
+	}
+}
+
+type jobPage struct {
+	Jobs   []Job `json:"jobs"`
+	Total  int64 `json:"total"`
+	Limit  int   `json:"limit"`
+	Offset int   `json:"offset"`
+}
+
+// getJobs lists the insight jobs of a database, newest first. from and to
+// select jobs by creation time, status by their status.
+func (a *API) getJobs(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseInsightFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	conditions := "insight_jobs.database_id = $1"
+	args := []any{filter.DatabaseID}
+	add := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions += fmt.Sprintf(" AND "+condition, len(args))
+	}
+	if !filter.From.IsZero() {
+		add("insight_jobs.created_at >= $%d", filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		add("insight_jobs.created_at < $%d", filter.To.UTC())
+	}
+	switch status := r.URL.Query().Get("status"); status {
+	case "":
+	case JobPending, JobRunning, JobDone, JobFailed:
+		add("insight_jobs.status = $%d", status)
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown status %q, expected pending, running, done or failed", status))
+		return
+	}
+
+	page := jobPage{Limit: filter.Limit, Offset: filter.Offset}
+	err = a.pool.QueryRow(r.Context(), "SELECT COUNT(*) FROM insight_jobs WHERE "+conditions, args...).Scan(&page.Total)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	args = append(args, filter.Limit, filter.Offset)
+	rows, err := a.pool.Query(r.Context(), fmt.Sprintf("%s WHERE %s ORDER BY insight_jobs.created_at DESC, insight_jobs.id DESC LIMIT $%d OFFSET $%d",
+		jobQuery, conditions, len(args)-1, len(args)), args...)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if page.Jobs, err = pgx.CollectRows(rows, scanJob); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (a *API) getJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid job id %q", r.PathValue("id")))
+		return
+	}
+
+	rows, err := a.pool.Query(r.Context(), jobQuery+" WHERE insight_jobs.id = $1", id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	job, err := pgx.CollectExactlyOneRow(rows, scanJob)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("job %d not found", id))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// insightQuery selects insights, insights stored before findings existed
+// have no metric name and severity
+const insightQuery = `SELECT insights.id, insights.database_id, db.dbname, COALESCE(insights.metric_name, ''),
+	COALESCE(insights.insight_data, ''), COALESCE(insights.severity, ''), insights.created_at
+	FROM insights JOIN db ON db.id = insights.database_id`
+
+// queryInsights runs an insightQuery and adds the findings of the insights
+func (a *API) queryInsights(ctx context.Context, query string, args ...any) ([]InsightRecord, error) {
+	rows, err := a.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	insights, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (i InsightRecord, err error) {
+		err = row.Scan(&i.ID, &i.DatabaseID, &i.DBName, &i.MetricName, &i.Summary, &i.Severity, &i.CreatedAt)
+		i.Findings = []Finding{}
+		return i, err
+	})
+	if err != nil || len(insights) == 0 {
+		return insights, err
+	}
+
+	ids := make([]int64, len(insights))
+	byID := make(map[int64]*InsightRecord, len(insights))
+	for n := range insights {
+		ids[n] = insights[n].ID
+		byID[insights[n].ID] = &insights[n]
+	}
+
+	rows, err = a.pool.Query(ctx, `SELECT insight_id, severity, affected_object, evidence, recommendation
+		FROM findings WHERE insight_id = ANY($1) ORDER BY severity_level DESC, id`, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var f Finding
+		if err = rows.Scan(&id, &f.Severity, &f.AffectedObject, &f.Evidence, &f.Recommendation); err != nil {
+			return nil, err
+		}
+		byID[id].Findings = append(byID[id].Findings, f)
+	}
+	return insights, rows.Err()
+}
+
+// streamInsights sends new insights as server-sent events, optionally
+// limited to the db_id, metric and min_severity query parameters
+func (a *API) streamInsights(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	query := r.URL.Query()
+	var dbID int64
+	if v := query.Get("db_id"); v != "" {
+		var err error
+		if dbID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid database id %q", v))
+			return
+		}
+	}
+	metric := query.Get("metric")
+	minLevel := 0
+	if v := query.Get("min_severity"); v != "" {
+		if minLevel = severityLevel(v); minLevel < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unknown severity %q", v))
+			return
+		}
+	}
+
+	insights, cancel := a.broadcaster.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			_, err := fmt.Fprint(w, ": heartbeat\n\n")
+			if err != nil {
+				return
+			}
+		case insight := <-insights:
+			if (dbID != 0 && insight.DatabaseID != dbID) || (metric != "" && insight.MetricName != metric) ||
+				severityLevel(insight.Severity) < minLevel {
+				continue
+			}
+			data, err := json.Marshal(insight)
+			if err != nil {
+				log.Println("[ERROR]: unable to encode insight: " + err.Error())
+				continue
+			}
+			if _, err = fmt.Fprintf(w, "id: %d\nevent: insight\ndata: %s\n\n", insight.ID, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("[ERROR]: unable to write response: " + err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	if status >= http.StatusInternalServerError {
+		log.Println("[ERROR]: insights API: " + err.Error())
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -9,28 +9,20 @@ export default async function Page({ params }) {
     let id = params.id
     
     const API_ENDPOINT = process.env.API_ENDPOINT
-    let response = await fetch(`${API_ENDPOINT}/get_database_insight?db_id=${id}`)
+    let response = await fetch(`${API_ENDPOINT}/api/databases/${id}/insights?limit=100`, { cache: 'no-store' })
     let jsonData = await response.json()
     
-    if(response.status == 500){
+    if(response.status != 200){
       return(
         <main>
-          {jsonData}
-        </main>
-      )
-    }
-    
-    if(response.status == 404){
-      return(
-        <main>
-          <InsightsComponent data={null} db_id={id} />
+          {jsonData["error"]}
         </main>
       )
     }
 
     return (
     <main>
-      <InsightsComponent data={jsonData} db_id={id}/>
+      <InsightsComponent data={jsonData["insights"]} db_id={id}/>
     </main> 
   );
 }
\ No newline at end of file
@@ -14,7 +14,7 @@ export default async function Home() {
     config()
     console.log(API_ENDPOINT)
   
-    let response = await fetch(`${API_ENDPOINT}/get_database_list`)
+    let response = await fetch(`${API_ENDPOINT}/api/databases`, { cache: 'no-store' })
     let data = await response.json()
 
     return (
@@ -1,6 +1,6 @@
 "use client"
 
-import { useState } from 'react'
+import { useEffect, useState } from 'react'
 import { Card, CardContent, CardHeader, CardTitle } from "@/components/ui/card"
 import { Table, TableBody, TableCell, TableHead, TableHeader, TableRow } from "@/components/ui/table"
 import { Input } from "@/components/ui/input"
@@ -8,17 +8,39 @@ import { Button } from "@/components/ui/button"
 import { ArrowLeft, Search, Filter } from 'lucide-react'
 import Link from 'next/link'
 
+interface Finding {
+  severity: string
+  affected_object: string
+  evidence: string
+  recommendation: string
+}
+
 interface Insight {
-  id: string
-  data: string
-  created_time: string
-  db_id: string
+  id: number
+  database_id: number
+  dbname: string
+  metric_name: string
+  summary: string
+  severity: string
+  created_at: string
+  findings: Finding[]
 }
 
+const API_ENDPOINT = process.env.NEXT_PUBLIC_API_ENDPOINT
 
-export function InsightsComponent({data, db_id}) {
+export function InsightsComponent({data: initial, db_id}) {
   const [searchTerm, setSearchTerm] = useState('')
-  console.log(data)
+  const [data, setData] = useState<Insight[]>(initial ?? [])
+
+  // new insights are streamed by the receiver as server-sent events
+  useEffect(() => {
+    const events = new EventSource(`${API_ENDPOINT}/api/insights/stream?db_id=${db_id}`)
+    events.addEventListener('insight', (e) => {
+      const insight: Insight = JSON.parse((e as MessageEvent).data)
+      setData((insights) => [insight, ...insights])
+    })
+    return () => events.close()
+  }, [db_id])
 
   return (
     <div className="container mx-auto p-4">
@@ -48,7 +70,7 @@ export function InsightsComponent({data, db_id}) {
               </Button>
             </div>
             <div className="text-sm text-muted-foreground">
-              {data != null ? data.length: 0} insights found
+              {data.length} insights found
             </div>
           </div>
           <div className="overflow-x-auto">
@@ -56,28 +78,37 @@ export function InsightsComponent({data, db_id}) {
               <TableHeader>
                 <TableRow>
                   <TableHead>Id</TableHead>
+                  <TableHead>Metric</TableHead>
+                  <TableHead>Severity</TableHead>
                   <TableHead>Description</TableHead>
                   <TableHead className="text-right">Created At</TableHead>
                 </TableRow>
               </TableHeader>
               <TableBody>
-                {data != null && data.map((insight) => (
-                  <TableRow key={insight["id"]} className="py-2">
-                    <TableCell className="text-left p-5" style={{borderBottom:"1px solid #00000022"}} >{insight["id"]}</TableCell>
+                {data.filter((insight) => insight.summary.toLowerCase().includes(searchTerm.toLowerCase())).map((insight) => (
+                  <TableRow key={insight.id} className="py-2">
+                    <TableCell className="text-left p-5" style={{borderBottom:"1px solid #00000022"}} >{insight.id}</TableCell>
+                    <TableCell style={{borderBottom:"1px solid #00000022"}} >{insight.metric_name}</TableCell>
+                    <TableCell style={{borderBottom:"1px solid #00000022"}} >{insight.severity}</TableCell>
                     <TableCell style={{border:"1px solid #00000022"}}>
                       <div style={{ overflowX: "auto" }}>
                         <pre style={{ whiteSpace: "pre-wrap", wordWrap: "break-word" }}>
-                          {insight["data"]}
+                          {insight.summary}
                         </pre>
+                        <ul>
+                          {insight.findings.map((finding, n) => (
+                            <li key={n}><b>{finding.severity}</b> {finding.affected_object}: {finding.recommendation}</li>
+                          ))}
+                        </ul>
                       </div>
                     </TableCell>
-                    <TableCell className="text-right" style={{borderBottom:"1px solid #00000022"}} >{new Date(insight["created_time"]).toLocaleString()}</TableCell>
+                    <TableCell className="text-right" style={{borderBottom:"1px solid #00000022"}} >{new Date(insight.created_at).toLocaleString()}</TableCell>
                   </TableRow>
                 ))}
               </TableBody>
             </Table>
           </div>
-          {data == null || data.length === 0 && (
+          {data.length === 0 && (
             <div className="text-center py-4 text-muted-foreground">
               No insights found. Try adjusting your search or filter.
             </div>
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Severities of findings, from least to most severe
+var severities = []string{"info", "low", "medium", "high", "critical"}
+
+// severityLevel returns the rank of severity, or -1 if it is unknown
+func severityLevel(severity string) int {
+	return slices.Index(severities, severity)
+}
+
+// insightInstructions asks the model for an Insight as JSON
+const insightInstructions = `You analyze PostgreSQL metrics collected by pgwatch.
+Respond only with a JSON object of this form, without any other text:
+{
+  "summary": "one or two sentences summarizing the state of the database",
+  "findings": [
+    {
+      "severity": "one of info, low, medium, high, critical",
+      "affected_object": "the table, index, query, replica or setting concerned",
+      "evidence": "the values that support the finding",
+      "recommendation": "a concrete action to take"
+    }
+  ]
+}
+Order findings by severity, most severe first. Use an empty findings list if everything looks fine.`
+
+// repairInstructions asks the model to fix a reply that isn't a valid Insight
+const repairInstructions = `Your reply was not valid: %s
+Reply again with only the JSON object in the requested form.`
+
+type Finding struct {
+	Severity       string `json:"severity"`
+	AffectedObject string `json:"affected_object"`
+	Evidence       string `json:"evidence"`
+	Recommendation string `json:"recommendation"`
+}
+
+// Insight is the structured analysis returned by the model
+type Insight struct {
+	Summary  string    `json:"summary"`
+	Findings []Finding `json:"findings"`
+}
+
+// Severity returns the highest severity of the findings, info if there
+// are none
+func (i *Insight) Severity() string {
+	level := 0
+	for _, f := range i.Findings {
+		level = max(level, severityLevel(f.Severity))
+	}
+	return severities[level]
+}
+
+// ParseInsight extracts and validates an Insight from a model reply,
+// tolerating code fences and text around the JSON object
+func ParseInsight(reply string) (*Insight, error) {
+	start := strings.Index(reply, "{")
+	end := strings.LastIndex(reply, "}")
+	if start < 0 || end < start {
+		return nil, errors.New("no JSON object found")
+	}
+
+	var insight Insight
+	if err := json.Unmarshal([]byte(reply[start:end+1]), &insight); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	if err := insight.validate(); err != nil {
+		return nil, err
+	}
+	return &insight, nil
+}
+
+// validate checks required fields and normalizes severities
+func (i *Insight) validate() error {
+	i.Summary = strings.TrimSpace(i.Summary)
+	if i.Summary == "" {
+		return errors.New("summary is missing")
+	}
+
+	var err error
+	for n := range i.Findings {
+		f := &i.Findings[n]
+		f.Severity = strings.ToLower(strings.TrimSpace(f.Severity))
+		if severityLevel(f.Severity) < 0 {
+			err = errors.Join(err, fmt.Errorf("finding %d: severity %q is not one of %s", n+1, f.Severity, strings.Join(severities, ", ")))
+		}
+		if strings.TrimSpace(f.AffectedObject) == "" {
+			err = errors.Join(err, fmt.Errorf("finding %d: affected_object is missing", n+1))
+		}
+		if strings.TrimSpace(f.Evidence) == "" {
+			err = errors.Join(err, fmt.Errorf("finding %d: evidence is missing", n+1))
+		}
+		if strings.TrimSpace(f.Recommendation) == "" {
+			err = errors.Join(err, fmt.Errorf("finding %d: recommendation is missing", n+1))
+		}
+	}
+
+	// most severe first
+	slices.SortStableFunc(i.Findings, func(a, b Finding) int {
+		return severityLevel(b.Severity) - severityLevel(a.Severity)
+	})
+	return err
+}
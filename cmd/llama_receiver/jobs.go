@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Job statuses
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// Job queue timing, variables so tests can speed them up
+var (
+	jobPollInterval = time.Second      // how often idle workers look for due jobs
+	staleJobAge     = 15 * time.Minute // running jobs not updated for this long were abandoned by their worker
+)
+
+// JobQueueConfig controls how queued insights are generated
+type JobQueueConfig struct {
+	Workers     int           // jobs processed concurrently
+	Cooldown    time.Duration // jobs of a database and metric created within this duration are merged, 0 to never merge
+	MaxAttempts int           // attempts before a job fails
+	Backoff     time.Duration // delay before the first retry, doubled for every further retry
+	MaxBackoff  time.Duration // upper bound of the delay between retries
+}
+
+func (cfg *JobQueueConfig) Validate() error {
+	if cfg.Workers <= 0 {
+		return errors.New("workers must be positive")
+	}
+	if cfg.MaxAttempts <= 0 {
+		return errors.New("max attempts must be positive")
+	}
+	if cfg.Cooldown < 0 || cfg.Backoff < 0 || cfg.MaxBackoff < cfg.Backoff {
+		return errors.New("cooldown and backoff must not be negative, max backoff must not be less than backoff")
+	}
+	return nil
+}
+
+// backoff returns the delay before retrying a job after its attempt failed
+func (cfg *JobQueueConfig) backoff(attempt int) time.Duration {
+	delay := cfg.Backoff
+	for i := 1; i < attempt && delay < cfg.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, cfg.MaxBackoff)
+}
+
+// Job is a queued insight of a metric of a database
+type Job struct {
+	ID         int64     `json:"id"`
+	DatabaseID int64     `json:"database_id"`
+	DBName     string    `json:"dbname"`
+	MetricName string    `json:"metric_name"`
+	Anomalies  []Anomaly `json:"anomalies"`
+	Status     string    `json:"status"`
+	Attempts   int       `json:"attempts"`
+	RunAt      time.Time `json:"run_at"`
+	LastError  *string   `json:"last_error"`
+	InsightID  *int64    `json:"insight_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// jobQuery selects jobs with the name of their database
+const jobQuery = `SELECT insight_jobs.id, insight_jobs.database_id, db.dbname, insight_jobs.metric_name, insight_jobs.anomalies,
+	insight_jobs.status, insight_jobs.attempts, insight_jobs.run_at, insight_jobs.last_error, insight_jobs.insight_id,
+	insight_jobs.created_at, insight_jobs.updated_at
+	FROM insight_jobs JOIN db ON db.id = insight_jobs.database_id`
+
+func scanJob(row pgx.CollectableRow) (job Job, err error) {
+	var anomalies []byte
+	err = row.Scan(&job.ID, &job.DatabaseID, &job.DBName, &job.MetricName, &anomalies, &job.Status, &job.Attempts,
+		&job.RunAt, &job.LastError, &job.InsightID, &job.CreatedAt, &job.UpdatedAt)
+	if err != nil {
+		return job, err
+	}
+	return job, json.Unmarshal(anomalies, &job.Anomalies)
+}
+
+// EnqueueInsight queues an insight of a metric of a database. If a job of
+// the same database and metric was created within the cooldown, the
+// anomalies are added to it if it is still pending, or dropped otherwise.
+// It returns the id of the new or merged job, or 0 if it was dropped.
+func (r *LLamaReceiver) EnqueueInsight(dbname, metricName string, anomalies []Anomaly) (int64, error) {
+	if anomalies == nil {
+		anomalies = []Anomaly{}
+	}
+	encoded, err := json.Marshal(anomalies)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := r.ConnPool.Begin(r.Ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback(r.Ctx) }()
+
+	var dbid int64
+	err = tx.QueryRow(r.Ctx, `SELECT id FROM db WHERE dbname = $1`, dbname).Scan(&dbid)
+	if err != nil {
+		return 0, fmt.Errorf("unable to find database %s: %w", dbname, err)
+	}
+
+	var id int64
+	if r.Jobs.Cooldown > 0 {
+		// serializes enqueueing per database, so concurrent measurements
+		// can't both miss each other's job
+		if _, err = tx.Exec(r.Ctx, `SELECT pg_advisory_xact_lock(hashtext('insight_jobs'), $1::INT)`, dbid); err != nil {
+			return 0, err
+		}
+
+		var status string
+		err = tx.QueryRow(r.Ctx, `SELECT id, status FROM insight_jobs
+			WHERE database_id = $1 AND metric_name = $2 AND created_at > $3
+			ORDER BY created_at DESC LIMIT 1`, dbid, metricName, time.Now().UTC().Add(-r.Jobs.Cooldown)).Scan(&id, &status)
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+		case err != nil:
+			return 0, err
+		case status == JobPending:
+			_, err = tx.Exec(r.Ctx, `UPDATE insight_jobs SET anomalies = anomalies || $2::JSONB, updated_at = NOW() AT TIME ZONE 'UTC'
+				WHERE id = $1`, id, encoded)
+			if err != nil {
+				return 0, err
+			}
+			return id, tx.Commit(r.Ctx)
+		default:
+			log.Printf("[INFO]: Skipping insight of %s in %s, job %d is in its cooldown", metricName, dbname, id)
+			return 0, nil
+		}
+	}
+
+	err = tx.QueryRow(r.Ctx, `INSERT INTO insight_jobs(database_id, metric_name, anomalies) VALUES($1, $2, $3) RETURNING id`,
+		dbid, metricName, encoded).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	if err = tx.Commit(r.Ctx); err != nil {
+		return 0, err
+	}
+
+	// wake up an idle worker
+	select {
+	case r.jobReady <- struct{}{}:
+	default:
+	}
+	return id, nil
+}
+
+// claimJob marks the next due job as running and returns it, or nil if no
+// job is due. Jobs abandoned by a crashed worker are claimed again.
+func (r *LLamaReceiver) claimJob() (*Job, error) {
+	rows, err := r.ConnPool.Query(r.Ctx, `WITH next AS (
+			SELECT id FROM insight_jobs
+			WHERE (status = 'pending' AND run_at <= NOW() AT TIME ZONE 'UTC')
+				OR (status = 'running' AND updated_at < $1)
+			ORDER BY run_at, id LIMIT 1 FOR UPDATE SKIP LOCKED
+		), claimed AS (
+			UPDATE insight_jobs SET status = 'running', attempts = attempts + 1, updated_at = NOW() AT TIME ZONE 'UTC'
+			FROM next WHERE insight_jobs.id = next.id
+			RETURNING insight_jobs.*
+		)
+		SELECT claimed.id, claimed.database_id, db.dbname, claimed.metric_name, claimed.anomalies,
+			claimed.status, claimed.attempts, claimed.run_at, claimed.last_error, claimed.insight_id,
+			claimed.created_at, claimed.updated_at
+		FROM claimed JOIN db ON db.id = claimed.database_id`, time.Now().UTC().Add(-staleJobAge))
+	if err != nil {
+		return nil, err
+	}
+	job, err := pgx.CollectExactlyOneRow(rows, scanJob)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return &job, err
+}
+
+// finishJob records the outcome of an attempt, scheduling a retry if the
+// attempt failed and the job has attempts left
+func (r *LLamaReceiver) finishJob(job *Job, insightID int64, jobErr error) error {
+	var err error
+	switch {
+	case jobErr == nil:
+		_, err = r.ConnPool.Exec(r.Ctx, `UPDATE insight_jobs SET status = 'done', insight_id = $2, last_error = NULL,
+			updated_at = NOW() AT TIME ZONE 'UTC' WHERE id = $1`, job.ID, insightID)
+	case job.Attempts < r.Jobs.MaxAttempts:
+		delay := r.Jobs.backoff(job.Attempts)
+		log.Printf("[WARNING]: Insight job %d failed, retrying in %s: %s", job.ID, delay, jobErr)
+		_, err = r.ConnPool.Exec(r.Ctx, `UPDATE insight_jobs SET status = 'pending', last_error = $2, run_at = $3,
+			updated_at = NOW() AT TIME ZONE 'UTC' WHERE id = $1`, job.ID, jobErr.Error(), time.Now().UTC().Add(delay))
+	default:
+		log.Printf("[ERROR]: Insight job %d failed after %d attempts: %s", job.ID, job.Attempts, jobErr)
+		_, err = r.ConnPool.Exec(r.Ctx, `UPDATE insight_jobs SET status = 'failed', last_error = $2,
+			updated_at = NOW() AT TIME ZONE 'UTC' WHERE id = $1`, job.ID, jobErr.Error())
+	}
+	return err
+}
+
+// runWorker processes due jobs until r.Ctx is done
+func (r *LLamaReceiver) runWorker() {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	for {
+		job, err := r.claimJob()
+		if err != nil && r.Ctx.Err() == nil {
+			log.Println("[ERROR]: unable to claim insight job: " + err.Error())
+		}
+		if job != nil {
+			insightID, err := r.generateInsight(job.DBName, job.MetricName, job.Anomalies)
+			if err = r.finishJob(job, insightID, err); err != nil {
+				log.Printf("[ERROR]: unable to update insight job %d: %s", job.ID, err)
+			}
+			continue
+		}
+
+		select {
+		case <-r.Ctx.Done():
+			return
+		case <-r.jobReady:
+		case <-ticker.C:
+		}
+	}
+}
+
+// WaitForJobs blocks until no job is due or running
+func (r *LLamaReceiver) WaitForJobs() error {
+	for {
+		var busy bool
+		err := r.ConnPool.QueryRow(r.Ctx, `SELECT EXISTS (SELECT 1 FROM insight_jobs
+			WHERE status = 'running' OR (status = 'pending' AND run_at <= NOW() AT TIME ZONE 'UTC'))`).Scan(&busy)
+		if err != nil || !busy {
+			return err
+		}
+		select {
+		case <-r.Ctx.Done():
+			return r.Ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
@@ -2,63 +2,81 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
-	"strings"
 	"sync"
 	"time"
 
+	"github.com/destrex271/pgwatch3_rpc_server/cmd/llama_receiver/schema"
 	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/rifaideen/talkative"
 )
 
-const contextString = `
-You are a PostgreSQL database metrics analyzer. Examine the following JSON data containing measurements for various Postgres database metrics:
-
-{DATA}
-
-Provide a concise analysis of these metrics, focusing on:
-- Key performance indicators
-- Anomalies or concerning trends
-- Resource utilization patterns
-- Potential bottlenecks or issues
-
-Based on your analysis, offer:
-- 2-3 actionable recommendations to improve database performance
+type Config struct {
+	BatchSize int             // measurements buffered before insights are generated
+	Prompts   *PromptLibrary  // prompt templates, nil uses the built-in ones
+	Window    ContextWindow   // measurements a prompt is built from
+	Detector  DetectorConfig  // anomalies triggering insights
+	Repairs   int             // attempts to get a valid insight after a malformed reply
+	Retention RetentionConfig // measurements kept in Postgres
+	Reports   ReportConfig    // periodic digests
+	Jobs      JobQueueConfig  // queued insight generation
+}
 
-Present your insights and recommendations in bullet points, prioritizing the most important findings.
-Be concise in your output. Your ourput should not exceed 200 words.
-`
+func (cfg *Config) Validate() error {
+	if cfg.BatchSize <= 0 {
+		return errors.New("batch size must be positive")
+	}
+	if cfg.Repairs < 0 {
+		return errors.New("repairs must not be negative")
+	}
+	return errors.Join(cfg.Window.Validate(), cfg.Detector.Validate(), cfg.Retention.Validate(), cfg.Reports.Validate(),
+		cfg.Jobs.Validate())
+}
 
 type LLamaReceiver struct {
-	Client    *talkative.Client
-	Context   string
-	Ctx       context.Context
-	ServerURI string
-	ConnPool  *pgxpool.Pool
-	MsmtBatch []*pb.MeasurementEnvelope
-	BatchSize int
-	mu sync.Mutex
-	MsCount   int
-	InsightsGenerationWg *sync.WaitGroup
+	Provider      Provider
+	Prompts       *PromptLibrary
+	Window        ContextWindow
+	Detector      *Detector // nil if insights are generated per batch
+	Repairs       int
+	Insights      *InsightBroadcaster // new insights for the API's event stream
+	Retention     RetentionConfig
+	Reports       ReportConfig
+	ReportSenders []ReportSender
+	Jobs          JobQueueConfig
+	Ctx           context.Context
+	ConnPool      *pgxpool.Pool
+	MsmtBatch     []*pb.MeasurementEnvelope
+	BatchSize     int
+	mu            sync.Mutex
+	MsCount       int
+	jobReady      chan struct{} // signals idle workers that a job was enqueued
 	sinks.SyncMetricHandler
 }
 
 type MeasurementsData struct {
 	metricName string
 	data       string
+	createdAt  time.Time
 }
 
-func NewLLamaReceiver(LLamaServerURI string, pgURI string, ctx context.Context, batchSize int) (recv *LLamaReceiver, err error) {
-	client, err := talkative.New(LLamaServerURI)
+func NewLLamaReceiver(provider Provider, pgURI string, ctx context.Context, cfg Config) (recv *LLamaReceiver, err error) {
+	if err = cfg.Validate(); err != nil {
+		return nil, err
+	}
+	detector, err := NewDetector(cfg.Detector)
 	if err != nil {
-		log.Println("[ERROR]: unable to initialize llama client")
 		return nil, err
 	}
+	if cfg.Prompts == nil {
+		if cfg.Prompts, err = LoadPromptLibrary(""); err != nil {
+			return nil, err
+		}
+	}
 
 	// To use in insight generation to avoid any stuff
 	pgxpool_config, err := pgxpool.ParseConfig(pgURI)
@@ -78,16 +96,23 @@ func NewLLamaReceiver(LLamaServerURI string, pgURI string, ctx context.Context,
 	}
 
 	recv = &LLamaReceiver{
-		Client:            client,
-		Context:           contextString,
+		Provider:          provider,
+		Prompts:           cfg.Prompts,
+		Window:            cfg.Window,
+		Detector:          detector,
+		Repairs:           cfg.Repairs,
+		Insights:          NewInsightBroadcaster(),
+		Retention:         cfg.Retention,
+		Reports:           cfg.Reports,
+		ReportSenders:     newReportSenders(cfg.Reports),
+		Jobs:              cfg.Jobs,
 		Ctx:               ctx,
-		ServerURI:         LLamaServerURI,
 		ConnPool:          pool,
-		MsmtBatch:         make([]*pb.MeasurementEnvelope, 0, batchSize),
-		BatchSize:         batchSize,
+		MsmtBatch:         make([]*pb.MeasurementEnvelope, 0, cfg.BatchSize),
+		BatchSize:         cfg.BatchSize,
 		SyncMetricHandler: sinks.NewSyncMetricHandler(1024),
 		MsCount:           0,
-		InsightsGenerationWg: &sync.WaitGroup{},
+		jobReady:          make(chan struct{}, 1),
 	}
 
 	err = recv.SetupTables()
@@ -97,6 +122,15 @@ func NewLLamaReceiver(LLamaServerURI string, pgURI string, ctx context.Context,
 	}
 
 	go recv.HandleSyncMetric()
+	for range cfg.Jobs.Workers {
+		go recv.runWorker()
+	}
+	if cfg.Retention.enabled() {
+		go recv.runRetention()
+	}
+	if cfg.Reports.enabled() {
+		go recv.runReports()
+	}
 
 	return recv, nil
 }
@@ -109,19 +143,14 @@ func (r *LLamaReceiver) HandleSyncMetric() {
 			return
 		}
 
-		// Acquire connetion
-		conn, err := r.ConnPool.Acquire(r.Ctx)
-		if err != nil {
-			log.Println("[ERROR]: Unable to acquire connection")
-			return
-		}
-		defer conn.Release()
-
+		// the pool acquires and releases a connection per statement, a
+		// failure only affects this request
+		var err error
 		switch req.Operation {
 		case pb.SyncOp_AddOp:
-			_, err = conn.Exec(r.Ctx, `INSERT INTO db(dbname) VALUES($1)`, req.GetDBName())
+			_, err = r.ConnPool.Exec(r.Ctx, `INSERT INTO db(dbname) VALUES($1) ON CONFLICT (dbname) DO NOTHING`, req.GetDBName())
 		case pb.SyncOp_DeleteOp:
-			_, err = conn.Exec(r.Ctx, `DELETE FROM db WHERE dbname=$1;`, req.GetDBName())
+			_, err = r.ConnPool.Exec(r.Ctx, `DELETE FROM db WHERE dbname=$1;`, req.GetDBName())
 		}
 
 		if err != nil {
@@ -130,43 +159,9 @@ func (r *LLamaReceiver) HandleSyncMetric() {
 	}
 }
 
+// SetupTables brings the schema up to date by applying pending migrations
 func (r *LLamaReceiver) SetupTables() error {
-	conn, err := r.ConnPool.Acquire(r.Ctx)
-	if err != nil {
-		return errors.New("unable to acquire new connection")
-	}
-	defer conn.Release()
-
-	_, err = conn.Exec(r.Ctx, `CREATE TABLE IF NOT EXISTS db(id BIGSERIAL PRIMARY KEY, dbname TEXT)`)
-	if err != nil {
-		log.Println("[ERROR]: unable to create db table : " + err.Error())
-		return err
-	}
-
-	_, err = conn.Exec(r.Ctx, `CREATE TABLE IF NOT EXISTS measurements (
-		created_at TIMESTAMP NOT NULL DEFAULT(NOW() AT TIME ZONE 'UTC'),
-		data JSONB,
-		metric_name TEXT,
-		database_id SERIAL,
-		FOREIGN KEY (database_id) REFERENCES db(id) ON DELETE CASCADE
-	);`)
-	if err != nil {
-		log.Println("[ERROR]: unable to create Measurement table : " + err.Error())
-		return err
-	}
-
-	_, err = conn.Exec(r.Ctx, `CREATE TABLE IF NOT EXISTS insights(
-		insight_data TEXT, 
-		database_id BIGSERIAL, 
-		created_at TIMESTAMP NOT NULL DEFAULT(NOW() AT TIME ZONE 'UTC'),
-		FOREIGN KEY (database_id) REFERENCES db(id) ON DELETE CASCADE
-	)`)
-	if err != nil {
-		log.Println("[ERROR]: unable to create Insigths table : " + err.Error())
-		return err
-	}
-
-	return nil
+	return schema.Migrate(r.Ctx, r.ConnPool)
 }
 
 func (r *LLamaReceiver) AddMeasurements(msg *pb.MeasurementEnvelope) error {
@@ -177,23 +172,11 @@ func (r *LLamaReceiver) AddMeasurements(msg *pb.MeasurementEnvelope) error {
 	defer conn.Release()
 
 	var id int
-	// Try to fetch id
-	err = conn.QueryRow(r.Ctx, `SELECT id FROM db WHERE dbname=$1`, msg.GetDBName()).Scan(&id)
+	// add database to table if it isn't registered yet and fetch its id
+	err = conn.QueryRow(r.Ctx, `INSERT INTO db(dbname) VALUES($1)
+		ON CONFLICT (dbname) DO UPDATE SET dbname = EXCLUDED.dbname RETURNING id`, msg.GetDBName()).Scan(&id)
 	if err != nil {
-		if err.Error() != "no rows in result set" {
-			return err
-		}
-		// if not found, add database to table
-		_, err := conn.Exec(r.Ctx, `INSERT INTO db(dbname) VALUES($1)`, msg.GetDBName())
-		if err != nil {
-			return err
-		}
-
-		// Get new id
-		err = conn.QueryRow(r.Ctx, `SELECT id FROM db WHERE dbname=$1`, msg.GetDBName()).Scan(&id)
-		if err != nil {
-			return err
-		}
+		return err
 	}
 
 	// insert measurements with current timestamp(default) into table measurements
@@ -210,24 +193,39 @@ func (r *LLamaReceiver) AddMeasurements(msg *pb.MeasurementEnvelope) error {
 	return nil
 }
 
-func (r *LLamaReceiver) GetAllMeasurements(dbname string, metric_name string, context_size uint) ([]MeasurementsData, error) {
+// GetAllMeasurements returns the measurements of a metric within window,
+// newest first
+func (r *LLamaReceiver) GetAllMeasurements(dbname string, metric_name string, window ContextWindow) ([]MeasurementsData, error) {
 	conn, err := r.ConnPool.Acquire(r.Ctx)
 	if err != nil {
 		return nil, errors.New("unable to acquire new connection")
 	}
 	defer conn.Release()
 
-	query := "SELECT metric_name, data FROM measurements INNER JOIN db ON measurements.database_id = db.id WHERE db.dbname = $1 ORDER BY created_at DESC LIMIT $2"
-	rows, err := conn.Query(r.Ctx, query, dbname, context_size)
+	query := `SELECT metric_name, data, created_at FROM measurements INNER JOIN db ON measurements.database_id = db.id
+		WHERE db.dbname = $1 AND metric_name = $2`
+	args := []any{dbname, metric_name}
+	if window.Duration > 0 {
+		args = append(args, time.Now().UTC().Add(-window.Duration))
+		query += fmt.Sprintf(" AND created_at >= $%d", len(args))
+	}
+	query += " ORDER BY created_at DESC"
+	if window.Rows > 0 {
+		args = append(args, window.Rows)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := conn.Query(r.Ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	var data []MeasurementsData
 
 	for rows.Next() {
 		var cur_data MeasurementsData
-		err = rows.Scan(&cur_data.metricName, &cur_data.data)
+		err = rows.Scan(&cur_data.metricName, &cur_data.data, &cur_data.createdAt)
 		if err != nil {
 			log.Println(err)
 			continue
@@ -235,29 +233,42 @@ func (r *LLamaReceiver) GetAllMeasurements(dbname string, metric_name string, co
 		data = append(data, cur_data)
 	}
 
-	return data, nil
+	return data, rows.Err()
 }
 
-func (r *LLamaReceiver) PreparePrompt(dbname string, metric_name string) (string, error) {
-	all_measurements, err := r.GetAllMeasurements(dbname, metric_name, 10)
+// PreparePrompt renders the prompt template of metric_name with the
+// measurements in the context window, their summary statistics and the
+// anomalies that triggered the insight
+func (r *LLamaReceiver) PreparePrompt(dbname string, metric_name string, anomalies []Anomaly) (string, error) {
+	all_measurements, err := r.GetAllMeasurements(dbname, metric_name, r.Window)
 	if err != nil {
 		return "", err
 	}
 
-	var data_string string
-	for _, measurement := range all_measurements {
-		data_string += "Metric Name -> " + measurement.metricName + ": " + measurement.data + ".\n"
+	data, err := newPromptData(dbname, metric_name, all_measurements)
+	if err != nil {
+		return "", err
 	}
+	data.Anomalies = anomalies
 
-	final_msg := strings.ReplaceAll(r.Context, "{DATA}", data_string)
-	return final_msg, nil
+	if r.Window.History > 0 {
+		rollups, err := r.GetRollups(dbname, metric_name, time.Now().Add(-r.Window.History))
+		if err != nil {
+			return "", err
+		}
+		data.History = summarizeHistory(rollups)
+		if len(rollups) > 0 {
+			data.HistoryFrom = rollups[0].Bucket
+		}
+	}
+	return r.Prompts.Render(data)
 }
 
 func (r *LLamaReceiver) GetDBID(dbname string) (int, error) {
 	conn, err := r.ConnPool.Acquire(r.Ctx)
 	if err != nil {
 		log.Println("[ERROR]: unable to acquire new connection")
-		return 0, err 
+		return 0, err
 	}
 	defer conn.Release()
 
@@ -266,81 +277,145 @@ func (r *LLamaReceiver) GetDBID(dbname string) (int, error) {
 	query := `SELECT id FROM db where dbname=$1`
 	err = conn.QueryRow(r.Ctx, query, dbname).Scan(&id)
 	if err != nil {
-		return 0, err 
+		return 0, err
 	}
 	return id, nil
 }
 
-func (r *LLamaReceiver) AddInsights(dbid int, insights string) error {
+// AddInsights stores an insight with its findings and returns its id
+func (r *LLamaReceiver) AddInsights(dbid int, metricName string, insight *Insight) (int64, error) {
 	conn, err := r.ConnPool.Acquire(r.Ctx)
 	if err != nil {
-		return errors.New("unable to acquire new connection")
+		return 0, errors.New("unable to acquire new connection")
 	}
 	defer conn.Release()
 
-	// Insert model response in table insights
-	query := `INSERT INTO insights(database_id, insight_data) VALUES($1, $2)`
-	_, err = conn.Exec(r.Ctx, query, dbid, insights)
+	tx, err := conn.Begin(r.Ctx)
 	if err != nil {
-		return fmt.Errorf("failed to execute query: %w", err)
+		return 0, err
 	}
+	defer func() { _ = tx.Rollback(r.Ctx) }()
 
-	return nil
-}
-
-func (r *LLamaReceiver) GenerateInsights(msg *pb.MeasurementEnvelope) error {
-	final_msg, err := r.PreparePrompt(msg.GetDBName(), msg.GetMetricName())
+	// Insert model response in table insights
+	var id int64
+	severity := insight.Severity()
+	query := `INSERT INTO insights(database_id, metric_name, insight_data, severity, severity_level) VALUES($1, $2, $3, $4, $5) RETURNING id`
+	err = tx.QueryRow(r.Ctx, query, dbid, metricName, insight.Summary, severity, severityLevel(severity)).Scan(&id)
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("failed to execute query: %w", err)
 	}
 
-	model := "tinyllama"
-	model_response := ""
-	// Callback function to handle the response
-	callback := func(cr string, err error) {
+	for _, f := range insight.Findings {
+		_, err = tx.Exec(r.Ctx, `INSERT INTO findings(insight_id, severity, severity_level, affected_object, evidence, recommendation)
+			VALUES($1, $2, $3, $4, $5, $6)`, id, f.Severity, severityLevel(f.Severity), f.AffectedObject, f.Evidence, f.Recommendation)
 		if err != nil {
-			fmt.Println(err)
-			return
+			return 0, fmt.Errorf("failed to insert finding: %w", err)
 		}
+	}
 
-		var response talkative.ChatResponse
+	return id, tx.Commit(r.Ctx)
+}
 
-		if err := json.Unmarshal([]byte(cr), &response); err != nil {
-			log.Println(err)
-			return
-		}
+// AddAnomalies stores the anomalies detected in the measurements of a database
+func (r *LLamaReceiver) AddAnomalies(dbid int, anomalies []Anomaly) error {
+	conn, err := r.ConnPool.Acquire(r.Ctx)
+	if err != nil {
+		return errors.New("unable to acquire new connection")
+	}
+	defer conn.Release()
 
-		model_response += response.Message.Content
-		log.Println(model_response)
+	batch := &pgx.Batch{}
+	for _, a := range anomalies {
+		batch.Queue(`INSERT INTO anomalies(database_id, metric_name, field, series, value, baseline, deviation, score, method)
+			VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			dbid, a.MetricName, a.Field, a.Series, a.Value, a.Baseline, a.Deviation, a.Score, a.Method)
 	}
+	if err = conn.SendBatch(r.Ctx, batch).Close(); err != nil {
+		return fmt.Errorf("failed to insert anomalies: %w", err)
+	}
+	return nil
+}
 
-	var params *talkative.ChatParams = nil
+// GenerateInsights asks the model about the recent measurements of msg's
+// metric, pointing out anomalies if any were detected
+func (r *LLamaReceiver) GenerateInsights(msg *pb.MeasurementEnvelope, anomalies []Anomaly) error {
+	_, err := r.generateInsight(msg.GetDBName(), msg.GetMetricName(), anomalies)
+	return err
+}
 
-	log.Println("Working on metrics....")
-	// The chat message to send
-	message := talkative.ChatMessage{
-		Role:    talkative.USER, // Initiate the chat as a user
-		Content: final_msg,
+// generateInsight asks the model about the recent measurements of a metric
+// of dbname, stores the insight and returns its id
+func (r *LLamaReceiver) generateInsight(dbname, metricName string, anomalies []Anomaly) (int64, error) {
+	final_msg, err := r.PreparePrompt(dbname, metricName, anomalies)
+	if err != nil {
+		return 0, err
 	}
 
-	done, err := r.Client.PlainChat(model, callback, params, message)
-
+	log.Println("Working on metrics....")
+	insight, err := r.chatInsight(final_msg)
 	if err != nil {
-		return errors.New("unable to send message to client. Please check if your ollama instance is up and running")
+		return 0, err
 	}
 
-	<-done // wait for the chat to complete
-	id, err := r.GetDBID(msg.GetDBName())
+	id, err := r.GetDBID(dbname)
 	if err != nil {
-		return errors.New("unable to find database in records")
+		return 0, errors.New("unable to find database in records")
 	}
 
-	err = r.AddInsights(id, model_response)
+	insightID, err := r.AddInsights(id, metricName, insight)
 	if err != nil {
-		return errors.New("unable to add new insights")
+		return 0, fmt.Errorf("unable to add new insights: %w", err)
+	}
+	if insight.Findings == nil {
+		insight.Findings = []Finding{}
+	}
+	r.Insights.Publish(InsightRecord{
+		ID:         insightID,
+		DatabaseID: int64(id),
+		DBName:     dbname,
+		MetricName: metricName,
+		Summary:    insight.Summary,
+		Severity:   insight.Severity(),
+		CreatedAt:  time.Now().UTC(),
+		Findings:   insight.Findings,
+	})
+
+	for _, f := range insight.Findings {
+		if severityLevel(f.Severity) >= severityLevel("high") {
+			log.Printf("[WARNING]: %s finding for %s in %s: %s", f.Severity, f.AffectedObject, dbname, f.Recommendation)
+		}
 	}
+	return insightID, nil
+}
 
-	return nil
+// chatInsight asks the model for an Insight, sending malformed replies back
+// with the validation error up to r.Repairs times
+func (r *LLamaReceiver) chatInsight(prompt string) (*Insight, error) {
+	messages := []Message{
+		{Role: RoleSystem, Content: insightInstructions},
+		{Role: RoleUser, Content: prompt},
+	}
+
+	for attempt := 0; ; attempt++ {
+		reply, err := r.Provider.Chat(r.Ctx, messages)
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate insights, please check if your LLM server is up and running: %w", err)
+		}
+
+		insight, err := ParseInsight(reply)
+		if err == nil {
+			return insight, nil
+		}
+		if attempt == r.Repairs {
+			return nil, fmt.Errorf("model returned an invalid insight after %d attempts: %w", attempt+1, err)
+		}
+
+		log.Println("[WARNING]: Invalid insight, asking the model to repair it: " + err.Error())
+		messages = append(messages,
+			Message{Role: RoleAssistant, Content: reply},
+			Message{Role: RoleUser, Content: fmt.Sprintf(repairInstructions, err)},
+		)
+	}
 }
 
 func (r *LLamaReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
@@ -351,6 +426,11 @@ func (r *LLamaReceiver) UpdateMeasurements(ctx context.Context, msg *pb.Measurem
 	}
 
 	log.Println("[INFO]: Inserted entry into database")
+
+	if r.Detector != nil {
+		return &pb.Reply{}, r.handleAnomalies(msg)
+	}
+
 	log.Println("[INFO]: Adding entry to batch")
 
 	// lock to avoid raceing of multiple pgwatch instances
@@ -359,16 +439,11 @@ func (r *LLamaReceiver) UpdateMeasurements(ctx context.Context, msg *pb.Measurem
 	r.MsCount += 1
 
 	if r.MsCount == r.BatchSize {
-		// Generate insights for measurements of batch set
+		// Queue insights for measurements of batch set
 		for _, val := range r.MsmtBatch {
-			r.InsightsGenerationWg.Add(1)
-			go func(val *pb.MeasurementEnvelope) {
-				defer r.InsightsGenerationWg.Done()
-				err = r.GenerateInsights(val)
-				if err != nil {
-					log.Printf("Error Generating Insights: %v", err)
-				}
-			}(val)
+			if _, err := r.EnqueueInsight(val.GetDBName(), val.GetMetricName(), nil); err != nil {
+				log.Printf("Error Queueing Insights: %v", err)
+			}
 		}
 
 		log.Println("[INFO]: Flushing Batch")
@@ -378,4 +453,25 @@ func (r *LLamaReceiver) UpdateMeasurements(ctx context.Context, msg *pb.Measurem
 	r.mu.Unlock()
 
 	return &pb.Reply{}, nil
-}
\ No newline at end of file
+}
+
+// handleAnomalies stores the anomalies of msg and queues an insight for
+// them, measurements without anomalies don't reach the model
+func (r *LLamaReceiver) handleAnomalies(msg *pb.MeasurementEnvelope) error {
+	anomalies := r.Detector.Observe(msg)
+	if len(anomalies) == 0 {
+		return nil
+	}
+	log.Printf("[INFO]: Detected %d anomalies in %s of %s", len(anomalies), msg.GetMetricName(), msg.GetDBName())
+
+	id, err := r.GetDBID(msg.GetDBName())
+	if err != nil {
+		return err
+	}
+	if err = r.AddAnomalies(id, anomalies); err != nil {
+		return err
+	}
+
+	_, err = r.EnqueueInsight(msg.GetDBName(), msg.GetMetricName(), anomalies)
+	return err
+}
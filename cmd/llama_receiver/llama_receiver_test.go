@@ -1,45 +1,34 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/destrex271/pgwatch3_rpc_server/cmd/llama_receiver/schema"
 	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
 	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"github.com/jackc/pgx/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/testcontainers/testcontainers-go"
-	tcollama "github.com/testcontainers/testcontainers-go/modules/ollama"
 	"github.com/testcontainers/testcontainers-go/modules/postgres"
 	"github.com/testcontainers/testcontainers-go/wait"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
-const new_image = "tinyllama_image"
-
-func initOllamaContainer(ctx context.Context) (*tcollama.OllamaContainer, error) {
-	ollamaContainer, err := tcollama.Run(ctx, new_image)
-	if err != nil {
-		ollamaContainer, err = tcollama.Run(ctx, "ollama/ollama:0.1.25")
-		if err != nil {
-			log.Printf("failed to start container: %s", err)
-			return nil, err
-		}
-
-		// Pull model and commit container
-		_, _, err = ollamaContainer.Exec(ctx, []string{"ollama", "pull", "tinyllama"})
-		if err != nil {
-			log.Println("unable to pull llama3: " + err.Error())
-			return nil, err
-		}
-		_ = ollamaContainer.Commit(ctx, new_image)
-	}
-
-	return ollamaContainer, nil
-}
-
 func initPostgresContainer(ctx context.Context) (*postgres.PostgresContainer, error) {
 	dbName := "postgres"
 	dbUser := "postgres"
@@ -64,34 +53,22 @@ func initPostgresContainer(ctx context.Context) (*postgres.PostgresContainer, er
 
 var (
 	ctx context.Context = context.Background()
-	llamaConnectionStr string
 	pgConnectionStr string
 )
 
 func TestMain(m *testing.M) {
-	ollamaContainer, err := initOllamaContainer(ctx)
-	if err != nil {
-		panic(err)
-	}
-
 	postgresContainer, err := initPostgresContainer(ctx)
 	if err != nil {
 		panic(err)
 	}
 
 	defer func() {
-		_ = ollamaContainer.Terminate(ctx)
 		_ = postgresContainer.Terminate(ctx)
 	}()
 
 	// wait a little to ensure full startup of containers
 	time.Sleep(5 * time.Second)
 
-	llamaConnectionStr, err = ollamaContainer.ConnectionString(ctx)
-	if err != nil {
-		panic(err)
-	}
-
 	pgConnectionStr, err = postgresContainer.ConnectionString(ctx)
 	if err != nil {
 		panic(err)
@@ -105,7 +82,10 @@ func TestMain(m *testing.M) {
 
 func TestLLamaReceiver(t *testing.T) {
 	var err error
-	recv, err := NewLLamaReceiver(llamaConnectionStr, pgConnectionStr, ctx, 1)
+	provider := &FakeProvider{Responses: []string{`{"summary": "Everything looks fine.", "findings": [
+		{"severity": "low", "affected_object": "testMetric", "evidence": "key is val", "recommendation": "keep watching"}]}`}}
+	recv, err := NewLLamaReceiver(provider, pgConnectionStr, ctx, Config{BatchSize: 1, Window: ContextWindow{Rows: 10},
+		Jobs: JobQueueConfig{Workers: 2, MaxAttempts: 2}})
 	assert.NotNil(t, recv, "Receiver object is nil")
 	assert.NoError(t, err, "Error encountered while creating receiver")
 
@@ -116,7 +96,7 @@ func TestLLamaReceiver(t *testing.T) {
 	msg := testutils.GetTestMeasurementEnvelope()
 
 	t.Run("check setuped tables", func(t *testing.T) {
-		dbs := [3]string{"db", "measurements", "insights"}
+		dbs := [5]string{"db", "measurements", "insights", "findings", "anomalies"}
 		var doesExist bool
 		for _, db := range dbs {
 			query := fmt.Sprintf("SELECT EXISTS (SELECT FROM information_schema.tables WHERE table_name = '%s');", db)
@@ -127,17 +107,46 @@ func TestLLamaReceiver(t *testing.T) {
 		}
 	})
 
+	t.Run("Migrations", func(t *testing.T) {
+		migrations, err := schema.Migrations()
+		assert.NoError(t, err)
+		version, err := schema.Version(ctx, conn)
+		assert.NoError(t, err)
+		assert.Equal(t, migrations[len(migrations)-1].Version, version)
+
+		// applying them again is a no-op
+		assert.NoError(t, recv.SetupTables())
+		var applied int
+		err = conn.QueryRow(ctx, "SELECT COUNT(*) FROM schema_migrations").Scan(&applied)
+		assert.NoError(t, err)
+		assert.Equal(t, len(migrations), applied)
+	})
+
 	t.Run("Update Measurements", func(t *testing.T) {
 		_, err := recv.UpdateMeasurements(ctx, msg)
 		assert.NoError(t, err, "error encountered while updating measurements")
 
 		// Check insights table for new entry
 		newInsightsCount := 0
-		recv.InsightsGenerationWg.Wait()
+		assert.NoError(t, recv.WaitForJobs())
 		err = conn.QueryRow(recv.Ctx, "SELECT COUNT(*) FROM insights;").Scan(&newInsightsCount)
 		
 		assert.NoError(t, err)
 		assert.Equal(t, newInsightsCount, 1, "No new entries inserted in insights table")
+
+		var insight, severity string
+		err = conn.QueryRow(recv.Ctx, "SELECT insight_data, severity FROM insights;").Scan(&insight, &severity)
+		assert.NoError(t, err)
+		assert.Equal(t, "Everything looks fine.", insight)
+		assert.Equal(t, "low", severity)
+		assert.Equal(t, RoleSystem, provider.Chats[0][0].Role)
+		assert.Contains(t, provider.Chats[0][1].Content, "testMetric")
+
+		var object, recommendation string
+		err = conn.QueryRow(recv.Ctx, "SELECT affected_object, recommendation FROM findings JOIN insights ON insights.id = findings.insight_id").Scan(&object, &recommendation)
+		assert.NoError(t, err)
+		assert.Equal(t, "testMetric", object)
+		assert.Equal(t, "keep watching", recommendation)
 	})
 
 	t.Run("Update Measurements Multiple", func(t *testing.T) {
@@ -147,7 +156,7 @@ func TestLLamaReceiver(t *testing.T) {
 		}
 
 		newInsightsCount := 0
-		recv.InsightsGenerationWg.Wait()
+		assert.NoError(t, recv.WaitForJobs())
 		err := conn.QueryRow(recv.Ctx, "SELECT COUNT(*) FROM insights;").Scan(&newInsightsCount)
 		
 		assert.NoError(t, err)
@@ -176,4 +185,831 @@ func TestLLamaReceiver(t *testing.T) {
 		assert.NoError(t, err)
 		assert.False(t, exists)
 	})
-}
\ No newline at end of file
+
+	t.Run("Metric scoped prompts", func(t *testing.T) {
+		other := testutils.GetTestMeasurementEnvelope()
+		other.MetricName = "otherMetric"
+		other.Data[0].Fields["key"] = structpb.NewStringValue("other")
+		assert.NoError(t, recv.AddMeasurements(other))
+
+		prompt, err := recv.PreparePrompt(msg.GetDBName(), msg.GetMetricName(), nil)
+		assert.NoError(t, err)
+		assert.Contains(t, prompt, `"testMetric"`)
+		assert.Contains(t, prompt, `{"key":"val"}`)
+		assert.NotContains(t, prompt, `"other"`)
+	})
+
+	t.Run("Anomalies trigger insights", func(t *testing.T) {
+		recv.Detector, err = NewDetector(DetectorConfig{Method: DetectorEWMA, Threshold: 3.5, Alpha: 0.1, WarmUp: 5})
+		assert.NoError(t, err)
+		defer func() { recv.Detector = nil }()
+
+		var before int
+		err = conn.QueryRow(ctx, "SELECT COUNT(*) FROM insights").Scan(&before)
+		assert.NoError(t, err)
+		calls := provider.Calls()
+
+		anomalous := testutils.GetTestMeasurementEnvelope()
+		anomalous.MetricName = "db_stats"
+		for i := range 10 {
+			anomalous.Data[0].Fields["numbackends"] = structpb.NewNumberValue(float64(10 + i%2))
+			_, err := recv.UpdateMeasurements(ctx, anomalous)
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, recv.WaitForJobs())
+		assert.Equal(t, calls, provider.Calls(), "routine data must not reach the model")
+
+		anomalous.Data[0].Fields["numbackends"] = structpb.NewNumberValue(200)
+		_, err := recv.UpdateMeasurements(ctx, anomalous)
+		assert.NoError(t, err)
+		assert.NoError(t, recv.WaitForJobs())
+
+		var after int
+		err = conn.QueryRow(ctx, "SELECT COUNT(*) FROM insights").Scan(&after)
+		assert.NoError(t, err)
+		assert.Equal(t, before+1, after)
+		assert.Contains(t, provider.Chats[len(provider.Chats)-1][1].Content, "- numbackends: 200, baseline")
+
+		var field string
+		var value float64
+		err = conn.QueryRow(ctx, "SELECT field, value FROM anomalies WHERE metric_name = 'db_stats'").Scan(&field, &value)
+		assert.NoError(t, err)
+		assert.Equal(t, "numbackends", field)
+		assert.Equal(t, 200.0, value)
+	})
+
+	t.Run("Retention", func(t *testing.T) {
+		now := time.Now().UTC()
+		old := testutils.GetTestMeasurementEnvelope()
+		old.DBName = "retention"
+		old.MetricName = "db_stats"
+		assert.NoError(t, recv.AddMeasurements(old))
+		dbid, err := recv.GetDBID("retention")
+		assert.NoError(t, err)
+
+		// two hours with two measurements each, one of two rows
+		for i, age := range []time.Duration{50 * time.Hour, 50*time.Hour + time.Minute, 49 * time.Hour, 49*time.Hour + time.Minute} {
+			_, err = conn.Exec(ctx, `INSERT INTO measurements(data, database_id, metric_name, created_at) VALUES($1, $2, 'db_stats', $3)`,
+				fmt.Sprintf(`[{"numbackends": %d, "datname": "retention", "epoch_ns": 1}, {"numbackends": 100, "tag_datname": "other"}]`, i),
+				dbid, now.Truncate(time.Hour).Add(-age).Add(30*time.Minute))
+			assert.NoError(t, err)
+		}
+
+		recv.Retention = RetentionConfig{Raw: 24 * time.Hour, Interval: time.Hour}
+		defer func() { recv.Retention = RetentionConfig{} }()
+		assert.NoError(t, recv.ApplyRetention(now))
+
+		var measurements int
+		err = conn.QueryRow(ctx, "SELECT COUNT(*) FROM measurements WHERE database_id = $1", dbid).Scan(&measurements)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, measurements, "only the recent measurement is kept")
+
+		rollups, err := recv.GetRollups("retention", "db_stats", now.Add(-7*24*time.Hour))
+		assert.NoError(t, err)
+		assert.Len(t, rollups, 4, "two hours of two series")
+		assert.Equal(t, HourlyRollup{Field: "numbackends", Bucket: now.Truncate(time.Hour).Add(-50 * time.Hour), Count: 2, Min: 0, Max: 1, Avg: 0.5}, rollups[0])
+		assert.Equal(t, "datname=other", rollups[1].Series)
+
+		// running again neither loses nor duplicates summaries
+		assert.NoError(t, recv.ApplyRetention(now))
+		again, err := recv.GetRollups("retention", "db_stats", now.Add(-7*24*time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, rollups, again)
+
+		recv.Window.History = 7 * 24 * time.Hour
+		defer func() { recv.Window.History = 0 }()
+		prompt, err := recv.PreparePrompt("retention", "db_stats", nil)
+		assert.NoError(t, err)
+		assert.Contains(t, prompt, "- numbackends: 2, 0, 3, 1.5")
+
+		recv.Retention.Rollups = 24 * time.Hour
+		assert.NoError(t, recv.ApplyRetention(now))
+		rollups, err = recv.GetRollups("retention", "db_stats", now.Add(-7*24*time.Hour))
+		assert.NoError(t, err)
+		assert.Empty(t, rollups)
+	})
+
+	t.Run("Reports", func(t *testing.T) {
+		calls := provider.Calls()
+		recv.Reports = ReportConfig{Period: ReportDaily, At: "07:00"}
+		defer func() { recv.Reports = ReportConfig{} }()
+
+		var webhooks []*Report
+		recv.ReportSenders = []ReportSender{senderFunc(func(report *Report) error {
+			webhooks = append(webhooks, report)
+			return nil
+		})}
+		defer func() { recv.ReportSenders = nil }()
+
+		end := time.Now().UTC().Add(time.Minute)
+		assert.NoError(t, recv.GenerateReports(end))
+		assert.Greater(t, provider.Calls(), calls, "the model summarizes the reports")
+		var report *Report
+		for _, r := range webhooks {
+			if r.DBName == msg.GetDBName() {
+				report = r
+			}
+		}
+		assert.NotNil(t, report)
+		assert.Positive(t, report.ID)
+		assert.Equal(t, "low", report.Severity)
+		assert.Contains(t, report.Markdown, "keep watching")
+
+		// reports of a period are only generated once
+		sent := len(webhooks)
+		assert.NoError(t, recv.GenerateReports(end))
+		assert.Len(t, webhooks, sent)
+
+		var markdown string
+		err = conn.QueryRow(ctx, "SELECT markdown FROM reports WHERE id = $1", report.ID).Scan(&markdown)
+		assert.NoError(t, err)
+		assert.Equal(t, report.Markdown, markdown)
+
+		server := httptest.NewServer(NewAPI(recv.ConnPool, recv.Insights, ""))
+		defer server.Close()
+		resp, err := http.Get(fmt.Sprintf("%s/api/databases/%d/reports", server.URL, report.DatabaseID))
+		assert.NoError(t, err)
+		var page reportPage
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&page))
+		_ = resp.Body.Close()
+		assert.Equal(t, int64(1), page.Total)
+		assert.Equal(t, report.ID, page.Reports[0].ID)
+
+		resp, err = http.Get(fmt.Sprintf("%s/api/reports/%d?format=markdown", server.URL, report.ID))
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		assert.Equal(t, report.Markdown, string(body))
+	})
+
+	t.Run("Insights API", func(t *testing.T) {
+		server := httptest.NewServer(NewAPI(recv.ConnPool, recv.Insights, ""))
+		defer server.Close()
+
+		get := func(path string, v any) int {
+			resp, err := http.Get(server.URL + path)
+			assert.NoError(t, err)
+			defer func() { _ = resp.Body.Close() }()
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+			return resp.StatusCode
+		}
+
+		var databases []databaseRecord
+		assert.Equal(t, http.StatusOK, get("/api/databases", &databases))
+		assert.NotEmpty(t, databases)
+		var db databaseRecord
+		for _, d := range databases {
+			if d.Name == msg.GetDBName() {
+				db = d
+			}
+		}
+		assert.Positive(t, db.MeasurementCount)
+		assert.Positive(t, db.InsightCount)
+
+		var page insightPage
+		assert.Equal(t, http.StatusOK, get(fmt.Sprintf("/api/databases/%d/insights?limit=1", db.ID), &page))
+		assert.Equal(t, db.InsightCount, page.Total)
+		assert.Len(t, page.Insights, 1)
+
+		assert.Equal(t, http.StatusOK, get(fmt.Sprintf("/api/databases/%d/metrics/testMetric/insights", db.ID), &page))
+		assert.NotEmpty(t, page.Insights)
+		for _, insight := range page.Insights {
+			assert.Equal(t, "testMetric", insight.MetricName)
+		}
+		first := page.Insights[len(page.Insights)-1]
+		assert.Equal(t, "low", first.Severity)
+		assert.Equal(t, "keep watching", first.Findings[0].Recommendation)
+
+		future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+		assert.Equal(t, http.StatusOK, get(fmt.Sprintf("/api/databases/%d/insights?from=%s", db.ID, future), &page))
+		assert.Zero(t, page.Total)
+		assert.Empty(t, page.Insights)
+
+		var insight InsightRecord
+		assert.Equal(t, http.StatusOK, get(fmt.Sprintf("/api/insights/%d", first.ID), &insight))
+		assert.Equal(t, first.Summary, insight.Summary)
+
+		var apiErr map[string]string
+		assert.Equal(t, http.StatusNotFound, get("/api/insights/0", &apiErr))
+		assert.Equal(t, http.StatusBadRequest, get(fmt.Sprintf("/api/databases/%d/insights?limit=0", db.ID), &apiErr))
+	})
+
+	t.Run("Job queue", func(t *testing.T) {
+		server := httptest.NewServer(NewAPI(recv.ConnPool, recv.Insights, ""))
+		defer server.Close()
+		getJob := func(id int64) (job Job) {
+			resp, err := http.Get(fmt.Sprintf("%s/api/jobs/%d", server.URL, id))
+			assert.NoError(t, err)
+			defer func() { _ = resp.Body.Close() }()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&job))
+			return job
+		}
+
+		// jobs of a metric within the cooldown are merged or dropped
+		recv.Jobs.Cooldown = time.Hour
+		first, err := recv.EnqueueInsight(msg.GetDBName(), "queued", []Anomaly{{MetricName: "queued", Field: "a"}})
+		assert.NoError(t, err)
+		assert.Positive(t, first)
+		second, err := recv.EnqueueInsight(msg.GetDBName(), "queued", []Anomaly{{MetricName: "queued", Field: "b"}})
+		assert.NoError(t, err)
+		assert.Contains(t, []int64{0, first}, second)
+		recv.Jobs.Cooldown = 0
+		assert.NoError(t, recv.WaitForJobs())
+
+		var jobs int
+		err = conn.QueryRow(ctx, "SELECT COUNT(*) FROM insight_jobs WHERE metric_name = 'queued'").Scan(&jobs)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, jobs)
+		job := getJob(first)
+		assert.Equal(t, JobDone, job.Status)
+		assert.Equal(t, 1, job.Attempts)
+		assert.NotNil(t, job.InsightID)
+		assert.Equal(t, "a", job.Anomalies[0].Field)
+
+		// failed attempts are retried until the job runs out of attempts
+		provider.Err = errors.New("model unavailable")
+		failing, err := recv.EnqueueInsight(msg.GetDBName(), msg.GetMetricName(), nil)
+		assert.NoError(t, err)
+		assert.NoError(t, recv.WaitForJobs())
+		provider.Err = nil
+
+		job = getJob(failing)
+		assert.Equal(t, JobFailed, job.Status)
+		assert.Equal(t, 2, job.Attempts)
+		assert.Nil(t, job.InsightID)
+		if assert.NotNil(t, job.LastError) {
+			assert.Contains(t, *job.LastError, "model unavailable")
+		}
+
+		var page jobPage
+		resp, err := http.Get(fmt.Sprintf("%s/api/databases/%d/jobs?status=failed", server.URL, job.DatabaseID))
+		assert.NoError(t, err)
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&page))
+		_ = resp.Body.Close()
+		assert.Equal(t, int64(1), page.Total)
+		assert.Equal(t, failing, page.Jobs[0].ID)
+
+		resp, err = http.Get(fmt.Sprintf("%s/api/databases/%d/jobs?status=unknown", server.URL, job.DatabaseID))
+		assert.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		resp, err = http.Get(server.URL + "/api/jobs/0")
+		assert.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("Provider errors", func(t *testing.T) {
+		provider.Err = errors.New("model unavailable")
+		defer func() { provider.Err = nil }()
+
+		err := recv.GenerateInsights(msg, nil)
+		assert.ErrorContains(t, err, "model unavailable")
+	})
+}
+
+type senderFunc func(report *Report) error
+
+func (f senderFunc) Send(_ context.Context, report *Report) error {
+	return f(report)
+}
+
+// legacySchema are the tables created by receivers before migrations
+const legacySchema = `
+CREATE TABLE db(id BIGSERIAL PRIMARY KEY, dbname TEXT);
+CREATE TABLE measurements (
+	created_at TIMESTAMP NOT NULL DEFAULT(NOW() AT TIME ZONE 'UTC'),
+	data JSONB,
+	metric_name TEXT,
+	database_id SERIAL,
+	FOREIGN KEY (database_id) REFERENCES db(id) ON DELETE CASCADE
+);
+CREATE TABLE insights(
+	insight_data TEXT,
+	database_id BIGSERIAL,
+	created_at TIMESTAMP NOT NULL DEFAULT(NOW() AT TIME ZONE 'UTC'),
+	FOREIGN KEY (database_id) REFERENCES db(id) ON DELETE CASCADE
+);
+INSERT INTO db(dbname) VALUES ('test'), ('test'), ('other');
+INSERT INTO measurements(data, metric_name, database_id) VALUES ('[{"key": 1}]', 'm', 1), ('[{"key": 2}]', 'm', 2), ('[{"key": 3}]', 'm', 3);
+INSERT INTO insights(insight_data, database_id) VALUES ('first', 1), ('second', 2);
+`
+
+func TestLegacyMigration(t *testing.T) {
+	conn, err := pgx.Connect(ctx, pgConnectionStr)
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close(ctx) }()
+	_, err = conn.Exec(ctx, "CREATE DATABASE legacy")
+	assert.NoError(t, err)
+
+	cfg, err := pgx.ParseConfig(pgConnectionStr)
+	assert.NoError(t, err)
+	cfg.Database = "legacy"
+	legacy, err := pgx.ConnectConfig(ctx, cfg)
+	assert.NoError(t, err)
+	defer func() { _ = legacy.Close(ctx) }()
+
+	_, err = legacy.Exec(ctx, legacySchema)
+	assert.NoError(t, err)
+	assert.NoError(t, schema.Migrate(ctx, legacy))
+
+	// duplicates are merged into the lowest id
+	var dbs, measurements, insights int
+	err = legacy.QueryRow(ctx, "SELECT COUNT(*) FROM db").Scan(&dbs)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, dbs)
+	err = legacy.QueryRow(ctx, "SELECT COUNT(*) FROM measurements WHERE database_id = 1").Scan(&measurements)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, measurements)
+	err = legacy.QueryRow(ctx, "SELECT COUNT(*) FROM insights WHERE database_id = 1").Scan(&insights)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, insights)
+
+	_, err = legacy.Exec(ctx, "INSERT INTO db(dbname) VALUES ('test')")
+	assert.ErrorContains(t, err, "db_dbname_key")
+
+	// existing rows got primary keys, database_id has no default anymore
+	var ids int
+	err = legacy.QueryRow(ctx, "SELECT COUNT(DISTINCT id) FROM measurements").Scan(&ids)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, ids)
+	_, err = legacy.Exec(ctx, "INSERT INTO measurements(data, metric_name) VALUES ('[]', 'm')")
+	assert.ErrorContains(t, err, "database_id")
+}
+
+func TestInsightFilter(t *testing.T) {
+	parse := func(target string) (InsightFilter, error) {
+		mux := http.NewServeMux()
+		var filter InsightFilter
+		var err error
+		mux.HandleFunc("GET /api/databases/{id}/insights", func(_ http.ResponseWriter, r *http.Request) {
+			filter, err = parseInsightFilter(r)
+		})
+		mux.HandleFunc("GET /api/databases/{id}/metrics/{metric}/insights", func(_ http.ResponseWriter, r *http.Request) {
+			filter, err = parseInsightFilter(r)
+		})
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+		return filter, err
+	}
+
+	filter, err := parse("/api/databases/3/insights")
+	assert.NoError(t, err)
+	assert.Equal(t, InsightFilter{DatabaseID: 3, Limit: defaultPageSize}, filter)
+	conditions, args := filter.where()
+	assert.Equal(t, "insights.database_id = $1", conditions)
+	assert.Equal(t, []any{int64(3)}, args)
+
+	filter, err = parse("/api/databases/3/metrics/locks/insights?limit=10&offset=20&from=2024-01-02T15:04:05Z&min_severity=high")
+	assert.NoError(t, err)
+	assert.Equal(t, "locks", filter.MetricName)
+	assert.Equal(t, 10, filter.Limit)
+	assert.Equal(t, 20, filter.Offset)
+	assert.Equal(t, time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC), filter.From)
+	conditions, args = filter.where()
+	assert.Equal(t, "insights.database_id = $1 AND insights.metric_name = $2 AND insights.created_at >= $3 AND insights.severity_level >= $4", conditions)
+	assert.Equal(t, severityLevel("high"), args[3])
+
+	for _, target := range []string{
+		"/api/databases/x/insights",
+		"/api/databases/3/insights?limit=0",
+		"/api/databases/3/insights?limit=100000",
+		"/api/databases/3/insights?offset=-1",
+		"/api/databases/3/insights?to=yesterday",
+		"/api/databases/3/insights?min_severity=urgent",
+	} {
+		_, err = parse(target)
+		assert.Error(t, err, target)
+	}
+}
+
+func TestInsightStream(t *testing.T) {
+	broadcaster := NewInsightBroadcaster()
+	server := httptest.NewServer(NewAPI(nil, broadcaster, "http://localhost:3000"))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/insights/stream?db_id=1&min_severity=medium")
+	assert.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "http://localhost:3000", resp.Header.Get("Access-Control-Allow-Origin"))
+
+	// filtered out by database and severity
+	broadcaster.Publish(InsightRecord{ID: 1, DatabaseID: 2, Severity: "high"})
+	broadcaster.Publish(InsightRecord{ID: 2, DatabaseID: 1, Severity: "low"})
+	broadcaster.Publish(InsightRecord{ID: 3, DatabaseID: 1, MetricName: "locks", Severity: "high", Summary: "Lock waits"})
+
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		assert.NoError(t, err)
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	assert.Equal(t, "id: 3", lines[0])
+	assert.Equal(t, "event: insight", lines[1])
+	var insight InsightRecord
+	assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &insight))
+	assert.Equal(t, "Lock waits", insight.Summary)
+
+	_ = resp.Body.Close()
+	assert.Eventually(t, func() bool {
+		broadcaster.mu.Lock()
+		defer broadcaster.mu.Unlock()
+		return len(broadcaster.subscribers) == 0
+	}, 5*time.Second, 10*time.Millisecond, "subscription must end with the request")
+}
+
+func TestOllamaProvider(t *testing.T) {
+	var request map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/chat", r.URL.Path)
+		_ = json.NewDecoder(r.Body).Decode(&request)
+		_, _ = w.Write([]byte(`{"model":"tinyllama","message":{"role":"assistant","content":"insight"},"done":true}`))
+	}))
+	defer server.Close()
+
+	provider, err := NewProvider(ProviderConfig{
+		Kind:        ProviderOllama,
+		URL:         server.URL,
+		Model:       "tinyllama",
+		Temperature: 0.5,
+		MaxTokens:   100,
+		Timeout:     time.Second,
+		JSON:        true,
+	})
+	assert.NoError(t, err)
+
+	reply, err := provider.Chat(ctx, []Message{{Role: RoleUser, Content: "hi"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "insight", reply)
+	assert.Equal(t, "tinyllama", request["model"])
+	assert.Equal(t, false, request["stream"])
+	assert.Equal(t, "json", request["format"])
+	assert.Equal(t, map[string]any{"temperature": 0.5, "num_predict": 100.0}, request["options"])
+}
+
+func TestOpenAIProvider(t *testing.T) {
+	var request map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/chat/completions", r.URL.Path)
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		_ = json.NewDecoder(r.Body).Decode(&request)
+		_, _ = w.Write([]byte(`{"choices":[{"index":0,"message":{"role":"assistant","content":"insight"}}]}`))
+	}))
+	defer server.Close()
+
+	provider, err := NewProvider(ProviderConfig{
+		Kind:      ProviderOpenAI,
+		URL:       server.URL + "/v1/",
+		APIKey:    "secret",
+		Model:     "qwen2.5",
+		MaxTokens: 200,
+		Timeout:   time.Second,
+	})
+	assert.NoError(t, err)
+
+	reply, err := provider.Chat(ctx, []Message{{Role: RoleUser, Content: "hi"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "insight", reply)
+	assert.Equal(t, "qwen2.5", request["model"])
+	assert.Equal(t, 200.0, request["max_tokens"])
+
+	// server errors are returned
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "model not found", http.StatusNotFound)
+	})
+	_, err = provider.Chat(ctx, []Message{{Role: RoleUser, Content: "hi"}})
+	assert.ErrorContains(t, err, "model not found")
+
+	_, err = NewProvider(ProviderConfig{Kind: "unknown", Timeout: time.Second})
+	assert.Error(t, err)
+}
+
+func TestPromptLibrary(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	measurements := []MeasurementsData{
+		{metricName: "stat_statements", createdAt: now, data: `[
+			{"query": "SELECT * FROM orders", "calls": 10, "total_exec_time": 5000, "mean_exec_time": 500},
+			{"query": "SELECT 1", "calls": 1000, "total_exec_time": 10, "mean_exec_time": 0.01}]`},
+		{metricName: "stat_statements", createdAt: now.Add(-time.Minute), data: `[
+			{"query": "SELECT * FROM orders", "calls": 5, "total_exec_time": 2500, "mean_exec_time": 500}]`},
+	}
+
+	data, err := newPromptData("test", "stat_statements", measurements)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(-time.Minute), data.From)
+	assert.Len(t, data.Samples, 3)
+	assert.Len(t, data.Latest, 2)
+
+	// statistics are computed over all rows, oldest first
+	calls := data.Summary[0]
+	assert.Equal(t, "calls", calls.Field)
+	assert.Equal(t, 3, calls.Count)
+	assert.Equal(t, 5.0, calls.First)
+	assert.Equal(t, 1000.0, calls.Last)
+	assert.Equal(t, 1000.0, calls.Max)
+	assert.InDelta(t, 338.33, calls.Mean, 0.01)
+
+	lib, err := LoadPromptLibrary("")
+	assert.NoError(t, err)
+	prompt, err := lib.Render(data)
+	assert.NoError(t, err)
+	assert.Contains(t, prompt, "pg_stat_statements")
+	// statements are ordered by total execution time
+	assert.Less(t, strings.Index(prompt, "SELECT * FROM orders"), strings.Index(prompt, "SELECT 1"))
+
+	// other metrics use the default template
+	data.MetricName = "wal"
+	prompt, err = lib.Render(data)
+	assert.NoError(t, err)
+	assert.Contains(t, prompt, `measurements of the metric "wal"`)
+	assert.Contains(t, prompt, "- calls: 3, 5, 1000, 338.3, 5, 1000")
+
+	// hourly summaries of older measurements are added for comparison
+	data.History = []FieldHistory{{Field: "calls", Series: "queryid=1", Hours: 24, Min: 1, Max: 20, Avg: 7.5}}
+	data.HistoryFrom = now.Add(-7 * 24 * time.Hour)
+	prompt, err = lib.Render(data)
+	assert.NoError(t, err)
+	assert.Contains(t, prompt, "summarized per hour since 2024-12-25 12:00 UTC")
+	assert.Contains(t, prompt, "- calls (queryid=1): 24, 1, 20, 7.5")
+	data.History = nil
+
+	// templates in the prompt directory replace built-in ones
+	dir := t.TempDir()
+	err = os.WriteFile(filepath.Join(dir, "wal.tmpl"), []byte(`{{.DBName}} {{.MetricName}} {{range .Summary}}{{.Field}}={{num .Change}} {{end}}`), 0644)
+	assert.NoError(t, err)
+	lib, err = LoadPromptLibrary(dir)
+	assert.NoError(t, err)
+	prompt, err = lib.Render(data)
+	assert.NoError(t, err)
+	assert.Equal(t, "test wal calls=995 mean_exec_time=-500 total_exec_time=-2490 ", prompt)
+
+	err = os.WriteFile(filepath.Join(dir, "broken.tmpl"), []byte(`{{.DBName`), 0644)
+	assert.NoError(t, err)
+	_, err = LoadPromptLibrary(dir)
+	assert.Error(t, err)
+}
+
+func TestDetector(t *testing.T) {
+	envelope := func(fields map[string]any) *pb.MeasurementEnvelope {
+		msg := testutils.GetTestMeasurementEnvelope()
+		row, err := structpb.NewStruct(fields)
+		assert.NoError(t, err)
+		msg.Data = []*structpb.Struct{row}
+		return msg
+	}
+
+	for _, method := range []string{DetectorEWMA, DetectorMAD} {
+		t.Run(method, func(t *testing.T) {
+			detector, err := NewDetector(DetectorConfig{Method: method, Threshold: 3.5, Alpha: 0.1, Window: 30, WarmUp: 10})
+			assert.NoError(t, err)
+
+			// noise and steadily growing counters are routine
+			for i := range 50 {
+				anomalies := detector.Observe(envelope(map[string]any{
+					"load":  10 + float64(i%3),
+					"calls": float64(i * 100),
+					"name":  "ignored",
+				}))
+				assert.Empty(t, anomalies, "value %d", i)
+			}
+
+			anomalies := detector.Observe(envelope(map[string]any{"load": 50, "calls": 5000}))
+			assert.Len(t, anomalies, 1)
+			assert.Equal(t, "load", anomalies[0].Field)
+			assert.Equal(t, 50.0, anomalies[0].Value)
+			assert.InDelta(t, 11, anomalies[0].Baseline, 1)
+			assert.Greater(t, anomalies[0].Score, 3.5)
+			assert.Equal(t, method, anomalies[0].Method)
+		})
+	}
+
+	t.Run("series", func(t *testing.T) {
+		detector, err := NewDetector(DetectorConfig{Method: DetectorEWMA, Threshold: 3.5, Alpha: 0.1, WarmUp: 10})
+		assert.NoError(t, err)
+
+		// rows are told apart by their tags, new series are warming up
+		for i := range 20 {
+			assert.Empty(t, detector.Observe(envelope(map[string]any{"tag_queryid": "1", "mean_time": 1 + float64(i%2)})))
+			assert.Empty(t, detector.Observe(envelope(map[string]any{"tag_queryid": "2", "mean_time": 1000 + float64(i%2)})))
+		}
+		assert.Empty(t, detector.Observe(envelope(map[string]any{"tag_queryid": "3", "mean_time": 5000})))
+
+		anomalies := detector.Observe(envelope(map[string]any{"tag_queryid": "1", "mean_time": 1000}))
+		assert.Len(t, anomalies, 1)
+		assert.Equal(t, "queryid=1", anomalies[0].Series)
+	})
+
+	detector, err := NewDetector(DetectorConfig{Method: DetectorNone})
+	assert.NoError(t, err)
+	assert.Nil(t, detector)
+
+	_, err = NewDetector(DetectorConfig{Method: "unknown"})
+	assert.Error(t, err)
+}
+
+func TestJobQueueConfig(t *testing.T) {
+	cfg := JobQueueConfig{Workers: 1, MaxAttempts: 5, Backoff: 30 * time.Second, MaxBackoff: 2 * time.Minute}
+	assert.NoError(t, cfg.Validate())
+	assert.Equal(t, 30*time.Second, cfg.backoff(1))
+	assert.Equal(t, time.Minute, cfg.backoff(2))
+	assert.Equal(t, 2*time.Minute, cfg.backoff(3))
+	assert.Equal(t, 2*time.Minute, cfg.backoff(10))
+
+	assert.Error(t, (&JobQueueConfig{MaxAttempts: 1}).Validate())
+	assert.Error(t, (&JobQueueConfig{Workers: 1}).Validate())
+	assert.Error(t, (&JobQueueConfig{Workers: 1, MaxAttempts: 1, Backoff: time.Minute}).Validate())
+	assert.Error(t, (&JobQueueConfig{Workers: 1, MaxAttempts: 1, Cooldown: -time.Minute}).Validate())
+}
+
+func TestSummarizeHistory(t *testing.T) {
+	hour := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	history := summarizeHistory([]HourlyRollup{
+		{Field: "calls", Bucket: hour, Count: 1, Min: 10, Max: 10, Avg: 10},
+		{Field: "calls", Bucket: hour.Add(time.Hour), Count: 3, Min: 2, Max: 30, Avg: 20},
+		{Field: "calls", Series: "queryid=1", Bucket: hour, Count: 2, Min: 1, Max: 3, Avg: 2},
+		{Field: "blks_hit", Bucket: hour.Add(2 * time.Hour), Count: 1, Min: 5, Max: 5, Avg: 5},
+	})
+
+	assert.Len(t, history, 3)
+	assert.Equal(t, "blks_hit", history[0].Field)
+	calls := history[1]
+	assert.Equal(t, "", calls.Series)
+	assert.Equal(t, 2, calls.Hours)
+	assert.Equal(t, hour, calls.From)
+	assert.Equal(t, hour.Add(2*time.Hour), calls.To)
+	assert.Equal(t, 2.0, calls.Min)
+	assert.Equal(t, 30.0, calls.Max)
+	// weighted by the measurements per hour
+	assert.InDelta(t, 17.5, calls.Avg, 1e-9)
+	assert.Equal(t, "queryid=1", history[2].Series)
+
+	cfg := RetentionConfig{Raw: time.Hour, PerDB: map[string]time.Duration{"big": time.Minute, "keep": 0}}
+	assert.Error(t, cfg.Validate(), "interval is required")
+	cfg.Interval = time.Minute
+	assert.NoError(t, cfg.Validate())
+	assert.Equal(t, time.Minute, cfg.retention("big"))
+	assert.Equal(t, time.Duration(0), cfg.retention("keep"))
+	assert.Equal(t, time.Hour, cfg.retention("other"))
+}
+
+func TestReportSchedule(t *testing.T) {
+	vienna, err := time.LoadLocation("Europe/Vienna")
+	assert.NoError(t, err)
+
+	daily := ReportConfig{Period: ReportDaily, At: "07:00", Location: vienna}
+	assert.NoError(t, daily.Validate())
+	now := time.Date(2025, 3, 5, 6, 30, 0, 0, vienna) // a Wednesday
+	next := daily.next(now)
+	assert.Equal(t, time.Date(2025, 3, 5, 7, 0, 0, 0, vienna), next)
+	assert.Equal(t, time.Date(2025, 3, 4, 7, 0, 0, 0, vienna), daily.start(next))
+	assert.Equal(t, time.Date(2025, 3, 6, 7, 0, 0, 0, vienna), daily.next(next))
+
+	weekly := ReportConfig{Period: ReportWeekly, At: "07:00", Weekday: time.Monday}
+	next = weekly.next(now)
+	assert.Equal(t, time.Date(2025, 3, 10, 7, 0, 0, 0, time.UTC), next)
+	assert.Equal(t, time.Date(2025, 3, 3, 7, 0, 0, 0, time.UTC), weekly.start(next))
+	assert.Equal(t, time.Date(2025, 3, 17, 7, 0, 0, 0, time.UTC), weekly.next(next))
+
+	assert.Error(t, (&ReportConfig{Period: "hourly", At: "07:00"}).Validate())
+	assert.Error(t, (&ReportConfig{Period: ReportDaily, At: "7am"}).Validate())
+	assert.Error(t, (&ReportConfig{Period: ReportDaily, At: "07:00", SMTP: SMTPConfig{Addr: "localhost:25"}}).Validate())
+	assert.NoError(t, (&ReportConfig{Period: ReportNone}).Validate())
+}
+
+func TestReportDelivery(t *testing.T) {
+	to := time.Date(2025, 3, 5, 7, 0, 0, 0, time.UTC)
+	report := &Report{
+		ID:         7,
+		DBName:     "orders",
+		Period:     ReportDaily,
+		From:       to.AddDate(0, 0, -1),
+		To:         to,
+		Severity:   "high",
+		Summary:    "Lock contention on <orders> peaked at night.",
+		Insights:   2,
+		Severities: []SeverityCount{{"high", 1}, {"low", 1}},
+		Findings: []ReportFinding{{
+			Finding:    Finding{Severity: "high", AffectedObject: "orders", Evidence: "12 waiting locks", Recommendation: "shorten transactions"},
+			MetricName: "locks",
+			CreatedAt:  to.Add(-5 * time.Hour),
+		}},
+		MoreFindings: 1,
+		Anomalies:    []MetricAnomalies{{Anomaly: Anomaly{MetricName: "locks", Field: "waiting", Value: 12, Baseline: 0.5, Score: 9.2}, Count: 3}},
+	}
+	assert.NoError(t, report.render())
+	assert.Contains(t, report.Markdown, "# Daily digest of orders")
+	assert.Contains(t, report.Markdown, "2 insights reported 1 high, 1 low findings.")
+	assert.Contains(t, report.Markdown, "- **high** `orders` in locks at Mar 5 02:00: 12 waiting locks\n  Recommendation: shorten transactions")
+	assert.Contains(t, report.Markdown, "1 less severe findings are not listed.")
+	assert.Contains(t, report.Markdown, "- locks: 3 anomalies, the largest waiting was 12 with a baseline of 0.5 (score 9.2)")
+	assert.Contains(t, report.HTML, "<h1>Daily digest of orders</h1>")
+	assert.Contains(t, report.HTML, "Lock contention on &lt;orders&gt; peaked at night.")
+
+	t.Run("webhook", func(t *testing.T) {
+		var received map[string]any
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/missing" {
+				http.NotFound(w, r)
+				return
+			}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+
+		sender := &WebhookSender{URL: server.URL, Client: server.Client()}
+		assert.NoError(t, sender.Send(ctx, report))
+		assert.Equal(t, "orders", received["dbname"])
+		assert.Equal(t, "2025-03-04T07:00:00Z", received["period_start"])
+		assert.Equal(t, report.Markdown, received["markdown"])
+		assert.NotContains(t, received, "Findings")
+
+		sender.URL = server.URL + "/missing"
+		assert.ErrorContains(t, sender.Send(ctx, report), "status 404")
+	})
+
+	t.Run("smtp", func(t *testing.T) {
+		addr, mails := testutils.StartSMTPServer(t)
+		senders := newReportSenders(ReportConfig{SMTP: SMTPConfig{Addr: addr, From: "pgwatch@example.com", To: []string{"dba@example.com", "oncall@example.com"}}})
+		assert.Len(t, senders, 1)
+		assert.NoError(t, senders[0].Send(ctx, report))
+
+		var raw string
+		select {
+		case raw = <-mails:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no mail received")
+		}
+		msg, err := mail.ReadMessage(strings.NewReader(raw))
+		assert.NoError(t, err)
+		assert.Equal(t, "Daily pgwatch digest of orders: 2025-03-05", msg.Header.Get("Subject"))
+		assert.Equal(t, "dba@example.com, oncall@example.com", msg.Header.Get("To"))
+
+		mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		assert.NoError(t, err)
+		assert.Equal(t, "multipart/alternative", mediaType)
+		parts := multipart.NewReader(msg.Body, params["boundary"])
+		for _, contentType := range []string{"text/plain; charset=utf-8", "text/html; charset=utf-8"} {
+			part, err := parts.NextPart()
+			assert.NoError(t, err)
+			assert.Equal(t, contentType, part.Header.Get("Content-Type"))
+			content, err := io.ReadAll(part)
+			assert.NoError(t, err)
+			assert.Contains(t, string(content), "Lock contention on")
+		}
+	})
+}
+
+func TestParseInsight(t *testing.T) {
+	insight, err := ParseInsight("Here you go:\n```json\n" + `{
+		"summary": "Lock contention on orders.",
+		"findings": [
+			{"severity": "Medium", "affected_object": "idx_orders", "evidence": "unused", "recommendation": "drop it"},
+			{"severity": "critical", "affected_object": "orders", "evidence": "12 waiting locks", "recommendation": "shorten transactions"}
+		]}` + "\n```")
+	assert.NoError(t, err)
+	assert.Equal(t, "Lock contention on orders.", insight.Summary)
+	assert.Equal(t, "critical", insight.Severity())
+	// most severe first, severities are normalized
+	assert.Equal(t, "orders", insight.Findings[0].AffectedObject)
+	assert.Equal(t, "medium", insight.Findings[1].Severity)
+
+	insight, err = ParseInsight(`{"summary": "All good.", "findings": []}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "info", insight.Severity())
+
+	_, err = ParseInsight("- everything is fine")
+	assert.ErrorContains(t, err, "no JSON object")
+	_, err = ParseInsight(`{"summary": "x", "findings": [{"severity": "urgent", "affected_object": "t"}]}`)
+	assert.ErrorContains(t, err, `severity "urgent"`)
+	assert.ErrorContains(t, err, "evidence is missing")
+}
+
+func TestInsightRepair(t *testing.T) {
+	provider := &FakeProvider{Responses: []string{
+		"The database looks fine.",
+		`{"summary": "The database looks fine.", "findings": []}`,
+	}}
+	recv := &LLamaReceiver{Provider: provider, Ctx: ctx, Repairs: 1}
+
+	insight, err := recv.chatInsight("prompt")
+	assert.NoError(t, err)
+	assert.Equal(t, "The database looks fine.", insight.Summary)
+
+	// the malformed reply is sent back with the validation error
+	repair := provider.Chats[1]
+	assert.Len(t, repair, 4)
+	assert.Equal(t, RoleAssistant, repair[2].Role)
+	assert.Equal(t, "The database looks fine.", repair[2].Content)
+	assert.Contains(t, repair[3].Content, "no JSON object found")
+
+	provider = &FakeProvider{Responses: []string{"not json"}}
+	recv.Provider = provider
+	_, err = recv.chatInsight("prompt")
+	assert.ErrorContains(t, err, "after 2 attempts")
+	assert.Equal(t, 2, provider.Calls())
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+)
+
+// defaultTemplate renders prompts of metrics without their own template
+const defaultTemplate = "default"
+
+//go:embed prompts/*.tmpl
+var builtinPrompts embed.FS
+
+// ContextWindow limits the measurements a prompt is built from
+type ContextWindow struct {
+	Rows     int           // most recent measurements used, 0 for no limit
+	Duration time.Duration // only measurements received within this duration, 0 for no limit
+	History  time.Duration // hourly summaries of older measurements within this duration, 0 for none
+}
+
+func (w *ContextWindow) Validate() error {
+	if w.Rows < 0 || w.Duration < 0 || w.History < 0 {
+		return errors.New("context window must not be negative")
+	}
+	if w.Rows == 0 && w.Duration == 0 {
+		return errors.New("context window needs a row count or a duration")
+	}
+	return nil
+}
+
+// PromptLibrary holds a prompt template per metric name
+type PromptLibrary struct {
+	templates map[string]*template.Template
+}
+
+// LoadPromptLibrary loads the built-in templates, then the <metric>.tmpl
+// files in dir, which replace built-in templates of the same name
+func LoadPromptLibrary(dir string) (*PromptLibrary, error) {
+	lib := &PromptLibrary{templates: make(map[string]*template.Template)}
+
+	builtin, err := fs.Sub(builtinPrompts, "prompts")
+	if err != nil {
+		return nil, err
+	}
+	if err = lib.load(builtin); err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		if err = lib.load(os.DirFS(dir)); err != nil {
+			return nil, fmt.Errorf("unable to load prompt templates from %s: %w", dir, err)
+		}
+	}
+	return lib, nil
+}
+
+func (l *PromptLibrary) load(fsys fs.FS) error {
+	files, err := fs.Glob(fsys, "*.tmpl")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		text, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(file, filepath.Ext(file))
+		tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(string(text))
+		if err != nil {
+			return err
+		}
+		l.templates[name] = tmpl
+	}
+	return nil
+}
+
+// Render returns the prompt for data using the template of its metric
+func (l *PromptLibrary) Render(data *PromptData) (string, error) {
+	tmpl, ok := l.templates[data.MetricName]
+	if !ok {
+		tmpl, ok = l.templates[defaultTemplate]
+	}
+	if !ok {
+		return "", fmt.Errorf("no prompt template for %s and no %s template", data.MetricName, defaultTemplate)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("unable to render prompt template %s: %w", tmpl.Name(), err)
+	}
+	return buf.String(), nil
+}
+
+// PromptData is passed to prompt templates
+type PromptData struct {
+	DBName      string
+	MetricName  string
+	From, To    time.Time        // time span of the measurements
+	Snapshots   int              // measurements in the context window
+	Latest      []map[string]any // rows of the most recent measurement
+	Samples     []Sample         // all rows in the context window, oldest first
+	Summary     []FieldSummary   // statistics of the numeric fields
+	Anomalies   []Anomaly        // values that triggered the insight
+	History     []FieldHistory   // hourly summaries of measurements removed by retention
+	HistoryFrom time.Time        // start of the oldest hourly summary
+}
+
+type Sample struct {
+	Time time.Time
+	Data map[string]any
+}
+
+// FieldSummary describes a numeric field over the context window
+type FieldSummary struct {
+	Field string
+	Count int
+	Min   float64
+	Max   float64
+	Mean  float64
+	First float64
+	Last  float64
+}
+
+// Change returns how much the field changed over the context window
+func (s FieldSummary) Change() float64 {
+	return s.Last - s.First
+}
+
+// newPromptData builds the template data from measurements ordered newest
+// first, as returned by GetAllMeasurements
+func newPromptData(dbName, metricName string, measurements []MeasurementsData) (*PromptData, error) {
+	data := &PromptData{DBName: dbName, MetricName: metricName, Snapshots: len(measurements)}
+
+	for i := len(measurements) - 1; i >= 0; i-- {
+		measurement := measurements[i]
+		var rows []map[string]any
+		if err := json.Unmarshal([]byte(measurement.data), &rows); err != nil {
+			return nil, fmt.Errorf("invalid measurement data: %w", err)
+		}
+		for _, row := range rows {
+			data.Samples = append(data.Samples, Sample{Time: measurement.createdAt, Data: row})
+		}
+		if i == 0 {
+			data.Latest = rows
+		}
+	}
+
+	if len(measurements) > 0 {
+		data.From = measurements[len(measurements)-1].createdAt
+		data.To = measurements[0].createdAt
+	}
+	data.Summary = summarize(data.Samples)
+	return data, nil
+}
+
+// summarize computes statistics of all numeric fields in samples
+func summarize(samples []Sample) []FieldSummary {
+	summaries := make(map[string]*FieldSummary)
+	for _, sample := range samples {
+		for field, value := range sample.Data {
+			v, ok := value.(float64)
+			if !ok || field == "epoch_ns" {
+				continue
+			}
+			s, ok := summaries[field]
+			if !ok {
+				s = &FieldSummary{Field: field, Min: v, Max: v, First: v}
+				summaries[field] = s
+			}
+			s.Count++
+			s.Min = math.Min(s.Min, v)
+			s.Max = math.Max(s.Max, v)
+			s.Mean += (v - s.Mean) / float64(s.Count)
+			s.Last = v
+		}
+	}
+
+	result := make([]FieldSummary, 0, len(summaries))
+	for _, field := range sinks.SortedKeys(summaries) {
+		result = append(result, *summaries[field])
+	}
+	return result
+}
+
+var templateFuncs = template.FuncMap{
+	// json encodes v compactly
+	"json": func(v any) string {
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return err.Error()
+		}
+		return string(encoded)
+	},
+	// num formats a number with up to 4 significant digits
+	"num": func(v any) string {
+		if v == nil {
+			return "n/a"
+		}
+		if f, ok := v.(float64); ok {
+			return fmt.Sprintf("%.4g", f)
+		}
+		return fmt.Sprint(v)
+	},
+	// truncate shortens s to n characters
+	"truncate": func(n int, v any) string {
+		s := fmt.Sprint(v)
+		if len(s) <= n {
+			return s
+		}
+		return s[:n] + "..."
+	},
+	// top returns the n rows with the largest value of field
+	"top": func(n int, field string, rows []map[string]any) []map[string]any {
+		sorted := make([]map[string]any, 0, len(rows))
+		for _, row := range rows {
+			if _, ok := row[field].(float64); ok {
+				sorted = append(sorted, row)
+			}
+		}
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i][field].(float64) > sorted[j][field].(float64)
+		})
+		return sorted[:min(n, len(sorted))]
+	},
+	// last returns the n most recent samples
+	"last": func(n int, samples []Sample) []Sample {
+		return samples[max(0, len(samples)-n):]
+	},
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Provider kinds selectable with -provider
+const (
+	ProviderOllama = "ollama"
+	ProviderOpenAI = "openai"
+	ProviderFake   = "fake"
+)
+
+// Chat roles
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
+
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// Provider sends a conversation to a language model and returns its reply
+type Provider interface {
+	Chat(ctx context.Context, messages []Message) (string, error)
+}
+
+type ProviderConfig struct {
+	Kind        string        // ollama, openai or fake
+	URL         string        // Ollama server or OpenAI compatible base URL, e.g. http://localhost:8080/v1
+	APIKey      string        // sent as bearer token to OpenAI compatible endpoints
+	Model       string        // model name, e.g. tinyllama
+	Temperature float64       // sampling temperature
+	MaxTokens   int           // maximum length of a reply, 0 uses the server default
+	Timeout     time.Duration // timeout of a single request
+	JSON        bool          // ask the server to constrain replies to JSON
+}
+
+func (cfg *ProviderConfig) Validate() error {
+	switch cfg.Kind {
+	case ProviderOllama, ProviderOpenAI:
+		if cfg.URL == "" {
+			return errors.New("LLM server URL is required")
+		}
+		if cfg.Model == "" {
+			return errors.New("model is required")
+		}
+	case ProviderFake:
+	default:
+		return fmt.Errorf("unknown provider %q, expected %s, %s or %s", cfg.Kind, ProviderOllama, ProviderOpenAI, ProviderFake)
+	}
+	if cfg.Temperature < 0 {
+		return errors.New("temperature must not be negative")
+	}
+	if cfg.MaxTokens < 0 {
+		return errors.New("max tokens must not be negative")
+	}
+	if cfg.Timeout <= 0 {
+		return errors.New("timeout must be positive")
+	}
+	return nil
+}
+
+func NewProvider(cfg ProviderConfig) (Provider, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: cfg.Timeout}
+	switch cfg.Kind {
+	case ProviderOllama:
+		return &ollamaProvider{cfg: cfg, client: client}, nil
+	case ProviderOpenAI:
+		return &openAIProvider{cfg: cfg, client: client}, nil
+	}
+	return &FakeProvider{}, nil
+}
+
+// ollamaProvider uses the /api/chat endpoint of an Ollama server
+type ollamaProvider struct {
+	cfg    ProviderConfig
+	client *http.Client
+}
+
+func (p *ollamaProvider) Chat(ctx context.Context, messages []Message) (string, error) {
+	options := map[string]any{"temperature": p.cfg.Temperature}
+	if p.cfg.MaxTokens > 0 {
+		options["num_predict"] = p.cfg.MaxTokens
+	}
+	request := map[string]any{
+		"model":    p.cfg.Model,
+		"messages": messages,
+		"stream":   false,
+		"options":  options,
+	}
+	if p.cfg.JSON {
+		request["format"] = "json"
+	}
+
+	var response struct {
+		Message Message `json:"message"`
+	}
+	if err := postJSON(ctx, p.client, strings.TrimRight(p.cfg.URL, "/")+"/api/chat", "", request, &response); err != nil {
+		return "", fmt.Errorf("ollama chat failed: %w", err)
+	}
+	return response.Message.Content, nil
+}
+
+// openAIProvider uses the chat completions endpoint implemented by OpenAI
+// and compatible servers like llama.cpp server, vLLM and LocalAI
+type openAIProvider struct {
+	cfg    ProviderConfig
+	client *http.Client
+}
+
+func (p *openAIProvider) Chat(ctx context.Context, messages []Message) (string, error) {
+	request := map[string]any{
+		"model":       p.cfg.Model,
+		"messages":    messages,
+		"temperature": p.cfg.Temperature,
+	}
+	if p.cfg.MaxTokens > 0 {
+		request["max_tokens"] = p.cfg.MaxTokens
+	}
+	if p.cfg.JSON {
+		request["response_format"] = map[string]string{"type": "json_object"}
+	}
+
+	var response struct {
+		Choices []struct {
+			Message Message `json:"message"`
+		} `json:"choices"`
+	}
+	url := strings.TrimRight(p.cfg.URL, "/") + "/chat/completions"
+	if err := postJSON(ctx, p.client, url, p.cfg.APIKey, request, &response); err != nil {
+		return "", fmt.Errorf("chat completion failed: %w", err)
+	}
+	if len(response.Choices) == 0 {
+		return "", errors.New("chat completion returned no choices")
+	}
+	return response.Choices[0].Message.Content, nil
+}
+
+func postJSON(ctx context.Context, client *http.Client, url, token string, request, response any) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// FakeProvider replies without a model so the insight pipeline can run
+// offline. It returns Responses in turn, repeating the last one, and
+// records the conversations it received.
+type FakeProvider struct {
+	Responses []string
+	Err       error
+
+	mu    sync.Mutex
+	calls int
+	Chats [][]Message
+}
+
+func (p *FakeProvider) Chat(_ context.Context, messages []Message) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.Chats = append(p.Chats, messages)
+	if p.Err != nil {
+		return "", p.Err
+	}
+	if len(p.Responses) == 0 {
+		return `{"summary": "No issues found in the received measurements.", "findings": []}`, nil
+	}
+	response := p.Responses[min(p.calls, len(p.Responses)-1)]
+	p.calls++
+	return response, nil
+}
+
+// Calls returns the number of conversations received
+func (p *FakeProvider) Calls() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.Chats)
+}
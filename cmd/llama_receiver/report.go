@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Report periods selectable with -reportPeriod
+const (
+	ReportNone   = "none"
+	ReportDaily  = "daily"
+	ReportWeekly = "weekly"
+)
+
+// maxReportFindings limits the findings listed in a report, most severe first
+const maxReportFindings = 20
+
+//go:embed reports/*.tmpl
+var reportTemplates embed.FS
+
+var reportFuncs = template.FuncMap{
+	"num":      templateFuncs["num"],
+	"truncate": templateFuncs["truncate"],
+	"title":    title,
+}
+
+// title capitalizes the first letter of s
+func title(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+var (
+	markdownReport = template.Must(template.New("digest.md.tmpl").Funcs(reportFuncs).ParseFS(reportTemplates, "reports/digest.md.tmpl"))
+	reportPrompt   = template.Must(template.New("prompt.tmpl").Funcs(reportFuncs).ParseFS(reportTemplates, "reports/prompt.tmpl"))
+	htmlReport     = htmltemplate.Must(htmltemplate.New("digest.html.tmpl").Funcs(htmltemplate.FuncMap(reportFuncs)).ParseFS(reportTemplates, "reports/digest.html.tmpl"))
+)
+
+type ReportConfig struct {
+	Period   string         // daily, weekly or none
+	At       string         // time of day reports are generated, e.g. 07:00
+	Weekday  time.Weekday   // day weekly reports are generated
+	Location *time.Location // time zone of At, UTC if nil
+	Webhook  string         // URL reports are posted to as JSON, if set
+	SMTP     SMTPConfig     // mail server reports are sent with, if set
+}
+
+// SMTPConfig describes how reports are mailed
+type SMTPConfig struct {
+	Addr     string // host:port of the mail server
+	From     string
+	To       []string
+	Username string // PLAIN authentication is used if set
+	Password string
+}
+
+func (cfg *ReportConfig) Validate() error {
+	switch cfg.Period {
+	case ReportNone, "":
+		return nil
+	case ReportDaily, ReportWeekly:
+	default:
+		return fmt.Errorf("unknown report period %q, expected %s, %s or %s", cfg.Period, ReportDaily, ReportWeekly, ReportNone)
+	}
+	if _, err := time.Parse("15:04", cfg.At); err != nil {
+		return fmt.Errorf("report time %q must be formatted as HH:MM", cfg.At)
+	}
+	if cfg.SMTP.Addr != "" && (cfg.SMTP.From == "" || len(cfg.SMTP.To) == 0) {
+		return errors.New("SMTP sender and recipients are required")
+	}
+	return nil
+}
+
+func (cfg *ReportConfig) enabled() bool {
+	return cfg.Period == ReportDaily || cfg.Period == ReportWeekly
+}
+
+// next returns the end of the next period after now
+func (cfg *ReportConfig) next(now time.Time) time.Time {
+	loc := cfg.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	at, _ := time.Parse("15:04", cfg.At)
+	now = now.In(loc)
+	next := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, loc)
+
+	days := 1
+	if cfg.Period == ReportWeekly {
+		days = 7
+		next = next.AddDate(0, 0, (int(cfg.Weekday)-int(next.Weekday())+7)%7)
+	}
+	if !next.After(now) {
+		next = next.AddDate(0, 0, days)
+	}
+	return next
+}
+
+// start returns the start of the period ending at end
+func (cfg *ReportConfig) start(end time.Time) time.Time {
+	if cfg.Period == ReportWeekly {
+		return end.AddDate(0, 0, -7)
+	}
+	return end.AddDate(0, 0, -1)
+}
+
+// Report is the digest of the insights and anomalies of a database
+type Report struct {
+	ID         int64     `json:"id"`
+	DatabaseID int64     `json:"database_id"`
+	DBName     string    `json:"dbname"`
+	Period     string    `json:"period"`
+	From       time.Time `json:"period_start"`
+	To         time.Time `json:"period_end"`
+	Severity   string    `json:"severity"` // of the most severe finding
+	Summary    string    `json:"summary"`
+	Markdown   string    `json:"markdown"`
+	HTML       string    `json:"html"`
+
+	Insights     int               `json:"-"`
+	Severities   []SeverityCount   `json:"-"` // findings per severity, most severe first
+	Findings     []ReportFinding   `json:"-"` // most severe findings
+	MoreFindings int               `json:"-"` // findings not listed
+	Anomalies    []MetricAnomalies `json:"-"`
+}
+
+type SeverityCount struct {
+	Severity string
+	Count    int
+}
+
+type ReportFinding struct {
+	Finding
+	MetricName string
+	CreatedAt  time.Time
+}
+
+// MetricAnomalies counts the anomalies of a metric and holds the largest
+type MetricAnomalies struct {
+	Anomaly
+	Count int
+}
+
+// GenerateReport builds the report of a database for the period from..to,
+// asking the model for a summary
+func (r *LLamaReceiver) GenerateReport(dbid int64, dbname, period string, from, to time.Time) (*Report, error) {
+	report := &Report{DatabaseID: dbid, DBName: dbname, Period: period, From: from, To: to, Severity: severities[0]}
+	if err := r.collectReport(report); err != nil {
+		return nil, err
+	}
+
+	var prompt bytes.Buffer
+	if err := reportPrompt.Execute(&prompt, report); err != nil {
+		return nil, err
+	}
+	insight, err := r.chatInsight(prompt.String())
+	if err != nil {
+		log.Printf("[WARNING]: Unable to summarize the %s report of %s: %s", period, dbname, err)
+		report.Summary = fmt.Sprintf("%d insights with %d findings and %d anomalies were recorded, no summary could be generated.",
+			report.Insights, len(report.Findings)+report.MoreFindings, report.anomalyCount())
+	} else {
+		report.Summary = insight.Summary
+	}
+
+	return report, report.render()
+}
+
+// render sets the Markdown and HTML content of the report
+func (rep *Report) render() error {
+	var markdown, html bytes.Buffer
+	if err := markdownReport.Execute(&markdown, rep); err != nil {
+		return err
+	}
+	if err := htmlReport.Execute(&html, rep); err != nil {
+		return err
+	}
+	rep.Markdown, rep.HTML = markdown.String(), html.String()
+	return nil
+}
+
+func (rep *Report) anomalyCount() (count int) {
+	for _, a := range rep.Anomalies {
+		count += a.Count
+	}
+	return count
+}
+
+// collectReport queries the insights, findings and anomalies of the period
+func (r *LLamaReceiver) collectReport(rep *Report) error {
+	conn, err := r.ConnPool.Acquire(r.Ctx)
+	if err != nil {
+		return errors.New("unable to acquire new connection")
+	}
+	defer conn.Release()
+
+	from, to := rep.From.UTC(), rep.To.UTC()
+	err = conn.QueryRow(r.Ctx, `SELECT COUNT(*) FROM insights WHERE database_id = $1 AND created_at >= $2 AND created_at < $3`,
+		rep.DatabaseID, from, to).Scan(&rep.Insights)
+	if err != nil {
+		return err
+	}
+
+	rows, err := conn.Query(r.Ctx, `SELECT findings.severity, COUNT(*) FROM findings JOIN insights ON insights.id = findings.insight_id
+		WHERE insights.database_id = $1 AND insights.created_at >= $2 AND insights.created_at < $3
+		GROUP BY findings.severity, findings.severity_level ORDER BY findings.severity_level DESC`, rep.DatabaseID, from, to)
+	if err != nil {
+		return err
+	}
+	total := 0
+	for rows.Next() {
+		var c SeverityCount
+		if err = rows.Scan(&c.Severity, &c.Count); err != nil {
+			rows.Close()
+			return err
+		}
+		total += c.Count
+		rep.Severities = append(rep.Severities, c)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if len(rep.Severities) > 0 {
+		rep.Severity = rep.Severities[0].Severity
+	}
+
+	rows, err = conn.Query(r.Ctx, `SELECT findings.severity, findings.affected_object, findings.evidence, findings.recommendation,
+		COALESCE(insights.metric_name, ''), insights.created_at
+		FROM findings JOIN insights ON insights.id = findings.insight_id
+		WHERE insights.database_id = $1 AND insights.created_at >= $2 AND insights.created_at < $3
+		ORDER BY findings.severity_level DESC, insights.created_at DESC LIMIT $4`, rep.DatabaseID, from, to, maxReportFindings)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var f ReportFinding
+		if err = rows.Scan(&f.Severity, &f.AffectedObject, &f.Evidence, &f.Recommendation, &f.MetricName, &f.CreatedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		f.CreatedAt = f.CreatedAt.In(rep.To.Location())
+		rep.Findings = append(rep.Findings, f)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rep.MoreFindings = total - len(rep.Findings)
+
+	// the largest anomaly of every metric with the number of its anomalies
+	rows, err = conn.Query(r.Ctx, `SELECT DISTINCT ON (metric_name) metric_name, COUNT(*) OVER (PARTITION BY metric_name),
+		field, series, value, baseline, deviation, score, method
+		FROM anomalies WHERE database_id = $1 AND created_at >= $2 AND created_at < $3
+		ORDER BY metric_name, abs(score) DESC`, rep.DatabaseID, from, to)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a MetricAnomalies
+		if err = rows.Scan(&a.MetricName, &a.Count, &a.Field, &a.Series, &a.Value, &a.Baseline, &a.Deviation, &a.Score, &a.Method); err != nil {
+			return err
+		}
+		rep.Anomalies = append(rep.Anomalies, a)
+	}
+	return rows.Err()
+}
+
+// AddReport stores a report, returning false if the report of this period
+// was already stored, e.g. by another receiver
+func (r *LLamaReceiver) AddReport(report *Report) (bool, error) {
+	conn, err := r.ConnPool.Acquire(r.Ctx)
+	if err != nil {
+		return false, errors.New("unable to acquire new connection")
+	}
+	defer conn.Release()
+
+	err = conn.QueryRow(r.Ctx, `INSERT INTO reports(database_id, period, period_start, period_end, severity, severity_level, markdown, html)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT (database_id, period, period_start) DO NOTHING RETURNING id`,
+		report.DatabaseID, report.Period, report.From.UTC(), report.To.UTC(), report.Severity, severityLevel(report.Severity),
+		report.Markdown, report.HTML).Scan(&report.ID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GenerateReports stores and delivers the reports of all databases for the
+// period ending at end. Databases whose report fails don't keep the others
+// from getting theirs, the failures are returned together.
+func (r *LLamaReceiver) GenerateReports(end time.Time) error {
+	conn, err := r.ConnPool.Acquire(r.Ctx)
+	if err != nil {
+		return errors.New("unable to acquire new connection")
+	}
+	rows, err := conn.Query(r.Ctx, `SELECT id, dbname FROM db ORDER BY dbname`)
+	if err != nil {
+		conn.Release()
+		return err
+	}
+	type database struct {
+		id   int64
+		name string
+	}
+	var dbs []database
+	for rows.Next() {
+		var db database
+		if err = rows.Scan(&db.id, &db.name); err != nil {
+			break
+		}
+		dbs = append(dbs, db)
+	}
+	rows.Close()
+	conn.Release()
+	if err = errors.Join(err, rows.Err()); err != nil {
+		return err
+	}
+
+	start := r.Reports.start(end)
+	var errs []error
+	for _, db := range dbs {
+		report, err := r.GenerateReport(db.id, db.name, r.Reports.Period, start, end)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to generate the report of %s: %w", db.name, err))
+			continue
+		}
+		added, err := r.AddReport(report)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to store the report of %s: %w", db.name, err))
+			continue
+		}
+		if !added {
+			log.Printf("[INFO]: The %s report of %s was already generated", report.Period, db.name)
+			continue
+		}
+		log.Printf("[INFO]: Generated the %s report of %s", report.Period, db.name)
+
+		for _, sender := range r.ReportSenders {
+			if err = sender.Send(r.Ctx, report); err != nil {
+				log.Printf("[ERROR]: unable to deliver the report of %s: %s", db.name, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// runReports generates reports at the end of every period until r.Ctx is done
+func (r *LLamaReceiver) runReports() {
+	for {
+		next := r.Reports.next(time.Now())
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-r.Ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := r.GenerateReports(next); err != nil {
+			log.Println("[ERROR]: " + err.Error())
+		}
+	}
+}
+
+// ReportSender delivers generated reports
+type ReportSender interface {
+	Send(ctx context.Context, report *Report) error
+}
+
+// newReportSenders returns the senders configured in cfg
+func newReportSenders(cfg ReportConfig) []ReportSender {
+	var senders []ReportSender
+	if cfg.Webhook != "" {
+		senders = append(senders, &WebhookSender{URL: cfg.Webhook, Client: &http.Client{Timeout: 30 * time.Second}})
+	}
+	if cfg.SMTP.Addr != "" {
+		senders = append(senders, &SMTPSender{Config: cfg.SMTP})
+	}
+	return senders
+}
+
+// WebhookSender posts reports as JSON
+type WebhookSender struct {
+	URL    string
+	Client *http.Client
+}
+
+func (s *WebhookSender) Send(ctx context.Context, report *Report) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook failed: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("webhook failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// SMTPSender mails reports with a plain text and an HTML part
+type SMTPSender struct {
+	Config SMTPConfig
+}
+
+func (s *SMTPSender) Send(_ context.Context, report *Report) error {
+	msg, err := s.message(report)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if s.Config.Username != "" {
+		host, _, err := net.SplitHostPort(s.Config.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Config.Username, s.Config.Password, host)
+	}
+	if err = smtp.SendMail(s.Config.Addr, auth, s.Config.From, s.Config.To, msg); err != nil {
+		return fmt.Errorf("unable to send mail: %w", err)
+	}
+	return nil
+}
+
+func (s *SMTPSender) message(report *Report) ([]byte, error) {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", report.Markdown},
+		{"text/html; charset=utf-8", report.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err = qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err = qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	subject := fmt.Sprintf("%s pgwatch digest of %s: %s", title(report.Period),
+		report.DBName, report.To.Format("2006-01-02"))
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.Config.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.Config.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", parts.Boundary())
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// RetentionConfig bounds the measurements kept in Postgres. Measurements
+// older than their retention are rolled up into hourly summaries of their
+// numeric fields before they are deleted.
+type RetentionConfig struct {
+	Raw      time.Duration            // retention of measurements, 0 keeps them forever
+	PerDB    map[string]time.Duration // retention of measurements of single databases, overriding Raw
+	Rollups  time.Duration            // retention of hourly summaries, 0 keeps them forever
+	Interval time.Duration            // time between retention runs
+}
+
+func (cfg *RetentionConfig) Validate() error {
+	if cfg.Raw < 0 || cfg.Rollups < 0 {
+		return errors.New("retention must not be negative")
+	}
+	for dbname, retention := range cfg.PerDB {
+		if retention < 0 {
+			return fmt.Errorf("retention of %s must not be negative", dbname)
+		}
+	}
+	if cfg.enabled() && cfg.Interval <= 0 {
+		return errors.New("retention interval must be positive")
+	}
+	return nil
+}
+
+func (cfg *RetentionConfig) enabled() bool {
+	return cfg.Raw > 0 || cfg.Rollups > 0 || len(cfg.PerDB) > 0
+}
+
+// retention returns the retention of the measurements of dbname
+func (cfg *RetentionConfig) retention(dbname string) time.Duration {
+	if retention, ok := cfg.PerDB[dbname]; ok {
+		return retention
+	}
+	return cfg.Raw
+}
+
+// HourlyRollup summarizes the values of a numeric field within an hour
+type HourlyRollup struct {
+	Field  string
+	Series string // tag values of the row, e.g. queryid=42
+	Bucket time.Time
+	Count  int64
+	Min    float64
+	Max    float64
+	Avg    float64
+}
+
+// FieldHistory summarizes the hourly rollups of a field over the history
+// window of a prompt
+type FieldHistory struct {
+	Field  string
+	Series string
+	Hours  int
+	From   time.Time
+	To     time.Time
+	Min    float64
+	Max    float64
+	Avg    float64 // weighted by the measurements per hour
+}
+
+// rollUpQuery moves the measurements of database $1 older than $2 into
+// measurement_rollups. Rows are told apart by their tag_ fields, like the
+// anomaly detector does.
+const rollUpQuery = `WITH expired AS (
+	DELETE FROM measurements WHERE database_id = $1 AND created_at < $2
+	RETURNING COALESCE(metric_name, '') AS metric_name, data, created_at
+), expanded AS (
+	SELECT expired.metric_name, date_trunc('hour', expired.created_at) AS bucket,
+		CASE WHEN jsonb_typeof(elem.obj) = 'object' THEN elem.obj ELSE '{}' END AS obj
+	FROM expired CROSS JOIN LATERAL jsonb_array_elements(
+		CASE WHEN jsonb_typeof(expired.data) = 'array' THEN expired.data ELSE '[]' END) AS elem(obj)
+), fields AS (
+	SELECT expanded.metric_name, expanded.bucket, field.key AS field, (field.value #>> '{}')::DOUBLE PRECISION AS value,
+		COALESCE((SELECT string_agg(substr(tag.key, 5) || '=' || (tag.value #>> '{}'), ',' ORDER BY tag.key)
+			FROM jsonb_each(expanded.obj) AS tag WHERE tag.key LIKE 'tag\_%'), '') AS series
+	FROM expanded CROSS JOIN LATERAL jsonb_each(expanded.obj) AS field
+	WHERE jsonb_typeof(field.value) = 'number' AND field.key <> 'epoch_ns' AND field.key NOT LIKE 'tag\_%'
+)
+INSERT INTO measurement_rollups AS r(database_id, metric_name, series, field, bucket, count, min, max, avg)
+SELECT $1, metric_name, series, field, bucket, COUNT(*), min(value), max(value), avg(value)
+FROM fields GROUP BY metric_name, series, field, bucket
+ON CONFLICT (database_id, metric_name, field, series, bucket) DO UPDATE SET
+	count = r.count + EXCLUDED.count,
+	min = LEAST(r.min, EXCLUDED.min),
+	max = GREATEST(r.max, EXCLUDED.max),
+	avg = (r.avg * r.count + EXCLUDED.avg * EXCLUDED.count) / (r.count + EXCLUDED.count)`
+
+// ApplyRetention rolls up and deletes the measurements older than the
+// retention of their database, then deletes rollups older than theirs
+func (r *LLamaReceiver) ApplyRetention(now time.Time) error {
+	conn, err := r.ConnPool.Acquire(r.Ctx)
+	if err != nil {
+		return errors.New("unable to acquire new connection")
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(r.Ctx, `SELECT id, dbname FROM db`)
+	if err != nil {
+		return err
+	}
+	dbs := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var dbname string
+		if err = rows.Scan(&id, &dbname); err != nil {
+			rows.Close()
+			return err
+		}
+		dbs[id] = dbname
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	now = now.UTC()
+	for id, dbname := range dbs {
+		retention := r.Retention.retention(dbname)
+		if retention == 0 {
+			continue
+		}
+		// deleting and rolling up in one statement, so measurements are
+		// never lost or summarized twice
+		tag, err := conn.Exec(r.Ctx, rollUpQuery, id, now.Add(-retention))
+		if err != nil {
+			return fmt.Errorf("unable to roll up measurements of %s: %w", dbname, err)
+		}
+		if tag.RowsAffected() > 0 {
+			log.Printf("[INFO]: Rolled up %d hourly summaries of measurements of %s older than %s", tag.RowsAffected(), dbname, retention)
+		}
+	}
+
+	if r.Retention.Rollups > 0 {
+		tag, err := conn.Exec(r.Ctx, `DELETE FROM measurement_rollups WHERE bucket < $1`, now.Add(-r.Retention.Rollups))
+		if err != nil {
+			return fmt.Errorf("unable to delete hourly summaries: %w", err)
+		}
+		if tag.RowsAffected() > 0 {
+			log.Printf("[INFO]: Deleted %d hourly summaries older than %s", tag.RowsAffected(), r.Retention.Rollups)
+		}
+	}
+	return nil
+}
+
+// runRetention applies the retention periodically until r.Ctx is done
+func (r *LLamaReceiver) runRetention() {
+	ticker := time.NewTicker(r.Retention.Interval)
+	defer ticker.Stop()
+	for {
+		if err := r.ApplyRetention(time.Now()); err != nil {
+			log.Println("[ERROR]: unable to apply retention: " + err.Error())
+		}
+		select {
+		case <-r.Ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// GetRollups returns the hourly summaries of a metric since the given
+// time, oldest first
+func (r *LLamaReceiver) GetRollups(dbname string, metric_name string, since time.Time) ([]HourlyRollup, error) {
+	conn, err := r.ConnPool.Acquire(r.Ctx)
+	if err != nil {
+		return nil, errors.New("unable to acquire new connection")
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(r.Ctx, `SELECT field, series, bucket, count, min, max, avg
+		FROM measurement_rollups INNER JOIN db ON measurement_rollups.database_id = db.id
+		WHERE db.dbname = $1 AND metric_name = $2 AND bucket >= $3
+		ORDER BY bucket, field, series`, dbname, metric_name, since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rollups []HourlyRollup
+	for rows.Next() {
+		var h HourlyRollup
+		if err = rows.Scan(&h.Field, &h.Series, &h.Bucket, &h.Count, &h.Min, &h.Max, &h.Avg); err != nil {
+			return nil, err
+		}
+		rollups = append(rollups, h)
+	}
+	return rollups, rows.Err()
+}
+
+// summarizeHistory combines the hourly rollups of every field and series
+func summarizeHistory(rollups []HourlyRollup) []FieldHistory {
+	type key struct{ field, series string }
+	histories := make(map[key]*FieldHistory)
+	counts := make(map[key]int64)
+	for _, h := range rollups {
+		k := key{h.Field, h.Series}
+		fh, ok := histories[k]
+		if !ok {
+			fh = &FieldHistory{Field: h.Field, Series: h.Series, From: h.Bucket, Min: h.Min, Max: h.Max}
+			histories[k] = fh
+		}
+		fh.Hours++
+		fh.Min = min(fh.Min, h.Min)
+		fh.Max = max(fh.Max, h.Max)
+		fh.From = minTime(fh.From, h.Bucket)
+		fh.To = maxTime(fh.To, h.Bucket.Add(time.Hour))
+		fh.Avg += (h.Avg - fh.Avg) * float64(h.Count) / float64(counts[k]+h.Count)
+		counts[k] += h.Count
+	}
+
+	result := make([]FieldHistory, 0, len(histories))
+	for _, fh := range histories {
+		result = append(result, *fh)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Field != result[j].Field {
+			return result[i].Field < result[j].Field
+		}
+		return result[i].Series < result[j].Series
+	})
+	return result
+}
+
+func minTime(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,51 @@
+-- Tables as created by the receiver before versioned migrations. Every
+-- statement is idempotent, so existing deployments pass through unchanged.
+
+CREATE TABLE IF NOT EXISTS db(id BIGSERIAL PRIMARY KEY, dbname TEXT);
+
+CREATE TABLE IF NOT EXISTS measurements (
+	created_at TIMESTAMP NOT NULL DEFAULT(NOW() AT TIME ZONE 'UTC'),
+	data JSONB,
+	metric_name TEXT,
+	database_id SERIAL,
+	FOREIGN KEY (database_id) REFERENCES db(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS insights(
+	insight_data TEXT,
+	database_id BIGSERIAL,
+	created_at TIMESTAMP NOT NULL DEFAULT(NOW() AT TIME ZONE 'UTC'),
+	FOREIGN KEY (database_id) REFERENCES db(id) ON DELETE CASCADE
+);
+
+ALTER TABLE insights
+	ADD COLUMN IF NOT EXISTS id BIGSERIAL PRIMARY KEY,
+	ADD COLUMN IF NOT EXISTS metric_name TEXT,
+	ADD COLUMN IF NOT EXISTS severity TEXT,
+	ADD COLUMN IF NOT EXISTS severity_level SMALLINT;
+
+CREATE TABLE IF NOT EXISTS findings(
+	id BIGSERIAL PRIMARY KEY,
+	insight_id BIGINT NOT NULL,
+	severity TEXT NOT NULL,
+	severity_level SMALLINT NOT NULL,
+	affected_object TEXT NOT NULL,
+	evidence TEXT NOT NULL,
+	recommendation TEXT NOT NULL,
+	FOREIGN KEY (insight_id) REFERENCES insights(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS anomalies(
+	id BIGSERIAL PRIMARY KEY,
+	database_id BIGINT NOT NULL,
+	metric_name TEXT NOT NULL,
+	field TEXT NOT NULL,
+	series TEXT NOT NULL DEFAULT '',
+	value DOUBLE PRECISION NOT NULL,
+	baseline DOUBLE PRECISION NOT NULL,
+	deviation DOUBLE PRECISION NOT NULL,
+	score DOUBLE PRECISION NOT NULL,
+	method TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT(NOW() AT TIME ZONE 'UTC'),
+	FOREIGN KEY (database_id) REFERENCES db(id) ON DELETE CASCADE
+);
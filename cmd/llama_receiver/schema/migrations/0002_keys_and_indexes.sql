@@ -0,0 +1,33 @@
+-- Databases registered more than once are merged into the row with the
+-- lowest id, so dbname can be unique.
+CREATE TEMPORARY TABLE db_merge ON COMMIT DROP AS
+	SELECT id, min(id) OVER (PARTITION BY dbname) AS keep FROM db;
+
+UPDATE measurements SET database_id = m.keep FROM db_merge m WHERE database_id = m.id AND m.id <> m.keep;
+UPDATE insights SET database_id = m.keep FROM db_merge m WHERE database_id = m.id AND m.id <> m.keep;
+UPDATE anomalies SET database_id = m.keep FROM db_merge m WHERE database_id = m.id AND m.id <> m.keep;
+DELETE FROM db USING db_merge m WHERE db.id = m.id AND m.id <> m.keep;
+DELETE FROM db WHERE dbname IS NULL;
+
+ALTER TABLE db
+	ALTER COLUMN dbname SET NOT NULL,
+	ADD CONSTRAINT db_dbname_key UNIQUE (dbname);
+
+-- database_id only references db(id), it must not draw values from a
+-- sequence of its own.
+ALTER TABLE measurements
+	ADD COLUMN id BIGSERIAL PRIMARY KEY,
+	ALTER COLUMN database_id DROP DEFAULT,
+	ALTER COLUMN database_id TYPE BIGINT,
+	ALTER COLUMN database_id SET NOT NULL;
+DROP SEQUENCE IF EXISTS measurements_database_id_seq;
+
+ALTER TABLE insights
+	ALTER COLUMN database_id DROP DEFAULT,
+	ALTER COLUMN database_id SET NOT NULL;
+DROP SEQUENCE IF EXISTS insights_database_id_seq;
+
+CREATE INDEX measurements_database_metric_created_idx ON measurements(database_id, metric_name, created_at DESC);
+CREATE INDEX insights_database_created_idx ON insights(database_id, created_at DESC);
+CREATE INDEX findings_insight_idx ON findings(insight_id);
+CREATE INDEX anomalies_database_created_idx ON anomalies(database_id, created_at DESC);
@@ -0,0 +1,17 @@
+-- Hourly summaries of numeric fields of measurements removed by retention.
+CREATE TABLE measurement_rollups(
+	database_id BIGINT NOT NULL,
+	metric_name TEXT NOT NULL,
+	series TEXT NOT NULL DEFAULT '',
+	field TEXT NOT NULL,
+	bucket TIMESTAMP NOT NULL,
+	count BIGINT NOT NULL,
+	min DOUBLE PRECISION NOT NULL,
+	max DOUBLE PRECISION NOT NULL,
+	avg DOUBLE PRECISION NOT NULL,
+	PRIMARY KEY (database_id, metric_name, field, series, bucket),
+	FOREIGN KEY (database_id) REFERENCES db(id) ON DELETE CASCADE
+);
+
+CREATE INDEX measurement_rollups_bucket_idx ON measurement_rollups(bucket);
+CREATE INDEX measurements_created_idx ON measurements(created_at);
@@ -0,0 +1,17 @@
+-- Periodic digests of a database, one per period and start.
+CREATE TABLE reports(
+	id BIGSERIAL PRIMARY KEY,
+	database_id BIGINT NOT NULL,
+	period TEXT NOT NULL,
+	period_start TIMESTAMP NOT NULL,
+	period_end TIMESTAMP NOT NULL,
+	severity TEXT NOT NULL,
+	severity_level SMALLINT NOT NULL,
+	markdown TEXT NOT NULL,
+	html TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT(NOW() AT TIME ZONE 'UTC'),
+	UNIQUE (database_id, period, period_start),
+	FOREIGN KEY (database_id) REFERENCES db(id) ON DELETE CASCADE
+);
+
+CREATE INDEX reports_database_created_idx ON reports(database_id, created_at DESC);
@@ -0,0 +1,21 @@
+-- Queue of insights to generate, processed by the worker pools of all
+-- receivers sharing the database.
+CREATE TABLE insight_jobs(
+	id BIGSERIAL PRIMARY KEY,
+	database_id BIGINT NOT NULL,
+	metric_name TEXT NOT NULL,
+	anomalies JSONB NOT NULL DEFAULT '[]',
+	status TEXT NOT NULL DEFAULT 'pending',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	run_at TIMESTAMP NOT NULL DEFAULT(NOW() AT TIME ZONE 'UTC'),
+	last_error TEXT,
+	insight_id BIGINT,
+	created_at TIMESTAMP NOT NULL DEFAULT(NOW() AT TIME ZONE 'UTC'),
+	updated_at TIMESTAMP NOT NULL DEFAULT(NOW() AT TIME ZONE 'UTC'),
+	CHECK (status IN ('pending', 'running', 'done', 'failed')),
+	FOREIGN KEY (database_id) REFERENCES db(id) ON DELETE CASCADE,
+	FOREIGN KEY (insight_id) REFERENCES insights(id) ON DELETE SET NULL
+);
+
+CREATE INDEX insight_jobs_due_idx ON insight_jobs(run_at) WHERE status IN ('pending', 'running');
+CREATE INDEX insight_jobs_database_metric_created_idx ON insight_jobs(database_id, metric_name, created_at DESC);
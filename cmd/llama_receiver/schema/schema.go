@@ -0,0 +1,150 @@
+// Package schema holds the Postgres schema of the LLama receiver as
+// versioned migrations, shared by the receiver and the insights API.
+package schema
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// lockID serializes migrations of concurrently starting processes
+const lockID = 7413200425
+
+//go:embed migrations/*.sql
+var files embed.FS
+
+// Migration is a migrations/<version>_<name>.sql file
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// DB is implemented by *pgx.Conn and *pgxpool.Pool
+type DB interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// Migrations returns all migrations ordered by version
+func Migrations() ([]Migration, error) {
+	names, err := fs.Glob(files, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]Migration, 0, len(names))
+	for _, name := range names {
+		base := strings.TrimSuffix(path.Base(name), ".sql")
+		prefix, title, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("migration %s is not named <version>_<name>.sql", name)
+		}
+		sql, err := fs.ReadFile(files, name)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: title, SQL: string(sql)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("duplicate migration version %d", migrations[i].Version)
+		}
+	}
+	return migrations, nil
+}
+
+// Migrate applies all migrations not recorded in schema_migrations yet,
+// each in its own transaction
+func Migrate(ctx context.Context, db DB) error {
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+
+	err = inTx(ctx, db, `CREATE TABLE IF NOT EXISTS schema_migrations(
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT(NOW() AT TIME ZONE 'UTC')
+	)`)
+	if err != nil {
+		return fmt.Errorf("unable to create schema_migrations table: %w", err)
+	}
+
+	for _, m := range migrations {
+		if err = apply(ctx, db, m); err != nil {
+			return fmt.Errorf("migration %d_%s failed: %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+func apply(ctx context.Context, db DB, m Migration) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if _, err = tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", lockID); err != nil {
+		return err
+	}
+
+	var applied bool
+	err = tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)", m.Version).Scan(&applied)
+	if err != nil || applied {
+		return err
+	}
+
+	if _, err = tx.Exec(ctx, m.SQL); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, "INSERT INTO schema_migrations(version, name) VALUES($1, $2)", m.Version, m.Name); err != nil {
+		return err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+	log.Printf("[INFO]: Applied migration %d_%s", m.Version, m.Name)
+	return nil
+}
+
+func inTx(ctx context.Context, db DB, sql string) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if _, err = tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", lockID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, sql); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Version returns the highest applied migration, 0 if none was applied
+func Version(ctx context.Context, db DB) (int, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var version int
+	err = tx.QueryRow(ctx, "SELECT COALESCE(max(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
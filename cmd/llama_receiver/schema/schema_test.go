@@ -0,0 +1,21 @@
+package schema
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, migrations)
+
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.Version, "versions must be consecutive")
+		assert.NotEmpty(t, m.Name)
+		assert.NotEmpty(t, strings.TrimSpace(m.SQL))
+	}
+	assert.Equal(t, "initial", migrations[0].Name)
+}
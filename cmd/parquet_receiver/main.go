@@ -3,6 +3,10 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 )
@@ -10,6 +14,10 @@ import (
 func main() {
 	port := flag.String("port", "-1", "Specify the port where you want your sink to receive the measurements on.")
 	StorageFolder := flag.String("rootFolder", ".", "Only for formats like CSV...\n")
+	compression := flag.String("compression", "snappy", "Compression codec: none, snappy, gzip, zstd or lz4")
+	rowGroupSize := flag.Int64("rowGroupSize", 10000, "Number of rows buffered in memory before a row group is written")
+	maxFileSize := flag.Int64("maxFileSize", 128*1024*1024, "Start a new file once the current one reaches this many bytes. 0 disables")
+	rollInterval := flag.Duration("rollInterval", time.Hour, "Start a new file once the current one is this old. 0 disables")
 	flag.Parse()
 
 	if *port == "-1" {
@@ -17,8 +25,30 @@ func main() {
 		return
 	}
 
-	server := NewParquetReceiver(*StorageFolder)
-	if err := sinks.ListenAndServe(server, *port); err != nil {
+	cfg := Config{
+		Compression:  *compression,
+		RowGroupSize: *rowGroupSize,
+		MaxFileSize:  *maxFileSize,
+		RollInterval: *rollInterval,
+	}
+
+	server, err := NewParquetReceiver(*StorageFolder, cfg)
+	if err != nil {
+		log.Fatal("[ERROR]: Unable to create parquet receiver", err)
+	}
+
+	// complete open files on shutdown
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		if err := server.Close(); err != nil {
+			log.Println("[ERROR]: Unable to close parquet files: ", err)
+		}
+		os.Exit(0)
+	}()
+
+	if err = sinks.ListenAndServe(server, *port); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -2,71 +2,267 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
 
 	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress"
 )
 
+// Files are written with this suffix and renamed once complete,
+// so readers globbing *.parquet never see partial files
+const inProgressSuffix = ".inprogress"
+
+var codecs = map[string]compress.Codec{
+	"none":   &parquet.Uncompressed,
+	"snappy": &parquet.Snappy,
+	"gzip":   &parquet.Gzip,
+	"zstd":   &parquet.Zstd,
+	"lz4":    &parquet.Lz4Raw,
+}
+
+type Config struct {
+	Compression  string        // one of none, snappy, gzip, zstd, lz4
+	RowGroupSize int64         // rows buffered in memory before a row group is written
+	MaxFileSize  int64         // roll files once their row groups reach this many bytes, 0 disables
+	RollInterval time.Duration // roll files after this long, 0 disables
+}
+
 type ParquetReceiver struct {
 	bufferPath string
+	cfg        Config
+	codec      compress.Codec
+	writers    map[writerKey]*metricWriter
+	seq        int
+	mu         sync.Mutex
 	sinks.SyncMetricHandler
 }
 
-type ParquetSchema struct {
-	DBName            string
-	MetricName        string
-	Data              string // json string
-	Tags              string
+type writerKey struct {
+	DBName     string
+	MetricName string
+}
+
+// metricWriter appends to one open parquet file of a database metric
+type metricWriter struct {
+	path    string
+	file    *os.File
+	size    *countingWriter
+	writer  *parquet.Writer
+	columns map[string]columnKind
+	opened  time.Time
+	pending int64 // rows not yet written as a row group
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
 }
 
-func NewParquetReceiver(fullPath string) *ParquetReceiver {
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func NewParquetReceiver(fullPath string, cfg Config) (*ParquetReceiver, error) {
+	codec, ok := codecs[cfg.Compression]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression codec: %s", cfg.Compression)
+	}
+	if cfg.RowGroupSize <= 0 {
+		return nil, errors.New("row group size must be positive")
+	}
+
 	// Create buffer storage
 	buffer_path := fullPath + "/parquet_readings"
-	_ = os.MkdirAll(buffer_path, os.ModePerm)
+	if err := os.MkdirAll(buffer_path, os.ModePerm); err != nil {
+		return nil, err
+	}
 
 	pr := &ParquetReceiver{
-		bufferPath: buffer_path,
+		bufferPath:        buffer_path,
+		cfg:               cfg,
+		codec:             codec,
+		writers:           make(map[writerKey]*metricWriter),
 		SyncMetricHandler: sinks.NewSyncMetricHandler(1024),
 	}
 	go pr.HandleSyncMetric()
+	if cfg.RollInterval > 0 {
+		go pr.rollPeriodically()
+	}
 
-	return pr
+	return pr, nil
 }
 
-func (r ParquetReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
-	dbFilePath := r.bufferPath + "/" + msg.GetDBName() + ".parquet"
-
-	data_points, err := parquet.ReadFile[ParquetSchema](dbFilePath)
+func (r *ParquetReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
+	tags, err := sinks.GetJson(msg.GetCustomTags())
 	if err != nil {
-		data_points = []ParquetSchema{}
+		return nil, err
 	}
 
-	data := ParquetSchema{}
-	data.DBName = msg.GetDBName()
-	data.MetricName = msg.GetMetricName()
-	data.Tags, err = sinks.GetJson(msg.CustomTags)
-	if err != nil {
-		return nil, err
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := writerKey{DBName: msg.GetDBName(), MetricName: msg.GetMetricName()}
+	w := r.writers[key]
+
+	// new fields or type changes need a new file with the merged schema
+	columns := make(map[string]columnKind)
+	if w != nil {
+		for name, kind := range w.columns {
+			columns[name] = kind
+		}
+	}
+	changed := false
+	for _, data := range msg.GetData() {
+		changed = mergeColumns(columns, data) || changed
 	}
 
-	for _, measurement := range msg.GetData() {
-		data.Data, err = sinks.GetJson(measurement)
-		if err != nil {
-			continue
+	if w != nil && (changed || r.shouldRoll(w)) {
+		if err = r.closeWriter(key); err != nil {
+			return nil, err
+		}
+		w = nil
+	}
+	if w == nil {
+		if w, err = r.openWriter(key, columns); err != nil {
+			log.Printf("[ERROR]: Unable to create parquet file for %s/%s.", key.DBName, key.MetricName)
+			return nil, err
 		}
-		data_points = append(data_points, data)
 	}
 
-	err = parquet.WriteFile(dbFilePath, data_points)
-	if err != nil {
-		log.Printf("[ERROR]: Unable to write to parquet file %s.", dbFilePath)
+	rows := make([]parquet.Row, 0, len(msg.GetData()))
+	for _, data := range msg.GetData() {
+		rows = append(rows, buildRow(w.writer.Schema(), w.columns, key.DBName, key.MetricName, tags, data))
+	}
+	if _, err = w.writer.WriteRows(rows); err != nil {
+		log.Printf("[ERROR]: Unable to write to parquet file %s.", w.path)
 		return nil, err
 	}
+	w.pending += int64(len(rows))
+	if w.pending >= r.cfg.RowGroupSize {
+		if err = w.writer.Flush(); err != nil {
+			return nil, err
+		}
+		w.pending = 0
+	}
 	log.Println("[INFO]: Updated Measurements for Database: ", msg.GetDBName())
 
+	if r.shouldRoll(w) {
+		if err = r.closeWriter(key); err != nil {
+			return nil, err
+		}
+	}
+
 	return &pb.Reply{}, nil
-}
\ No newline at end of file
+}
+
+// metricDir returns the directory files of a database metric are stored in
+func (r *ParquetReceiver) metricDir(key writerKey) (string, error) {
+	rel := filepath.Join(key.DBName, key.MetricName)
+	if !filepath.IsLocal(rel) || strings.Count(rel, string(filepath.Separator)) != 1 {
+		return "", fmt.Errorf("invalid database or metric name: %s/%s", key.DBName, key.MetricName)
+	}
+	return filepath.Join(r.bufferPath, rel), nil
+}
+
+func (r *ParquetReceiver) openWriter(key writerKey, columns map[string]columnKind) (*metricWriter, error) {
+	dir, err := r.metricDir(key)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	r.seq++
+	name := fmt.Sprintf("%s-%s-%d.parquet", key.MetricName, now.Format("20060102T150405"), r.seq)
+	path := filepath.Join(dir, name)
+
+	file, err := os.Create(path + inProgressSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	size := &countingWriter{w: file}
+	writer := parquet.NewWriter(size,
+		buildSchema(key.MetricName, columns),
+		parquet.Compression(r.codec),
+		parquet.MaxRowsPerRowGroup(r.cfg.RowGroupSize),
+		// write row groups straight to the file so its size is known
+		parquet.WriteBufferSize(0),
+	)
+
+	w := &metricWriter{
+		path:    path,
+		file:    file,
+		size:    size,
+		writer:  writer,
+		columns: columns,
+		opened:  now,
+	}
+	r.writers[key] = w
+	return w, nil
+}
+
+// closeWriter writes the file footer and makes the file visible
+func (r *ParquetReceiver) closeWriter(key writerKey) error {
+	w := r.writers[key]
+	delete(r.writers, key)
+
+	err := w.writer.Close()
+	err = errors.Join(err, w.file.Close())
+	if err != nil {
+		return err
+	}
+	return os.Rename(w.path+inProgressSuffix, w.path)
+}
+
+func (r *ParquetReceiver) shouldRoll(w *metricWriter) bool {
+	if r.cfg.MaxFileSize > 0 && w.size.n >= r.cfg.MaxFileSize {
+		return true
+	}
+	return r.cfg.RollInterval > 0 && time.Since(w.opened) >= r.cfg.RollInterval
+}
+
+func (r *ParquetReceiver) rollPeriodically() {
+	ticker := time.NewTicker(min(r.cfg.RollInterval, time.Minute))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.mu.Lock()
+		for key, w := range r.writers {
+			if !r.shouldRoll(w) {
+				continue
+			}
+			if err := r.closeWriter(key); err != nil {
+				log.Printf("[ERROR]: Unable to close parquet file %s: %v", w.path, err)
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+// Close completes all open files
+func (r *ParquetReceiver) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var err error
+	for key := range r.writers {
+		err = errors.Join(err, r.closeWriter(key))
+	}
+	return err
+}
@@ -3,12 +3,36 @@ package main
 import (
 	"context"
 	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
 	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"github.com/parquet-go/parquet-go"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
+var testConfig = Config{Compression: "zstd", RowGroupSize: 100}
+
+func openParquetFile(t *testing.T, path string) *parquet.File {
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = file.Close() })
+
+	stat, err := file.Stat()
+	assert.NoError(t, err)
+	pf, err := parquet.OpenFile(file, stat.Size())
+	assert.NoError(t, err)
+	return pf
+}
+
+func metricFiles(t *testing.T, root string, msg *pb.MeasurementEnvelope) []string {
+	files, err := filepath.Glob(filepath.Join(root, "parquet_readings", msg.GetDBName(), msg.GetMetricName(), "*.parquet"))
+	assert.NoError(t, err)
+	return files
+}
+
 func TestUpdateMeasurements(t *testing.T) {
 	fullPath, err := os.Getwd()
 	if err != nil {
@@ -17,13 +41,113 @@ func TestUpdateMeasurements(t *testing.T) {
 	defer func () { _ = os.RemoveAll(fullPath + "/parquet_readings") }()
 
 	msg := testutils.GetTestMeasurementEnvelope()
-	recv := NewParquetReceiver(fullPath)
+	recv, err := NewParquetReceiver(fullPath, testConfig)
+	assert.NoError(t, err)
 	_, err = os.Stat(fullPath + "/parquet_readings")
 	assert.False(t, os.IsNotExist(err), "Measurements Directory does not exist")
 
 	_, err = recv.UpdateMeasurements(context.Background(), msg)
-	dbFilePath := fullPath + "/parquet_readings/" + msg.GetDBName() + ".parquet"
+	assert.NoError(t, err)
+	assert.Empty(t, metricFiles(t, fullPath, msg), "Incomplete file should not be visible")
 
+	assert.NoError(t, recv.Close())
+	files := metricFiles(t, fullPath, msg)
+	assert.Len(t, files, 1, "Metric Parquet file not found")
+
+	pf := openParquetFile(t, files[0])
+	assert.Equal(t, int64(1), pf.NumRows())
+	for _, column := range []string{timestampColumn, dbNameColumn, metricNameColumn, tagsColumn, "key"} {
+		_, ok := pf.Schema().Lookup(column)
+		assert.True(t, ok, "column %s not found", column)
+	}
+}
+
+func TestTypedColumns(t *testing.T) {
+	root := t.TempDir()
+	recv, err := NewParquetReceiver(root, testConfig)
+	assert.NoError(t, err)
+
+	data, err := structpb.NewStruct(map[string]any{
+		"epoch_ns":   1.7e18,
+		"xact_count": 42,
+		"is_primary": true,
+		"state":      "active",
+		"settings":   map[string]any{"a": 1},
+	})
 	assert.NoError(t, err)
-	assert.FileExists(t, dbFilePath, "Database Parquet file not found")
-}
\ No newline at end of file
+	msg := &pb.MeasurementEnvelope{DBName: "test", MetricName: "typed", Data: []*structpb.Struct{data}}
+	_, err = recv.UpdateMeasurements(context.Background(), msg)
+	assert.NoError(t, err)
+	assert.NoError(t, recv.Close())
+
+	files := metricFiles(t, root, msg)
+	assert.Len(t, files, 1)
+	schema := openParquetFile(t, files[0]).Schema()
+
+	expected := map[string]parquet.Kind{
+		timestampColumn: parquet.Int64,
+		"epoch_ns":      parquet.Double,
+		"xact_count":    parquet.Double,
+		"is_primary":    parquet.Boolean,
+		"state":         parquet.ByteArray,
+		"settings":      parquet.ByteArray,
+	}
+	for column, kind := range expected {
+		leaf, ok := schema.Lookup(column)
+		assert.True(t, ok, "column %s not found", column)
+		assert.Equal(t, kind, leaf.Node.Type().Kind(), "unexpected type of column %s", column)
+	}
+}
+
+func TestSchemaChangeRollsFile(t *testing.T) {
+	root := t.TempDir()
+	recv, err := NewParquetReceiver(root, testConfig)
+	assert.NoError(t, err)
+
+	send := func(fields map[string]any) {
+		data, err := structpb.NewStruct(fields)
+		assert.NoError(t, err)
+		msg := &pb.MeasurementEnvelope{DBName: "test", MetricName: "evolving", Data: []*structpb.Struct{data}}
+		_, err = recv.UpdateMeasurements(context.Background(), msg)
+		assert.NoError(t, err)
+	}
+
+	send(map[string]any{"value": 1})
+	send(map[string]any{"value": 2})
+	send(map[string]any{"value": "three"})
+	assert.NoError(t, recv.Close())
+
+	msg := &pb.MeasurementEnvelope{DBName: "test", MetricName: "evolving"}
+	files := metricFiles(t, root, msg)
+	assert.Len(t, files, 2, "Type change should start a new file")
+
+	var rows int64
+	for _, path := range files {
+		rows += openParquetFile(t, path).NumRows()
+	}
+	assert.Equal(t, int64(3), rows)
+}
+
+func TestRollBySize(t *testing.T) {
+	root := t.TempDir()
+	recv, err := NewParquetReceiver(root, Config{Compression: "snappy", RowGroupSize: 1, MaxFileSize: 1})
+	assert.NoError(t, err)
+
+	msg := testutils.GetTestMeasurementEnvelope()
+	for range 3 {
+		_, err = recv.UpdateMeasurements(context.Background(), msg)
+		assert.NoError(t, err)
+	}
+
+	// files are completed as soon as they exceed the size limit
+	assert.Len(t, metricFiles(t, root, msg), 3)
+	assert.NoError(t, recv.Close())
+}
+
+func TestInvalidConfig(t *testing.T) {
+	_, err := NewParquetReceiver(t.TempDir(), Config{Compression: "brotli", RowGroupSize: 1})
+	assert.Error(t, err)
+
+	_, err = NewParquetReceiver(t.TempDir(), Config{Compression: "snappy"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+	"github.com/parquet-go/parquet-go"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Columns written for every measurement, data fields
+// with the same name are dropped
+const (
+	timestampColumn  = "timestamp"
+	dbNameColumn     = "dbname"
+	metricNameColumn = "metric_name"
+	tagsColumn       = "custom_tags"
+)
+
+// columnKind is the parquet type inferred for a measurement field
+type columnKind int
+
+const (
+	kindDouble columnKind = iota
+	kindBoolean
+	kindString
+	kindJSON
+)
+
+func (k columnKind) node() parquet.Node {
+	switch k {
+	case kindDouble:
+		return parquet.Leaf(parquet.DoubleType)
+	case kindBoolean:
+		return parquet.Leaf(parquet.BooleanType)
+	case kindJSON:
+		return parquet.JSON()
+	}
+	return parquet.String()
+}
+
+func isReserved(name string) bool {
+	switch name {
+	case timestampColumn, dbNameColumn, metricNameColumn, tagsColumn:
+		return true
+	}
+	return false
+}
+
+// kindOf returns the column kind of v, false for null values
+// which carry no type information
+func kindOf(v *structpb.Value) (columnKind, bool) {
+	switch v.GetKind().(type) {
+	case *structpb.Value_NumberValue:
+		return kindDouble, true
+	case *structpb.Value_BoolValue:
+		return kindBoolean, true
+	case *structpb.Value_StringValue:
+		return kindString, true
+	case *structpb.Value_StructValue, *structpb.Value_ListValue:
+		return kindJSON, true
+	}
+	return 0, false
+}
+
+// mergeColumns adds the fields of data to columns. Fields seen with
+// different types are widened to strings. Returns true if columns changed.
+func mergeColumns(columns map[string]columnKind, data *structpb.Struct) bool {
+	changed := false
+	for name, value := range data.GetFields() {
+		if isReserved(name) {
+			continue
+		}
+		kind, ok := kindOf(value)
+		if !ok {
+			continue
+		}
+
+		cur, exists := columns[name]
+		switch {
+		case !exists:
+			columns[name] = kind
+		case cur == kind || cur == kindString:
+			continue
+		default:
+			columns[name] = kindString
+		}
+		changed = true
+	}
+	return changed
+}
+
+func buildSchema(metricName string, columns map[string]columnKind) *parquet.Schema {
+	group := parquet.Group{
+		timestampColumn:  parquet.Timestamp(parquet.Nanosecond),
+		dbNameColumn:     parquet.String(),
+		metricNameColumn: parquet.String(),
+		tagsColumn:       parquet.Optional(parquet.JSON()),
+	}
+	for name, kind := range columns {
+		group[name] = parquet.Optional(kind.node())
+	}
+	return parquet.NewSchema(metricName, group)
+}
+
+// buildRow converts a measurement into a row of schema
+func buildRow(schema *parquet.Schema, columns map[string]columnKind, dbName, metricName, tags string, data *structpb.Struct) parquet.Row {
+	paths := schema.Columns()
+	row := make(parquet.Row, len(paths))
+	fields := data.GetFields()
+	for i, path := range paths {
+		name := path[0]
+		var value parquet.Value
+		switch name {
+		case timestampColumn:
+			row[i] = parquet.Int64Value(sinks.MeasurementTime(data, time.Now().UTC()).UnixNano()).Level(0, 0, i)
+			continue
+		case dbNameColumn:
+			row[i] = parquet.ByteArrayValue([]byte(dbName)).Level(0, 0, i)
+			continue
+		case metricNameColumn:
+			row[i] = parquet.ByteArrayValue([]byte(metricName)).Level(0, 0, i)
+			continue
+		case tagsColumn:
+			value = parquet.ByteArrayValue([]byte(tags))
+		default:
+			value = fieldValue(columns[name], fields[name])
+		}
+
+		if value.IsNull() {
+			row[i] = value.Level(0, 0, i)
+		} else {
+			row[i] = value.Level(0, 1, i)
+		}
+	}
+	return row
+}
+
+func fieldValue(kind columnKind, v *structpb.Value) parquet.Value {
+	if _, ok := kindOf(v); !ok {
+		return parquet.NullValue()
+	}
+
+	switch kind {
+	case kindDouble:
+		return parquet.DoubleValue(v.GetNumberValue())
+	case kindBoolean:
+		return parquet.BooleanValue(v.GetBoolValue())
+	}
+
+	if s, ok := v.GetKind().(*structpb.Value_StringValue); ok {
+		return parquet.ByteArrayValue([]byte(s.StringValue))
+	}
+	encoded, err := json.Marshal(v.AsInterface())
+	if err != nil {
+		return parquet.NullValue()
+	}
+	return parquet.ByteArrayValue(encoded)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+)
+
+// maxPendingRows bounds the rows kept per table while ingestion fails
+const maxPendingRows = 100000
+
+type BatchConfig struct {
+	FlushInterval time.Duration // buffered rows are ingested this often, 0 ingests every envelope right away
+	MaxRows       int           // ingest a table's rows early once this many are buffered, 0 disables
+}
+
+func (cfg *BatchConfig) Validate() error {
+	if cfg.FlushInterval < 0 {
+		return errors.New("flush interval must not be negative")
+	}
+	if cfg.MaxRows < 0 {
+		return errors.New("max rows must not be negative")
+	}
+	return nil
+}
+
+// add queues rows for table, they become one segment per flush instead
+// of one tiny segment per envelope
+func (r *PinotReceiver) add(table string, rows []map[string]any) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	if r.batchCfg.FlushInterval == 0 {
+		return r.ingest(table, rows)
+	}
+
+	r.pendingMu.Lock()
+	r.pending[table] = append(r.pending[table], rows...)
+	var batch []map[string]any
+	if r.batchCfg.MaxRows > 0 && len(r.pending[table]) >= r.batchCfg.MaxRows {
+		batch = r.pending[table]
+		delete(r.pending, table)
+	}
+	r.pendingMu.Unlock()
+
+	if batch == nil {
+		return nil
+	}
+	// failed rows are retried with the next flush, returning the error
+	// would make pgwatch send them again
+	if err := r.ingest(table, batch); err != nil {
+		log.Printf("[ERROR]: Unable to ingest rows of %s, retrying with the next flush: %v", table, err)
+		r.requeue(table, batch)
+	}
+	return nil
+}
+
+// flush ingests all buffered rows
+func (r *PinotReceiver) flush() error {
+	r.pendingMu.Lock()
+	pending := r.pending
+	r.pending = make(map[string][]map[string]any)
+	r.pendingMu.Unlock()
+
+	var err error
+	for _, table := range sinks.SortedKeys(pending) {
+		if err2 := r.ingest(table, pending[table]); err2 != nil {
+			r.requeue(table, pending[table])
+			err = errors.Join(err, err2)
+		}
+	}
+	return err
+}
+
+// requeue puts rows that failed to ingest back in front of the queue,
+// dropping them if too many are waiting already
+func (r *PinotReceiver) requeue(table string, rows []map[string]any) {
+	r.pendingMu.Lock()
+	defer r.pendingMu.Unlock()
+
+	if len(r.pending[table])+len(rows) > maxPendingRows {
+		log.Printf("[ERROR]: Dropping %d rows of %s, too many rows are waiting for ingestion", len(rows), table)
+		return
+	}
+	r.pending[table] = append(rows, r.pending[table]...)
+}
+
+func (r *PinotReceiver) flushPeriodically() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.batchCfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			if err := r.flush(); err != nil {
+				log.Println("[ERROR]: Unable to ingest buffered rows: " + err.Error())
+			}
+		}
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"flag"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 )
@@ -15,7 +18,15 @@ func main() {
 	// Important Flags
 	port := flag.String("port", "", "Specify the port where you want your sink to receive the measurements on. Required.")
 	pinotControllerURL := flag.String("pinotController", "", "URL for the Pinot controller. Required (e.g., http://localhost:9000).")
-	configDir := flag.String("configDir", "./config", "Directory containing Pinot schema and table config files")
+	configDir := flag.String("configDir", "./config", "Directory containing Pinot schema.json and table.json files")
+	generateTables := flag.Bool("generateTables", false, "Generate per metric schemas and tables instead of using --configDir")
+	tablePrefix := flag.String("tablePrefix", "pgwatch", "Prefix of generated table names")
+	flushInterval := flag.Duration("flushInterval", 30*time.Second, "Buffered rows are ingested as one segment per table this often, 0 ingests every measurement right away")
+	maxRows := flag.Int("maxRows", 50000, "Ingest a table's buffered rows early once this many are waiting, 0 disables")
+	kafkaBrokers := flag.String("kafkaBrokers", "", "Comma separated Kafka brokers. If set, measurements are written to Kafka and REALTIME tables are created (requires --generateTables)")
+	pinotKafkaBrokers := flag.String("pinotKafkaBrokers", "", "Comma separated Kafka brokers as reachable from Pinot, defaults to --kafkaBrokers")
+	topicPrefix := flag.String("topicPrefix", "", "Prefix of Kafka topic names, topics are named <prefix><table>")
+	segmentFlushTime := flag.Duration("segmentFlushTime", time.Hour, "Pinot completes consuming segments of REALTIME tables after this long")
 	flag.Parse()
 
 	// Validate required parameters
@@ -41,50 +52,95 @@ func main() {
 	}
 	log.Printf("[INFO]: Using Pinot controller URL: %s", *pinotControllerURL)
 
+	batchCfg := BatchConfig{FlushInterval: *flushInterval, MaxRows: *maxRows}
+
+	var server *PinotReceiver
+	var err error
+	if *generateTables {
+		var stream *StreamConfig
+		if *kafkaBrokers != "" {
+			stream = &StreamConfig{
+				Brokers:          splitList(*kafkaBrokers),
+				PinotBrokers:     splitList(*pinotKafkaBrokers),
+				TopicPrefix:      *topicPrefix,
+				SegmentFlushTime: *segmentFlushTime,
+			}
+		}
+		server, err = NewAutoPinotReceiver(*pinotControllerURL, *tablePrefix, batchCfg, stream)
+		if err != nil {
+			log.Fatalf("[ERROR]: Failed to initialize Pinot receiver: %v", err)
+		}
+	} else {
+		if *kafkaBrokers != "" {
+			log.Fatal("[ERROR]: --kafkaBrokers requires --generateTables")
+		}
+		server = newFileConfigReceiver(*pinotControllerURL, *configDir, batchCfg)
+	}
+
+	log.Println("[INFO]: Pinot Receiver Initialized")
+
+	// ingest buffered rows on shutdown
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		if err := server.Close(); err != nil {
+			log.Println("[ERROR]: Unable to ingest buffered rows: " + err.Error())
+		}
+		os.Exit(0)
+	}()
+
+	if err := sinks.ListenAndServe(server, *port); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newFileConfigReceiver creates a receiver writing to the table configured
+// in configDir, exiting if the configs are invalid
+func newFileConfigReceiver(pinotControllerURL, configDir string, batchCfg BatchConfig) *PinotReceiver {
 	// Verify config directory exists
-	if _, err := os.Stat(*configDir); os.IsNotExist(err) {
-		log.Fatalf("[ERROR]: Config directory %s does not exist.", *configDir)
-		return
+	if _, err := os.Stat(configDir); os.IsNotExist(err) {
+		log.Fatalf("[ERROR]: Config directory %s does not exist.", configDir)
 	}
 
 	// Verify schema.json exists and get table name
-	schemaPath := filepath.Join(*configDir, "schema.json")
+	schemaPath := filepath.Join(configDir, "schema.json")
 	if _, err := os.Stat(schemaPath); os.IsNotExist(err) {
 		log.Fatalf("[ERROR]: Schema file %s does not exist.", schemaPath)
-		return
 	}
 
 	// Extract table name from schema.json
 	schemaData, err := os.ReadFile(schemaPath)
 	if err != nil {
 		log.Fatalf("[ERROR]: Failed to read schema file: %v", err)
-		return
 	}
 
 	var schemaConfig map[string]interface{}
 	if err := json.Unmarshal(schemaData, &schemaConfig); err != nil {
 		log.Fatalf("[ERROR]: Failed to parse schema file: %v", err)
-		return
 	}
 
 	tableName, ok := schemaConfig["schemaName"].(string)
 	if !ok || tableName == "" {
 		log.Fatalf("[ERROR]: Invalid or missing schemaName in schema.json")
-		return
 	}
 
 	log.Printf("[INFO]: Using table name from schema: %s", tableName)
 
 	// Initialize Pinot receiver
-	server, err := NewPinotReceiver(*pinotControllerURL, tableName, *configDir)
+	server, err := NewPinotReceiver(pinotControllerURL, tableName, configDir, batchCfg)
 	if err != nil {
 		log.Fatalf("[ERROR]: Failed to initialize Pinot receiver: %v", err)
-		return
 	}
+	return server
+}
 
-	log.Println("[INFO]: Pinot Receiver Initialized")
-
-	if err := sinks.ListenAndServe(server, *port); err != nil {
-		log.Fatal(err)
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
 }
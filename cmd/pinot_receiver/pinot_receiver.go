@@ -13,30 +13,45 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 // PinotReceiver handles sending metrics to a Pinot cluster
 type PinotReceiver struct {
 	ControllerURL string // URL to Pinot controller
-	TableName     string // Name of the table in Pinot
-	ConfigDir     string // Directory containing schema and table config
+	TableName     string // Name of the table in Pinot, only used with ConfigDir
+	ConfigDir     string // Directory containing schema and table config, overrides generated configs
+	TablePrefix   string // Generated tables are named <prefix>_<metric>
 	Client        *http.Client
+	schemas       map[string]*Schema
+	definitions   map[string]metricDefinition
+	mu            sync.Mutex
+	batchCfg      BatchConfig
+	pending       map[string][]map[string]any // buffered rows by table
+	pendingMu     sync.Mutex
+	stream        *StreamConfig
+	producer      messageWriter
+	stop          chan struct{}
+	done          chan struct{}
 	sinks.SyncMetricHandler
 }
 
-func NewPinotReceiver(controllerURL, tableName, configDir string) (*PinotReceiver, error) {
-	receiver := &PinotReceiver{
-		ControllerURL:     controllerURL,
-		TableName:         tableName,
-		ConfigDir:         configDir,
-		Client:            &http.Client{Timeout: 30 * time.Second},
-		SyncMetricHandler: sinks.NewSyncMetricHandler(1024),
+// NewPinotReceiver writes all measurements to a single table created from
+// the schema.json and table.json files in configDir
+func NewPinotReceiver(controllerURL, tableName, configDir string, batchCfg BatchConfig) (*PinotReceiver, error) {
+	if err := batchCfg.Validate(); err != nil {
+		return nil, err
 	}
 
+	receiver := newReceiver(controllerURL, batchCfg)
+	receiver.TableName = tableName
+	receiver.ConfigDir = configDir
+
 	// Ensure config directory exists
 	if _, err := os.Stat(configDir); os.IsNotExist(err) {
 		return nil, fmt.Errorf("config directory %s does not exist", configDir)
@@ -47,11 +62,70 @@ func NewPinotReceiver(controllerURL, tableName, configDir string) (*PinotReceive
 		return nil, fmt.Errorf("failed to initialize Pinot table: %v", err)
 	}
 
-	go receiver.HandleSyncMetric()
+	receiver.start()
+	return receiver, nil
+}
+
+// NewAutoPinotReceiver writes each metric to its own table. Schemas and
+// table configs are generated from the measurements and the metric
+// definitions sent by pgwatch, and schemas grow with new fields.
+// With stream set, REALTIME tables consuming Kafka topics are created
+// instead of OFFLINE tables.
+func NewAutoPinotReceiver(controllerURL, tablePrefix string, batchCfg BatchConfig, stream *StreamConfig) (*PinotReceiver, error) {
+	if err := batchCfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	receiver := newReceiver(controllerURL, batchCfg)
+	receiver.TablePrefix = tablePrefix
+	if stream != nil {
+		if err := stream.Validate(); err != nil {
+			return nil, err
+		}
+		receiver.stream = stream
+		receiver.producer = newKafkaWriter(stream)
+	}
 
+	receiver.start()
 	return receiver, nil
 }
 
+func newReceiver(controllerURL string, batchCfg BatchConfig) *PinotReceiver {
+	return &PinotReceiver{
+		ControllerURL:     controllerURL,
+		Client:            &http.Client{Timeout: 30 * time.Second},
+		schemas:           make(map[string]*Schema),
+		definitions:       make(map[string]metricDefinition),
+		batchCfg:          batchCfg,
+		pending:           make(map[string][]map[string]any),
+		stop:              make(chan struct{}),
+		done:              make(chan struct{}),
+		SyncMetricHandler: sinks.NewSyncMetricHandler(1024),
+	}
+}
+
+func (r *PinotReceiver) start() {
+	go r.HandleSyncMetric()
+	// the Kafka writer batches on its own
+	if r.batchCfg.FlushInterval > 0 && r.stream == nil {
+		go r.flushPeriodically()
+	} else {
+		close(r.done)
+	}
+}
+
+// Close ingests buffered rows and closes the Kafka writer
+func (r *PinotReceiver) Close() error {
+	close(r.stop)
+	<-r.done
+
+	err := r.flush()
+	if r.producer != nil {
+		err = errors.Join(err, r.producer.Close())
+	}
+	return err
+}
+
 // initializePinotTable creates the schema and table in Pinot if they don't exist
 func (r *PinotReceiver) initializePinotTable() error {
 	// Check for required schema and table config files
@@ -91,8 +165,14 @@ func (r *PinotReceiver) initializePinotTable() error {
 		return fmt.Errorf("failed to parse table config: %v", err)
 	}
 
-	schemaName := schemaConfig["schemaName"].(string)
-	tableName := tableConfig["tableName"].(string)
+	schemaName, ok := schemaConfig["schemaName"].(string)
+	if !ok || schemaName == "" {
+		return fmt.Errorf("schemaName missing in %s", schemaConfigPath)
+	}
+	tableName, ok := tableConfig["tableName"].(string)
+	if !ok || tableName == "" {
+		return fmt.Errorf("tableName missing in %s", tableConfigPath)
+	}
 
 	if schemaName != tableName {
 		return fmt.Errorf("schema name (%s) does not match table name (%s)", schemaName, tableName)
@@ -121,42 +201,17 @@ func (r *PinotReceiver) uploadSchema(schemaPath string) error {
 	if err != nil {
 		return err
 	}
+	return r.postSchema(schemaData)
+}
 
+// postSchema creates a schema, existing schemas are left unchanged
+func (r *PinotReceiver) postSchema(schemaData []byte) error {
 	// Log the exact schema being sent to Pinot
 	log.Printf("[DEBUG]: Schema being sent to Pinot: %s", string(schemaData))
 
-	// URL for schema upload
-	url := fmt.Sprintf("%s/schemas", r.ControllerURL)
-	log.Printf("[DEBUG]: Sending schema to: %s", url)
-
-	// Create request
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(schemaData))
-	if err != nil {
-		return err
+	if err := r.sendConfig(http.MethodPost, "/schemas", schemaData); err != nil {
+		return fmt.Errorf("failed to upload schema: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
-
-	// Send request
-	resp, err := r.Client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer func() {_ = resp.Body.Close()}()
-
-	// Check response
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(resp.Body)
-		// Log full response for debugging
-		log.Printf("[ERROR]: Pinot schema upload response: %s", string(body))
-
-		// If error message indicates schema already exists, that's fine
-		if bytes.Contains(body, []byte("already exists")) {
-			log.Printf("[INFO]: Schema %s already exists", r.TableName)
-			return nil
-		}
-		return fmt.Errorf("failed to upload schema: %s - %s", resp.Status, string(body))
-	}
-
 	return nil
 }
 
@@ -167,91 +222,189 @@ func (r *PinotReceiver) createTable(tableConfigPath string) error {
 	if err != nil {
 		return err
 	}
+	return r.postTable(tableData)
+}
 
+// postTable creates a table, existing tables are left unchanged
+func (r *PinotReceiver) postTable(tableData []byte) error {
 	// Log the exact table config being sent to Pinot
 	log.Printf("[DEBUG]: Table configuration being sent to Pinot: %s", string(tableData))
 
-	// URL for table creation
-	url := fmt.Sprintf("%s/tables", r.ControllerURL)
-	log.Printf("[DEBUG]: Sending table creation request to: %s", url)
+	if err := r.sendConfig(http.MethodPost, "/tables", tableData); err != nil {
+		return fmt.Errorf("failed to create table: %w", err)
+	}
+	return nil
+}
+
+// sendConfig sends a schema or table config to the controller. Configs
+// that already exist are fine.
+func (r *PinotReceiver) sendConfig(method, path string, data []byte) error {
+	url := r.ControllerURL + path
+	log.Printf("[DEBUG]: Sending config to: %s", url)
 
-	// Create request
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(tableData))
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(data))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	// Send request
 	resp, err := r.Client.Do(req)
 	if err != nil {
 		return err
 	}
-	defer func() {_ = resp.Body.Close()}()
+	defer func() { _ = resp.Body.Close() }()
 
-	// Check response (table might already exist, which is fine)
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
 		body, _ := io.ReadAll(resp.Body)
-		// Log full response for debugging
-		log.Printf("[ERROR]: Pinot table creation response: %s", string(body))
-
-		// If error message indicates table already exists, that's fine
 		if bytes.Contains(body, []byte("already exists")) {
-			log.Printf("[INFO]: Table %s already exists", r.TableName)
+			log.Printf("[INFO]: %s already exists", path)
 			return nil
 		}
-		return fmt.Errorf("failed to create table: %s - %s", resp.Status, string(body))
+		log.Printf("[ERROR]: Pinot response: %s", string(body))
+		return fmt.Errorf("%s - %s", resp.Status, string(body))
 	}
-
 	return nil
 }
 
-func (r *PinotReceiver) insertData(dbName, metricName, data, customTags string) error {
-	// Format data for Pinot ingestion
-	ingestionData := map[string]interface{}{
-		"dbname":      dbName,
-		"metric_name": metricName,
-		"data":        data,
-		"custom_tags": customTags,
-		"timestamp":   time.Now().UnixMilli(),
+// fetchSchema returns the schema of table from the controller, nil if
+// there is none
+func (r *PinotReceiver) fetchSchema(table string) (*Schema, error) {
+	resp, err := r.Client.Get(r.ControllerURL + "/schemas/" + url.PathEscape(table))
+	if err != nil {
+		return nil, err
 	}
+	defer func() { _ = resp.Body.Close() }()
 
-	// Convert to JSON
-	jsonData, err := json.Marshal([]map[string]interface{}{ingestionData})
-	if err != nil {
-		return err
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to fetch schema %s: %s - %s", table, resp.Status, string(body))
 	}
 
-	// Create a file with the JSON data
-	tempFile, err := os.CreateTemp("", "pinot-ingestion-*.json")
+	var schema Schema
+	if err = json.NewDecoder(resp.Body).Decode(&schema); err != nil {
+		return nil, fmt.Errorf("failed to parse schema %s: %w", table, err)
+	}
+	return &schema, nil
+}
+
+// ensureTable creates the schema and table of metric on first sight and
+// adds columns for new fields or gauges to the schema. Callers hold r.mu.
+func (r *PinotReceiver) ensureTable(metric string, data []*structpb.Struct) (*Schema, error) {
+	definition := r.definitions[metric]
+	name := metric
+	if definition.StorageName != "" {
+		name = definition.StorageName
+	}
+	table := tableName(r.TablePrefix, name)
+
+	schema, known := r.schemas[table]
+	if !known {
+		existing, err := r.fetchSchema(table)
+		if err != nil {
+			return nil, err
+		}
+		schema = existing
+	}
+
+	created := schema == nil
+	if created {
+		schema = newSchema(table)
+	}
+
+	changed := false
+	for _, gauge := range definition.gauges() {
+		if schema.dataType(gauge) == "" {
+			schema.addColumn(gauge, typeDouble)
+			changed = true
+		}
+	}
+	if schema.addFields(data) {
+		changed = true
+	}
+	if !created && !changed {
+		r.schemas[table] = schema
+		return schema, nil
+	}
+
+	schemaData, err := json.Marshal(schema)
 	if err != nil {
-		return fmt.Errorf("failed to create temp file: %v", err)
+		return nil, err
 	}
-	defer func() {_ = os.Remove(tempFile.Name())}()
-	defer func() {_ = tempFile.Close()}()
 
-	if _, err := tempFile.Write(jsonData); err != nil {
-		return fmt.Errorf("failed to write to temp file: %v", err)
+	if created {
+		if err = r.postSchema(schemaData); err != nil {
+			return nil, err
+		}
+		config := tableConfig(schema)
+		if r.stream != nil {
+			config = realtimeTableConfig(schema, r.stream)
+		}
+		tableData, err := json.Marshal(config)
+		if err != nil {
+			return nil, err
+		}
+		if err = r.postTable(tableData); err != nil {
+			return nil, err
+		}
+		log.Printf("[INFO]: Created table %s for metric %s", table, metric)
+	} else {
+		// new columns are backward compatible, reload applies them to existing segments
+		if err = r.sendConfig(http.MethodPut, "/schemas/"+url.PathEscape(table)+"?reload=true", schemaData); err != nil {
+			delete(r.schemas, table)
+			return nil, fmt.Errorf("failed to update schema: %w", err)
+		}
+		log.Printf("[INFO]: Added columns to schema %s", table)
 	}
-	_ = tempFile.Close() // Close the file before reading it
 
-	// Create a buffer to hold the multipart form data
-	var buffer bytes.Buffer
-	writer := multipart.NewWriter(&buffer)
+	r.schemas[table] = schema
+	return schema, nil
+}
 
-	// Open the temp file for reading
-	fileReader, err := os.Open(tempFile.Name())
+// rows converts the measurements of msg to rows of schema
+func rows(schema *Schema, msg *pb.MeasurementEnvelope) []map[string]any {
+	tags := make(map[string]any, len(msg.GetCustomTags()))
+	for key, value := range msg.GetCustomTags() {
+		tags[key] = value
+	}
+
+	result := make([]map[string]any, 0, len(msg.GetData()))
+	for _, measurement := range msg.GetData() {
+		row := map[string]any{
+			"dbname":      msg.GetDBName(),
+			"metric_name": msg.GetMetricName(),
+			"custom_tags": tags,
+			"timestamp":   sinks.MeasurementTime(measurement, time.Now().UTC()).UnixMilli(),
+		}
+		for field, value := range measurement.GetFields() {
+			name := columnName(field)
+			if converted, ok := convertValue(schema.dataType(name), value); ok {
+				row[name] = converted
+			}
+		}
+		result = append(result, row)
+	}
+	return result
+}
+
+// ingest uploads rows to the OFFLINE table as one segment
+func (r *PinotReceiver) ingest(table string, rows []map[string]any) error {
+	jsonData, err := json.Marshal(rows)
 	if err != nil {
-		return fmt.Errorf("failed to open temp file: %v", err)
+		return err
 	}
-	defer func() {_ = fileReader.Close()}()
 
-	// Add the file to the form
+	// Create a buffer to hold the multipart form data
+	var buffer bytes.Buffer
+	writer := multipart.NewWriter(&buffer)
+
 	filePart, err := writer.CreateFormFile("file", "data.json")
 	if err != nil {
 		return fmt.Errorf("failed to create form file: %v", err)
 	}
-	if _, err := io.Copy(filePart, fileReader); err != nil {
+	if _, err := filePart.Write(jsonData); err != nil {
 		return fmt.Errorf("failed to copy file data: %v", err)
 	}
 
@@ -263,24 +416,20 @@ func (r *PinotReceiver) insertData(dbName, metricName, data, customTags string)
 	// URL with batchConfigMapStr parameter for JSON input format
 	batchConfig := url.QueryEscape(`{"inputFormat":"json"}`)
 	url := fmt.Sprintf("%s/ingestFromFile?tableNameWithType=%s_OFFLINE&batchConfigMapStr=%s",
-		r.ControllerURL, r.TableName, batchConfig)
+		r.ControllerURL, table, batchConfig)
 	log.Printf("[DEBUG] Sending to URL: %s", url)
 
-	// Create the HTTP request
 	req, err := http.NewRequest("POST", url, &buffer)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %v", err)
 	}
-
-	// Set the content type header
 	req.Header.Set("Content-Type", writer.FormDataContentType())
 
-	// Send the request
 	resp, err := r.Client.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to send request: %v", err)
 	}
-	defer func() {_ = resp.Body.Close()}()
+	defer func() { _ = resp.Body.Close() }()
 
 	// Read and log the response
 	body, _ := io.ReadAll(resp.Body)
@@ -295,29 +444,101 @@ func (r *PinotReceiver) insertData(dbName, metricName, data, customTags string)
 }
 
 func (r *PinotReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
+	if r.ConfigDir == "" {
+		return r.updateGeneratedTable(ctx, msg)
+	}
+
 	customTagsJSON, err := sinks.GetJson(msg.GetCustomTags())
 	if err != nil {
 		return nil, err
 	}
 
 	reply := &pb.Reply{}
-	for _, measurement := range msg.GetData() {
-		if ctx.Err() != nil {
-			reply.Logmsg = "context cancelled, stopping writer..."
-			return reply, nil
-		}
+	if ctx.Err() != nil {
+		reply.Logmsg = "context cancelled, stopping writer..."
+		return reply, nil
+	}
 
+	rows := make([]map[string]any, 0, len(msg.GetData()))
+	for _, measurement := range msg.GetData() {
 		measurementJSON, err := sinks.GetJson(measurement)
 		if err != nil {
 			continue
 		}
-		err = r.insertData(msg.GetDBName(), msg.GetMetricName(), measurementJSON, customTagsJSON)
-		if err != nil {
-			logMsg := fmt.Sprintf("error inserting data: %v", err)
-			return nil, errors.New(logMsg)
-		}
+		rows = append(rows, map[string]any{
+			"dbname":      msg.GetDBName(),
+			"metric_name": msg.GetMetricName(),
+			"data":        measurementJSON,
+			"custom_tags": customTagsJSON,
+			"timestamp":   sinks.MeasurementTime(measurement, time.Now().UTC()).UnixMilli(),
+		})
+	}
+
+	if err = r.add(r.TableName, rows); err != nil {
+		return nil, fmt.Errorf("error inserting data: %w", err)
 	}
 	log.Println("[INFO]: Successfully inserted batch at : " + time.Now().String())
 
 	return reply, nil
-}
\ No newline at end of file
+}
+
+func (r *PinotReceiver) updateGeneratedTable(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
+	if ctx.Err() != nil {
+		return &pb.Reply{Logmsg: "context cancelled, stopping writer..."}, nil
+	}
+
+	// the schema gains columns for new fields of concurrent calls, so
+	// the rows are converted while it can't change
+	r.mu.Lock()
+	schema, err := r.ensureTable(msg.GetMetricName(), msg.GetData())
+	var converted []map[string]any
+	if err == nil {
+		converted = rows(schema, msg)
+	}
+	r.mu.Unlock()
+	if err != nil {
+		log.Println("[ERROR]: Unable to prepare table: " + err.Error())
+		return nil, err
+	}
+
+	if r.stream != nil {
+		err = r.publish(ctx, schema.SchemaName, converted)
+	} else {
+		err = r.add(schema.SchemaName, converted)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error inserting data: %w", err)
+	}
+	log.Println("[INFO]: Successfully inserted batch at : " + time.Now().String())
+	return &pb.Reply{}, nil
+}
+
+// DefineMetrics remembers the gauges and storage names of metrics and
+// creates tables for metrics with known gauges upfront
+func (r *PinotReceiver) DefineMetrics(ctx context.Context, payload *structpb.Struct) (*pb.Reply, error) {
+	if r.ConfigDir != "" {
+		return &pb.Reply{Logmsg: "metric definitions ignored, using configured table"}, nil
+	}
+
+	definitions, err := parseDefinitions(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metric definitions: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, metric := range sinks.SortedKeys(definitions) {
+		r.definitions[metric] = definitions[metric]
+		if len(definitions[metric].gauges()) == 0 {
+			continue
+		}
+		if _, err2 := r.ensureTable(metric, nil); err2 != nil {
+			err = errors.Join(err, fmt.Errorf("metric %s: %w", metric, err2))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pb.Reply{Logmsg: fmt.Sprintf("%d metric definitions received", len(definitions))}, nil
+}
@@ -2,15 +2,25 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"github.com/segmentio/kafka-go"
+	kafkaprotocol "github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/produce"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 // mockHTTPServer creates a mock Pinot controller server for testing
@@ -110,12 +120,12 @@ func TestNewPinotReceiver(t *testing.T) {
 	defer cleanup()
 
 	// Test valid initialization
-	receiver, err := NewPinotReceiver(server.URL, "pgwatch_metrics", configDir)
+	receiver, err := NewPinotReceiver(server.URL, "pgwatch_metrics", configDir, BatchConfig{})
 	assert.NoError(t, err, "NewPinotReceiver should initialize without error")
 	assert.NotNil(t, receiver, "Receiver should not be nil")
 
 	// Test with invalid config dir
-	_, err = NewPinotReceiver(server.URL, "pgwatch_metrics", "/non/existent/dir")
+	_, err = NewPinotReceiver(server.URL, "pgwatch_metrics", "/non/existent/dir", BatchConfig{})
 	assert.Error(t, err, "Should error with non-existent config dir")
 	assert.Contains(t, err.Error(), "config directory", "Error should mention config directory")
 }
@@ -127,7 +137,7 @@ func TestInitializePinotTable(t *testing.T) {
 	configDir, cleanup := setupTestConfigDir(t)
 	defer cleanup()
 
-	_, err := NewPinotReceiver(server.URL, "pgwatch_metrics", configDir)
+	_, err := NewPinotReceiver(server.URL, "pgwatch_metrics", configDir, BatchConfig{})
 	assert.NoError(t, err, "NewPinotReceiver should initialize without error")
 
 	// Test is already covered by initialization, but we can add additional test cases:
@@ -153,7 +163,7 @@ func TestUpdateMeasurements(t *testing.T) {
 	configDir, cleanup := setupTestConfigDir(t)
 	defer cleanup()
 
-	receiver, err := NewPinotReceiver(server.URL, "pgwatch_metrics", configDir)
+	receiver, err := NewPinotReceiver(server.URL, "pgwatch_metrics", configDir, BatchConfig{})
 	assert.NoError(t, err)
 
 	msg := testutils.GetTestMeasurementEnvelope()
@@ -195,4 +205,375 @@ func TestPinotAPIErrors(t *testing.T) {
 	err = receiver.createTable(filepath.Join(configDir, "table.json"))
 	assert.Error(t, err, "Should error when Pinot API returns error")
 	assert.Contains(t, err.Error(), "failed to create table", "Error should mention table creation failure")
-}
\ No newline at end of file
+}
+// controllerStandIn keeps schemas, tables and ingested rows like a Pinot controller
+type controllerStandIn struct {
+	mu            sync.Mutex
+	schemas       map[string]*Schema
+	tables        map[string]map[string]any
+	schemaUpdates int
+	ingested      map[string][]map[string]any
+	segments      int
+	failIngest    bool
+}
+
+func newControllerStandIn() (*controllerStandIn, *httptest.Server) {
+	c := &controllerStandIn{
+		schemas:  make(map[string]*Schema),
+		tables:   make(map[string]map[string]any),
+		ingested: make(map[string][]map[string]any),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /schemas/{name}", func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		schema, ok := c.schemas[r.PathValue("name")]
+		if !ok {
+			http.Error(w, `{"code":404,"error":"Schema not found"}`, http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(schema)
+	})
+	mux.HandleFunc("POST /schemas", func(w http.ResponseWriter, r *http.Request) {
+		var schema Schema
+		_ = json.NewDecoder(r.Body).Decode(&schema)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if _, ok := c.schemas[schema.SchemaName]; ok {
+			http.Error(w, "schema already exists", http.StatusConflict)
+			return
+		}
+		c.schemas[schema.SchemaName] = &schema
+	})
+	mux.HandleFunc("PUT /schemas/{name}", func(w http.ResponseWriter, r *http.Request) {
+		var schema Schema
+		_ = json.NewDecoder(r.Body).Decode(&schema)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.schemas[r.PathValue("name")] = &schema
+		c.schemaUpdates++
+	})
+	mux.HandleFunc("POST /tables", func(w http.ResponseWriter, r *http.Request) {
+		var table map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&table)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.tables[table["tableName"].(string)] = table
+	})
+	mux.HandleFunc("POST /ingestFromFile", func(w http.ResponseWriter, r *http.Request) {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var rows []map[string]any
+		_ = json.NewDecoder(file).Decode(&rows)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.failIngest {
+			http.Error(w, "server unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		table := r.URL.Query().Get("tableNameWithType")
+		c.ingested[table] = append(c.ingested[table], rows...)
+		c.segments++
+	})
+	return c, httptest.NewServer(mux)
+}
+
+func TestAutoTables(t *testing.T) {
+	controller, server := newControllerStandIn()
+	defer server.Close()
+
+	receiver, err := NewAutoPinotReceiver(server.URL, "pgwatch", BatchConfig{}, nil)
+	assert.NoError(t, err)
+	_, err = receiver.UpdateMeasurements(context.Background(), testutils.GetTestMeasurementEnvelope())
+	assert.NoError(t, err)
+
+	schema := controller.schemas["pgwatch_testMetric"]
+	assert.Equal(t, typeString, schema.dataType("key"))
+	assert.Equal(t, typeTime, schema.dataType("timestamp"))
+	assert.Contains(t, controller.tables, "pgwatch_testMetric")
+	assert.Len(t, controller.ingested["pgwatch_testMetric_OFFLINE"], 1)
+	assert.Equal(t, "val", controller.ingested["pgwatch_testMetric_OFFLINE"][0]["key"])
+
+	// new fields are added to the schema
+	msg := testutils.GetTestMeasurementEnvelope()
+	msg.Data[0].Fields["calls"] = structpb.NewNumberValue(3)
+	msg.Data[0].Fields["dbname"] = structpb.NewStringValue("postgres")
+	_, err = receiver.UpdateMeasurements(context.Background(), msg)
+	assert.NoError(t, err)
+
+	schema = controller.schemas["pgwatch_testMetric"]
+	assert.Equal(t, 1, controller.schemaUpdates)
+	assert.Equal(t, typeDouble, schema.dataType("calls"))
+	assert.Equal(t, typeString, schema.dataType("data_dbname"))
+	rows := controller.ingested["pgwatch_testMetric_OFFLINE"]
+	assert.Equal(t, 3.0, rows[1]["calls"])
+	assert.Equal(t, "test", rows[1]["dbname"])
+
+	// a restarted receiver picks up the existing schema
+	receiver, err = NewAutoPinotReceiver(server.URL, "pgwatch", BatchConfig{}, nil)
+	assert.NoError(t, err)
+	_, err = receiver.UpdateMeasurements(context.Background(), msg)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, controller.schemaUpdates)
+}
+
+func TestConcurrentFields(t *testing.T) {
+	controller, server := newControllerStandIn()
+	defer server.Close()
+
+	receiver, err := NewAutoPinotReceiver(server.URL, "pgwatch", BatchConfig{}, nil)
+	assert.NoError(t, err)
+
+	// every call adds a column to the schema the others convert rows with
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := testutils.GetTestMeasurementEnvelope()
+			msg.Data[0].Fields[fmt.Sprintf("field_%d", i)] = structpb.NewNumberValue(float64(i))
+			_, err := receiver.UpdateMeasurements(context.Background(), msg)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.NoError(t, receiver.Close())
+
+	controller.mu.Lock()
+	defer controller.mu.Unlock()
+	assert.Len(t, controller.ingested["pgwatch_testMetric_OFFLINE"], 50)
+	for i := range 50 {
+		assert.Equal(t, typeDouble, controller.schemas["pgwatch_testMetric"].dataType(fmt.Sprintf("field_%d", i)))
+	}
+}
+
+func TestDefineMetrics(t *testing.T) {
+	controller, server := newControllerStandIn()
+	defer server.Close()
+
+	receiver, err := NewAutoPinotReceiver(server.URL, "pgwatch", BatchConfig{}, nil)
+	assert.NoError(t, err)
+	payload, err := structpb.NewStruct(map[string]any{
+		"metrics": map[string]any{
+			"db_stats":   map[string]any{"gauges": []any{"numbackends"}},
+			"wal":        map[string]any{"gauges": []any{"*"}},
+			"backends_2": map[string]any{"storage_name": "backends"},
+		},
+	})
+	assert.NoError(t, err)
+
+	reply, err := receiver.DefineMetrics(context.Background(), payload)
+	assert.NoError(t, err)
+	assert.Equal(t, "3 metric definitions received", reply.GetLogmsg())
+
+	// only metrics with known gauges get tables upfront
+	assert.Equal(t, typeDouble, controller.schemas["pgwatch_db_stats"].dataType("numbackends"))
+	assert.NotContains(t, controller.schemas, "pgwatch_wal")
+
+	msg := testutils.GetTestMeasurementEnvelope()
+	msg.MetricName = "backends_2"
+	_, err = receiver.UpdateMeasurements(context.Background(), msg)
+	assert.NoError(t, err)
+	assert.Len(t, controller.ingested["pgwatch_backends_OFFLINE"], 1)
+}
+
+func TestMissingConfigNames(t *testing.T) {
+	server := mockHTTPServer()
+	defer server.Close()
+
+	configDir, cleanup := setupTestConfigDir(t)
+	defer cleanup()
+
+	// a schema without schemaName is an error, not a panic
+	err := os.WriteFile(filepath.Join(configDir, "schema.json"), []byte(`{"dimensionFieldSpecs": []}`), 0644)
+	assert.NoError(t, err)
+	_, err = NewPinotReceiver(server.URL, "pgwatch_metrics", configDir, BatchConfig{})
+	assert.ErrorContains(t, err, "schemaName missing")
+}
+
+func TestBatching(t *testing.T) {
+	controller, server := newControllerStandIn()
+	defer server.Close()
+
+	receiver, err := NewAutoPinotReceiver(server.URL, "pgwatch", BatchConfig{FlushInterval: time.Hour, MaxRows: 5}, nil)
+	assert.NoError(t, err)
+
+	msg := testutils.GetTestMeasurementEnvelope()
+	for range 3 {
+		_, err = receiver.UpdateMeasurements(context.Background(), msg)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 0, controller.segments)
+
+	// rows of a table are ingested together once MaxRows are buffered
+	for range 2 {
+		_, err = receiver.UpdateMeasurements(context.Background(), msg)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, controller.segments)
+	assert.Len(t, controller.ingested["pgwatch_testMetric_OFFLINE"], 5)
+
+	// Close ingests the rest
+	_, err = receiver.UpdateMeasurements(context.Background(), msg)
+	assert.NoError(t, err)
+	assert.NoError(t, receiver.Close())
+	assert.Equal(t, 2, controller.segments)
+	assert.Len(t, controller.ingested["pgwatch_testMetric_OFFLINE"], 6)
+}
+
+func TestEarlyIngestFailure(t *testing.T) {
+	controller, server := newControllerStandIn()
+	defer server.Close()
+
+	receiver, err := NewAutoPinotReceiver(server.URL, "pgwatch", BatchConfig{FlushInterval: time.Hour, MaxRows: 2}, nil)
+	assert.NoError(t, err)
+
+	controller.mu.Lock()
+	controller.failIngest = true
+	controller.mu.Unlock()
+	for range 2 {
+		_, err = receiver.UpdateMeasurements(context.Background(), testutils.GetTestMeasurementEnvelope())
+		assert.NoError(t, err, "failed rows are retried, pgwatch must not send them again")
+	}
+
+	controller.mu.Lock()
+	controller.failIngest = false
+	controller.mu.Unlock()
+	assert.NoError(t, receiver.Close())
+	assert.Len(t, controller.ingested["pgwatch_testMetric_OFFLINE"], 2)
+}
+
+func TestFlushInterval(t *testing.T) {
+	controller, server := newControllerStandIn()
+	defer server.Close()
+
+	configDir, cleanup := setupTestConfigDir(t)
+	defer cleanup()
+
+	receiver, err := NewPinotReceiver(server.URL, "pgwatch_metrics", configDir, BatchConfig{FlushInterval: 50 * time.Millisecond})
+	assert.NoError(t, err)
+	defer func() { _ = receiver.Close() }()
+
+	for range 10 {
+		_, err = receiver.UpdateMeasurements(context.Background(), testutils.GetTestMeasurementEnvelope())
+		assert.NoError(t, err)
+	}
+
+	assert.Eventually(t, func() bool {
+		controller.mu.Lock()
+		defer controller.mu.Unlock()
+		return len(controller.ingested["pgwatch_metrics_OFFLINE"]) == 10
+	}, 5*time.Second, 10*time.Millisecond)
+	controller.mu.Lock()
+	defer controller.mu.Unlock()
+	assert.Equal(t, 1, controller.segments)
+}
+
+// fakeWriter records messages instead of writing them to Kafka
+type fakeWriter struct {
+	messages []kafka.Message
+	closed   bool
+}
+
+func (w *fakeWriter) WriteMessages(_ context.Context, msgs ...kafka.Message) error {
+	w.messages = append(w.messages, msgs...)
+	return nil
+}
+
+func (w *fakeWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestRealtime(t *testing.T) {
+	controller, server := newControllerStandIn()
+	defer server.Close()
+
+	_, err := NewAutoPinotReceiver(server.URL, "pgwatch", BatchConfig{}, &StreamConfig{})
+	assert.Error(t, err, "brokers are required")
+
+	stream := &StreamConfig{
+		Brokers:          []string{"localhost:9092"},
+		PinotBrokers:     []string{"kafka:29092"},
+		TopicPrefix:      "pgwatch.",
+		SegmentFlushTime: time.Hour,
+	}
+	receiver, err := NewAutoPinotReceiver(server.URL, "pgwatch", BatchConfig{}, stream)
+	assert.NoError(t, err)
+	writer := &fakeWriter{}
+	receiver.producer = writer
+
+	_, err = receiver.UpdateMeasurements(context.Background(), testutils.GetTestMeasurementEnvelope())
+	assert.NoError(t, err)
+
+	// a REALTIME table consuming the metric's topic is created
+	table := controller.tables["pgwatch_testMetric"]
+	assert.Equal(t, "REALTIME", table["tableType"])
+	streamConfigs := table["ingestionConfig"].(map[string]any)["streamIngestionConfig"].(map[string]any)["streamConfigMaps"].([]any)
+	streamConfig := streamConfigs[0].(map[string]any)
+	assert.Equal(t, "pgwatch.pgwatch_testMetric", streamConfig["stream.kafka.topic.name"])
+	assert.Equal(t, "kafka:29092", streamConfig["stream.kafka.broker.list"])
+	assert.Equal(t, "60m", streamConfig["realtime.segment.flush.threshold.time"])
+
+	// rows go to Kafka instead of the controller
+	assert.Equal(t, 0, controller.segments)
+	assert.Len(t, writer.messages, 1)
+	assert.Equal(t, "pgwatch.pgwatch_testMetric", writer.messages[0].Topic)
+	assert.Equal(t, "test", string(writer.messages[0].Key))
+	var row map[string]any
+	assert.NoError(t, json.Unmarshal(writer.messages[0].Value, &row))
+	assert.Equal(t, "val", row["key"])
+
+	assert.NoError(t, receiver.Close())
+	assert.True(t, writer.closed)
+}
+
+// brokerStandIn answers the metadata and produce requests of a kafka.Writer
+type brokerStandIn struct {
+	mu       sync.Mutex
+	produced int
+}
+
+func (b *brokerStandIn) RoundTrip(_ context.Context, _ net.Addr, req kafkaprotocol.Message) (kafkaprotocol.Message, error) {
+	switch req := req.(type) {
+	case *metadata.Request:
+		res := &metadata.Response{}
+		for _, topic := range req.TopicNames {
+			res.Topics = append(res.Topics, metadata.ResponseTopic{Name: topic, Partitions: []metadata.ResponsePartition{{}}})
+		}
+		return res, nil
+	case *produce.Request:
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.produced++
+		res := &produce.Response{}
+		for _, topic := range req.Topics {
+			res.Topics = append(res.Topics, produce.ResponseTopic{Topic: topic.Topic, Partitions: []produce.ResponsePartition{{}}})
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("unexpected request %T", req)
+}
+
+func TestRealtimeWriteLatency(t *testing.T) {
+	_, server := newControllerStandIn()
+	defer server.Close()
+
+	stream := &StreamConfig{Brokers: []string{"localhost:9092"}, SegmentFlushTime: time.Hour}
+	receiver, err := NewAutoPinotReceiver(server.URL, "pgwatch", BatchConfig{FlushInterval: 30 * time.Second, MaxRows: 50000}, stream)
+	assert.NoError(t, err)
+	broker := &brokerStandIn{}
+	receiver.producer.(*kafka.Writer).Transport = broker
+	defer func() { _ = receiver.Close() }()
+
+	// the OFFLINE batching settings must not delay writes to Kafka
+	start := time.Now()
+	_, err = receiver.UpdateMeasurements(context.Background(), testutils.GetTestMeasurementEnvelope())
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, 1, broker.produced)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Pinot data types used in generated schemas
+const (
+	typeDouble  = "DOUBLE"
+	typeBoolean = "BOOLEAN"
+	typeString  = "STRING"
+	typeJSON    = "JSON"
+	typeTime    = "TIMESTAMP"
+)
+
+// reservedColumns are part of every generated schema, measurement fields
+// with the same name are stored as data_<name>
+var reservedColumns = map[string]bool{
+	"dbname":      true,
+	"metric_name": true,
+	"custom_tags": true,
+	"timestamp":   true,
+}
+
+type FieldSpec struct {
+	Name        string `json:"name"`
+	DataType    string `json:"dataType"`
+	Format      string `json:"format,omitempty"`
+	Granularity string `json:"granularity,omitempty"`
+}
+
+type Schema struct {
+	SchemaName          string      `json:"schemaName"`
+	DimensionFieldSpecs []FieldSpec `json:"dimensionFieldSpecs"`
+	MetricFieldSpecs    []FieldSpec `json:"metricFieldSpecs,omitempty"`
+	DateTimeFieldSpecs  []FieldSpec `json:"dateTimeFieldSpecs"`
+}
+
+// newSchema returns a schema with the columns every metric table has
+func newSchema(name string) *Schema {
+	return &Schema{
+		SchemaName: name,
+		DimensionFieldSpecs: []FieldSpec{
+			{Name: "dbname", DataType: typeString},
+			{Name: "metric_name", DataType: typeString},
+			{Name: "custom_tags", DataType: typeJSON},
+		},
+		DateTimeFieldSpecs: []FieldSpec{
+			{Name: "timestamp", DataType: typeTime, Format: "1:MILLISECONDS:EPOCH", Granularity: "1:MILLISECONDS"},
+		},
+	}
+}
+
+// dataType returns the type of column name, or "" if it doesn't exist
+func (s *Schema) dataType(name string) string {
+	for _, specs := range [][]FieldSpec{s.DimensionFieldSpecs, s.MetricFieldSpecs, s.DateTimeFieldSpecs} {
+		for _, spec := range specs {
+			if spec.Name == name {
+				return spec.DataType
+			}
+		}
+	}
+	return ""
+}
+
+// addColumn adds numeric columns as metrics and all others as dimensions
+func (s *Schema) addColumn(name, dataType string) {
+	spec := FieldSpec{Name: name, DataType: dataType}
+	if dataType == typeDouble {
+		s.MetricFieldSpecs = append(s.MetricFieldSpecs, spec)
+	} else {
+		s.DimensionFieldSpecs = append(s.DimensionFieldSpecs, spec)
+	}
+}
+
+// addFields adds columns for the fields of data missing in the schema and
+// reports whether any were added
+func (s *Schema) addFields(data []*structpb.Struct) bool {
+	added := false
+	for _, row := range data {
+		fields := row.GetFields()
+		for _, field := range sinks.SortedKeys(fields) {
+			if field == "epoch_ns" {
+				continue
+			}
+			name := columnName(field)
+			if s.dataType(name) != "" {
+				continue
+			}
+			if dataType := inferType(fields[field]); dataType != "" {
+				s.addColumn(name, dataType)
+				added = true
+			}
+		}
+	}
+	return added
+}
+
+// tableConfig returns an OFFLINE table config for schema
+func tableConfig(schema *Schema) map[string]any {
+	return map[string]any{
+		"tableName": schema.SchemaName,
+		"tableType": "OFFLINE",
+		"segmentsConfig": map[string]any{
+			"schemaName":     schema.SchemaName,
+			"timeColumnName": "timestamp",
+			"timeType":       "MILLISECONDS",
+			"replication":    "1",
+		},
+		"tableIndexConfig": map[string]any{"loadMode": "MMAP"},
+		"tenants":          map[string]any{},
+		"metadata":         map[string]any{},
+	}
+}
+
+// columnName maps a measurement field to its column
+func columnName(field string) string {
+	if reservedColumns[field] {
+		return "data_" + field
+	}
+	return field
+}
+
+var invalidTableChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// tableName returns the table measurements of metric are stored in
+func tableName(prefix, metric string) string {
+	name := metric
+	if prefix != "" {
+		name = prefix + "_" + metric
+	}
+	return invalidTableChars.ReplaceAllString(name, "_")
+}
+
+// inferType returns the column type for v, or "" for nulls
+func inferType(v *structpb.Value) string {
+	switch v.GetKind().(type) {
+	case *structpb.Value_NumberValue:
+		return typeDouble
+	case *structpb.Value_BoolValue:
+		return typeBoolean
+	case *structpb.Value_StringValue:
+		return typeString
+	case *structpb.Value_StructValue, *structpb.Value_ListValue:
+		return typeJSON
+	}
+	return ""
+}
+
+// convertValue converts v for a column of dataType. Values that don't
+// fit are dropped, as Pinot can't change the type of a column.
+func convertValue(dataType string, v *structpb.Value) (any, bool) {
+	switch dataType {
+	case typeDouble:
+		if n, ok := v.GetKind().(*structpb.Value_NumberValue); ok {
+			return n.NumberValue, true
+		}
+	case typeBoolean:
+		if b, ok := v.GetKind().(*structpb.Value_BoolValue); ok {
+			return b.BoolValue, true
+		}
+	case typeString:
+		if s, ok := v.GetKind().(*structpb.Value_StringValue); ok {
+			return s.StringValue, true
+		}
+		if encoded, err := json.Marshal(v.AsInterface()); err == nil {
+			return string(encoded), true
+		}
+	case typeJSON:
+		return v.AsInterface(), true
+	}
+	return nil, false
+}
+
+// metricDefinition holds the parts of a pgwatch metric definition used to
+// generate schemas
+type metricDefinition struct {
+	Gauges      []string `json:"gauges"`
+	StorageName string   `json:"storage_name"`
+}
+
+// parseDefinitions extracts metric definitions from a DefineMetrics payload,
+// i.e. {"metrics": {"<name>": {"gauges": [...], "storage_name": "..."}}}
+func parseDefinitions(payload *structpb.Struct) (map[string]metricDefinition, error) {
+	encoded, err := json.Marshal(payload.AsMap())
+	if err != nil {
+		return nil, err
+	}
+
+	var decoded struct {
+		Metrics map[string]metricDefinition `json:"metrics"`
+	}
+	if err = json.Unmarshal(encoded, &decoded); err != nil {
+		return nil, err
+	}
+	return decoded.Metrics, nil
+}
+
+// gauges returns the numeric columns known from a definition, "*" marks
+// all columns as gauges and tells nothing about their names
+func (d metricDefinition) gauges() []string {
+	var gauges []string
+	for _, gauge := range d.Gauges {
+		if gauge != "*" && strings.TrimSpace(gauge) != "" {
+			gauges = append(gauges, columnName(gauge))
+		}
+	}
+	return gauges
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// StreamConfig enables the REALTIME mode, rows are written to a Kafka
+// topic per table which Pinot consumes
+type StreamConfig struct {
+	Brokers          []string      // Kafka brokers the receiver writes to
+	PinotBrokers     []string      // Kafka brokers as seen by Pinot, defaults to Brokers
+	TopicPrefix      string        // topics are named <prefix><table>
+	SegmentFlushTime time.Duration // Pinot completes consuming segments after this long
+}
+
+func (cfg *StreamConfig) Validate() error {
+	if len(cfg.Brokers) == 0 {
+		return errors.New("at least one Kafka broker is required")
+	}
+	if cfg.SegmentFlushTime < time.Minute {
+		return errors.New("segment flush time must be at least a minute")
+	}
+	return nil
+}
+
+func (cfg *StreamConfig) topic(table string) string {
+	return cfg.TopicPrefix + table
+}
+
+// messageWriter is implemented by kafka.Writer
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// newKafkaWriter returns a synchronous writer, every publish waits until
+// its rows are acknowledged. The batch timeout must stay short as writes
+// smaller than a batch wait for it to expire.
+func newKafkaWriter(cfg *StreamConfig) *kafka.Writer {
+	return &kafka.Writer{
+		Addr: kafka.TCP(cfg.Brokers...),
+		// keep the measurements of a database in order
+		Balancer:               &kafka.Hash{},
+		RequiredAcks:           kafka.RequireOne,
+		AllowAutoTopicCreation: true,
+		BatchTimeout:           10 * time.Millisecond,
+	}
+}
+
+// realtimeTableConfig returns a REALTIME table config consuming the topic
+// of schema's table
+func realtimeTableConfig(schema *Schema, cfg *StreamConfig) map[string]any {
+	brokers := cfg.PinotBrokers
+	if len(brokers) == 0 {
+		brokers = cfg.Brokers
+	}
+
+	return map[string]any{
+		"tableName": schema.SchemaName,
+		"tableType": "REALTIME",
+		"segmentsConfig": map[string]any{
+			"schemaName":                schema.SchemaName,
+			"timeColumnName":            "timestamp",
+			"timeType":                  "MILLISECONDS",
+			"replicasPerPartition":      "1",
+			"retentionTimeUnit":         "DAYS",
+			"retentionTimeValue":        "30",
+			"segmentPushType":           "APPEND",
+			"segmentAssignmentStrategy": "BalanceNumSegmentAssignmentStrategy",
+		},
+		"tableIndexConfig": map[string]any{"loadMode": "MMAP"},
+		"ingestionConfig": map[string]any{
+			"streamIngestionConfig": map[string]any{
+				"streamConfigMaps": []any{map[string]any{
+					"streamType":                                    "kafka",
+					"stream.kafka.topic.name":                       cfg.topic(schema.SchemaName),
+					"stream.kafka.broker.list":                      strings.Join(brokers, ","),
+					"stream.kafka.consumer.type":                    "lowlevel",
+					"stream.kafka.consumer.factory.class.name":      "org.apache.pinot.plugin.stream.kafka20.KafkaConsumerFactory",
+					"stream.kafka.decoder.class.name":               "org.apache.pinot.plugin.inputformat.json.JSONMessageDecoder",
+					"stream.kafka.consumer.prop.auto.offset.reset":  "smallest",
+					"realtime.segment.flush.threshold.time":         fmt.Sprintf("%dm", int(cfg.SegmentFlushTime.Minutes())),
+					"realtime.segment.flush.threshold.rows":         "0",
+					"realtime.segment.flush.threshold.segment.size": "100M",
+				}},
+			},
+		},
+		"tenants":  map[string]any{},
+		"metadata": map[string]any{},
+	}
+}
+
+// publish writes rows to the topic of table, keyed by database
+func (r *PinotReceiver) publish(ctx context.Context, table string, rows []map[string]any) error {
+	messages := make([]kafka.Message, 0, len(rows))
+	for _, row := range rows {
+		value, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		dbName, _ := row["dbname"].(string)
+		messages = append(messages, kafka.Message{
+			Topic: r.stream.topic(table),
+			Key:   []byte(dbName),
+			Value: value,
+		})
+	}
+	return r.producer.WriteMessages(ctx, messages...)
+}
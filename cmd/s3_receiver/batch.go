@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// Supported object formats
+const (
+	FormatNDJSON  = "ndjson"
+	FormatParquet = "parquet"
+)
+
+type BatchConfig struct {
+	Format        string        // object format: "ndjson" (gzip compressed) or "parquet"
+	FlushInterval time.Duration // how long measurements are buffered before being uploaded
+	MaxRows       int           // upload a partition early once it holds this many rows, 0 disables
+}
+
+func (cfg *BatchConfig) Validate() error {
+	if cfg.Format != FormatNDJSON && cfg.Format != FormatParquet {
+		return fmt.Errorf("unsupported object format: %s", cfg.Format)
+	}
+	if cfg.FlushInterval <= 0 {
+		return errors.New("flush interval must be positive")
+	}
+	return nil
+}
+
+// Record is a single measurement row as written to NDJSON objects
+type Record struct {
+	Timestamp  time.Time         `json:"timestamp"`
+	DBName     string            `json:"dbname"`
+	MetricName string            `json:"metric_name"`
+	CustomTags map[string]string `json:"custom_tags"`
+	Data       map[string]any    `json:"data"`
+}
+
+// ParquetRecord is the parquet schema of a measurement row,
+// data and custom tags are stored as JSON strings
+type ParquetRecord struct {
+	Timestamp  time.Time `parquet:"timestamp,timestamp(millisecond)"`
+	DBName     string    `parquet:"dbname"`
+	MetricName string    `parquet:"metric_name"`
+	CustomTags string    `parquet:"custom_tags"`
+	Data       string    `parquet:"data"`
+}
+
+// partition identifies the Hive-style key prefix a record is stored under
+type partition struct {
+	MetricName string
+	DBName     string
+	Hour       time.Time
+}
+
+type batch struct {
+	records []Record
+}
+
+func newPartition(rec Record) partition {
+	return partition{
+		MetricName: rec.MetricName,
+		DBName:     rec.DBName,
+		Hour:       rec.Timestamp.UTC().Truncate(time.Hour),
+	}
+}
+
+// Prefix returns the key prefix in the form of
+// metric=<name>/db=<name>/dt=YYYY-MM-DD/hour=HH/
+func (p partition) Prefix() string {
+	return fmt.Sprintf("metric=%s/db=%s/dt=%s/hour=%s/",
+		url.PathEscape(p.MetricName),
+		url.PathEscape(p.DBName),
+		p.Hour.Format("2006-01-02"),
+		p.Hour.Format("15"),
+	)
+}
+
+func objectExtension(format string) string {
+	if format == FormatNDJSON {
+		return ".json.gz"
+	}
+	return ".parquet"
+}
+
+func contentType(format string) string {
+	if format == FormatNDJSON {
+		return "application/gzip"
+	}
+	return "application/vnd.apache.parquet"
+}
+
+func encodeRecords(format string, records []Record) ([]byte, error) {
+	switch format {
+	case FormatNDJSON:
+		return encodeNDJSON(records)
+	case FormatParquet:
+		return encodeParquet(records)
+	}
+	return nil, fmt.Errorf("unsupported object format: %s", format)
+}
+
+func encodeNDJSON(records []Record) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	encoder := json.NewEncoder(gz)
+	for _, rec := range records {
+		if err := encoder.Encode(rec); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeParquet(records []Record) ([]byte, error) {
+	rows := make([]ParquetRecord, 0, len(records))
+	for _, rec := range records {
+		data, err := json.Marshal(rec.Data)
+		if err != nil {
+			return nil, err
+		}
+		tags, err := json.Marshal(rec.CustomTags)
+		if err != nil {
+			return nil, err
+		}
+
+		rows = append(rows, ParquetRecord{
+			Timestamp:  rec.Timestamp,
+			DBName:     rec.DBName,
+			MetricName: rec.MetricName,
+			CustomTags: string(tags),
+			Data:       string(data),
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := parquet.Write(&buf, rows, parquet.Compression(&parquet.Snappy)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
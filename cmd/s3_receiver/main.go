@@ -1,17 +1,33 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/objectstore"
 )
 
 func main() {
 	port := flag.String("port", "-1", "Specify the port where you want your sink to receive the measurements on.")
 	awsEndpoint := flag.String("awsEndpoint", "", "Specify aws endpoint")
 	awsRegion := flag.String("awsRegion", "us-east-1", "Specify AWS region")
+	format := flag.String("format", FormatParquet, "Object format, either parquet or ndjson (gzip compressed)")
+	flushInterval := flag.Duration("flushInterval", time.Minute, "Time window for batching measurements into one object per partition")
+	maxRows := flag.Int("maxRows", 100000, "Upload a partition before the flush interval once it holds this many rows. 0 disables the limit")
+	bucket := flag.String("bucket", "", "Store all databases in this bucket instead of creating one bucket per database")
+	keyPrefix := flag.String("keyPrefix", "", "Go template prepended to object keys, e.g. pgwatch/{{.DBName}}/")
+	sse := flag.String("sse", "", "Server-side encryption, AES256 (SSE-S3) or aws:kms (SSE-KMS)")
+	sseKMSKeyID := flag.String("sseKmsKeyId", "", "KMS key ID used for SSE-KMS")
+	storageClass := flag.String("storageClass", "", "Storage class for uploaded objects, e.g. STANDARD_IA")
+	tagObjects := flag.Bool("tagObjects", false, "Tag uploaded objects with the measurements' custom tags")
+	checksum := flag.String("checksum", "", "Verify uploads using MD5 (Content-MD5) or a checksum algorithm: CRC32, CRC32C, SHA1, SHA256")
+	storeURL := flag.String("storeURL", "", "Archive to another object store instead of S3, e.g. file:///data, gs://bucket/prefix or azblob://container/prefix")
 	username := os.Getenv("awsuser")
 	password := os.Getenv("awspasswd")
 	flag.Parse()
@@ -21,11 +37,57 @@ func main() {
 		return
 	}
 
-	server, err := NewS3Receiver(*awsEndpoint, *awsRegion, username, password)
+	batchCfg := BatchConfig{
+		Format:        *format,
+		FlushInterval: *flushInterval,
+		MaxRows:       *maxRows,
+	}
+
+	uploadCfg := UploadConfig{
+		Bucket:       *bucket,
+		KeyPrefix:    *keyPrefix,
+		SSE:          *sse,
+		SSEKMSKeyID:  *sseKMSKeyID,
+		StorageClass: *storageClass,
+		TagObjects:   *tagObjects,
+		Checksum:     *checksum,
+	}
+
+	var server *S3Receiver
+	var store objectstore.Store
+	var err error
+	if *storeURL != "" {
+		// S3 only flags would be silently ignored
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "awsEndpoint", "awsRegion", "bucket", "sse", "sseKmsKeyId", "storageClass", "tagObjects", "checksum":
+				log.Fatalf("[ERROR]: --%s can't be used with --storeURL", f.Name)
+			}
+		})
+		if store, err = objectstore.New(context.Background(), *storeURL); err != nil {
+			log.Fatal("[ERROR]: Unable to open object store", err)
+		}
+		server, err = NewObjectStoreReceiver(store, batchCfg, *keyPrefix)
+	} else {
+		server, err = NewS3Receiver(*awsEndpoint, *awsRegion, username, password, batchCfg, uploadCfg)
+	}
 	if err != nil {
 		log.Fatal("[ERROR]: Unable to create S3 receiver", err)
 	}
 
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		if err := server.Close(); err != nil {
+			log.Println("[ERROR]: Unable to upload buffered measurements: " + err.Error())
+		}
+		if store != nil {
+			_ = store.Close()
+		}
+		os.Exit(0)
+	}()
+
 	if err := sinks.ListenAndServe(server, *port); err != nil {
 		log.Fatal(err)
 	}
@@ -3,16 +3,15 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
-	"strconv"
+	"sync"
 	"time"
 
 	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/objectstore"
 	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -21,16 +20,37 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go"
+	"github.com/google/uuid"
 )
 
 type S3Receiver struct {
 	S3Client  *s3.Client
 	S3Manager *manager.Uploader
+	// Store replaces the S3 client when measurements are
+	// archived to another object store, see NewObjectStoreReceiver
+	Store     objectstore.Store
 	Ctx       context.Context
+	BatchCfg  BatchConfig
+	UploadCfg UploadConfig
+	batches   map[partition]*batch
+	buckets   map[string]bool
+	mu        sync.Mutex
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
 	sinks.SyncMetricHandler
 }
 
-func NewS3Receiver(awsEndpoint string, awsRegion string, username string, passwd string) (*S3Receiver, error) {
+// maxPendingRows bounds the rows kept per partition while uploads fail
+const maxPendingRows = 500000
+
+func NewS3Receiver(awsEndpoint string, awsRegion string, username string, passwd string, batchCfg BatchConfig, uploadCfg UploadConfig) (*S3Receiver, error) {
+	if err := batchCfg.Validate(); err != nil {
+		return nil, err
+	}
+	if err := uploadCfg.Validate(); err != nil {
+		return nil, err
+	}
 	awsCfg, err := config.LoadDefaultConfig(context.TODO(),
 		config.WithRegion(awsRegion),
 		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(username, passwd, "")),
@@ -45,13 +65,55 @@ func NewS3Receiver(awsEndpoint string, awsRegion string, username string, passwd
 		o.BaseEndpoint = aws.String(awsEndpoint)
 	})
 
+	var partMiBs int64 = 10
+	uploader := manager.NewUploader(client, func(u *manager.Uploader) {
+		u.PartSize = partMiBs * 1024 * 1024
+	})
+
 	recv := &S3Receiver{
 		S3Client:          client,
+		S3Manager:         uploader,
 		Ctx:               context.Background(),
+		BatchCfg:          batchCfg,
+		UploadCfg:         uploadCfg,
+		batches:           make(map[partition]*batch),
+		buckets:           make(map[string]bool),
+		stop:              make(chan struct{}),
+		done:              make(chan struct{}),
 		SyncMetricHandler: sinks.NewSyncMetricHandler(1024),
 	}
 
 	go recv.HandleSyncMetric()
+	go recv.flushPeriodically()
+
+	return recv, nil
+}
+
+// NewObjectStoreReceiver archives measurements to any objectstore.Store
+// (local directory, GCS, Azure Blob...) using the same object layout.
+// S3 specific upload options (SSE, storage class, tagging) don't apply.
+func NewObjectStoreReceiver(store objectstore.Store, batchCfg BatchConfig, keyPrefix string) (*S3Receiver, error) {
+	if err := batchCfg.Validate(); err != nil {
+		return nil, err
+	}
+	uploadCfg := UploadConfig{KeyPrefix: keyPrefix}
+	if err := uploadCfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	recv := &S3Receiver{
+		Store:             store,
+		Ctx:               context.Background(),
+		BatchCfg:          batchCfg,
+		UploadCfg:         uploadCfg,
+		batches:           make(map[partition]*batch),
+		stop:              make(chan struct{}),
+		done:              make(chan struct{}),
+		SyncMetricHandler: sinks.NewSyncMetricHandler(1024),
+	}
+
+	go recv.HandleSyncMetric()
+	go recv.flushPeriodically()
 
 	return recv, nil
 }
@@ -92,52 +154,180 @@ func (r *S3Receiver) DBExists(bucketName string) (bool, error) {
 	return exists, err
 }
 
-func (r *S3Receiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
-	exists, err := r.DBExists(msg.DBName)
+// ensureBucket creates the bucket on first use
+func (r *S3Receiver) ensureBucket(bucketName string) error {
+	if r.Store != nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	known := r.buckets[bucketName]
+	r.mu.Unlock()
+	if known {
+		return nil
+	}
+
+	exists, err := r.DBExists(bucketName)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	if !exists {
-		err = r.AddDatabase(msg.DBName)
+		if err = r.AddDatabase(bucketName); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	r.buckets[bucketName] = true
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *S3Receiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
+	if err := r.ensureBucket(r.bucketFor(msg.GetDBName())); err != nil {
 		return nil, err
 	}
 
 	reply := &pb.Reply{}
+	full := make(map[partition]*batch)
+
+	r.mu.Lock()
 	for _, data := range msg.GetData() {
 		if ctx.Err() != nil {
+			r.mu.Unlock()
 			reply.Logmsg = "context cancelled, stopping writer..."
 			return reply, nil
 		}
 
-		// Json data
-		jsonData, err := json.Marshal(data)
-		if err != nil {
-			return nil, status.Error(codes.InvalidArgument, err.Error())
+		rec := Record{
+			Timestamp:  sinks.MeasurementTime(data, time.Now().UTC()),
+			DBName:     msg.GetDBName(),
+			MetricName: msg.GetMetricName(),
+			CustomTags: msg.GetCustomTags(),
+			Data:       data.AsMap(),
+		}
+
+		p := newPartition(rec)
+		b, ok := r.batches[p]
+		if !ok {
+			b = &batch{}
+			r.batches[p] = b
 		}
+		b.records = append(b.records, rec)
 
-		// Get buffer
-		buffer := bytes.NewReader(jsonData)
-		var partMiBs int64 = 10
+		// upload the partition early if it has grown too big
+		if r.BatchCfg.MaxRows > 0 && len(b.records) >= r.BatchCfg.MaxRows {
+			full[p] = b
+			delete(r.batches, p)
+		}
+	}
+	r.mu.Unlock()
+
+	// failed batches are retried with the next flush, returning the error
+	// would make pgwatch send the measurements again
+	if err := r.uploadBatches(ctx, full); err != nil {
+		log.Printf("[ERROR]: unable to upload measurements to S3, retrying with the next flush: %v", err)
+	}
+	return reply, nil
+}
+
+// Flush uploads all buffered measurements
+func (r *S3Receiver) Flush(ctx context.Context) error {
+	r.mu.Lock()
+	pending := r.batches
+	r.batches = make(map[partition]*batch)
+	r.mu.Unlock()
+
+	return r.uploadBatches(ctx, pending)
+}
+
+func (r *S3Receiver) flushPeriodically() {
+	defer close(r.done)
 
-		// Setup uploader
-		uploader := manager.NewUploader(r.S3Client, func(u *manager.Uploader) {
-			u.PartSize = partMiBs * 1024 * 1024
-		})
+	ticker := time.NewTicker(r.BatchCfg.FlushInterval)
+	defer ticker.Stop()
 
-		objectKey := msg.DBName + "_" + strconv.FormatInt(time.Now().UTC().Unix(), 10)
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			if err := r.Flush(r.Ctx); err != nil {
+				log.Printf("[ERROR]: unable to flush measurements to S3: %v", err)
+			}
+		}
+	}
+}
 
-		// Upload data
-		_, err = uploader.Upload(context.TODO(), &s3.PutObjectInput{
-			Bucket: aws.String(msg.GetDBName()),
-			Key:    aws.String(objectKey),
-			Body:   buffer,
-		})
+// Close stops the periodic flushes and uploads all buffered measurements
+func (r *S3Receiver) Close() (err error) {
+	r.closeOnce.Do(func() {
+		close(r.stop)
+		<-r.done
+		err = r.Flush(r.Ctx)
+	})
+	return err
+}
 
-		if err != nil {
-			return nil, err
+// uploadBatches writes one object per partition, batches that
+// fail to upload are requeued so they are retried on next flush
+func (r *S3Receiver) uploadBatches(ctx context.Context, batches map[partition]*batch) error {
+	var err error
+	for p, b := range batches {
+		if err2 := r.uploadBatch(ctx, p, b); err2 != nil {
+			err = errors.Join(err, err2)
+			r.requeue(p, b)
 		}
 	}
+	return err
+}
 
-	return reply, nil
-}
\ No newline at end of file
+// requeue puts records that failed to upload back in front of their
+// partition, dropping them if too many are waiting already
+func (r *S3Receiver) requeue(p partition, b *batch) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cur, ok := r.batches[p]
+	if !ok {
+		cur = &batch{}
+		r.batches[p] = cur
+	}
+	if len(cur.records)+len(b.records) > maxPendingRows {
+		log.Printf("[ERROR]: Dropping %d measurements of %s/%s, too many are waiting for upload", len(b.records), p.MetricName, p.DBName)
+		return
+	}
+	cur.records = append(b.records, cur.records...)
+}
+
+func (r *S3Receiver) uploadBatch(ctx context.Context, p partition, b *batch) error {
+	body, err := encodeRecords(r.BatchCfg.Format, b.records)
+	if err != nil {
+		return err
+	}
+
+	keyPrefix, err := r.objectKey(p)
+	if err != nil {
+		return err
+	}
+
+	objectKey := keyPrefix + uuid.NewString() + objectExtension(r.BatchCfg.Format)
+	if r.Store != nil {
+		opts := objectstore.PutOptions{ContentType: contentType(r.BatchCfg.Format)}
+		if err = r.Store.Put(ctx, objectKey, bytes.NewReader(body), opts); err != nil {
+			return fmt.Errorf("unable to upload %s: %w", objectKey, err)
+		}
+
+		log.Printf("[INFO]: Uploaded %d measurements to %s", len(b.records), objectKey)
+		return nil
+	}
+
+	bucket := r.bucketFor(p.DBName)
+	if err = r.putObject(ctx, bucket, objectKey, body, b.records); err != nil {
+		return fmt.Errorf("unable to upload %s: %w", objectKey, err)
+	}
+
+	log.Printf("[INFO]: Uploaded %d measurements to %s/%s", len(b.records), bucket, objectKey)
+	return nil
+}
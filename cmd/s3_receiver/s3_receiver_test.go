@@ -2,10 +2,18 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/objectstore"
 	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
 	"github.com/docker/go-connections/nat"
 	"github.com/stretchr/testify/assert"
@@ -23,9 +31,9 @@ func initContainer(ctx context.Context) (*localstack.LocalStackContainer, error)
 }
 
 var (
-	ctx context.Context
+	ctx        context.Context
 	mappedPort nat.Port
-	host string
+	host       string
 )
 
 func TestMain(m *testing.M) {
@@ -48,7 +56,7 @@ func TestMain(m *testing.M) {
 	if err != nil {
 		panic(err)
 	}
-	defer func() {_ = provider.Close()}()
+	defer func() { _ = provider.Close() }()
 
 	host, err = provider.DaemonHost(ctx)
 	if err != nil {
@@ -65,9 +73,27 @@ var client *S3Receiver
 
 func TestNewS3Receiver(t *testing.T) {
 	var err error
-	client, err = NewS3Receiver(fmt.Sprintf("http://%s:%d", host, mappedPort.Int()), "us-east-1", "test", "test")
+	batchCfg := BatchConfig{Format: FormatParquet, FlushInterval: time.Hour}
+	client, err = NewS3Receiver(fmt.Sprintf("http://%s:%d", host, mappedPort.Int()), "us-east-1", "test", "test", batchCfg, UploadConfig{})
 	assert.NoError(t, err, "error encountered while creating S3Receiver")
 	assert.NotNil(t, client, "received nil instead of client")
+
+	batchCfg.Format = "avro"
+	_, err = NewS3Receiver(fmt.Sprintf("http://%s:%d", host, mappedPort.Int()), "us-east-1", "test", "test", batchCfg, UploadConfig{})
+	assert.Error(t, err, "expected error for unsupported object format")
+
+	batchCfg.Format = FormatNDJSON
+	invalidUploadCfgs := []UploadConfig{
+		{SSE: "aes"},
+		{SSE: "AES256", SSEKMSKeyID: "key"},
+		{StorageClass: "COLD"},
+		{Checksum: "SHA512"},
+		{KeyPrefix: "{{.DBName"},
+	}
+	for _, uploadCfg := range invalidUploadCfgs {
+		_, err = NewS3Receiver(fmt.Sprintf("http://%s:%d", host, mappedPort.Int()), "us-east-1", "test", "test", batchCfg, uploadCfg)
+		assert.Errorf(t, err, "expected error for upload config %+v", uploadCfg)
+	}
 }
 
 func TestAddDatabase(t *testing.T) {
@@ -80,14 +106,164 @@ func TestAddDatabase(t *testing.T) {
 	assert.True(t, res, "bucket should exist")
 }
 
+func TestPartitionPrefix(t *testing.T) {
+	p := partition{
+		MetricName: "db_stats",
+		DBName:     "my db",
+		Hour:       time.Date(2025, 6, 1, 7, 0, 0, 0, time.UTC),
+	}
+	assert.Equal(t, "metric=db_stats/db=my%20db/dt=2025-06-01/hour=07/", p.Prefix())
+}
+
+func TestObjectTagging(t *testing.T) {
+	records := []Record{
+		{CustomTags: map[string]string{"env": "prod", "team": "dba"}},
+		{CustomTags: map[string]string{"env": "prod", "team": "dev"}},
+	}
+	assert.Equal(t, "env=prod", objectTagging(records))
+	assert.Equal(t, "", objectTagging(nil))
+}
+
+func listObjectKeys(t *testing.T, bucket string) []string {
+	out, err := client.S3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String(bucket)})
+	assert.NoError(t, err, "error encountered while listing objects")
+
+	keys := make([]string, 0, len(out.Contents))
+	for _, obj := range out.Contents {
+		keys = append(keys, aws.ToString(obj.Key))
+	}
+	return keys
+}
+
 func TestUpdateMeasurements(t *testing.T) {
 	msg := testutils.GetTestMeasurementEnvelope()
 	_, err := client.UpdateMeasurements(ctx, msg)
 	assert.NoError(t, err, "error encountered while updating measurements")
 
+	// measurements are buffered until flushed
+	assert.Empty(t, listObjectKeys(t, msg.GetDBName()))
+	assert.NoError(t, client.Flush(ctx), "error encountered while flushing measurements")
+
+	keys := listObjectKeys(t, msg.GetDBName())
+	assert.Len(t, keys, 1)
+	for _, key := range keys {
+		assert.True(t, strings.HasPrefix(key, "metric=testMetric/db=test/dt="), "unexpected object key %s", key)
+		assert.True(t, strings.HasSuffix(key, ".parquet"), "unexpected object key %s", key)
+	}
+
 	newCtx, cancel := context.WithCancel(ctx)
 	cancel()
 	reply, err := client.UpdateMeasurements(newCtx, msg)
 	assert.Equal(t, reply.GetLogmsg(), "context cancelled, stopping writer...")
 	assert.NoError(t, err)
-}
\ No newline at end of file
+}
+
+func TestSingleBucketMode(t *testing.T) {
+	batchCfg := BatchConfig{Format: FormatNDJSON, FlushInterval: time.Hour}
+	uploadCfg := UploadConfig{
+		Bucket:       "pgwatch-archive",
+		KeyPrefix:    "pgwatch/{{.DBName}}/",
+		SSE:          "AES256",
+		StorageClass: "STANDARD_IA",
+		TagObjects:   true,
+		Checksum:     "sha256",
+	}
+	recv, err := NewS3Receiver(fmt.Sprintf("http://%s:%d", host, mappedPort.Int()), "us-east-1", "test", "test", batchCfg, uploadCfg)
+	assert.NoError(t, err, "error encountered while creating S3Receiver")
+
+	// database names that aren't valid bucket names
+	msg := testutils.GetTestMeasurementEnvelope()
+	msg.DBName = "Test_DB"
+	_, err = recv.UpdateMeasurements(ctx, msg)
+	assert.NoError(t, err, "error encountered while updating measurements")
+	assert.NoError(t, recv.Flush(ctx), "error encountered while flushing measurements")
+
+	out, err := recv.S3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String(uploadCfg.Bucket)})
+	assert.NoError(t, err, "error encountered while listing objects")
+	assert.Len(t, out.Contents, 1)
+	for _, obj := range out.Contents {
+		key := aws.ToString(obj.Key)
+		assert.True(t, strings.HasPrefix(key, "pgwatch/Test_DB/metric=testMetric/db=Test_DB/dt="), "unexpected object key %s", key)
+		assert.True(t, strings.HasSuffix(key, ".json.gz"), "unexpected object key %s", key)
+
+		tagging, err := recv.S3Client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+			Bucket: aws.String(uploadCfg.Bucket),
+			Key:    obj.Key,
+		})
+		assert.NoError(t, err, "error encountered while getting object tags")
+		assert.Len(t, tagging.TagSet, 1)
+		for _, tag := range tagging.TagSet {
+			assert.Equal(t, "tagName", aws.ToString(tag.Key))
+			assert.Equal(t, "tagValue", aws.ToString(tag.Value))
+		}
+	}
+}
+
+func TestObjectStoreReceiver(t *testing.T) {
+	store, err := objectstore.NewLocalStore(t.TempDir())
+	assert.NoError(t, err)
+
+	batchCfg := BatchConfig{Format: FormatParquet, FlushInterval: time.Hour}
+	recv, err := NewObjectStoreReceiver(store, batchCfg, "{{.DBName}}/")
+	assert.NoError(t, err, "error encountered while creating object store receiver")
+
+	msg := testutils.GetTestMeasurementEnvelope()
+	_, err = recv.UpdateMeasurements(ctx, msg)
+	assert.NoError(t, err, "error encountered while updating measurements")
+	assert.NoError(t, recv.Flush(ctx), "error encountered while flushing measurements")
+
+	keys, err := store.List(ctx, "test/metric=testMetric/db=test/dt=")
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+	for _, key := range keys {
+		assert.True(t, strings.HasSuffix(key, ".parquet"), "unexpected object key %s", key)
+	}
+}
+
+// failingStore fails uploads while fail is set
+type failingStore struct {
+	objectstore.Store
+	fail atomic.Bool
+}
+
+func (s *failingStore) Put(ctx context.Context, key string, body io.Reader, opts objectstore.PutOptions) error {
+	if s.fail.Load() {
+		return errors.New("store unavailable")
+	}
+	return s.Store.Put(ctx, key, body, opts)
+}
+
+func TestUploadRetries(t *testing.T) {
+	local, err := objectstore.NewLocalStore(t.TempDir())
+	assert.NoError(t, err)
+	store := &failingStore{Store: local}
+	store.fail.Store(true)
+
+	batchCfg := BatchConfig{Format: FormatNDJSON, FlushInterval: time.Hour, MaxRows: 1}
+	recv, err := NewObjectStoreReceiver(store, batchCfg, "")
+	assert.NoError(t, err)
+
+	// failed uploads are retried instead of being sent again by pgwatch
+	msg := testutils.GetTestMeasurementEnvelope()
+	_, err = recv.UpdateMeasurements(ctx, msg)
+	assert.NoError(t, err)
+	assert.Len(t, recv.batches, 1)
+
+	// Close uploads what is left
+	store.fail.Store(false)
+	assert.NoError(t, recv.Close())
+	keys, err := store.List(ctx, "metric=testMetric/")
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+	assert.Empty(t, recv.batches)
+	assert.NoError(t, recv.Close(), "closing again is a no-op")
+}
+
+func TestRequeueLimit(t *testing.T) {
+	recv := &S3Receiver{batches: make(map[partition]*batch)}
+	p := partition{MetricName: "testMetric", DBName: "test"}
+
+	recv.requeue(p, &batch{records: make([]Record, maxPendingRows)})
+	recv.requeue(p, &batch{records: make([]Record, 1)})
+	assert.Len(t, recv.batches[p].records, maxPendingRows)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ChecksumMD5 sends a Content-MD5 header instead of a flexible checksum
+const ChecksumMD5 = "MD5"
+
+// S3 allows at most 10 tags per object
+const maxObjectTags = 10
+
+type UploadConfig struct {
+	Bucket       string // when set all databases are stored in this bucket instead of one bucket per database
+	KeyPrefix    string // Go template prepended to object keys, e.g. "pgwatch/{{.DBName}}/"
+	SSE          string // server-side encryption: "", "AES256" (SSE-S3) or "aws:kms" (SSE-KMS)
+	SSEKMSKeyID  string // KMS key used with SSE-KMS, implies SSE "aws:kms"
+	StorageClass string // e.g. STANDARD_IA, GLACIER_IR. Empty uses the bucket default
+	TagObjects   bool   // tag objects with the measurements' custom tags
+	Checksum     string // "", "MD5", "CRC32", "CRC32C", "SHA1" or "SHA256"
+
+	keyPrefix *template.Template // KeyPrefix parsed by Validate, nil if empty
+}
+
+// keyPrefixData is passed to the key prefix template
+type keyPrefixData struct {
+	DBName     string
+	MetricName string
+}
+
+func (cfg *UploadConfig) Validate() error {
+	if cfg.SSEKMSKeyID != "" {
+		if cfg.SSE == "" {
+			cfg.SSE = string(types.ServerSideEncryptionAwsKms)
+		}
+		if cfg.SSE != string(types.ServerSideEncryptionAwsKms) {
+			return errors.New("a KMS key ID can only be used with aws:kms server-side encryption")
+		}
+	}
+
+	if cfg.SSE != "" && !slices.Contains(types.ServerSideEncryption("").Values(), types.ServerSideEncryption(cfg.SSE)) {
+		return fmt.Errorf("unsupported server-side encryption: %s", cfg.SSE)
+	}
+
+	if cfg.StorageClass != "" && !slices.Contains(types.StorageClass("").Values(), types.StorageClass(cfg.StorageClass)) {
+		return fmt.Errorf("unsupported storage class: %s", cfg.StorageClass)
+	}
+
+	cfg.Checksum = strings.ToUpper(cfg.Checksum)
+	if cfg.Checksum != "" && cfg.Checksum != ChecksumMD5 &&
+		!slices.Contains(types.ChecksumAlgorithm("").Values(), types.ChecksumAlgorithm(cfg.Checksum)) {
+		return fmt.Errorf("unsupported checksum algorithm: %s", cfg.Checksum)
+	}
+
+	cfg.keyPrefix = nil
+	if cfg.KeyPrefix != "" {
+		keyPrefix, err := template.New("keyPrefix").Option("missingkey=error").Parse(cfg.KeyPrefix)
+		if err != nil {
+			return fmt.Errorf("invalid key prefix template: %w", err)
+		}
+		cfg.keyPrefix = keyPrefix
+	}
+	return nil
+}
+
+// bucketFor returns the bucket measurements of dbname are stored in
+func (r *S3Receiver) bucketFor(dbname string) string {
+	if r.UploadCfg.Bucket != "" {
+		return r.UploadCfg.Bucket
+	}
+	return dbname
+}
+
+func (r *S3Receiver) objectKey(p partition) (string, error) {
+	var prefix strings.Builder
+	if r.UploadCfg.keyPrefix != nil {
+		err := r.UploadCfg.keyPrefix.Execute(&prefix, keyPrefixData{DBName: p.DBName, MetricName: p.MetricName})
+		if err != nil {
+			return "", err
+		}
+	}
+	return prefix.String() + p.Prefix(), nil
+}
+
+// objectTagging encodes the custom tags shared by all records
+// in the batch as an S3 tagging query string
+func objectTagging(records []Record) string {
+	if len(records) == 0 {
+		return ""
+	}
+
+	tags := url.Values{}
+	for key, value := range records[0].CustomTags {
+		shared := true
+		for _, rec := range records[1:] {
+			if v, ok := rec.CustomTags[key]; !ok || v != value {
+				shared = false
+				break
+			}
+		}
+		if shared {
+			tags.Set(key, value)
+		}
+	}
+
+	if len(tags) > maxObjectTags {
+		keys := make([]string, 0, len(tags))
+		for key := range tags {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		log.Printf("[WARNING]: S3 supports at most %d object tags, dropping tags %v", maxObjectTags, keys[maxObjectTags:])
+		for _, key := range keys[maxObjectTags:] {
+			tags.Del(key)
+		}
+	}
+	return tags.Encode()
+}
+
+func (r *S3Receiver) putObject(ctx context.Context, bucket, key string, body []byte, records []Record) error {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(contentType(r.BatchCfg.Format)),
+	}
+
+	cfg := r.UploadCfg
+	if cfg.SSE != "" {
+		input.ServerSideEncryption = types.ServerSideEncryption(cfg.SSE)
+	}
+	if cfg.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(cfg.SSEKMSKeyID)
+	}
+	if cfg.StorageClass != "" {
+		input.StorageClass = types.StorageClass(cfg.StorageClass)
+	}
+	if cfg.TagObjects {
+		if tagging := objectTagging(records); tagging != "" {
+			input.Tagging = aws.String(tagging)
+		}
+	}
+
+	switch cfg.Checksum {
+	case "":
+	case ChecksumMD5:
+		// Content-MD5 is only valid for single part uploads
+		sum := md5.Sum(body)
+		input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+		_, err := r.S3Client.PutObject(ctx, input)
+		return err
+	default:
+		input.ChecksumAlgorithm = types.ChecksumAlgorithm(cfg.Checksum)
+	}
+
+	_, err := r.S3Manager.Upload(ctx, input)
+	return err
+}
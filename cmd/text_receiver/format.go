@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+)
+
+// Built-in output formats, each maps to a template in presets
+const (
+	FormatBlock  = "block"
+	FormatLogfmt = "logfmt"
+	FormatNDJSON = "ndjson"
+	FormatTable  = "table"
+)
+
+type preset struct {
+	template  string
+	extension string
+}
+
+var presets = map[string]preset{
+	FormatBlock: {
+		template: "DBName: {{.DBName}}\nMetric: {{.MetricName}}\n" +
+			"{{range .Measurements}}{{json .Data}}\n{{end}}" +
+			"\n===================================\n\n",
+		extension: ".txt",
+	},
+	FormatLogfmt: {
+		template:  "{{range .Measurements}}{{logfmt .}}\n{{end}}",
+		extension: ".log",
+	},
+	FormatNDJSON: {
+		template:  "{{range .Measurements}}{{json .}}\n{{end}}",
+		extension: ".ndjson",
+	},
+	FormatTable: {
+		template:  "# {{.DBName}} {{.MetricName}} {{.Time.Format \"2006-01-02T15:04:05Z07:00\"}}\n{{table .Measurements}}\n",
+		extension: ".txt",
+	},
+}
+
+// Envelope is the data passed to output templates, once per
+// received measurement envelope
+type Envelope struct {
+	Time         time.Time // time the envelope was received
+	DBName       string
+	MetricName   string
+	CustomTags   map[string]string
+	Measurements []Measurement
+}
+
+// Measurement is a single row of an Envelope
+type Measurement struct {
+	Time       time.Time         `json:"time"`
+	DBName     string            `json:"dbname"`
+	MetricName string            `json:"metric"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	Data       map[string]any    `json:"data"`
+}
+
+func newEnvelope(msg *pb.MeasurementEnvelope) Envelope {
+	env := Envelope{
+		Time:       time.Now().UTC(),
+		DBName:     msg.GetDBName(),
+		MetricName: msg.GetMetricName(),
+		CustomTags: msg.GetCustomTags(),
+	}
+	for _, data := range msg.GetData() {
+		env.Measurements = append(env.Measurements, Measurement{
+			Time:       sinks.MeasurementTime(data, env.Time),
+			DBName:     env.DBName,
+			MetricName: env.MetricName,
+			Tags:       env.CustomTags,
+			Data:       data.AsMap(),
+		})
+	}
+	return env
+}
+
+var templateFuncs = template.FuncMap{
+	"json":   toJSON,
+	"logfmt": toLogfmt,
+	"table":  toTable,
+}
+
+// loadTemplate returns the template of a built-in format, or
+// parses templateFile if it is set
+func loadTemplate(format, templateFile string) (*template.Template, string, error) {
+	if templateFile != "" {
+		content, err := os.ReadFile(templateFile)
+		if err != nil {
+			return nil, "", err
+		}
+		tmpl, err := template.New("output").Funcs(templateFuncs).Parse(string(content))
+		return tmpl, ".txt", err
+	}
+
+	p, ok := presets[format]
+	if !ok {
+		return nil, "", fmt.Errorf("unsupported output format: %s", format)
+	}
+	tmpl, err := template.New(format).Funcs(templateFuncs).Parse(p.template)
+	return tmpl, p.extension, err
+}
+
+func toJSON(v any) (string, error) {
+	encoded, err := json.Marshal(v)
+	return string(encoded), err
+}
+
+// toLogfmt renders a Measurement or a map as space separated
+// key=value pairs, map keys are sorted
+func toLogfmt(v any) string {
+	var pairs []string
+	add := func(key string, value any) {
+		pairs = append(pairs, key+"="+logfmtValue(value))
+	}
+
+	switch m := v.(type) {
+	case Measurement:
+		add("time", m.Time.Format(time.RFC3339Nano))
+		add("db", m.DBName)
+		add("metric", m.MetricName)
+		for _, key := range sinks.SortedKeys(m.Tags) {
+			add("tag_"+key, m.Tags[key])
+		}
+		for _, key := range sinks.SortedKeys(m.Data) {
+			add(key, m.Data[key])
+		}
+	case map[string]any:
+		for _, key := range sinks.SortedKeys(m) {
+			add(key, m[key])
+		}
+	case map[string]string:
+		for _, key := range sinks.SortedKeys(m) {
+			add(key, m[key])
+		}
+	default:
+		return logfmtValue(v)
+	}
+	return strings.Join(pairs, " ")
+}
+
+func logfmtValue(v any) string {
+	s := formatValue(v)
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func formatValue(v any) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	}
+
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
+
+// toTable renders measurements as an aligned table with
+// one column per data field
+func toTable(measurements []Measurement) (string, error) {
+	columns := make(map[string]bool)
+	for _, m := range measurements {
+		for key := range m.Data {
+			columns[key] = true
+		}
+	}
+	header := sinks.SortedKeys(columns)
+
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, m := range measurements {
+		values := make([]string, len(header))
+		for i, column := range header {
+			values[i] = formatValue(m.Data[column])
+		}
+		_, _ = fmt.Fprintln(w, strings.Join(values, "\t"))
+	}
+	err := w.Flush()
+	return buf.String(), err
+}
@@ -3,6 +3,9 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 )
@@ -10,6 +13,12 @@ import (
 func main() {
 	port := flag.String("port", "-1", "Specify the port where you want your sink to receive the measurements on.")
 	StorageFolder := flag.String("rootFolder", ".", "Only for formats like CSV...\n")
+	format := flag.String("format", FormatBlock, "Output format: block, logfmt, ndjson or table")
+	templateFile := flag.String("template", "", "Go text/template file used to render measurements, overrides -format")
+	maxFileSize := flag.Int64("maxFileSize", 0, "Rotate files once they reach this many bytes. 0 disables")
+	rotateInterval := flag.Duration("rotateInterval", 0, "Rotate files once they are this old, e.g. 24h. 0 disables")
+	maxBackups := flag.Int("maxBackups", 0, "Number of rotated files to keep per database. 0 keeps all")
+	compress := flag.Bool("compress", false, "Compress rotated files with gzip")
 	flag.Parse()
 
 	if *port == "-1" {
@@ -17,8 +26,29 @@ func main() {
 		return
 	}
 
-	server := NewTextReceiver(*StorageFolder)
+	cfg := RotateConfig{
+		MaxFileSize:    *maxFileSize,
+		RotateInterval: *rotateInterval,
+		MaxBackups:     *maxBackups,
+		Compress:       *compress,
+	}
+
+	server, err := NewTextReceiver(*StorageFolder, *format, *templateFile, cfg)
+	if err != nil {
+		log.Fatal("[ERROR]: Unable to create text receiver ", err)
+	}
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		if err := server.Close(); err != nil {
+			log.Println("[ERROR]: Unable to close files: ", err)
+		}
+		os.Exit(0)
+	}()
+
 	if err := sinks.ListenAndServe(server, *port); err != nil {
 		log.Fatal(err)
 	}
-}
\ No newline at end of file
+}
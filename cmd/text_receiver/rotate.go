@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+)
+
+const rotatedTimeFormat = "20060102T150405.000"
+
+type RotateConfig struct {
+	MaxFileSize    int64         // rotate once the file reaches this many bytes, 0 disables
+	RotateInterval time.Duration // rotate once the file is this old, 0 disables
+	MaxBackups     int           // number of rotated files kept, 0 keeps all
+	Compress       bool          // gzip rotated files
+}
+
+// rotatingFile appends to <dir>/<name><ext> and moves it aside as
+// <name>-<timestamp><ext>[.gz] when it grows too big or too old
+type rotatingFile struct {
+	dir    string
+	name   string
+	ext    string
+	cfg    RotateConfig
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func (f *rotatingFile) path() string {
+	return filepath.Join(f.dir, f.name+f.ext)
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = stat.Size()
+	f.opened = time.Now()
+	if f.size > 0 {
+		f.opened = f.startTime()
+	}
+	return nil
+}
+
+// startTime returns when a reopened file was started, that is when the
+// newest backup was rotated. Its modification time would postpone the
+// rotation with every restart, so files that were never rotated are
+// rotated with the next write instead.
+func (f *rotatingFile) startTime() time.Time {
+	backups, err := f.backups()
+	if err != nil {
+		log.Println("[ERROR]: Unable to list rotated files: " + err.Error())
+	}
+	if len(backups) == 0 {
+		return time.Time{}
+	}
+	match := f.backupPattern().FindStringSubmatch(backups[len(backups)-1])
+	rotated, err := time.Parse(rotatedTimeFormat, match[1])
+	if err != nil {
+		return time.Time{}
+	}
+	return rotated
+}
+
+// Write writes p at once, rotating the file beforehand if needed
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	if f.size > 0 && f.shouldRotate(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) shouldRotate(next int64) bool {
+	if f.cfg.MaxFileSize > 0 && f.size+next > f.cfg.MaxFileSize {
+		return true
+	}
+	return f.cfg.RotateInterval > 0 && time.Since(f.opened) >= f.cfg.RotateInterval
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	rotated := f.rotatedPath(time.Now().UTC())
+	if err := os.Rename(f.path(), rotated); err != nil {
+		return err
+	}
+
+	if f.cfg.Compress {
+		if err := sinks.GzipFile(rotated); err != nil {
+			log.Println("[ERROR]: Unable to compress rotated file " + rotated + ": " + err.Error())
+		}
+	}
+	if err := f.removeOldBackups(); err != nil {
+		log.Println("[ERROR]: Unable to remove old rotated files: " + err.Error())
+	}
+	return f.open()
+}
+
+// rotatedPath returns the first unused name for a file rotated at t
+func (f *rotatingFile) rotatedPath(t time.Time) string {
+	for {
+		path := filepath.Join(f.dir, f.name+"-"+t.Format(rotatedTimeFormat)+f.ext)
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			if _, err = os.Stat(path + ".gz"); errors.Is(err, os.ErrNotExist) {
+				return path
+			}
+		}
+		t = t.Add(time.Millisecond)
+	}
+}
+
+// removeOldBackups deletes the oldest rotated files above MaxBackups
+func (f *rotatingFile) removeOldBackups() error {
+	if f.cfg.MaxBackups <= 0 {
+		return nil
+	}
+
+	backups, err := f.backups()
+	if err != nil {
+		return err
+	}
+	if len(backups) <= f.cfg.MaxBackups {
+		return nil
+	}
+
+	for _, name := range backups[:len(backups)-f.cfg.MaxBackups] {
+		err = errors.Join(err, os.Remove(filepath.Join(f.dir, name)))
+	}
+	return err
+}
+
+// backupPattern matches the names of rotated files, capturing their
+// timestamp
+func (f *rotatingFile) backupPattern() *regexp.Regexp {
+	return regexp.MustCompile("^" + regexp.QuoteMeta(f.name) + `-(\d{8}T\d{6}\.\d{3})` + regexp.QuoteMeta(f.ext) + `(\.gz)?$`)
+}
+
+// backups returns the names of the rotated files, oldest first
+func (f *rotatingFile) backups() ([]string, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	pattern := f.backupPattern()
+	var backups []string
+	for _, entry := range entries {
+		if pattern.MatchString(entry.Name()) {
+			backups = append(backups, entry.Name())
+		}
+	}
+	// timestamps sort lexically
+	sort.Strings(backups)
+	return backups, nil
+}
+
+func (f *rotatingFile) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -1,61 +1,87 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"log"
-	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
 
 	"github.com/destrex271/pgwatch3_rpc_server/sinks"
 	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
 )
 
 type TextReceiver struct {
-	FullPath string
+	FullPath  string
+	Cfg       RotateConfig
+	tmpl      *template.Template
+	extension string
+	files     map[string]*rotatingFile
+	mu        sync.Mutex
 	sinks.SyncMetricHandler
 }
 
-func NewTextReceiver(fullPath string) (tr *TextReceiver) {
-	tr = &TextReceiver{
+// NewTextReceiver writes measurements of each database to <db><ext> using
+// one of the built-in formats, or templateFile if it is set
+func NewTextReceiver(fullPath string, format string, templateFile string, cfg RotateConfig) (*TextReceiver, error) {
+	tmpl, extension, err := loadTemplate(format, templateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := &TextReceiver{
 		FullPath:          fullPath,
+		Cfg:               cfg,
+		tmpl:              tmpl,
+		extension:         extension,
+		files:             make(map[string]*rotatingFile),
 		SyncMetricHandler: sinks.NewSyncMetricHandler(1024),
 	}
 	go tr.HandleSyncMetric()
 
-	return tr
+	return tr, nil
 }
 
-func (r TextReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
-	// Write Metrics in a text file
-	fileName := msg.GetDBName() + ".txt"
-	file, err := os.OpenFile(r.FullPath + "/" + fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+func (r *TextReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
+	dbName := msg.GetDBName()
+	if !filepath.IsLocal(dbName) || filepath.Base(dbName) != dbName {
+		return nil, fmt.Errorf("invalid database name: %s", dbName)
+	}
 
-	if err != nil {
-		log.Println("Unable to open file. Error: " + err.Error())
+	// Render the whole envelope first so rotation never splits it
+	var output bytes.Buffer
+	if err := r.tmpl.Execute(&output, newEnvelope(msg)); err != nil {
+		log.Println("[ERROR]: Unable to render measurements. Error: " + err.Error())
 		return nil, err
 	}
 
-	writer := bufio.NewWriter(file)
-	defer func() {_ = file.Close()}()
-
-	output := "DBName: " + msg.GetDBName() + "\n" + "Metric: " + msg.GetMetricName() + "\n"
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	for _, measurement := range msg.GetData() {
-		data, err := sinks.GetJson(measurement)
-		if err != nil {
-			continue
-		}
-		output += data + "\n"
+	file, ok := r.files[dbName]
+	if !ok {
+		file = &rotatingFile{dir: r.FullPath, name: dbName, ext: r.extension, cfg: r.Cfg}
+		r.files[dbName] = file
 	}
 
-	output += "\n===================================\n"
-
-	_, err = fmt.Fprintln(writer, output)
-	if err != nil {
+	if _, err := file.Write(output.Bytes()); err != nil {
+		log.Println("[ERROR]: Unable to write to file. Error: " + err.Error())
 		return nil, err
 	}
+	return &pb.Reply{}, nil
+}
 
-	err = writer.Flush()
-	return &pb.Reply{}, err
-}
\ No newline at end of file
+// Close closes all open files
+func (r *TextReceiver) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var err error
+	for _, file := range r.files {
+		err = errors.Join(err, file.Close())
+	}
+	return err
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"context"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
 	"github.com/stretchr/testify/assert"
@@ -29,12 +32,100 @@ func TestUpdateMeasurements(t *testing.T) {
 		panic(err)
 	}
 
-	recv := NewTextReceiver(path)
+	recv, err := NewTextReceiver(path, FormatBlock, "", RotateConfig{})
+	assert.NoError(t, err)
 	msg := GetTestMeasurementEnvelope()
 	_, err = recv.UpdateMeasurements(context.Background(), msg)
 
 	assert.NoError(t, err, "Error encountered while updating measurements")
 	assert.FileExists(t, path + "/" + msg.DBName + ".txt", "Database file does not exist")
+	assert.NoError(t, recv.Close())
 
 	_ = os.Remove(path + "/" + msg.DBName + ".txt")
-}
\ No newline at end of file
+}
+
+func renderMeasurements(t *testing.T, format, templateFile string) string {
+	root := t.TempDir()
+	recv, err := NewTextReceiver(root, format, templateFile, RotateConfig{})
+	assert.NoError(t, err)
+
+	msg := GetTestMeasurementEnvelope()
+	msg.CustomTags = map[string]string{"env": "prod"}
+	_, err = recv.UpdateMeasurements(context.Background(), msg)
+	assert.NoError(t, err)
+	assert.NoError(t, recv.Close())
+
+	files, err := filepath.Glob(filepath.Join(root, "test.*"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	content, err := os.ReadFile(files[0])
+	assert.NoError(t, err)
+	return string(content)
+}
+
+func TestOutputFormats(t *testing.T) {
+	output := renderMeasurements(t, FormatBlock, "")
+	assert.Equal(t, "DBName: test\nMetric: testMetric\n{\"key\":\"val\"}\n\n===================================\n\n", output)
+
+	output = renderMeasurements(t, FormatLogfmt, "")
+	assert.Regexp(t, `^time=\S+ db=test metric=testMetric tag_env=prod key=val\n$`, output)
+
+	output = renderMeasurements(t, FormatNDJSON, "")
+	assert.Regexp(t, `^\{"time":"[^"]+","dbname":"test","metric":"testMetric","tags":\{"env":"prod"\},"data":\{"key":"val"\}\}\n$`, output)
+
+	output = renderMeasurements(t, FormatTable, "")
+	assert.Regexp(t, `^# test testMetric \S+\nkey\nval\n`, output)
+
+	_, err := NewTextReceiver(t.TempDir(), "xml", "", RotateConfig{})
+	assert.Error(t, err)
+}
+
+func TestTemplateFile(t *testing.T) {
+	templateFile := filepath.Join(t.TempDir(), "custom.tmpl")
+	tmpl := `{{range .Measurements}}{{.MetricName}} {{index .Data "key"}} {{logfmt .Tags}}{{"\n"}}{{end}}`
+	assert.NoError(t, os.WriteFile(templateFile, []byte(tmpl), 0644))
+
+	output := renderMeasurements(t, FormatLogfmt, templateFile)
+	assert.Equal(t, "testMetric val env=prod\n", output)
+}
+
+func TestRotation(t *testing.T) {
+	root := t.TempDir()
+	cfg := RotateConfig{MaxFileSize: 1, MaxBackups: 2, Compress: true}
+	recv, err := NewTextReceiver(root, FormatNDJSON, "", cfg)
+	assert.NoError(t, err)
+
+	msg := GetTestMeasurementEnvelope()
+	for range 5 {
+		_, err = recv.UpdateMeasurements(context.Background(), msg)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, recv.Close())
+
+	// every write rotates the previous one, only the newest backups are kept
+	backups, err := filepath.Glob(filepath.Join(root, "test-*.ndjson.gz"))
+	assert.NoError(t, err)
+	assert.Len(t, backups, 2)
+
+	content, err := os.ReadFile(filepath.Join(root, "test.ndjson"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(content), "\n"))
+}
+
+func TestReopenKeepsStartDate(t *testing.T) {
+	root := t.TempDir()
+	rotated := time.Now().UTC().Add(-time.Hour).Format(rotatedTimeFormat)
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "test-"+rotated+".ndjson"), []byte("{}\n"), 0644))
+	// the file was written to a moment ago but started an hour ago
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "test.ndjson"), []byte("{}\n"), 0644))
+
+	recv, err := NewTextReceiver(root, FormatNDJSON, "", RotateConfig{RotateInterval: 30 * time.Minute})
+	assert.NoError(t, err)
+	_, err = recv.UpdateMeasurements(context.Background(), GetTestMeasurementEnvelope())
+	assert.NoError(t, err)
+	assert.NoError(t, recv.Close())
+
+	backups, err := filepath.Glob(filepath.Join(root, "test-*.ndjson"))
+	assert.NoError(t, err)
+	assert.Len(t, backups, 2, "the file is older than the rotate interval")
+}
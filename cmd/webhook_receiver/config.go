@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the YAML file with the routes measurements are sent to and how
+// requests are batched, retried and signed
+type Config struct {
+	BatchSize     int               `yaml:"batch_size"`     // measurements per request
+	FlushInterval time.Duration     `yaml:"flush_interval"` // incomplete batches are sent after this
+	MaxAttempts   int               `yaml:"max_attempts"`   // attempts before a request is dead-lettered
+	Backoff       time.Duration     `yaml:"backoff"`        // delay before the first retry, doubled for every further retry
+	MaxBackoff    time.Duration     `yaml:"max_backoff"`    // upper bound of the delay between retries
+	Timeout       time.Duration     `yaml:"timeout"`        // timeout of a single request
+	Concurrency   int               `yaml:"concurrency"`    // requests sent at once, more than 1 doesn't keep their order
+	DeadLetter    string            `yaml:"dead_letter"`    // file requests that failed permanently are appended to
+	Secret        string            `yaml:"secret"`         // HMAC-SHA256 key requests are signed with, unsigned if empty
+	Headers       map[string]string `yaml:"headers"`        // added to requests of all routes
+	Routes        []*Route          `yaml:"routes"`
+}
+
+// Route sends the measurements of matching databases and metrics to a URL
+type Route struct {
+	Name        string            `yaml:"name"`
+	DBName      string            `yaml:"dbname"` // regular expression matching the whole name, all databases if empty
+	Metric      string            `yaml:"metric"` // regular expression matching the whole name, all metrics if empty
+	URL         string            `yaml:"url"`    // text/template with .DBName, .MetricName and .CustomTags
+	Method      string            `yaml:"method"`
+	Headers     map[string]string `yaml:"headers"`
+	Secret      string            `yaml:"secret"`       // overrides the global secret
+	Template    string            `yaml:"template"`     // text/template rendering the body from .Measurements
+	Mapping     map[string]any    `yaml:"mapping"`      // object per measurement with values taken from JSONPath-like expressions
+	ContentType string            `yaml:"content_type"` // defaults to application/json
+
+	dbname   *regexp.Regexp
+	metric   *regexp.Regexp
+	url      *template.Template
+	template *template.Template
+	mapping  mapping
+}
+
+// LoadConfig reads and validates the routes file at path
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+// ParseConfig parses a routes file, sets defaults and validates it.
+// Environment variables like ${WEBHOOK_SECRET} in secrets and headers are
+// expanded.
+func ParseConfig(data []byte) (*Config, error) {
+	cfg := &Config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("invalid routes file: %w", err)
+	}
+
+	cfg.setDefaults()
+	cfg.Secret = os.ExpandEnv(cfg.Secret)
+	expandHeaders(cfg.Headers)
+	for _, route := range cfg.Routes {
+		route.Secret = os.ExpandEnv(route.Secret)
+		expandHeaders(route.Headers)
+	}
+	return cfg, cfg.Validate()
+}
+
+func (cfg *Config) setDefaults() {
+	if cfg.BatchSize == 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.FlushInterval == 0 {
+		cfg.FlushInterval = 5 * time.Second
+	}
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.Backoff == 0 {
+		cfg.Backoff = time.Second
+	}
+	if cfg.MaxBackoff == 0 {
+		cfg.MaxBackoff = max(time.Minute, cfg.Backoff)
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.Concurrency == 0 {
+		cfg.Concurrency = 1
+	}
+}
+
+func expandHeaders(headers map[string]string) {
+	for name, value := range headers {
+		headers[name] = os.ExpandEnv(value)
+	}
+}
+
+func (cfg *Config) Validate() error {
+	switch {
+	case cfg.BatchSize <= 0 || cfg.MaxAttempts <= 0 || cfg.Concurrency <= 0:
+		return errors.New("batch_size, max_attempts and concurrency must be positive")
+	case cfg.FlushInterval <= 0 || cfg.Timeout <= 0:
+		return errors.New("flush_interval and timeout must be positive")
+	case cfg.Backoff <= 0 || cfg.MaxBackoff < cfg.Backoff:
+		return errors.New("backoff must be positive and max_backoff must not be less than backoff")
+	case len(cfg.Routes) == 0:
+		return errors.New("no routes defined")
+	}
+
+	var errs []error
+	for i, route := range cfg.Routes {
+		if route.Name == "" {
+			route.Name = fmt.Sprintf("route %d", i+1)
+		}
+		if err := route.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", route.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var urlFuncs = template.FuncMap{"pathescape": url.PathEscape}
+
+// compile validates the route, sets defaults and compiles its selectors,
+// templates and mapping
+func (route *Route) compile() (err error) {
+	if route.URL == "" {
+		return errors.New("url is required")
+	}
+	if route.Template != "" && route.Mapping != nil {
+		return errors.New("template and mapping are mutually exclusive")
+	}
+	switch route.Method = strings.ToUpper(route.Method); route.Method {
+	case "":
+		route.Method = http.MethodPost
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+	default:
+		return fmt.Errorf("unsupported method %q, expected POST, PUT or PATCH", route.Method)
+	}
+	if route.ContentType == "" {
+		route.ContentType = "application/json"
+	}
+
+	if route.dbname, err = compileSelector(route.DBName); err != nil {
+		return fmt.Errorf("invalid dbname selector: %w", err)
+	}
+	if route.metric, err = compileSelector(route.Metric); err != nil {
+		return fmt.Errorf("invalid metric selector: %w", err)
+	}
+
+	if route.url, err = template.New("url").Funcs(urlFuncs).Option("missingkey=zero").Parse(route.URL); err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if route.Template != "" {
+		if route.template, err = template.New("body").Funcs(bodyFuncs).Parse(route.Template); err != nil {
+			return fmt.Errorf("invalid template: %w", err)
+		}
+	}
+	if route.Mapping != nil {
+		if route.mapping, err = compileMapping(route.Mapping); err != nil {
+			return fmt.Errorf("invalid mapping: %w", err)
+		}
+	}
+	return nil
+}
+
+// renderURL returns the URL measurements of msg are sent to
+func (route *Route) renderURL(msg *pb.MeasurementEnvelope) (string, error) {
+	var rendered strings.Builder
+	err := route.url.Execute(&rendered, struct {
+		DBName     string
+		MetricName string
+		CustomTags map[string]string
+	}{msg.GetDBName(), msg.GetMetricName(), msg.GetCustomTags()})
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(rendered.String())
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid URL %q, expected an absolute http or https URL", rendered.String())
+	}
+	return u.String(), nil
+}
+
+// compileSelector compiles a regular expression matching whole names, or
+// returns nil for an empty pattern
+func compileSelector(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// matches reports whether measurements of a metric of a database are sent
+// to the route
+func (route *Route) matches(dbname, metric string) bool {
+	return (route.dbname == nil || route.dbname.MatchString(dbname)) &&
+		(route.metric == nil || route.metric.MatchString(metric))
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+)
+
+func main() {
+	port := flag.String("port", "-1", "Specify the port where you want your sink to receive the measurements on.")
+	routesFile := flag.String("routes", "routes.yaml", "YAML file with the routes measurements are sent to")
+	flag.Parse()
+
+	if *port == "-1" {
+		log.Println("[ERROR]: No Port Specified")
+		return
+	}
+
+	cfg, err := LoadConfig(*routesFile)
+	if err != nil {
+		log.Fatal("[ERROR]: Unable to load routes ", err)
+	}
+
+	server, err := NewWebhookReceiver(cfg)
+	if err != nil {
+		log.Fatal("[ERROR]: Unable to create webhook receiver ", err)
+	}
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		if err := server.Close(); err != nil {
+			log.Println("[ERROR]: Unable to close dead-letter file: ", err)
+		}
+		os.Exit(0)
+	}()
+
+	if err := sinks.ListenAndServe(server, *port); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+)
+
+// Measurement is a single row of a measurement envelope, requests of routes
+// without a template or mapping are a JSON array of them
+type Measurement struct {
+	Time       time.Time         `json:"time"`
+	DBName     string            `json:"dbname"`
+	MetricName string            `json:"metric"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	Data       map[string]any    `json:"data"`
+}
+
+func newMeasurements(msg *pb.MeasurementEnvelope, received time.Time) []Measurement {
+	measurements := make([]Measurement, 0, len(msg.GetData()))
+	for _, data := range msg.GetData() {
+		measurements = append(measurements, Measurement{
+			Time:       sinks.MeasurementTime(data, received),
+			DBName:     msg.GetDBName(),
+			MetricName: msg.GetMetricName(),
+			Tags:       msg.GetCustomTags(),
+			Data:       data.AsMap(),
+		})
+	}
+	return measurements
+}
+
+var bodyFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// render returns the body of a request sending measurements to the route
+func (route *Route) render(measurements []Measurement) ([]byte, error) {
+	switch {
+	case route.template != nil:
+		var body bytes.Buffer
+		err := route.template.Execute(&body, struct{ Measurements []Measurement }{measurements})
+		return body.Bytes(), err
+	case route.mapping != nil:
+		objects := make([]any, len(measurements))
+		for i, m := range measurements {
+			objects[i] = route.mapping.apply(m.document())
+		}
+		return json.Marshal(objects)
+	default:
+		return json.Marshal(measurements)
+	}
+}
+
+// document returns the measurement as the generic JSON value mapping
+// expressions are evaluated against
+func (m *Measurement) document() map[string]any {
+	tags := make(map[string]any, len(m.Tags))
+	for name, value := range m.Tags {
+		tags[name] = value
+	}
+	return map[string]any{
+		"time":   m.Time.Format(time.RFC3339Nano),
+		"dbname": m.DBName,
+		"metric": m.MetricName,
+		"tags":   tags,
+		"data":   m.Data,
+	}
+}
+
+// mapping builds a JSON value from a measurement document
+type mapping interface {
+	apply(doc any) any
+}
+
+// pathMapping selects a value by its keys, like the JSONPath $.data.field
+type pathMapping []string
+
+func (path pathMapping) apply(doc any) any {
+	for _, key := range path {
+		object, ok := doc.(map[string]any)
+		if !ok {
+			return nil
+		}
+		doc = object[key]
+	}
+	return doc
+}
+
+type objectMapping map[string]mapping
+
+func (object objectMapping) apply(doc any) any {
+	result := make(map[string]any, len(object))
+	for key, m := range object {
+		result[key] = m.apply(doc)
+	}
+	return result
+}
+
+type listMapping []mapping
+
+func (list listMapping) apply(doc any) any {
+	result := make([]any, len(list))
+	for i, m := range list {
+		result[i] = m.apply(doc)
+	}
+	return result
+}
+
+type literalMapping struct{ value any }
+
+func (literal literalMapping) apply(any) any {
+	return literal.value
+}
+
+// compileMapping compiles a mapping from YAML: strings starting with $ are
+// paths like $.dbname or $.data.numbackends, $ is the whole measurement,
+// objects and lists are mapped recursively and other values are literals
+func compileMapping(v any) (mapping, error) {
+	switch v := v.(type) {
+	case string:
+		if !strings.HasPrefix(v, "$") {
+			return literalMapping{v}, nil
+		}
+		if v == "$" {
+			return pathMapping{}, nil
+		}
+		keys, ok := strings.CutPrefix(v, "$.")
+		if !ok || keys == "" || strings.Contains(keys, "..") || strings.HasSuffix(keys, ".") {
+			return nil, fmt.Errorf("invalid path %q, expected $ or $.<key>[.<key>...]", v)
+		}
+		return pathMapping(strings.Split(keys, ".")), nil
+	case map[string]any:
+		object := make(objectMapping, len(v))
+		for key, value := range v {
+			m, err := compileMapping(value)
+			if err != nil {
+				return nil, err
+			}
+			object[key] = m
+		}
+		return object, nil
+	case []any:
+		list := make(listMapping, len(v))
+		for i, value := range v {
+			m, err := compileMapping(value)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = m
+		}
+		return list, nil
+	default:
+		return literalMapping{v}, nil
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/destrex271/pgwatch3_rpc_server/sinks"
+	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
+)
+
+// Signature headers of signed requests
+const (
+	TimestampHeader = "X-Pgwatch-Timestamp"
+	SignatureHeader = "X-Pgwatch-Signature"
+)
+
+// batch collects measurements for one URL of a route
+type batch struct {
+	route        *Route
+	url          string
+	measurements []Measurement
+}
+
+// request is a rendered batch
+type request struct {
+	route *Route
+	url   string
+	body  []byte
+	count int // measurements in the body
+}
+
+type WebhookReceiver struct {
+	Cfg        *Config
+	Client     *http.Client
+	batches    map[string]*batch // by route name and URL
+	mu         sync.Mutex
+	closed     bool // guarded by mu, no more measurements are accepted
+	queue      chan *request
+	queueMu    sync.RWMutex // held while sending to queue, so it isn't closed meanwhile
+	workers    sync.WaitGroup
+	stop       chan struct{}
+	flusher    sync.WaitGroup
+	deadLetter *os.File
+	dlMu       sync.Mutex
+	sinks.SyncMetricHandler
+}
+
+// NewWebhookReceiver sends measurements to the routes of cfg, it has to be
+// closed to send the remaining batches
+func NewWebhookReceiver(cfg *Config) (*WebhookReceiver, error) {
+	recv := &WebhookReceiver{
+		Cfg:               cfg,
+		Client:            &http.Client{Timeout: cfg.Timeout},
+		batches:           make(map[string]*batch),
+		queue:             make(chan *request, 1024),
+		stop:              make(chan struct{}),
+		SyncMetricHandler: sinks.NewSyncMetricHandler(1024),
+	}
+	if cfg.DeadLetter != "" {
+		file, err := os.OpenFile(cfg.DeadLetter, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open dead-letter file: %w", err)
+		}
+		recv.deadLetter = file
+	}
+
+	go recv.HandleSyncMetric()
+	for range cfg.Concurrency {
+		recv.workers.Add(1)
+		go recv.send()
+	}
+	recv.flusher.Add(1)
+	go recv.flushPeriodically()
+	return recv, nil
+}
+
+func (r *WebhookReceiver) UpdateMeasurements(ctx context.Context, msg *pb.MeasurementEnvelope) (*pb.Reply, error) {
+	var measurements []Measurement
+	var full []*batch
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil, errors.New("receiver is closed")
+	}
+	for _, route := range r.Cfg.Routes {
+		if !route.matches(msg.GetDBName(), msg.GetMetricName()) {
+			continue
+		}
+		if measurements == nil {
+			measurements = newMeasurements(msg, time.Now().UTC())
+		}
+
+		// a failing route must not keep the others from getting the
+		// measurements, pgwatch would resend them to all routes
+		url, err := route.renderURL(msg)
+		if err != nil {
+			log.Printf("[ERROR]: Unable to render URL of %s: %s", route.Name, err)
+			body, _ := json.Marshal(measurements)
+			req := &request{route: route, body: body, count: len(measurements)}
+			r.writeDeadLetter(req, 0, 0, fmt.Errorf("unable to render URL: %w", err))
+			continue
+		}
+		key := route.Name + "\x00" + url
+		b, ok := r.batches[key]
+		if !ok {
+			b = &batch{route: route, url: url}
+			r.batches[key] = b
+		}
+
+		// split envelopes larger than a batch
+		for _, m := range measurements {
+			b.measurements = append(b.measurements, m)
+			if len(b.measurements) == r.Cfg.BatchSize {
+				full = append(full, &batch{route: route, url: b.url, measurements: b.measurements})
+				b.measurements = nil
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	var err error
+	for _, b := range full {
+		err = errors.Join(err, r.enqueue(ctx, b))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pb.Reply{}, nil
+}
+
+// enqueue renders a batch and queues it for the workers, blocking while
+// the queue is full. Batches that can't be queued are dead-lettered.
+func (r *WebhookReceiver) enqueue(ctx context.Context, b *batch) error {
+	body, err := b.route.render(b.measurements)
+	if err != nil {
+		err = fmt.Errorf("unable to render body of %s: %w", b.route.Name, err)
+		log.Println("[ERROR]: " + err.Error())
+		body, _ = json.Marshal(b.measurements)
+		r.writeDeadLetter(&request{route: b.route, url: b.url, body: body, count: len(b.measurements)}, 0, 0, err)
+		return nil
+	}
+
+	req := &request{route: b.route, url: b.url, body: body, count: len(b.measurements)}
+	r.queueMu.RLock()
+	defer r.queueMu.RUnlock()
+	select {
+	case r.queue <- req:
+		return nil
+	case <-ctx.Done():
+		log.Printf("[ERROR]: Unable to queue %d measurements for %s: %s", req.count, req.url, ctx.Err())
+		r.writeDeadLetter(req, 0, 0, fmt.Errorf("not queued: %w", ctx.Err()))
+		return ctx.Err()
+	}
+}
+
+// flush queues all incomplete batches
+func (r *WebhookReceiver) flush() {
+	r.mu.Lock()
+	var pending []*batch
+	for key, b := range r.batches {
+		if len(b.measurements) > 0 {
+			pending = append(pending, b)
+		}
+		delete(r.batches, key)
+	}
+	r.mu.Unlock()
+
+	for _, b := range pending {
+		_ = r.enqueue(context.Background(), b)
+	}
+}
+
+func (r *WebhookReceiver) flushPeriodically() {
+	defer r.flusher.Done()
+	ticker := time.NewTicker(r.Cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.flush()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// send delivers queued requests until the queue is closed
+func (r *WebhookReceiver) send() {
+	defer r.workers.Done()
+	for req := range r.queue {
+		r.deliver(req)
+	}
+}
+
+// deliver sends a request, retrying network errors, 408, 429 and 5xx
+// responses with exponential backoff. Requests failing permanently or
+// running out of attempts are dead-lettered.
+func (r *WebhookReceiver) deliver(req *request) {
+	for attempt := 1; ; attempt++ {
+		status, retryAfter, err := r.post(req)
+		if err == nil {
+			return
+		}
+
+		retryable := status == 0 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+		if !retryable || attempt == r.Cfg.MaxAttempts {
+			log.Printf("[ERROR]: Giving up sending %d measurements to %s after %d attempts: %s", req.count, req.url, attempt, err)
+			r.writeDeadLetter(req, attempt, status, err)
+			return
+		}
+
+		delay := max(r.backoff(attempt), min(retryAfter, r.Cfg.MaxBackoff))
+		log.Printf("[WARNING]: Sending to %s failed, retrying in %s: %s", req.url, delay, err)
+		time.Sleep(delay)
+	}
+}
+
+// backoff returns the delay before retrying a request after its attempt
+// failed
+func (r *WebhookReceiver) backoff(attempt int) time.Duration {
+	delay := r.Cfg.Backoff
+	for i := 1; i < attempt && delay < r.Cfg.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, r.Cfg.MaxBackoff)
+}
+
+// post sends a request once and returns the response status, 0 if there
+// was none, and the delay asked for by a Retry-After header
+func (r *WebhookReceiver) post(req *request) (int, time.Duration, error) {
+	httpReq, err := http.NewRequest(req.route.Method, req.url, bytes.NewReader(req.body))
+	if err != nil {
+		return 0, 0, err
+	}
+	httpReq.Header.Set("Content-Type", req.route.ContentType)
+	for name, value := range r.Cfg.Headers {
+		httpReq.Header.Set(name, value)
+	}
+	for name, value := range req.route.Headers {
+		httpReq.Header.Set(name, value)
+	}
+	secret := r.Cfg.Secret
+	if req.route.Secret != "" {
+		secret = req.route.Secret
+	}
+	if secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		httpReq.Header.Set(TimestampHeader, timestamp)
+		httpReq.Header.Set(SignatureHeader, "sha256="+Sign(secret, timestamp, req.body))
+	}
+
+	resp, err := r.Client.Do(httpReq)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, 0, nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+	return resp.StatusCode, time.Duration(retryAfter) * time.Second,
+		fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of "<timestamp>.<body>", the
+// timestamp keeps captured requests from being replayed later
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// DeadLetter is a line of the dead-letter file
+type DeadLetter struct {
+	Time     time.Time `json:"time"`
+	Route    string    `json:"route"`
+	Method   string    `json:"method"`
+	URL      string    `json:"url"`
+	Attempts int       `json:"attempts"`
+	Status   int       `json:"status,omitempty"`
+	Error    string    `json:"error"`
+	Count    int       `json:"count"`
+	Body     string    `json:"body"`
+}
+
+func (r *WebhookReceiver) writeDeadLetter(req *request, attempts, status int, reqErr error) {
+	if r.deadLetter == nil {
+		return
+	}
+	line, err := json.Marshal(DeadLetter{
+		Time:     time.Now().UTC(),
+		Route:    req.route.Name,
+		Method:   req.route.Method,
+		URL:      req.url,
+		Attempts: attempts,
+		Status:   status,
+		Error:    reqErr.Error(),
+		Count:    req.count,
+		Body:     string(req.body),
+	})
+	if err != nil {
+		log.Println("[ERROR]: Unable to encode dead letter: " + err.Error())
+		return
+	}
+
+	r.dlMu.Lock()
+	defer r.dlMu.Unlock()
+	if _, err = r.deadLetter.Write(append(line, '\n')); err != nil {
+		log.Println("[ERROR]: Unable to write dead letter: " + err.Error())
+	}
+}
+
+// Close stops accepting measurements, sends the remaining batches, waits
+// for all requests to be delivered or dead-lettered and closes the
+// dead-letter file
+func (r *WebhookReceiver) Close() error {
+	r.mu.Lock()
+	closed := r.closed
+	r.closed = true
+	r.mu.Unlock()
+	if closed {
+		return nil
+	}
+
+	close(r.stop)
+	r.flusher.Wait()
+	r.flush()
+	// waits for calls still queueing full batches
+	r.queueMu.Lock()
+	close(r.queue)
+	r.queueMu.Unlock()
+	r.workers.Wait()
+	if r.deadLetter != nil {
+		return r.deadLetter.Close()
+	}
+	return nil
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	testutils "github.com/destrex271/pgwatch3_rpc_server/sinks/test_utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// received is a request recorded by startServer
+type received struct {
+	method string
+	path   string
+	header http.Header
+	body   string
+}
+
+// startServer records requests and answers them with the status returned
+// by respond for the n-th request to a path
+func startServer(t *testing.T, respond func(path string, n int) int) (*httptest.Server, func() []received) {
+	var mu sync.Mutex
+	var requests []received
+	counts := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, received{r.Method, r.URL.Path, r.Header, string(body)})
+		counts[r.URL.Path]++
+		n := counts[r.URL.Path]
+		mu.Unlock()
+		w.WriteHeader(respond(r.URL.Path, n))
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []received {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]received(nil), requests...)
+	}
+}
+
+func ok(string, int) int { return http.StatusOK }
+
+func newTestReceiver(t *testing.T, routes string) *WebhookReceiver {
+	cfg, err := ParseConfig([]byte(routes))
+	assert.NoError(t, err)
+	recv, err := NewWebhookReceiver(cfg)
+	assert.NoError(t, err)
+	return recv
+}
+
+func readDeadLetters(t *testing.T, path string) []DeadLetter {
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+	defer func() { _ = file.Close() }()
+
+	var letters []DeadLetter
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var letter DeadLetter
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &letter))
+		letters = append(letters, letter)
+	}
+	return letters
+}
+
+func TestParseConfig(t *testing.T) {
+	t.Setenv("WEBHOOK_SECRET", "s3cret")
+	t.Setenv("EVENTS_TOKEN", "token")
+	cfg, err := LoadConfig("routes.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cret", cfg.Secret)
+	assert.Equal(t, 10*time.Second, cfg.Timeout)
+	assert.Equal(t, 1, cfg.Concurrency)
+	assert.Len(t, cfg.Routes, 3)
+	assert.Equal(t, http.MethodPost, cfg.Routes[0].Method)
+	assert.Equal(t, "Bearer token", cfg.Routes[1].Headers["Authorization"])
+	assert.True(t, cfg.Routes[1].matches("prod-1", "replication"))
+	assert.False(t, cfg.Routes[1].matches("prod-1", "replication_slots"))
+	assert.False(t, cfg.Routes[1].matches("staging", "replication"))
+	assert.Equal(t, "application/x-ndjson", cfg.Routes[2].ContentType)
+
+	url, err := cfg.Routes[0].renderURL(testutils.NewMeasurementEnvelope("my db", "m"))
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost:8080/measurements/my%20db", url)
+
+	for name, routes := range map[string]string{
+		"unknown key":          "routes: [{url: 'http://localhost', methd: PUT}]",
+		"no routes":            "batch_size: 10",
+		"missing url":          "routes: [{name: a}]",
+		"invalid url":          "routes: [{url: '{{ .DBName'}]",
+		"invalid method":       "routes: [{url: 'http://localhost', method: GET}]",
+		"invalid selector":     "routes: [{url: 'http://localhost', metric: '('}]",
+		"template and mapping": "routes: [{url: 'http://localhost', template: x, mapping: {a: $.dbname}}]",
+		"invalid path":         "routes: [{url: 'http://localhost', mapping: {a: $data}}]",
+		"invalid backoff":      "backoff: 1m\nmax_backoff: 1s\nroutes: [{url: 'http://localhost'}]",
+	} {
+		_, err := ParseConfig([]byte(routes))
+		assert.Error(t, err, name)
+	}
+
+	route := &Route{URL: "{{ .DBName }}/path"}
+	assert.NoError(t, route.compile())
+	_, err = route.renderURL(testutils.NewMeasurementEnvelope("db", "m"))
+	assert.Error(t, err, "relative URLs are rejected")
+}
+
+func TestBatching(t *testing.T) {
+	server, requests := startServer(t, ok)
+	recv := newTestReceiver(t, fmt.Sprintf(`
+batch_size: 2
+flush_interval: 1h
+routes:
+  - url: %s/{{ .DBName }}/{{ .MetricName }}
+`, server.URL))
+
+	epoch := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := range 3 {
+		_, err := recv.UpdateMeasurements(context.Background(), testutils.NewMeasurementEnvelope("db1", "db_stats",
+			map[string]any{"numbackends": i, "epoch_ns": float64(epoch.UnixNano())}))
+		assert.NoError(t, err)
+	}
+	msg := testutils.NewMeasurementEnvelope("db2", "db_stats", map[string]any{"numbackends": 9})
+	msg.CustomTags = map[string]string{"env": "prod"}
+	_, err := recv.UpdateMeasurements(context.Background(), msg)
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool { return len(requests()) == 1 }, 5*time.Second, 10*time.Millisecond,
+		"full batches are sent right away")
+	assert.NoError(t, recv.Close())
+
+	bodies := make(map[string][]Measurement)
+	for _, req := range requests() {
+		assert.Equal(t, http.MethodPost, req.method)
+		assert.Equal(t, "application/json", req.header.Get("Content-Type"))
+		assert.Empty(t, req.header.Get(SignatureHeader))
+		var measurements []Measurement
+		assert.NoError(t, json.Unmarshal([]byte(req.body), &measurements))
+		bodies[req.path] = append(bodies[req.path], measurements...)
+	}
+	if assert.Len(t, bodies["/db1/db_stats"], 3) {
+		assert.Equal(t, 0.0, bodies["/db1/db_stats"][0].Data["numbackends"])
+		assert.Equal(t, epoch, bodies["/db1/db_stats"][0].Time)
+	}
+	if assert.Len(t, bodies["/db2/db_stats"], 1) {
+		assert.Equal(t, map[string]string{"env": "prod"}, bodies["/db2/db_stats"][0].Tags)
+	}
+	assert.Len(t, requests(), 3)
+}
+
+func TestFailingRoute(t *testing.T) {
+	server, requests := startServer(t, ok)
+	deadLetter := filepath.Join(t.TempDir(), "dead.jsonl")
+	recv := newTestReceiver(t, fmt.Sprintf(`
+batch_size: 1
+flush_interval: 1h
+dead_letter: %s
+routes:
+  - name: good
+    url: %s/{{ .DBName }}
+  - name: broken
+    url: '{{ index .CustomTags "host" }}/{{ .DBName }}'
+`, deadLetter, server.URL))
+
+	msg := testutils.NewMeasurementEnvelope("db1", "db_stats", map[string]any{"numbackends": 1}, map[string]any{"numbackends": 2})
+	_, err := recv.UpdateMeasurements(context.Background(), msg)
+	assert.NoError(t, err, "the measurements were accepted by the good route")
+	assert.NoError(t, recv.Close())
+
+	reqs := requests()
+	assert.Len(t, reqs, 2, "full batches of the good route are sent")
+	for _, req := range reqs {
+		assert.Equal(t, "/db1", req.path)
+	}
+
+	letters := readDeadLetters(t, deadLetter)
+	if assert.Len(t, letters, 1) {
+		assert.Equal(t, "broken", letters[0].Route)
+		assert.Equal(t, 2, letters[0].Count)
+		assert.Contains(t, letters[0].Error, "unable to render URL")
+	}
+}
+
+func TestPayloads(t *testing.T) {
+	server, requests := startServer(t, ok)
+	recv := newTestReceiver(t, fmt.Sprintf(`
+headers: {X-Source: pgwatch, X-Team: all}
+routes:
+  - name: mapped
+    metric: replication
+    url: %[1]s/events
+    method: put
+    headers: {X-Team: dba}
+    mapping:
+      source: pgwatch
+      host: $.dbname
+      lag: $.data.replay_lag_b
+      missing: $.data.nothing.here
+      env: [$.tags.env, 1]
+  - name: templated
+    metric: db_stats
+    url: %[1]s/bulk
+    content_type: text/plain
+    template: '{{ range .Measurements }}{{ .DBName }} {{ .Data.numbackends }};{{ end }}'
+`, server.URL))
+
+	msg := testutils.NewMeasurementEnvelope("prod", "replication", map[string]any{"replay_lag_b": 1024})
+	msg.CustomTags = map[string]string{"env": "prod"}
+	_, err := recv.UpdateMeasurements(context.Background(), msg)
+	assert.NoError(t, err)
+	_, err = recv.UpdateMeasurements(context.Background(), testutils.NewMeasurementEnvelope("prod", "db_stats",
+		map[string]any{"numbackends": 5}, map[string]any{"numbackends": 6}))
+	assert.NoError(t, err)
+	_, err = recv.UpdateMeasurements(context.Background(), testutils.NewMeasurementEnvelope("prod", "other", map[string]any{"x": 1}))
+	assert.NoError(t, err)
+	assert.NoError(t, recv.Close())
+
+	paths := make(map[string]received)
+	for _, req := range requests() {
+		paths[req.path] = req
+	}
+	assert.Len(t, paths, 2)
+
+	events := paths["/events"]
+	assert.Equal(t, http.MethodPut, events.method)
+	assert.Equal(t, "pgwatch", events.header.Get("X-Source"))
+	assert.Equal(t, "dba", events.header.Get("X-Team"), "route headers override global ones")
+	assert.JSONEq(t, `[{"source": "pgwatch", "host": "prod", "lag": 1024, "missing": null, "env": ["prod", 1]}]`, events.body)
+
+	bulk := paths["/bulk"]
+	assert.Equal(t, "text/plain", bulk.header.Get("Content-Type"))
+	assert.Equal(t, "prod 5;prod 6;", bulk.body)
+}
+
+func TestSigning(t *testing.T) {
+	server, requests := startServer(t, ok)
+	recv := newTestReceiver(t, fmt.Sprintf(`
+secret: global
+routes:
+  - {url: '%[1]s/global', metric: a}
+  - {url: '%[1]s/route', metric: b, secret: route}
+`, server.URL))
+
+	for _, metric := range []string{"a", "b"} {
+		_, err := recv.UpdateMeasurements(context.Background(), testutils.NewMeasurementEnvelope("db", metric, map[string]any{"x": 1}))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, recv.Close())
+
+	secrets := map[string]string{"/global": "global", "/route": "route"}
+	assert.Len(t, requests(), 2)
+	for _, req := range requests() {
+		timestamp := req.header.Get(TimestampHeader)
+		assert.NotEmpty(t, timestamp)
+		expected := "sha256=" + Sign(secrets[req.path], timestamp, []byte(req.body))
+		assert.True(t, hmac.Equal([]byte(expected), []byte(req.header.Get(SignatureHeader))), req.path)
+	}
+
+	// HMAC-SHA256("key", "1700000000.{}")
+	assert.Equal(t, "9d713ed406bb7076d4123f0dc2c39d2df5c654ed4b0cd56b52c8b4c940bd63ae", Sign("key", "1700000000", []byte("{}")))
+}
+
+func TestRetries(t *testing.T) {
+	server, requests := startServer(t, func(path string, n int) int {
+		switch {
+		case path == "/flaky" && n <= 2:
+			return http.StatusServiceUnavailable
+		case path == "/bad":
+			return http.StatusBadRequest
+		case path == "/down":
+			return http.StatusInternalServerError
+		}
+		return http.StatusOK
+	})
+	deadLetter := filepath.Join(t.TempDir(), "dead_letter.ndjson")
+	recv := newTestReceiver(t, fmt.Sprintf(`
+max_attempts: 3
+backoff: 1ms
+max_backoff: 4ms
+dead_letter: %[2]s
+routes:
+  - {name: flaky, metric: flaky, url: '%[1]s/flaky'}
+  - {name: bad, metric: bad, url: '%[1]s/bad'}
+  - {name: down, metric: down, url: '%[1]s/down'}
+`, server.URL, deadLetter))
+
+	assert.Equal(t, time.Millisecond, recv.backoff(1))
+	assert.Equal(t, 2*time.Millisecond, recv.backoff(2))
+	assert.Equal(t, 4*time.Millisecond, recv.backoff(3))
+	assert.Equal(t, 4*time.Millisecond, recv.backoff(10))
+
+	for _, metric := range []string{"flaky", "bad", "down"} {
+		_, err := recv.UpdateMeasurements(context.Background(), testutils.NewMeasurementEnvelope("db", metric, map[string]any{"x": 1}))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, recv.Close())
+
+	attempts := make(map[string]int)
+	for _, req := range requests() {
+		attempts[req.path]++
+	}
+	assert.Equal(t, map[string]int{"/flaky": 3, "/bad": 1, "/down": 3}, attempts)
+
+	letters := readDeadLetters(t, deadLetter)
+	if assert.Len(t, letters, 2) {
+		byRoute := map[string]DeadLetter{letters[0].Route: letters[0], letters[1].Route: letters[1]}
+		assert.Equal(t, 1, byRoute["bad"].Attempts, "client errors aren't retried")
+		assert.Equal(t, http.StatusBadRequest, byRoute["bad"].Status)
+		assert.Equal(t, 3, byRoute["down"].Attempts)
+		assert.Equal(t, http.StatusInternalServerError, byRoute["down"].Status)
+		assert.Equal(t, server.URL+"/down", byRoute["down"].URL)
+		assert.Equal(t, 1, byRoute["down"].Count)
+
+		var measurements []Measurement
+		assert.NoError(t, json.Unmarshal([]byte(byRoute["down"].Body), &measurements))
+		assert.Equal(t, "down", measurements[0].MetricName)
+	}
+}
+
+func TestClose(t *testing.T) {
+	release := make(chan struct{})
+	server, _ := startServer(t, func(path string, n int) int {
+		if path == "/slow" {
+			<-release
+		}
+		return http.StatusOK
+	})
+	deadLetter := filepath.Join(t.TempDir(), "dead_letter.ndjson")
+	recv := newTestReceiver(t, fmt.Sprintf(`
+batch_size: 1
+dead_letter: %s
+routes:
+  - url: '%s/{{ .MetricName }}'
+`, deadLetter, server.URL))
+
+	// one request is sent, the others fill the queue
+	for range cap(recv.queue) + 1 {
+		_, err := recv.UpdateMeasurements(context.Background(), testutils.NewMeasurementEnvelope("db", "slow", map[string]any{"x": 1}))
+		assert.NoError(t, err)
+	}
+
+	// batches of cancelled calls are dead-lettered instead of dropped
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := recv.UpdateMeasurements(ctx, testutils.NewMeasurementEnvelope("db", "cancelled", map[string]any{"x": 1}))
+	assert.ErrorIs(t, err, context.Canceled)
+	letters := readDeadLetters(t, deadLetter)
+	if assert.Len(t, letters, 1) {
+		assert.Equal(t, server.URL+"/cancelled", letters[0].URL)
+		assert.Equal(t, 1, letters[0].Count)
+	}
+	close(release)
+
+	// measurements arriving while closing don't send on the closed queue
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = recv.UpdateMeasurements(context.Background(), testutils.NewMeasurementEnvelope("db", "fast", map[string]any{"x": 1}))
+		}()
+	}
+	assert.NoError(t, recv.Close())
+	wg.Wait()
+
+	_, err = recv.UpdateMeasurements(context.Background(), testutils.NewMeasurementEnvelope("db", "fast", map[string]any{"x": 1}))
+	assert.Error(t, err)
+	assert.NoError(t, recv.Close())
+}
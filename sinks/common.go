@@ -1,11 +1,18 @@
 package sinks
 
 import (
+	"compress/gzip"
 	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"time"
 
 	"github.com/destrex271/pgwatch3_rpc_server/sinks/pb"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 func GetJson(value any) (string, error) {
@@ -27,4 +34,51 @@ func IsValidMeasurement(msg *pb.MeasurementEnvelope) error {
 		return status.Error(codes.InvalidArgument, "no data provided")
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// MeasurementTime returns the time a measurement was taken using the
+// epoch_ns field pgwatch adds to every measurement, or fallback without it
+func MeasurementTime(data *structpb.Struct, fallback time.Time) time.Time {
+	if ns := data.GetFields()["epoch_ns"].GetNumberValue(); ns > 0 {
+		return time.Unix(0, int64(ns)).UTC()
+	}
+	return fallback
+}
+
+// SortedKeys returns the keys of m in ascending order
+func SortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// GzipFile replaces path with path.gz
+func GzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = src.Close() }()
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	err = errors.Join(err, zw.Close(), dst.Close())
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	if err = os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
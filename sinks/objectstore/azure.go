@@ -0,0 +1,108 @@
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+)
+
+// AzureStore stores objects in an Azure Blob Storage container.
+// Credentials are read from AZURE_STORAGE_CONNECTION_STRING or
+// AZURE_STORAGE_ACCOUNT and AZURE_STORAGE_KEY.
+type AzureStore struct {
+	client    *azblob.Client
+	container string
+	prefix    string
+}
+
+// NewAzureStore supports the `endpoint` query parameter to override the
+// service URL, e.g. for Azurite
+func NewAzureStore(container, prefix string, params url.Values) (*AzureStore, error) {
+	if container == "" {
+		return nil, errors.New("azure object store requires a container")
+	}
+
+	client, err := newAzureClient(params.Get("endpoint"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &AzureStore{
+		client:    client,
+		container: container,
+		prefix:    prefix,
+	}, nil
+}
+
+func newAzureClient(endpoint string) (*azblob.Client, error) {
+	if connStr := os.Getenv("AZURE_STORAGE_CONNECTION_STRING"); connStr != "" {
+		return azblob.NewClientFromConnectionString(connStr, nil)
+	}
+
+	account := os.Getenv("AZURE_STORAGE_ACCOUNT")
+	key := os.Getenv("AZURE_STORAGE_KEY")
+	if account == "" || key == "" {
+		return nil, errors.New("set AZURE_STORAGE_CONNECTION_STRING or AZURE_STORAGE_ACCOUNT and AZURE_STORAGE_KEY")
+	}
+
+	cred, err := azblob.NewSharedKeyCredential(account, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net/", account)
+	}
+	return azblob.NewClientWithSharedKeyCredential(endpoint, cred, nil)
+}
+
+func (s *AzureStore) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
+	uploadOpts := &azblob.UploadStreamOptions{}
+	if opts.ContentType != "" {
+		uploadOpts.HTTPHeaders = &blob.HTTPHeaders{BlobContentType: &opts.ContentType}
+	}
+
+	_, err := s.client.UploadStream(ctx, s.container, s.prefix+key, body, uploadOpts)
+	return err
+}
+
+func (s *AzureStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.client.DownloadStream(ctx, s.container, s.prefix+key, nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *AzureStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	fullPrefix := s.prefix + prefix
+	pager := s.client.NewListBlobsFlatPager(s.container, &azblob.ListBlobsFlatOptions{Prefix: &fullPrefix})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Segment.BlobItems {
+			if item.Name != nil {
+				keys = append(keys, strings.TrimPrefix(*item.Name, s.prefix))
+			}
+		}
+	}
+	return keys, nil
+}
+
+func (s *AzureStore) Close() error {
+	return nil
+}
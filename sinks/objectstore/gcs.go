@@ -0,0 +1,74 @@
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// GCSStore stores objects in a Google Cloud Storage bucket. Credentials are
+// taken from Application Default Credentials, STORAGE_EMULATOR_HOST is honored
+type GCSStore struct {
+	client *storage.Client
+	bucket *storage.BucketHandle
+	prefix string
+}
+
+func NewGCSStore(ctx context.Context, bucket, prefix string) (*GCSStore, error) {
+	if bucket == "" {
+		return nil, errors.New("gcs object store requires a bucket")
+	}
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GCSStore{
+		client: client,
+		bucket: client.Bucket(bucket),
+		prefix: prefix,
+	}, nil
+}
+
+func (s *GCSStore) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
+	writer := s.bucket.Object(s.prefix + key).NewWriter(ctx)
+	writer.ContentType = opts.ContentType
+
+	if _, err := io.Copy(writer, body); err != nil {
+		_ = writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+func (s *GCSStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	reader, err := s.bucket.Object(s.prefix + key).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, ErrNotFound
+	}
+	return reader, err
+}
+
+func (s *GCSStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	it := s.bucket.Objects(ctx, &storage.Query{Prefix: s.prefix + prefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, strings.TrimPrefix(attrs.Name, s.prefix))
+	}
+}
+
+func (s *GCSStore) Close() error {
+	return s.client.Close()
+}
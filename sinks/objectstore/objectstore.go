@@ -0,0 +1,68 @@
+// Package objectstore provides a minimal blob storage abstraction so that
+// receivers writing files (CSV, Parquet, NDJSON...) can archive them to S3,
+// Google Cloud Storage, Azure Blob Storage or a local directory.
+//
+// Stores are created from URLs:
+//
+//	file:///data/pgwatch
+//	s3://bucket/prefix?region=us-east-1&endpoint=http://localhost:9000
+//	gs://bucket/prefix
+//	azblob://container/prefix?endpoint=http://localhost:10000/devstoreaccount1
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+type PutOptions struct {
+	ContentType string
+}
+
+// Store is a flat key/value blob store. Keys use "/" as separator and
+// are relative to the prefix given in the store URL.
+type Store interface {
+	// Put writes the object, replacing it if it already exists
+	Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error
+	// Get returns the object content, ErrNotFound if it doesn't exist
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// List returns the keys of all objects starting with prefix
+	List(ctx context.Context, prefix string) ([]string, error)
+	Close() error
+}
+
+// New returns the Store described by rawURL
+func New(ctx context.Context, rawURL string) (Store, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object store URL: %w", err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		return NewLocalStore(u.Path)
+	case "s3":
+		return NewS3Store(ctx, u.Host, trimPrefix(u.Path), u.Query())
+	case "gs":
+		return NewGCSStore(ctx, u.Host, trimPrefix(u.Path))
+	case "azblob":
+		return NewAzureStore(u.Host, trimPrefix(u.Path), u.Query())
+	}
+	return nil, fmt.Errorf("unsupported object store scheme: %q", u.Scheme)
+}
+
+// trimPrefix normalizes a URL path into a key prefix,
+// i.e. "/a/b" becomes "a/b/" and "/" becomes ""
+func trimPrefix(path string) string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return ""
+	}
+	return path + "/"
+}
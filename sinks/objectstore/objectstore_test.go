@@ -0,0 +1,59 @@
+package objectstore
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalStore(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(ctx, "file://"+t.TempDir())
+	assert.NoError(t, err)
+	defer func() { _ = store.Close() }()
+
+	keys := []string{"metric=cpu/db=test/a.json", "metric=cpu/db=test/b.json", "metric=mem/db=test/c.json"}
+	for _, key := range keys {
+		err = store.Put(ctx, key, strings.NewReader(key), PutOptions{ContentType: "application/json"})
+		assert.NoError(t, err)
+	}
+
+	body, err := store.Get(ctx, keys[0])
+	assert.NoError(t, err)
+	content, err := io.ReadAll(body)
+	assert.NoError(t, err)
+	assert.NoError(t, body.Close())
+	assert.Equal(t, keys[0], string(content))
+
+	listed, err := store.List(ctx, "metric=cpu/")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, keys[:2], listed)
+
+	listed, err = store.List(ctx, "")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, keys, listed)
+
+	_, err = store.Get(ctx, "missing.json")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	err = store.Put(ctx, "../escape.json", strings.NewReader("{}"), PutOptions{})
+	assert.Error(t, err)
+}
+
+func TestNewUnsupportedScheme(t *testing.T) {
+	_, err := New(context.Background(), "ftp://host/path")
+	assert.ErrorContains(t, err, "unsupported object store scheme")
+
+	_, err = New(context.Background(), "file://")
+	assert.Error(t, err)
+}
+
+func TestTrimPrefix(t *testing.T) {
+	assert.Equal(t, "", trimPrefix(""))
+	assert.Equal(t, "", trimPrefix("/"))
+	assert.Equal(t, "a/b/", trimPrefix("/a/b"))
+	assert.Equal(t, "a/b/", trimPrefix("/a/b/"))
+}
@@ -1,8 +1,12 @@
 package sinks
 
 import (
+	"compress/gzip"
 	"context"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -11,6 +15,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 func TestSyncMetricHandler_ValidSyncReqs(t *testing.T) {
@@ -107,4 +112,39 @@ func TestIsValidMeasurement(t *testing.T) {
 	msg = testutils.GetTestMeasurementEnvelope()
 	err = IsValidMeasurement(msg)
 	assert.NoError(t, err)
-}
\ No newline at end of file
+}
+
+func TestMeasurementTime(t *testing.T) {
+	fallback := time.Date(2024, 5, 17, 0, 0, 0, 0, time.UTC)
+	data, err := structpb.NewStruct(map[string]any{"epoch_ns": 1.7e18})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Unix(0, 1.7e18).UTC(), MeasurementTime(data, fallback))
+
+	data, err = structpb.NewStruct(map[string]any{"value": 1})
+	assert.NoError(t, err)
+	assert.Equal(t, fallback, MeasurementTime(data, fallback))
+}
+
+func TestSortedKeys(t *testing.T) {
+	assert.Equal(t, []string{"a", "b", "c"}, SortedKeys(map[string]int{"c": 1, "a": 2, "b": 3}))
+	assert.Empty(t, SortedKeys(map[string]int{}))
+}
+
+func TestGzipFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "measurements.csv")
+	assert.NoError(t, os.WriteFile(path, []byte("a,b\n1,2\n"), 0o644))
+	assert.NoError(t, GzipFile(path))
+	assert.NoFileExists(t, path)
+	assert.NoFileExists(t, path+".gz.tmp")
+
+	file, err := os.Open(path + ".gz")
+	assert.NoError(t, err)
+	defer func() { _ = file.Close() }()
+	zr, err := gzip.NewReader(file)
+	assert.NoError(t, err)
+	content, err := io.ReadAll(zr)
+	assert.NoError(t, err)
+	assert.Equal(t, "a,b\n1,2\n", string(content))
+
+	assert.Error(t, GzipFile(filepath.Join(t.TempDir(), "missing.csv")))
+}
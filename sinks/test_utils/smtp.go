@@ -0,0 +1,57 @@
+package testutils
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// StartSMTPServer accepts mails like an SMTP server and sends them to the
+// returned channel
+func StartSMTPServer(t *testing.T) (string, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	mails := make(chan string, 10)
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn := textproto.NewConn(c)
+				defer func() { _ = conn.Close() }()
+				_ = conn.PrintfLine("220 localhost ESMTP")
+				for {
+					line, err := conn.ReadLine()
+					if err != nil {
+						return
+					}
+					switch command := strings.ToUpper(strings.Fields(line + " ")[0]); command {
+					case "EHLO", "HELO":
+						_ = conn.PrintfLine("250-localhost\r\n250 8BITMIME")
+					case "DATA":
+						_ = conn.PrintfLine("354 go ahead")
+						lines, err := conn.ReadDotLines()
+						if err != nil {
+							return
+						}
+						mails <- strings.Join(lines, "\r\n")
+						_ = conn.PrintfLine("250 OK")
+					case "QUIT":
+						_ = conn.PrintfLine("221 bye")
+						return
+					default:
+						_ = conn.PrintfLine("250 OK")
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), mails
+}
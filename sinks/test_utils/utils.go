@@ -19,6 +19,20 @@ func GetTestMeasurementEnvelope() *pb.MeasurementEnvelope {
 	}
 }
 
+// NewMeasurementEnvelope returns a measurement of metric in dbname with a
+// data row for each of rows
+func NewMeasurementEnvelope(dbname, metric string, rows ...map[string]any) *pb.MeasurementEnvelope {
+	msg := &pb.MeasurementEnvelope{DBName: dbname, MetricName: metric}
+	for _, row := range rows {
+		st, err := structpb.NewStruct(row)
+		if err != nil {
+			panic(err)
+		}
+		msg.Data = append(msg.Data, st)
+	}
+	return msg
+}
+
 func GetTestRPCSyncRequest() *pb.SyncReq {
 	return &pb.SyncReq{
 		DBName:     "test_database",